@@ -16,6 +16,9 @@ import (
 	"github.com/google/uuid"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
+	"github.com/air-iot/sdk-go/v4/utils/probe"
 )
 
 type App interface {
@@ -123,6 +126,7 @@ func NewApp() App {
 			}
 		}()
 	}
+	metrics.Serve(Cfg.Metrics)
 	a.cacheValue = sync.Map{}
 	return a
 }
@@ -133,6 +137,7 @@ func (a *app) Start(service Service) {
 	cli := Client{cacheConfig: sync.Map{}, cacheConfigNum: sync.Map{}}
 	// grpc客户端Start
 	a.cli = cli.Start(a, service)
+	probe.Serve(Cfg.Probe, a.cli.checks)
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL)
 	sig := <-ch
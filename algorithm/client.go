@@ -4,18 +4,23 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/air-iot/errors"
 	"github.com/air-iot/json"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 
 	pb "github.com/air-iot/api-client-go/v4/algorithm"
 	"github.com/air-iot/logger"
+
+	"github.com/air-iot/sdk-go/v4/utils/grpcx"
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
+	"github.com/air-iot/sdk-go/v4/utils/probe"
 )
 
 type Client struct {
+	lock             sync.RWMutex
 	conn             *grpc.ClientConn
 	cli              pb.AlgorithmServiceClient
 	app              App
@@ -24,8 +29,13 @@ type Client struct {
 	cacheConfig      sync.Map
 	cacheConfigNum   sync.Map
 	//healthTime        time.Time
+	streamCount int32
+	// lastHealth 最近一次健康检查正常的时间(UnixNano)
+	lastHealth atomic.Int64
 }
 
+const totalStream = 2
+
 func (c *Client) Start(app App, algorithmService Service) *Client {
 	c.app = app
 	c.algorithmService = algorithmService
@@ -69,17 +79,22 @@ func (c *Client) restart() {
 
 func (c *Client) connAlgorithm() error {
 	logger.Infof("连接算法管理: 配置=%+v", Cfg.AlgorithmGrpc)
+	opts, err := grpcx.DialOptions(Cfg.AlgorithmGrpc.TLS, string(Cfg.AlgorithmGrpc.Token))
+	if err != nil {
+		return err
+	}
 	conn, err := grpc.NewClient(
 		fmt.Sprintf("%s:%d", Cfg.AlgorithmGrpc.Host, Cfg.AlgorithmGrpc.Port),
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(Cfg.AlgorithmGrpc.Limit*1024*1024), grpc.MaxCallSendMsgSize(Cfg.AlgorithmGrpc.Limit*1024*1024)),
+		append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(Cfg.AlgorithmGrpc.Limit*1024*1024), grpc.MaxCallSendMsgSize(Cfg.AlgorithmGrpc.Limit*1024*1024)))...,
 	)
 	if err != nil {
 		return fmt.Errorf("grpc.Dial error: %s", err)
 	}
 	cli := pb.NewAlgorithmServiceClient(conn)
+	c.lock.Lock()
 	c.conn = conn
 	c.cli = cli
+	c.lock.Unlock()
 	return nil
 }
 
@@ -98,6 +113,7 @@ func (c *Client) healthCheck(ctx context.Context) {
 				state := false
 				for retry >= 0 {
 					healthRes, err := c.healthRequest(ctx)
+					metrics.HealthCheck(metrics.ServiceAlgorithm, err == nil && healthRes.GetStatus() == pb.HealthCheckResponse_SERVING)
 					if err != nil {
 						logger.WithContext(logger.NewErrorContext(ctxHealth, err)).Errorf("健康检查: 健康检查请求错误")
 						state = true
@@ -105,6 +121,7 @@ func (c *Client) healthCheck(ctx context.Context) {
 					} else {
 						state = false
 						if healthRes.GetStatus() == pb.HealthCheckResponse_SERVING {
+							c.lastHealth.Store(time.Now().UnixNano())
 							logger.WithContext(ctxHealth).Infof("健康检查: 正常")
 							if healthRes.Errors != nil && len(healthRes.Errors) > 0 {
 								for _, e := range healthRes.Errors {
@@ -128,6 +145,23 @@ func (c *Client) healthCheck(ctx context.Context) {
 	}()
 }
 
+// checks 返回算法管理连接、stream和健康检查的状态
+func (c *Client) checks() []probe.Check {
+	c.lock.RLock()
+	conn := c.conn
+	c.lock.RUnlock()
+	var last time.Time
+	if v := c.lastHealth.Load(); v > 0 {
+		last = time.Unix(0, v)
+	}
+	maxAge := time.Second * time.Duration((Cfg.AlgorithmGrpc.WaitTime+Cfg.AlgorithmGrpc.Health.RequestTime)*(Cfg.AlgorithmGrpc.Health.Retry+2))
+	return []probe.Check{
+		probe.GRPC(conn),
+		probe.Streams(int(atomic.LoadInt32(&c.streamCount)), totalStream),
+		probe.HealthCheck(last, maxAge),
+	}
+}
+
 func (c *Client) healthRequest(ctx context.Context) (*pb.HealthCheckResponse, error) {
 	reqCtx, reqCancel := context.WithTimeout(ctx, time.Second*time.Duration(Cfg.AlgorithmGrpc.Health.RequestTime))
 	defer reqCancel()
@@ -150,6 +184,7 @@ func (c *Client) startSteam(ctx context.Context) {
 					errCtx := logger.NewErrorContext(ctx1, err)
 					logger.WithContext(errCtx).Errorf("schema: stream创建错误")
 				}
+				metrics.StreamReconnects.WithLabelValues(metrics.ServiceAlgorithm, "schema").Inc()
 				time.Sleep(time.Second * time.Duration(Cfg.AlgorithmGrpc.WaitTime))
 			}
 		}
@@ -168,6 +203,7 @@ func (c *Client) startSteam(ctx context.Context) {
 					errCtx := logger.NewErrorContext(ctx1, err)
 					logger.WithContext(errCtx).Errorf("run: stream创建错误")
 				}
+				metrics.StreamReconnects.WithLabelValues(metrics.ServiceAlgorithm, "run").Inc()
 				time.Sleep(time.Second * time.Duration(Cfg.AlgorithmGrpc.WaitTime))
 			}
 		}
@@ -186,17 +222,22 @@ func (c *Client) SchemaStream(ctx context.Context) error {
 		}
 	}()
 	logger.WithContext(ctx).Infof("schema: stream连接成功")
+	atomic.AddInt32(&c.streamCount, 1)
+	defer atomic.AddInt32(&c.streamCount, -1)
 	for {
 		rec, err := stream.Recv()
 		if err != nil {
 			return err
 		}
 		go func(req *pb.SchemaRequest) {
+			obs := metrics.StartRequest(metrics.ServiceAlgorithm, "schema")
+			defer obs.Done()
 			ctx1, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(Cfg.Algorithm.Timeout))
 			defer cancel()
 			ctx1 = logger.NewModuleContext(ctx1, MODULE_SCHEMA)
 			defer func() {
 				if errR := recover(); errR != nil {
+					obs.Panic()
 					var errStr string
 					switch v := errR.(type) {
 					case error:
@@ -222,6 +263,7 @@ func (c *Client) SchemaStream(ctx context.Context) error {
 			schema, err := c.algorithmService.Schema(ctx1, c.app, req.Lang)
 			schemaRes := new(grpcResult)
 			if err != nil {
+				obs.Fail()
 				schemaRes.Error = err.Error()
 				schemaRes.Code = 400
 			} else {
@@ -252,18 +294,22 @@ func (c *Client) RunStream(ctx context.Context) error {
 		}
 	}()
 	logger.WithContext(ctx).Infof("run: stream连接成功")
+	atomic.AddInt32(&c.streamCount, 1)
+	defer atomic.AddInt32(&c.streamCount, -1)
 	for {
 		res0, err := stream.Recv()
 		if err != nil {
 			return err
 		}
 		go func(res *pb.RunRequest) {
-
+			obs := metrics.StartRequest(metrics.ServiceAlgorithm, "run")
+			defer obs.Done()
 			ctx1, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(Cfg.Algorithm.Timeout))
 			defer cancel()
 			ctx1 = logger.NewModuleContext(ctx1, MODULE_RUN)
 			defer func() {
 				if errR := recover(); errR != nil {
+					obs.Panic()
 					var errStr string
 					switch v := errR.(type) {
 					case error:
@@ -289,6 +335,7 @@ func (c *Client) RunStream(ctx context.Context) error {
 			runRes, err := c.algorithmService.Run(ctx1, c.app, res.Data)
 			gr := new(grpcResult)
 			if err != nil {
+				obs.Fail()
 				gr.Error = err.Error()
 				gr.Code = 400
 			} else {
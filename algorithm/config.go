@@ -5,6 +5,11 @@ import (
 	"encoding/hex"
 	"github.com/air-iot/logger"
 	"google.golang.org/grpc/metadata"
+
+	"github.com/air-iot/sdk-go/v4/utils/grpcx"
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
+	"github.com/air-iot/sdk-go/v4/utils/probe"
+	"github.com/air-iot/sdk-go/v4/utils/tlsx"
 )
 
 var Cfg = new(Config)
@@ -25,6 +30,8 @@ type Config struct {
 		Host   string `json:"host" yaml:"host"`
 		Port   string `json:"port" yaml:"port"`
 	} `json:"pprof" yaml:"pprof"`
+	Metrics metrics.Config `json:"metrics" yaml:"metrics"`
+	Probe   probe.Config   `json:"probe" yaml:"probe"`
 }
 
 type GrpcConfig struct {
@@ -34,8 +41,10 @@ type GrpcConfig struct {
 		RequestTime int `json:"requestTime" yaml:"requestTime"`
 		Retry       int `json:"retry" yaml:"retry"`
 	} `json:"health" yaml:"health"`
-	WaitTime int `json:"waitTime" yaml:"waitTime"`
-	Limit    int `json:"limit" yaml:"limit"`
+	WaitTime int         `json:"waitTime" yaml:"waitTime"`
+	Limit    int         `json:"limit" yaml:"limit"`
+	TLS      tlsx.Config `json:"tls" yaml:"tls"`     // 传输层加密及双向认证
+	Token    grpcx.Token `json:"token" yaml:"token"` // 每个请求携带的Bearer令牌
 }
 
 func GetGrpcContext(ctx context.Context, serviceId, id, name string) context.Context {
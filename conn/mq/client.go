@@ -8,6 +8,7 @@ import (
 
 const (
 	Mqtt   string = "MQTT"
+	Mqtt5  string = "MQTT5"
 	Rabbit string = "RABBIT"
 	Kafka  string = "KAFKA"
 )
@@ -22,14 +23,25 @@ type Config struct {
 
 // NewMQ 创建消息队列
 func NewMQ(cfg Config) (MQ, func(), error) {
+	var (
+		m     MQ
+		clean func()
+		err   error
+	)
 	switch strings.ToUpper(cfg.Type) {
 	case Rabbit:
-		return NewRabbitClient(cfg.Rabbit)
+		m, clean, err = NewRabbitClient(cfg.Rabbit)
 	case Mqtt:
-		return NewMQTTClient(cfg.MQTT)
+		m, clean, err = NewMQTTClient(cfg.MQTT)
+	case Mqtt5:
+		m, clean, err = NewMQTT5Client(cfg.MQTT)
 	case Kafka:
-		return NewKafkaClient(cfg.Kafka)
+		m, clean, err = NewKafkaClient(cfg.Kafka)
 	default:
 		return nil, nil, fmt.Errorf("未知mq类型")
 	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return Instrument(m), clean, nil
 }
@@ -0,0 +1,44 @@
+package mq
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
+	"github.com/air-iot/sdk-go/v4/utils/tracing"
+)
+
+// instrumented 记录消息发送耗时和失败次数,按主题第一段区分.
+// 发送时创建producer span,支持消息头的消息队列把链路上下文写入消息头
+type instrumented struct {
+	MQ
+}
+
+// Instrument 为消息队列添加发送指标
+func Instrument(m MQ) MQ {
+	if _, ok := m.(instrumented); ok {
+		return m
+	}
+	return instrumented{MQ: m}
+}
+
+func (m instrumented) Publish(ctx context.Context, topicParams []string, payload []byte) error {
+	var prefix string
+	if len(topicParams) > 0 {
+		prefix = topicParams[0]
+	}
+	ctx, span := tracing.Start(ctx, "mq.publish "+prefix, trace.SpanKindProducer,
+		attribute.String("messaging.destination.name", strings.Join(topicParams, "/")))
+	begin := time.Now()
+	err := m.MQ.Publish(ctx, topicParams, payload)
+	tracing.End(span, err)
+	metrics.MQPublishDuration.WithLabelValues(prefix).Observe(time.Since(begin).Seconds())
+	if err != nil {
+		metrics.MQPublishFailures.WithLabelValues(prefix).Inc()
+	}
+	return err
+}
@@ -2,28 +2,50 @@ package mq
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"regexp"
+	"net"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/air-iot/logger"
+
+	"github.com/air-iot/sdk-go/v4/utils/tlsx"
+	"github.com/air-iot/sdk-go/v4/utils/tracing"
 )
 
 var _ MQ = new(kafka)
 
 type kafka struct {
-	lock                 sync.RWMutex
-	config               KafkaConfig
-	client               sarama.Client
-	producer             sarama.SyncProducer
-	consumer             sarama.ConsumerGroup
-	callbacks            []Callback
-	consumerTopicContext map[string]context.CancelFunc
+	lock      sync.RWMutex
+	config    KafkaConfig
+	client    sarama.Client
+	producer  sarama.SyncProducer
+	consumer  sarama.ConsumerGroup
+	callbacks []Callback
+	// failed 发送消息时broker不可用为true,重新连接broker后恢复,只在状态变化时通知回调.
+	// 消费者组的错误由consumeLoop重试,不影响发送
+	failed atomic.Bool
+
+	subsLock sync.RWMutex
+	// subs 按订阅主题保存处理函数,收到消息时按层级匹配
+	subs *topicTrie[*kafkaSubscription]
+	// topics kafka主题的订阅数量,变化时重新加入消费者组
+	topics map[string]int
+	// restart 结束当前消费会话
+	restart context.CancelFunc
+	done    chan struct{}
 }
 
+const (
+	kafkaMinBackoff = time.Second
+	kafkaMaxBackoff = 30 * time.Second
+)
+
 // KafkaConfig mqtt配置参数
 type KafkaConfig struct {
 	Brokers         []string
@@ -34,6 +56,23 @@ type KafkaConfig struct {
 	Balancer        string
 	Partition       *int32
 	AutoCommit      *bool
+	TLS             tlsx.Config     `json:"tls" yaml:"tls"`
+	SASL            KafkaSASLConfig `json:"sasl" yaml:"sasl"`
+}
+
+// Kafka SASL认证机制
+const (
+	SASLPlain       = "PLAIN"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+	SASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// KafkaSASLConfig Kafka SASL认证配置
+type KafkaSASLConfig struct {
+	Enable    bool   `json:"enable" yaml:"enable"`
+	Mechanism string `json:"mechanism" yaml:"mechanism"` // PLAIN、SCRAM-SHA-256或SCRAM-SHA-512,默认为PLAIN
+	Username  string `json:"username" yaml:"username"`
+	Password  string `json:"password" yaml:"password"`
 }
 
 // NewKafkaClient 创建Kafka消息队列
@@ -41,12 +80,15 @@ func NewKafkaClient(cfg KafkaConfig) (mq MQ, clean func(), err error) {
 	cli := new(kafka)
 	cli.config = cfg
 	cli.callbacks = make([]Callback, 0)
-	cli.consumerTopicContext = make(map[string]context.CancelFunc)
+	cli.subs = newTopicTrie[*kafkaSubscription]()
+	cli.topics = make(map[string]int)
+	cli.done = make(chan struct{})
 	client, err := cli.getClient()
 	if err != nil {
 		return nil, nil, err
 	}
 	cleanFunc := func() {
+		cli.stopConsumer()
 		logger.Infof("关闭kafka客户端")
 		if err := client.Close(); err != nil {
 			logger.Errorf("关闭kafka客户端错误:%v", err)
@@ -56,7 +98,7 @@ func NewKafkaClient(cfg KafkaConfig) (mq MQ, clean func(), err error) {
 	return cli, cleanFunc, nil
 }
 
-func (k *kafka) Publish(_ context.Context, topicParams []string, payload []byte) error {
+func (k *kafka) Publish(ctx context.Context, topicParams []string, payload []byte) error {
 	if len(topicParams) == 0 {
 		return fmt.Errorf("topic为空")
 	}
@@ -73,47 +115,228 @@ func (k *kafka) Publish(_ context.Context, topicParams []string, payload []byte)
 	if k.config.Partition != nil {
 		msg.Partition = *k.config.Partition
 	}
+	for key, val := range tracing.Headers(ctx) {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(val)})
+	}
 	producer, err := k.getProducer()
 	if err != nil {
+		k.fail(err)
 		return err
 	}
 	_, _, err = producer.SendMessage(msg)
 	if err != nil {
+		k.fail(err)
 		return fmt.Errorf("发送消息错误:%w", err)
 	}
 	return nil
 }
 
+// fail broker不可用时通知Lost回调,并在后台等待broker恢复
+func (k *kafka) fail(err error) {
+	if !kafkaUnavailable(err) || !k.failed.CompareAndSwap(false, true) {
+		return
+	}
+	logger.Errorf("kafka broker不可用:%v", err)
+	k.lost()
+	go k.reconnect()
+}
+
+// reconnect 按退避间隔刷新元数据,broker恢复后通知Connect回调
+func (k *kafka) reconnect() {
+	backoff := kafkaMinBackoff
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-time.After(backoff):
+		}
+		if err := k.client.RefreshMetadata(); err != nil {
+			logger.Errorf("kafka 重连错误,%s后重试:%v", backoff, err)
+			backoff = min(backoff*2, kafkaMaxBackoff)
+			continue
+		}
+		logger.Infof("kafka 已重连")
+		if k.failed.CompareAndSwap(true, false) {
+			k.connect()
+		}
+		return
+	}
+}
+
+// kafkaUnavailable 判断错误是否为连接不到broker,消息本身的错误(如消息过大)不影响连接状态
+func kafkaUnavailable(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, sarama.ErrOutOfBrokers) ||
+		errors.Is(err, sarama.ErrNotConnected) ||
+		errors.Is(err, sarama.ErrClosedClient) ||
+		errors.Is(err, sarama.ErrBrokerNotAvailable) ||
+		errors.Is(err, sarama.ErrLeaderNotAvailable) ||
+		errors.Is(err, sarama.ErrNotLeaderForPartition) ||
+		errors.Is(err, sarama.ErrRequestTimedOut) ||
+		errors.As(err, &netErr)
+}
+
+// Consume 订阅主题的第一级为kafka主题,其余部分与消息的key匹配,支持+、#通配符.
+// 所有订阅共用一个消费者组,ctx结束或取消订阅后不再收到该主题的消息
 func (k *kafka) Consume(ctx context.Context, topicParams []string, splitN int, handler Handler) error {
 	if len(topicParams) == 0 {
 		return fmt.Errorf("topic为空")
 	}
-	errChan := make(chan error)
-	newCtx, newCancel := context.WithCancel(ctx)
-	kh := &kafkaHandler{topicParams: topicParams, topicString: strings.Join(topicParams, TOPICSEPWITHMQTT), splitN: splitN, handler: handler, k: k, errChan: errChan, cancel: newCancel}
-	go func() {
-		select {
-		case <-newCtx.Done():
-			logger.Infof("订阅数据,发起停止,topic:%+v", topicParams)
-		case err := <-errChan:
-			if err != nil {
-				logger.Errorf("订阅数据错误,收到管道信息,topic:%+v,错误:%v", topicParams, err)
-			}
+	topic := topicParams[0]
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("kafka主题不支持通配符:%s", topic)
+	}
+	filter := strings.Join(topicParams, TOPICSEPWITHMQTT)
+	sub := &kafkaSubscription{topic: topic, splitN: splitN, handler: handler}
+	k.subsLock.Lock()
+	defer k.subsLock.Unlock()
+	if err := k.startConsumer(); err != nil {
+		return err
+	}
+	if old, ok := k.subs.get(filter); ok {
+		old.stop()
+	} else {
+		k.topics[topic]++
+		if k.topics[topic] == 1 {
+			k.restartConsumer()
 		}
-		//close(errChan)
-		k.clean()
-	}()
-	return kh.consume(newCtx)
+	}
+	k.subs.add(filter, sub)
+	sub.stop = context.AfterFunc(ctx, func() {
+		logger.Infof("订阅数据,发起停止,topic:%s", filter)
+		k.unsubscribe(filter, sub)
+	})
+	return nil
 }
 
 func (k *kafka) UnSubscription(_ context.Context, topicParams []string) error {
 	if len(topicParams) == 0 {
 		return fmt.Errorf("topic为空")
 	}
-	//k.cancelFunc(topicParams[0])
+	k.unsubscribe(strings.Join(topicParams, TOPICSEPWITHMQTT), nil)
 	return nil
 }
 
+// unsubscribe 删除订阅,sub不为空时只删除该订阅,避免删除同一主题后来的订阅
+func (k *kafka) unsubscribe(filter string, sub *kafkaSubscription) {
+	k.subsLock.Lock()
+	defer k.subsLock.Unlock()
+	cur, ok := k.subs.get(filter)
+	if !ok || (sub != nil && cur != sub) {
+		return
+	}
+	cur.stop()
+	k.subs.remove(filter)
+	k.topics[cur.topic]--
+	if k.topics[cur.topic] == 0 {
+		delete(k.topics, cur.topic)
+		k.restartConsumer()
+	}
+}
+
+// startConsumer 第一次订阅时创建消费者组,调用时需持有subsLock
+func (k *kafka) startConsumer() error {
+	select {
+	case <-k.done:
+		return fmt.Errorf("kafka客户端已关闭")
+	default:
+	}
+	if k.consumer != nil {
+		return nil
+	}
+	consumer, err := sarama.NewConsumerGroupFromClient(k.config.GroupID, k.client)
+	if err != nil {
+		return fmt.Errorf("创建消费者错误:%w", err)
+	}
+	k.consumer = consumer
+	go func() {
+		// 分区消费和提交偏移量的错误由sarama重试,只记录日志
+		for err := range consumer.Errors() {
+			logger.Errorf("订阅数据,收到错误:%v", err)
+		}
+	}()
+	go k.consumeLoop(consumer)
+	return nil
+}
+
+// restartConsumer 订阅的kafka主题变化时结束当前消费会话,按新的主题重新加入消费者组,调用时需持有subsLock
+func (k *kafka) restartConsumer() {
+	if k.restart != nil {
+		k.restart()
+	}
+}
+
+// stopConsumer 停止消费并关闭消费者组
+func (k *kafka) stopConsumer() {
+	k.subsLock.Lock()
+	consumer := k.consumer
+	close(k.done)
+	k.restartConsumer()
+	k.subsLock.Unlock()
+	if consumer == nil {
+		return
+	}
+	if err := consumer.Close(); err != nil {
+		logger.Errorf("关闭kafka消费者错误:%v", err)
+	}
+}
+
+// consumeLoop 使用一个消费者组消费所有订阅的kafka主题.
+// 会话因重平衡或订阅变化结束时重新加入,消费错误时按退避间隔重试,只重启消费者,不通知Lost回调
+func (k *kafka) consumeLoop(consumer sarama.ConsumerGroup) {
+	backoff := kafkaMinBackoff
+	for {
+		k.subsLock.Lock()
+		topics := make([]string, 0, len(k.topics))
+		for topic := range k.topics {
+			topics = append(topics, topic)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		k.restart = cancel
+		k.subsLock.Unlock()
+		sort.Strings(topics)
+
+		var err error
+		if len(topics) == 0 {
+			<-ctx.Done()
+		} else {
+			logger.Infof("订阅数据,topic:%v", topics)
+			err = consumer.Consume(ctx, topics, &kafkaHandler{k: k})
+		}
+		cancel()
+		select {
+		case <-k.done:
+			return
+		default:
+		}
+		if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+			return
+		}
+		if err == nil {
+			backoff = kafkaMinBackoff
+			continue
+		}
+		logger.Errorf("订阅数据,消费错误,topic:%v,%s后重试,错误:%v", topics, backoff, err)
+		select {
+		case <-k.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, kafkaMaxBackoff)
+	}
+}
+
+// dispatch 将消息交给匹配的订阅处理,主题为kafka主题/消息key
+func (k *kafka) dispatch(msg *sarama.ConsumerMessage) {
+	topic := strings.Join([]string{msg.Topic, string(msg.Key)}, TOPICSEPWITHMQTT)
+	k.subsLock.RLock()
+	subs := k.subs.match(topic)
+	k.subsLock.RUnlock()
+	for _, sub := range subs {
+		sub.handler(topic, strings.SplitN(topic, TOPICSEPWITHMQTT, sub.splitN), msg.Value)
+	}
+}
+
 func (k *kafka) Callback(cb Callback) {
 	k.lock.Lock()
 	defer k.lock.Unlock()
@@ -156,6 +379,32 @@ func (k *kafka) getConfig() (c *sarama.Config, err error) {
 	if k.config.ClientID != "" {
 		config.ClientID = k.config.ClientID
 	}
+	tlsCfg, err := k.config.TLS.Load()
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsCfg
+	}
+	if sasl := k.config.SASL; sasl.Enable {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.Handshake = true
+		config.Net.SASL.User = sasl.Username
+		config.Net.SASL.Password = sasl.Password
+		switch strings.ToUpper(sasl.Mechanism) {
+		case "", SASLPlain:
+			config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case SASLScramSHA256:
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return newSCRAMSHA256Client() }
+		case SASLScramSHA512:
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return newSCRAMSHA512Client() }
+		default:
+			return nil, fmt.Errorf("不支持的kafka SASL认证机制:%s", sasl.Mechanism)
+		}
+	}
 	return config, nil
 }
 
@@ -189,12 +438,6 @@ func (k *kafka) getProducer() (sarama.SyncProducer, error) {
 	return k.producer, nil
 }
 
-func (k *kafka) clean() {
-	time.Sleep(time.Second)
-	k.lost()
-	k.connect()
-}
-
 func (k *kafka) lost() {
 	k.lock.Lock()
 	defer k.lock.Unlock()
@@ -219,79 +462,40 @@ func (k *kafka) connect() {
 	return
 }
 
+// kafkaSubscription 一个订阅主题的处理函数
+type kafkaSubscription struct {
+	topic   string
+	splitN  int
+	handler Handler
+	// stop 停止监听订阅时传入的ctx
+	stop func() bool
+}
+
 type kafkaHandler struct {
-	splitN      int
-	handler     Handler
-	k           *kafka
-	topicParams []string
-	topicString string
-	cancel      context.CancelFunc
-	errChan     chan error
+	k *kafka
 }
 
 func (h *kafkaHandler) Setup(sess sarama.ConsumerGroupSession) error {
-	logger.Infof("kafka handler setup,topic:%+v,MemberID:%s,GenerationID:%d", h.topicParams, sess.MemberID(), sess.GenerationID())
+	logger.Infof("kafka handler setup,topic:%+v,MemberID:%s,GenerationID:%d", sess.Claims(), sess.MemberID(), sess.GenerationID())
 	return nil
 }
 
 func (h *kafkaHandler) Cleanup(sess sarama.ConsumerGroupSession) error {
-	logger.Infof("kafka handler cleanup,topic:%+v,MemberID:%s,GenerationID:%d", h.topicParams, sess.MemberID(), sess.GenerationID())
-	h.cancel()
+	logger.Infof("kafka handler cleanup,topic:%+v,MemberID:%s,GenerationID:%d", sess.Claims(), sess.MemberID(), sess.GenerationID())
 	return nil
 }
 
 func (h *kafkaHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	for msg := range claim.Messages() {
-		h.handlerMessage(sess, claim, msg)
-	}
-	return nil
-}
-
-func (h *kafkaHandler) handlerMessage(sess sarama.ConsumerGroupSession, _ sarama.ConsumerGroupClaim, msg *sarama.ConsumerMessage) {
-	if msg == nil {
-		return
-	}
-	defer func() {
-		sess.MarkMessage(msg, "")
-	}()
-	topic := strings.Join([]string{msg.Topic, string(msg.Key)}, TOPICSEPWITHMQTT)
-	if h.mqttMatch(h.topicString, topic) {
-		h.handler(topic, strings.SplitN(topic, TOPICSEPWITHMQTT, h.splitN), msg.Value)
-	}
-}
-
-func (h *kafkaHandler) mqttMatch(subscription, topic string) bool {
-	subscription = strings.ReplaceAll(subscription, "+", "[^/]+")
-	subscription = strings.ReplaceAll(subscription, "#", ".*")
-	subscription = "^" + subscription + "$"
-
-	match, _ := regexp.MatchString(subscription, topic)
-	return match
-}
-
-func (h *kafkaHandler) consume(ctx context.Context) error {
-	consumer, err := sarama.NewConsumerGroupFromClient(h.k.config.GroupID, h.k.client)
-	if err != nil {
-		return fmt.Errorf("创建消费者错误:%w", err)
-	}
-	topic := h.topicParams[0]
-	go func() {
+	for {
 		select {
-		case <-ctx.Done():
-			logger.Infof("订阅数据,上下文消费错误停止,topic:%s", topic)
-			return
-		case err := <-consumer.Errors():
-			logger.Errorf("订阅数据,收到错误,topic:%s,错误:%v", topic, err)
-			h.cancel()
-			h.errChan <- err
-		}
-	}()
-	go func() {
-		logger.Infof("订阅数据,topic:%s", topic)
-		if err := consumer.Consume(ctx, []string{topic}, h); err != nil {
-			logger.Errorf("订阅数据,消费错误,topic:%s,错误:%v", topic, err)
-			h.errChan <- err
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			h.k.dispatch(msg)
+			sess.MarkMessage(msg, "")
+		case <-sess.Context().Done():
+			return nil
 		}
-	}()
-	return nil
+	}
 }
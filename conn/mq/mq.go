@@ -1,12 +1,22 @@
 package mq
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type Handler func(topic string, topicSplit []string, payload []byte)
 
 // MQ is a mq interface
 type MQ interface {
+	// Publish 发送消息. 以下发送选项通过ctx传递,保持接口兼容,不支持的实现忽略:
+	//   - WithQoS: 本次发送的QoS,MQTT和MQTT v5生效,未设置时使用配置的QoS
+	//   - WithRetain: 是否为保留消息,MQTT和MQTT v5生效
+	//   - WithMessageExpiry: 消息过期时间,只对MQTT v5生效
+	//
+	// ctx中的链路追踪信息作为消息头发送(MQTT v3不支持消息头)
 	Publish(ctx context.Context, topicParams []string, payload []byte) error
+	// Consume 订阅主题,WithQoS设置本次订阅的QoS,只对MQTT和MQTT v5生效
 	Consume(ctx context.Context, topicParams []string, splitN int, handler Handler) error
 	UnSubscription(ctx context.Context, sub []string) error
 	Callback(Callback)
@@ -16,3 +26,42 @@ type Callback interface {
 	Connect(MQ) error
 	Lost(MQ) error
 }
+
+type (
+	qosKey    struct{}
+	retainKey struct{}
+	expiryKey struct{}
+)
+
+// WithQoS 设置本次发送或订阅使用的QoS,只对MQTT生效
+func WithQoS(ctx context.Context, qos byte) context.Context {
+	return context.WithValue(ctx, qosKey{}, qos)
+}
+
+// QoSFromContext 返回WithQoS设置的QoS
+func QoSFromContext(ctx context.Context) (byte, bool) {
+	qos, ok := ctx.Value(qosKey{}).(byte)
+	return qos, ok
+}
+
+// WithRetain 设置本次发送的消息是否为保留消息,只对MQTT生效
+func WithRetain(ctx context.Context, retain bool) context.Context {
+	return context.WithValue(ctx, retainKey{}, retain)
+}
+
+// RetainFromContext 返回WithRetain设置的值,未设置时为false
+func RetainFromContext(ctx context.Context) bool {
+	retain, _ := ctx.Value(retainKey{}).(bool)
+	return retain
+}
+
+// WithMessageExpiry 设置本次发送的消息过期时间,只对MQTT v5生效
+func WithMessageExpiry(ctx context.Context, expiry time.Duration) context.Context {
+	return context.WithValue(ctx, expiryKey{}, expiry)
+}
+
+// MessageExpiryFromContext 返回WithMessageExpiry设置的过期时间
+func MessageExpiryFromContext(ctx context.Context) (time.Duration, bool) {
+	expiry, ok := ctx.Value(expiryKey{}).(time.Duration)
+	return expiry, ok
+}
@@ -10,12 +10,25 @@ import (
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 
 	"github.com/air-iot/logger"
+
+	"github.com/air-iot/sdk-go/v4/utils/tlsx"
 )
 
 type mqtt struct {
 	lock      sync.RWMutex
 	client    MQTT.Client
 	callbacks []Callback
+	qos       byte
+
+	subsLock sync.Mutex
+	// subs 已订阅的主题,重连后没有保留会话时重新订阅
+	subs map[string]mqttSubscription
+}
+
+// mqttSubscription 订阅的QoS和消息处理函数
+type mqttSubscription struct {
+	qos     byte
+	handler MQTT.MessageHandler
 }
 
 // MQTTConfig mqtt配置参数
@@ -27,9 +40,39 @@ type MQTTConfig struct {
 	KeepAlive       uint   `json:"keepAlive" yaml:"keepAlive" default:"60"`
 	ConnectTimeout  uint   `json:"connectTimeout" yaml:"connectTimeout" default:"20"`
 	ProtocolVersion uint   `json:"protocolVersion" yaml:"protocolVersion" default:"4"`
+	// ClientID 客户端ID,为空时由服务端分配. 开启持久会话时必须设置
+	ClientID string `json:"clientId" yaml:"clientId"`
+	// PersistentSession 使用持久会话(CleanSession=false),断线期间服务端保留订阅和QoS 1、2的消息
+	PersistentSession bool `json:"persistentSession" yaml:"persistentSession"`
+	// QoS 发送和订阅默认使用的QoS,可通过WithQoS按次设置
+	QoS byte `json:"qos" yaml:"qos"`
+	// TLS 开启时使用ssl://,使用WebSocket时为wss://
+	TLS tlsx.Config `json:"tls" yaml:"tls"`
+	// WebSocket 通过WebSocket连接,Path为WebSocket路径,如/mqtt
+	WebSocket bool   `json:"webSocket" yaml:"webSocket"`
+	Path      string `json:"path" yaml:"path"`
+
+	// 以下配置只对MQTT v5(protocolVersion为5或mq类型为MQTT5)生效
+
+	// SessionExpiry 会话过期时间(秒),持久会话未设置时为1天
+	SessionExpiry uint32 `json:"sessionExpiry" yaml:"sessionExpiry"`
+	// MessageExpiry 消息过期时间(秒),0为不过期,可通过WithMessageExpiry按次设置
+	MessageExpiry uint32 `json:"messageExpiry" yaml:"messageExpiry"`
+	// ShareGroup 共享订阅分组,不为空时订阅$share/分组/主题,多个驱动副本分担消息
+	ShareGroup string `json:"shareGroup" yaml:"shareGroup"`
+	// TopicAliasMaximum 发送消息使用的主题别名数量,不超过服务端允许的数量,0为不使用
+	TopicAliasMaximum uint16 `json:"topicAliasMaximum" yaml:"topicAliasMaximum"`
 }
 
 func (a MQTTConfig) DNS() string {
+	switch {
+	case a.WebSocket && a.TLS.Enable:
+		return fmt.Sprintf("wss://%s:%d%s", a.Host, a.Port, a.Path)
+	case a.WebSocket:
+		return fmt.Sprintf("ws://%s:%d%s", a.Host, a.Port, a.Path)
+	case a.TLS.Enable:
+		return fmt.Sprintf("ssl://%s:%d", a.Host, a.Port)
+	}
 	return fmt.Sprintf("tcp://%s:%d", a.Host, a.Port)
 }
 
@@ -38,22 +81,53 @@ const TOPICSEPWITHMQTT = "/"
 func NewMQTT(cli MQTT.Client) MQ {
 	m := new(mqtt)
 	m.client = cli
+	m.subs = make(map[string]mqttSubscription)
 	return m
 }
 
 // NewMQTTClient 创建MQTT消息队列
 func NewMQTTClient(cfg MQTTConfig) (MQ, func(), error) {
+	if cfg.ProtocolVersion == 5 {
+		return NewMQTT5Client(cfg)
+	}
+	if cfg.QoS > 2 {
+		return nil, nil, fmt.Errorf("MQTT QoS %d 错误,取值为0、1、2", cfg.QoS)
+	}
+	if cfg.PersistentSession && cfg.ClientID == "" {
+		return nil, nil, fmt.Errorf("MQTT 持久会话需要设置clientId")
+	}
+	keepAlive, connectTimeout, protocolVersion := cfg.KeepAlive, cfg.ConnectTimeout, cfg.ProtocolVersion
+	if keepAlive == 0 {
+		keepAlive = 60
+	}
+	if connectTimeout == 0 {
+		connectTimeout = 20
+	}
+	if protocolVersion == 0 {
+		protocolVersion = 4
+	}
+	tlsCfg, err := cfg.TLS.Load()
+	if err != nil {
+		return nil, nil, err
+	}
 	mqCli := new(mqtt)
 	mqCli.callbacks = make([]Callback, 0)
+	mqCli.qos = cfg.QoS
+	mqCli.subs = make(map[string]mqttSubscription)
 	opts := MQTT.NewClientOptions()
 	opts.AddBroker(cfg.DNS())
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
+	}
 	opts.SetAutoReconnect(true)
-	opts.SetCleanSession(true)
+	opts.SetCleanSession(!cfg.PersistentSession)
+	opts.SetResumeSubs(cfg.PersistentSession)
+	opts.SetClientID(cfg.ClientID)
 	opts.SetUsername(cfg.Username)
 	opts.SetPassword(cfg.Password)
-	opts.SetConnectTimeout(time.Second * 20)
-	opts.SetKeepAlive(time.Second * 60)
-	opts.SetProtocolVersion(4)
+	opts.SetConnectTimeout(time.Second * time.Duration(connectTimeout))
+	opts.SetKeepAlive(time.Second * time.Duration(keepAlive))
+	opts.SetProtocolVersion(protocolVersion)
 	opts.SetConnectionLostHandler(func(client MQTT.Client, e error) {
 		if e != nil {
 			logger.Errorf("MQTT Lost错误: %s", e.Error())
@@ -63,6 +137,7 @@ func NewMQTTClient(cfg MQTTConfig) (MQ, func(), error) {
 	opts.SetOrderMatters(false)
 	opts.SetOnConnectHandler(func(client MQTT.Client) {
 		logger.Infof("MQTT 已连接")
+		mqCli.resubscribe(client)
 		mqCli.connect()
 	})
 	// Start the connection
@@ -106,9 +181,37 @@ func (p *mqtt) connect() {
 	return
 }
 
+// resubscribe 重连后重新订阅. 服务端保留了会话时订阅仍然有效,重复订阅不影响
+func (p *mqtt) resubscribe(client MQTT.Client) {
+	p.subsLock.Lock()
+	defer p.subsLock.Unlock()
+	for topic, sub := range p.subs {
+		if token := client.Subscribe(topic, sub.qos, sub.handler); token.Wait() && token.Error() != nil {
+			logger.Errorf("MQTT 重新订阅 %s 错误: %s", topic, token.Error())
+		}
+	}
+}
+
+// qosOf 返回ctx中通过WithQoS设置的QoS,未设置时使用配置的QoS
+func (p *mqtt) qosOf(ctx context.Context) (byte, error) {
+	qos, ok := QoSFromContext(ctx)
+	if !ok {
+		return p.qos, nil
+	}
+	if qos > 2 {
+		return 0, fmt.Errorf("MQTT QoS %d 错误,取值为0、1、2", qos)
+	}
+	return qos, nil
+}
+
+// Publish MQTT 3.1.1没有消息头,链路上下文不随消息传递
 func (p *mqtt) Publish(ctx context.Context, topicParams []string, payload []byte) error {
 	topic := strings.Join(topicParams, TOPICSEPWITHMQTT)
-	if token := p.client.Publish(topic, 0, false, string(payload)); token.Wait() && token.Error() != nil {
+	qos, err := p.qosOf(ctx)
+	if err != nil {
+		return err
+	}
+	if token := p.client.Publish(topic, qos, RetainFromContext(ctx), string(payload)); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
 	return nil
@@ -116,18 +219,29 @@ func (p *mqtt) Publish(ctx context.Context, topicParams []string, payload []byte
 
 func (p *mqtt) Consume(ctx context.Context, topicParams []string, splitN int, handler Handler) error {
 	topic := strings.Join(topicParams, TOPICSEPWITHMQTT)
-	if token := p.client.Subscribe(topic, 0, func(client MQTT.Client, message MQTT.Message) {
+	qos, err := p.qosOf(ctx)
+	if err != nil {
+		return err
+	}
+	sub := mqttSubscription{qos: qos, handler: func(client MQTT.Client, message MQTT.Message) {
 		handler(message.Topic(), strings.SplitN(message.Topic(), TOPICSEPWITHMQTT, splitN), message.Payload())
-	}); token.Wait() && token.Error() != nil {
+	}}
+	p.subsLock.Lock()
+	defer p.subsLock.Unlock()
+	if token := p.client.Subscribe(topic, sub.qos, sub.handler); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
+	p.subs[topic] = sub
 	return nil
 }
 
 func (p *mqtt) UnSubscription(ctx context.Context, topicParams []string) error {
 	topic := strings.Join(topicParams, TOPICSEPWITHMQTT)
+	p.subsLock.Lock()
+	defer p.subsLock.Unlock()
 	if token := p.client.Unsubscribe(topic); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
+	delete(p.subs, topic)
 	return nil
 }
@@ -0,0 +1,323 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/extensions/topicaliases"
+
+	"github.com/air-iot/logger"
+
+	"github.com/air-iot/sdk-go/v4/utils/tracing"
+)
+
+// mqtt5 MQTT v5消息队列,支持用户属性、消息过期、共享订阅和主题别名
+type mqtt5 struct {
+	lock      sync.RWMutex
+	cm        *autopaho.ConnectionManager
+	callbacks []Callback
+	// connected 连接状态,服务端断开时可能同时触发服务端断开和客户端错误,每次断开只通知一次Lost
+	connected bool
+	cfg       MQTTConfig
+	router    *paho.StandardRouter
+
+	aliasLock sync.Mutex
+	// aliases 当前连接的主题别名,主题别名只在一个连接内有效,重连后重新创建
+	aliases *topicaliases.TAHandler
+
+	subsLock sync.Mutex
+	// subs 已订阅的主题,重连后服务端没有保留会话时重新订阅
+	subs map[string]byte
+}
+
+// ReasonCodeError MQTT v5服务端返回的失败原因码
+type ReasonCodeError struct {
+	Op     string
+	Code   byte
+	Reason string
+}
+
+func (e *ReasonCodeError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("MQTT %s 失败: 原因码=0x%02x", e.Op, e.Code)
+	}
+	return fmt.Sprintf("MQTT %s 失败: 原因码=0x%02x,%s", e.Op, e.Code, e.Reason)
+}
+
+// NewMQTT5Client 创建MQTT v5消息队列
+func NewMQTT5Client(cfg MQTTConfig) (MQ, func(), error) {
+	if cfg.QoS > 2 {
+		return nil, nil, fmt.Errorf("MQTT QoS %d 错误,取值为0、1、2", cfg.QoS)
+	}
+	if cfg.PersistentSession && cfg.ClientID == "" {
+		return nil, nil, fmt.Errorf("MQTT 持久会话需要设置clientId")
+	}
+	if cfg.KeepAlive == 0 {
+		cfg.KeepAlive = 60
+	}
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = 20
+	}
+	sessionExpiry := cfg.SessionExpiry
+	if cfg.PersistentSession && sessionExpiry == 0 {
+		// 会话过期时间为0时断开连接即清除会话
+		sessionExpiry = 24 * 60 * 60
+	}
+	server, err := url.Parse(cfg.DNS())
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsCfg, err := cfg.TLS.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+	m := &mqtt5{cfg: cfg, router: paho.NewStandardRouter(), subs: make(map[string]byte)}
+	clientCfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{server},
+		TlsCfg:                        tlsCfg,
+		KeepAlive:                     uint16(cfg.KeepAlive),
+		CleanStartOnInitialConnection: !cfg.PersistentSession,
+		SessionExpiryInterval:         sessionExpiry,
+		ConnectTimeout:                time.Second * time.Duration(cfg.ConnectTimeout),
+		ConnectUsername:               cfg.Username,
+		ConnectPassword:               []byte(cfg.Password),
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+			logger.Infof("MQTT5 已连接")
+			m.resetAliases(connack)
+			if !connack.SessionPresent {
+				m.resubscribe(cm)
+			}
+			m.connect()
+		},
+		OnConnectError: func(err error) {
+			logger.Errorf("MQTT5 连接错误: %v", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: cfg.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					m.router.Route(pr.Packet.Packet())
+					return true, nil
+				},
+			},
+			OnClientError: func(err error) {
+				logger.Errorf("MQTT5 Lost错误: %v", err)
+				m.lost()
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				logger.Errorf("MQTT5 服务端断开连接: %v", &ReasonCodeError{Op: "连接", Code: d.ReasonCode, Reason: disconnectReason(d)})
+				m.lost()
+			},
+			PublishHook: m.publishHook,
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cm, err := autopaho.NewConnection(ctx, clientCfg)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	connectCtx, connectCancel := context.WithTimeout(ctx, clientCfg.ConnectTimeout)
+	defer connectCancel()
+	if err := cm.AwaitConnection(connectCtx); err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("MQTT5 连接 %s 错误: %w", server, err)
+	}
+	m.cm = cm
+	cleanFunc := func() {
+		disconnectCtx, disconnectCancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer disconnectCancel()
+		_ = cm.Disconnect(disconnectCtx)
+		cancel()
+	}
+	return m, cleanFunc, nil
+}
+
+func disconnectReason(d *paho.Disconnect) string {
+	if d.Properties == nil {
+		return ""
+	}
+	return d.Properties.ReasonString
+}
+
+func (p *mqtt5) Callback(cb Callback) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.callbacks = append(p.callbacks, cb)
+}
+
+func (p *mqtt5) lost() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.connected {
+		return
+	}
+	p.connected = false
+	for _, cb := range p.callbacks {
+		if err := cb.Lost(p); err != nil {
+			logger.Fatalf("lost callback err, %s", err)
+		}
+	}
+}
+
+func (p *mqtt5) connect() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.connected = true
+	for _, cb := range p.callbacks {
+		if err := cb.Connect(p); err != nil {
+			logger.Fatalf("connect callback err, %s", err)
+		}
+	}
+}
+
+// resetAliases 按配置和服务端允许的最大值创建主题别名,任一方为0时不使用主题别名
+func (p *mqtt5) resetAliases(connack *paho.Connack) {
+	p.aliasLock.Lock()
+	defer p.aliasLock.Unlock()
+	p.aliases = nil
+	max := p.cfg.TopicAliasMaximum
+	if connack.Properties == nil || connack.Properties.TopicAliasMaximum == nil {
+		return
+	}
+	if server := *connack.Properties.TopicAliasMaximum; server < max {
+		max = server
+	}
+	if max > 0 {
+		p.aliases = topicaliases.NewTAHandler(max)
+	}
+}
+
+func (p *mqtt5) publishHook(pb *paho.Publish) {
+	p.aliasLock.Lock()
+	defer p.aliasLock.Unlock()
+	if p.aliases != nil {
+		p.aliases.PublishHook(pb)
+	}
+}
+
+func (p *mqtt5) resubscribe(cm *autopaho.ConnectionManager) {
+	p.subsLock.Lock()
+	defer p.subsLock.Unlock()
+	for topic, qos := range p.subs {
+		if err := p.subscribe(context.Background(), cm, topic, qos); err != nil {
+			logger.Errorf("MQTT5 重新订阅 %s 错误: %v", topic, err)
+		}
+	}
+}
+
+// subscribe 订阅主题,服务端拒绝时返回ReasonCodeError
+func (p *mqtt5) subscribe(ctx context.Context, cm *autopaho.ConnectionManager, topic string, qos byte) error {
+	suback, err := cm.Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}}})
+	if suback != nil && len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+		var reason string
+		if suback.Properties != nil {
+			reason = suback.Properties.ReasonString
+		}
+		return &ReasonCodeError{Op: "订阅 " + topic, Code: suback.Reasons[0], Reason: reason}
+	}
+	return err
+}
+
+// qosOf 返回ctx中通过WithQoS设置的QoS,未设置时使用配置的QoS
+func (p *mqtt5) qosOf(ctx context.Context) (byte, error) {
+	qos, ok := QoSFromContext(ctx)
+	if !ok {
+		return p.cfg.QoS, nil
+	}
+	if qos > 2 {
+		return 0, fmt.Errorf("MQTT QoS %d 错误,取值为0、1、2", qos)
+	}
+	return qos, nil
+}
+
+// Publish 链路上下文写入用户属性
+func (p *mqtt5) Publish(ctx context.Context, topicParams []string, payload []byte) error {
+	topic := strings.Join(topicParams, TOPICSEPWITHMQTT)
+	qos, err := p.qosOf(ctx)
+	if err != nil {
+		return err
+	}
+	props := new(paho.PublishProperties)
+	for k, v := range tracing.Headers(ctx) {
+		props.User.Add(k, v)
+	}
+	expiry := p.cfg.MessageExpiry
+	if d, ok := MessageExpiryFromContext(ctx); ok {
+		expiry = uint32(d / time.Second)
+	}
+	if expiry > 0 {
+		props.MessageExpiry = &expiry
+	}
+	res, err := p.cm.Publish(ctx, &paho.Publish{
+		QoS:        qos,
+		Retain:     RetainFromContext(ctx),
+		Topic:      topic,
+		Properties: props,
+		Payload:    payload,
+	})
+	// QoS 2的PUBREC返回失败原因码时paho不返回错误
+	if res != nil && res.ReasonCode >= 0x80 {
+		var reason string
+		if res.Properties != nil {
+			reason = res.Properties.ReasonString
+		}
+		return &ReasonCodeError{Op: "发送 " + topic, Code: res.ReasonCode, Reason: reason}
+	}
+	return err
+}
+
+// Consume 配置了shareGroup时使用共享订阅($share/分组/主题),同一分组的多个副本分担消息
+func (p *mqtt5) Consume(ctx context.Context, topicParams []string, splitN int, handler Handler) error {
+	topic := p.filter(topicParams)
+	qos, err := p.qosOf(ctx)
+	if err != nil {
+		return err
+	}
+	p.subsLock.Lock()
+	defer p.subsLock.Unlock()
+	p.router.RegisterHandler(topic, func(pb *paho.Publish) {
+		handler(pb.Topic, strings.SplitN(pb.Topic, TOPICSEPWITHMQTT, splitN), pb.Payload)
+	})
+	if err := p.subscribe(ctx, p.cm, topic, qos); err != nil {
+		p.router.UnregisterHandler(topic)
+		return err
+	}
+	p.subs[topic] = qos
+	return nil
+}
+
+func (p *mqtt5) UnSubscription(ctx context.Context, topicParams []string) error {
+	topic := p.filter(topicParams)
+	p.subsLock.Lock()
+	defer p.subsLock.Unlock()
+	unsuback, err := p.cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{topic}})
+	if unsuback != nil && len(unsuback.Reasons) > 0 && unsuback.Reasons[0] >= 0x80 {
+		var reason string
+		if unsuback.Properties != nil {
+			reason = unsuback.Properties.ReasonString
+		}
+		return &ReasonCodeError{Op: "取消订阅 " + topic, Code: unsuback.Reasons[0], Reason: reason}
+	}
+	if err != nil {
+		return err
+	}
+	p.router.UnregisterHandler(topic)
+	delete(p.subs, topic)
+	return nil
+}
+
+// filter 返回订阅使用的主题,配置了共享订阅分组时添加$share前缀
+func (p *mqtt5) filter(topicParams []string) string {
+	topic := strings.Join(topicParams, TOPICSEPWITHMQTT)
+	if p.cfg.ShareGroup == "" {
+		return topic
+	}
+	return "$share/" + p.cfg.ShareGroup + "/" + topic
+}
@@ -0,0 +1,95 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func TestMQTT5_Share(t *testing.T) {
+	s, _, port := startBroker(t)
+	var count [2]int32
+	for i := range count {
+		i := i
+		m := newTestMQTT(t, port, MQTTConfig{ProtocolVersion: 5, ShareGroup: "g"})
+		if err := m.Consume(context.Background(), []string{"share", "+"}, 2, func(topic string, split []string, _ []byte) {
+			if topic != "share/t" || len(split) != 2 {
+				t.Errorf("共享订阅收到 topic=%s,split=%v", topic, split)
+			}
+			atomic.AddInt32(&count[i], 1)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const n = 20
+	for i := 0; i < n; i++ {
+		if err := s.Publish("share/t", []byte("x"), false, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 同一分组的订阅共同收到全部消息,每条消息只投递一次
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&count[0])+atomic.LoadInt32(&count[1]) < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if total := atomic.LoadInt32(&count[0]) + atomic.LoadInt32(&count[1]); total != n {
+		t.Fatalf("共享订阅收到 %d 条消息, want %d", total, n)
+	}
+}
+
+func TestMQTT5_ReasonCode(t *testing.T) {
+	_, _, port := startBroker(t)
+	m := newTestMQTT(t, port, MQTTConfig{ProtocolVersion: 5})
+	// 共享订阅的分组不能包含通配符,服务端返回失败原因码
+	err := m.Consume(context.Background(), []string{"$share", "g+", "t"}, 1, func(string, []string, []byte) {})
+	var rc *ReasonCodeError
+	if !errors.As(err, &rc) || rc.Code < 0x80 {
+		t.Fatalf("Consume() error = %v", err)
+	}
+}
+
+func TestMQTT5_LostOnce(t *testing.T) {
+	m := new(mqtt5)
+	cb := &testCallback{reconnect: make(chan struct{}, 1)}
+	m.Callback(cb)
+	m.connect()
+	// 同一次断开的服务端断开和客户端错误只通知一次Lost
+	m.lost()
+	m.lost()
+	if n := atomic.LoadInt32(&cb.lost); n != 1 {
+		t.Fatalf("Lost次数 = %d, want 1", n)
+	}
+	m.connect()
+	<-cb.reconnect
+	m.lost()
+	if n := atomic.LoadInt32(&cb.lost); n != 2 {
+		t.Fatalf("重连后断开 Lost次数 = %d, want 2", n)
+	}
+}
+
+func TestMQTT5_ServerDisconnect(t *testing.T) {
+	s, _, port := startBroker(t)
+	m := newTestMQTT(t, port, MQTTConfig{ProtocolVersion: 5, ClientID: "lost-once"})
+	cb := &testCallback{reconnect: make(chan struct{}, 1)}
+	m.Callback(cb)
+	cl, ok := s.Clients.Get("lost-once")
+	if !ok {
+		t.Fatal("服务端未找到客户端")
+	}
+	// 服务端断开连接时同时触发服务端断开和客户端错误,只通知一次Lost
+	s.DisconnectClient(cl, packets.ErrAdministrativeAction)
+	select {
+	case <-cb.reconnect:
+	case <-time.After(20 * time.Second):
+		t.Fatal("断开后未通知Lost或未重连")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&cb.lost); n != 1 {
+		t.Fatalf("Lost次数 = %d, want 1", n)
+	}
+}
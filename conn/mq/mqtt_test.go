@@ -0,0 +1,223 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// published 服务端收到的发送消息
+type published struct {
+	topic  string
+	qos    byte
+	retain bool
+	expiry uint32
+}
+
+// recordHook 记录服务端收到的发送消息
+type recordHook struct {
+	mochi.HookBase
+	lock sync.Mutex
+	pubs []published
+}
+
+func (h *recordHook) ID() string { return "record" }
+
+func (h *recordHook) Provides(b byte) bool { return b == mochi.OnPublish }
+
+func (h *recordHook) OnPublish(_ *mochi.Client, pk packets.Packet) (packets.Packet, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.pubs = append(h.pubs, published{topic: pk.TopicName, qos: pk.FixedHeader.Qos, retain: pk.FixedHeader.Retain, expiry: pk.Properties.MessageExpiryInterval})
+	return pk, nil
+}
+
+// wait 等待服务端收到主题的消息,QoS 0的消息发送后不等待服务端确认
+func (h *recordHook) wait(topic string) (published, bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		h.lock.Lock()
+		for i := len(h.pubs) - 1; i >= 0; i-- {
+			if p := h.pubs[i]; p.topic == topic {
+				h.lock.Unlock()
+				return p, true
+			}
+		}
+		h.lock.Unlock()
+	}
+	return published{}, false
+}
+
+// startBroker 在本地随机端口启动内嵌MQTT服务端
+func startBroker(t *testing.T) (*mochi.Server, *recordHook, int) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := lis.Addr().(*net.TCPAddr).Port
+	_ = lis.Close()
+	s := mochi.New(&mochi.Options{InlineClient: true})
+	hook := new(recordHook)
+	if err := s.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddHook(hook, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: fmt.Sprintf("127.0.0.1:%d", port)})); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s, hook, port
+}
+
+func newTestMQTT(t *testing.T, port int, cfg MQTTConfig) MQ {
+	t.Helper()
+	cfg.Host = "127.0.0.1"
+	cfg.Port = port
+	cfg.ConnectTimeout = 5
+	m, clean, err := NewMQTTClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(clean)
+	return m
+}
+
+// receive 等待订阅收到消息
+func receive(t *testing.T, ch <-chan string) string {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("未收到消息")
+		return ""
+	}
+}
+
+// testCallback 记录连接状态回调,reconnect在断开后重新连接时通知
+type testCallback struct {
+	lost      int32
+	reconnect chan struct{}
+}
+
+func (cb *testCallback) Connect(MQ) error {
+	// 首次连接的回调可能在注册后才执行
+	if atomic.LoadInt32(&cb.lost) > 0 {
+		cb.reconnect <- struct{}{}
+	}
+	return nil
+}
+
+func (cb *testCallback) Lost(MQ) error {
+	atomic.AddInt32(&cb.lost, 1)
+	return nil
+}
+
+var protocolVersions = []uint{4, 5}
+
+func TestMQTT_PublishOptions(t *testing.T) {
+	_, hook, port := startBroker(t)
+	for _, v := range protocolVersions {
+		t.Run(fmt.Sprintf("v%d", v), func(t *testing.T) {
+			m := newTestMQTT(t, port, MQTTConfig{ProtocolVersion: v})
+			topic := fmt.Sprintf("opts/v%d", v)
+
+			if err := m.Publish(context.Background(), []string{topic, "default"}, []byte("1")); err != nil {
+				t.Fatal(err)
+			}
+			if p, ok := hook.wait(topic + "/default"); !ok || p.qos != 0 || p.retain {
+				t.Fatalf("默认发送 = %+v, %v", p, ok)
+			}
+
+			ctx := WithRetain(WithQoS(context.Background(), 1), true)
+			ctx = WithMessageExpiry(ctx, time.Minute)
+			if err := m.Publish(ctx, []string{topic, "set"}, []byte("2")); err != nil {
+				t.Fatal(err)
+			}
+			p, ok := hook.wait(topic + "/set")
+			if !ok || p.qos != 1 || !p.retain {
+				t.Fatalf("设置QoS和保留消息后发送 = %+v, %v", p, ok)
+			}
+			// 消息过期时间只对MQTT v5生效
+			if want := map[uint]uint32{4: 0, 5: 60}[v]; p.expiry != want {
+				t.Fatalf("消息过期时间 = %d, want %d", p.expiry, want)
+			}
+
+			// 保留消息在订阅后立即收到
+			got := make(chan string, 1)
+			if err := m.Consume(context.Background(), []string{topic, "set"}, 2, func(_ string, _ []string, payload []byte) {
+				got <- string(payload)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if msg := receive(t, got); msg != "2" {
+				t.Fatalf("保留消息 = %s", msg)
+			}
+
+			if err := m.Publish(WithQoS(context.Background(), 3), []string{topic}, nil); err == nil {
+				t.Fatal("QoS 3 应返回错误")
+			}
+		})
+	}
+}
+
+func TestMQTT_Resubscribe(t *testing.T) {
+	s, _, port := startBroker(t)
+	for _, v := range protocolVersions {
+		t.Run(fmt.Sprintf("v%d", v), func(t *testing.T) {
+			clientID := fmt.Sprintf("resub-v%d", v)
+			m := newTestMQTT(t, port, MQTTConfig{ProtocolVersion: v, ClientID: clientID})
+			cb := &testCallback{reconnect: make(chan struct{}, 1)}
+			m.Callback(cb)
+			topic := fmt.Sprintf("resub/v%d", v)
+			got := make(chan string, 10)
+			if err := m.Consume(context.Background(), []string{topic, "+"}, 2, func(topic string, _ []string, payload []byte) {
+				got <- string(payload)
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// 服务端断开连接并清除会话,重连后需要重新订阅
+			cl, ok := s.Clients.Get(clientID)
+			if !ok {
+				t.Fatalf("服务端未找到客户端 %s", clientID)
+			}
+			s.DisconnectClient(cl, packets.ErrAdministrativeAction)
+			select {
+			case <-cb.reconnect:
+			case <-time.After(20 * time.Second):
+				t.Fatal("断开后未通知Lost或未重连")
+			}
+			// 重新订阅完成前发送的消息收不到,重复发送直到收到
+			ticker := time.NewTicker(100 * time.Millisecond)
+			defer ticker.Stop()
+			timeout := time.After(5 * time.Second)
+			for {
+				if err := s.Publish(topic+"/a", []byte("after"), false, 0); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case <-got:
+					return
+				case <-ticker.C:
+				case <-timeout:
+					t.Fatal("重连后未重新订阅")
+				}
+			}
+		})
+	}
+}
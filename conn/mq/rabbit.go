@@ -2,19 +2,46 @@ package mq
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rabbitmq/amqp091-go"
 
 	"github.com/air-iot/logger"
+
+	"github.com/air-iot/sdk-go/v4/utils/tlsx"
+	"github.com/air-iot/sdk-go/v4/utils/tracing"
 )
 
 type rabbit struct {
-	//queue    string
-	//exchange string
-	conn *amqp091.Connection
+	cfg    RabbitMQConfig
+	tlsCfg *tls.Config
+
+	lock   sync.RWMutex
+	conn   *amqp091.Connection
+	closed bool
+	done   chan struct{}
+	// pool 发送消息复用的channel
+	pool chan *amqp091.Channel
+
+	cbLock    sync.RWMutex
+	callbacks []Callback
+
+	subsLock sync.Mutex
+	// subs 已订阅的路由键,重连后重新订阅
+	subs map[string]*rabbitConsumer
+}
+
+// rabbitConsumer 订阅的路由键和消息处理函数,每个订阅使用单独的channel
+type rabbitConsumer struct {
+	key     string
+	splitN  int
+	handler Handler
+	channel *amqp091.Channel
 }
 
 // RabbitMQConfig rabbitmq配置参数
@@ -24,12 +51,33 @@ type RabbitMQConfig struct {
 	Username string `json:"username" yaml:"username"`
 	Password string `json:"password" yaml:"password"`
 	VHost    string `json:"vHost" yaml:"vHost"`
+	// Exchange 发送和订阅使用的topic类型交换机,默认为amq.topic
 	Exchange string `json:"exchange" yaml:"exchange"`
-	Queue    string `json:"queue" yaml:"queue"`
+	// Queue 订阅队列名称前缀,设置后每个订阅使用持久队列"前缀.路由键",多个副本共享队列分担消息,
+	// 所有副本断开后队列保留,重连后继续消费断开期间的消息;
+	// 为空时使用服务端生成的排他队列,每个副本都收到全部消息
+	Queue string `json:"queue" yaml:"queue"`
+	// TLS 开启时使用amqps连接
+	TLS tlsx.Config `json:"tls" yaml:"tls"`
+	// PoolSize 发送消息复用的channel数量,默认为10
+	PoolSize int `json:"poolSize" yaml:"poolSize"`
+	// Confirm 开启发送确认,服务端确认收到消息后Publish才返回
+	Confirm bool `json:"confirm" yaml:"confirm"`
+	// ManualAck 消息处理完成后再确认,处理时panic的消息重新入队一次. 默认为收到即确认
+	ManualAck bool `json:"manualAck" yaml:"manualAck"`
+	// Prefetch 每个订阅未确认消息的最大数量,默认为1
+	Prefetch int `json:"prefetch" yaml:"prefetch"`
+	// ReconnectInterval 连接断开后重连的间隔,默认为5s
+	ReconnectInterval time.Duration `json:"reconnectInterval" yaml:"reconnectInterval"`
 }
 
 func (a RabbitMQConfig) DNS() string {
-	return fmt.Sprintf("amqp://%s:%s@%s:%d/%s",
+	scheme := "amqp"
+	if a.TLS.Enable {
+		scheme = "amqps"
+	}
+	return fmt.Sprintf("%s://%s:%s@%s:%d/%s",
+		scheme,
 		a.Username,
 		a.Password,
 		a.Host,
@@ -39,31 +87,208 @@ func (a RabbitMQConfig) DNS() string {
 
 const TOPICSEPWITHRABBIT = "."
 
+// defaultRabbitExchange 默认交换机,与RabbitMQ MQTT插件使用的交换机相同
+const defaultRabbitExchange = "amq.topic"
+
 func NewRabbitClient(cfg RabbitMQConfig) (MQ, func(), error) {
-	conn, err := amqp091.Dial(cfg.DNS())
+	tlsCfg, err := cfg.TLS.Load()
 	if err != nil {
-		return nil, nil, fmt.Errorf("创建AMQP客户端错误: %+v", err)
+		return nil, nil, err
+	}
+	if cfg.Exchange == "" {
+		cfg.Exchange = defaultRabbitExchange
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 10
+	}
+	if cfg.Prefetch <= 0 {
+		cfg.Prefetch = 1
+	}
+	if cfg.ReconnectInterval <= 0 {
+		cfg.ReconnectInterval = 5 * time.Second
+	}
+	m := &rabbit{
+		cfg:    cfg,
+		tlsCfg: tlsCfg,
+		done:   make(chan struct{}),
+		pool:   make(chan *amqp091.Channel, cfg.PoolSize),
+		subs:   make(map[string]*rabbitConsumer),
+	}
+	conn, notify, err := m.dial()
+	if err != nil {
+		return nil, nil, err
 	}
-	m := new(rabbit)
 	m.conn = conn
-	cleanFunc := func() {
-		if err := conn.Close(); err != nil {
-			logger.Errorf("rabbitmq close error: %s", err.Error())
+	go m.watch(notify)
+	return m, m.close, nil
+}
+
+// dial 创建连接并声明交换机,返回连接关闭通知
+func (p *rabbit) dial() (*amqp091.Connection, chan *amqp091.Error, error) {
+	conn, err := amqp091.DialTLS(p.cfg.DNS(), p.tlsCfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("创建AMQP客户端错误: %+v", err)
+	}
+	// amq.开头的交换机由服务端预先创建,不能声明
+	if !strings.HasPrefix(p.cfg.Exchange, "amq.") {
+		channel, err := conn.Channel()
+		if err == nil {
+			err = p.NewExchange(channel, p.cfg.Exchange)
+			_ = channel.Close()
+		}
+		if err != nil {
+			_ = conn.Close()
+			return nil, nil, fmt.Errorf("声明交换机 %s 错误: %w", p.cfg.Exchange, err)
 		}
 	}
-	return m, cleanFunc, nil
+	return conn, conn.NotifyClose(make(chan *amqp091.Error, 1)), nil
 }
 
-func (p *rabbit) Callback(Callback) {}
+// watch 连接断开后按间隔重连,重连成功后重新订阅并通知回调
+func (p *rabbit) watch(notify chan *amqp091.Error) {
+	for {
+		select {
+		case <-p.done:
+			return
+		case err := <-notify:
+			p.lock.RLock()
+			closed := p.closed
+			p.lock.RUnlock()
+			if closed {
+				return
+			}
+			logger.Errorf("RabbitMQ 连接断开: %v", err)
+		}
+		p.lost()
+		var ok bool
+		if notify, ok = p.reconnect(); !ok {
+			return
+		}
+		p.resubscribe()
+		logger.Infof("RabbitMQ 已重连")
+		p.connect()
+	}
+}
+
+// reconnect 重连直到成功或客户端关闭,关闭时返回false
+func (p *rabbit) reconnect() (chan *amqp091.Error, bool) {
+	for {
+		select {
+		case <-p.done:
+			return nil, false
+		case <-time.After(p.cfg.ReconnectInterval):
+		}
+		conn, notify, err := p.dial()
+		if err != nil {
+			logger.Errorf("RabbitMQ 重连错误: %v", err)
+			continue
+		}
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			_ = conn.Close()
+			return nil, false
+		}
+		p.conn = conn
+		p.lock.Unlock()
+		return notify, true
+	}
+}
+
+func (p *rabbit) close() {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return
+	}
+	p.closed = true
+	conn := p.conn
+	p.lock.Unlock()
+	close(p.done)
+	if err := conn.Close(); err != nil && !errors.Is(err, amqp091.ErrClosed) {
+		logger.Errorf("rabbitmq close error: %s", err.Error())
+	}
+}
+
+func (p *rabbit) Callback(cb Callback) {
+	p.cbLock.Lock()
+	defer p.cbLock.Unlock()
+	p.callbacks = append(p.callbacks, cb)
+}
+
+func (p *rabbit) lost() {
+	p.cbLock.RLock()
+	defer p.cbLock.RUnlock()
+	for _, cb := range p.callbacks {
+		if err := cb.Lost(p); err != nil {
+			logger.Fatalf("lost callback err, %s", err)
+		}
+	}
+}
+
+func (p *rabbit) connect() {
+	p.cbLock.RLock()
+	defer p.cbLock.RUnlock()
+	for _, cb := range p.callbacks {
+		if err := cb.Connect(p); err != nil {
+			logger.Fatalf("connect callback err, %s", err)
+		}
+	}
+}
+
+// channel 从池中取出发送使用的channel,没有可用的channel时创建
+func (p *rabbit) channel() (*amqp091.Channel, error) {
+	// 丢弃连接断开后池中已关闭的channel
+	for {
+		var ch *amqp091.Channel
+		select {
+		case ch = <-p.pool:
+		default:
+		}
+		if ch == nil {
+			break
+		}
+		if !ch.IsClosed() {
+			return ch, nil
+		}
+	}
+	p.lock.RLock()
+	conn := p.conn
+	p.lock.RUnlock()
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("打开channel错误: %w", err)
+	}
+	if p.cfg.Confirm {
+		if err := ch.Confirm(false); err != nil {
+			_ = ch.Close()
+			return nil, fmt.Errorf("开启发送确认错误: %w", err)
+		}
+	}
+	return ch, nil
+}
+
+// release 发送成功的channel放回池中,发送失败或池已满时关闭
+func (p *rabbit) release(ch *amqp091.Channel, err error) {
+	if err != nil || ch.IsClosed() {
+		_ = ch.Close()
+		return
+	}
+	select {
+	case p.pool <- ch:
+	default:
+		_ = ch.Close()
+	}
+}
 
 func (p *rabbit) NewQueue(channel *amqp091.Channel, queueName string) (*amqp091.Queue, error) {
 	queue, err := channel.QueueDeclare(
-		queueName, // name
-		true,      // durable
-		true,      // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		nil,       // arguments
+		queueName,       // name
+		queueName != "", // durable
+		queueName == "", // delete when unused,命名队列断开后保留消息
+		queueName == "", // exclusive
+		false,           // no-wait
+		nil,             // arguments
 	)
 	if err != nil {
 		return nil, err
@@ -83,96 +308,219 @@ func (p *rabbit) NewExchange(channel *amqp091.Channel, exchange string) error {
 	)
 }
 
+// routingKey 主题转换为路由键,MQTT的单层通配符+转换为*
+func routingKey(topicParams []string) string {
+	key := strings.Join(topicParams, TOPICSEPWITHRABBIT)
+	if !strings.Contains(key, "+") {
+		return key
+	}
+	parts := strings.Split(key, TOPICSEPWITHRABBIT)
+	for i, part := range parts {
+		if part == "+" {
+			parts[i] = "*"
+		}
+	}
+	return strings.Join(parts, TOPICSEPWITHRABBIT)
+}
+
 func (p *rabbit) Publish(ctx context.Context, topicParams []string, payload []byte) error {
-	channel, err := p.conn.Channel()
+	ch, err := p.channel()
 	if err != nil {
 		return err
 	}
-	exchange, ok := ctx.Value("exchange").(string)
-	if !ok {
-		return errors.New("context exchange not found")
+	var headers amqp091.Table
+	if trace := tracing.Headers(ctx); trace != nil {
+		headers = make(amqp091.Table, len(trace))
+		for key, val := range trace {
+			headers[key] = val
+		}
+	}
+	msg := amqp091.Publishing{
+		// 持久消息在命名队列中保留到服务端重启后
+		DeliveryMode: amqp091.Persistent,
+		ContentType:  "text/plain",
+		Headers:      headers,
+		Body:         payload,
 	}
 	topic := strings.Join(topicParams, TOPICSEPWITHRABBIT)
-	return channel.Publish(
-		exchange, // exchange
-		topic,    // routing key
-		false,    // mandatory
-		false,
-		amqp091.Publishing{
-			DeliveryMode: amqp091.Transient,
-			ContentType:  "text/plain",
-			Body:         payload,
-		})
-}
-
-func (p *rabbit) Consume(ctx context.Context, topicParams []string, splitN int, handler Handler) error {
-	channel, err := p.conn.Channel()
-	if err != nil {
+	if !p.cfg.Confirm {
+		err = ch.PublishWithContext(ctx, p.cfg.Exchange, topic, false, false, msg)
+		p.release(ch, err)
 		return err
 	}
-
-	queue, ok := ctx.Value("exchange").(string)
-	if !ok {
-		return errors.New("context queue not found")
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, p.cfg.Exchange, topic, false, false, msg)
+	if err == nil {
+		var ack bool
+		if ack, err = confirm.WaitContext(ctx); err == nil && !ack {
+			err = fmt.Errorf("RabbitMQ 服务端拒绝消息 %s", topic)
+		}
 	}
+	p.release(ch, err)
+	return err
+}
 
-	exchange, ok := ctx.Value("exchange").(string)
-	if !ok {
-		return errors.New("context exchange not found")
-	}
-	q, err := p.NewQueue(channel, queue)
-	if err != nil {
-		return err
+func (p *rabbit) Consume(_ context.Context, topicParams []string, splitN int, handler Handler) error {
+	if len(topicParams) == 0 {
+		return fmt.Errorf("topic为空")
 	}
-	err = p.NewExchange(channel, exchange)
-	if err != nil {
-		return err
+	c := &rabbitConsumer{key: routingKey(topicParams), splitN: splitN, handler: handler}
+	p.subsLock.Lock()
+	defer p.subsLock.Unlock()
+	if old, ok := p.subs[c.key]; ok {
+		_ = old.channel.Close()
+		delete(p.subs, c.key)
 	}
-	topic := strings.Join(topicParams, TOPICSEPWITHRABBIT)
-	err = channel.QueueBind(
-		q.Name,   // queue name
-		topic,    // routing key
-		exchange, // exchange
-		false,
-		nil,
-	)
-	if err != nil {
+	if err := p.subscribe(c); err != nil {
 		return err
 	}
-	err = channel.Qos(
-		1,     // prefetch count
-		0,     // prefetch size
-		false, // global
-	)
+	p.subs[c.key] = c
+	return nil
+}
+
+// subscribe 在新的channel上声明队列、绑定路由键并开始接收消息
+func (p *rabbit) subscribe(c *rabbitConsumer) error {
+	p.lock.RLock()
+	conn := p.conn
+	p.lock.RUnlock()
+	channel, err := conn.Channel()
 	if err != nil {
-		return err
+		return fmt.Errorf("打开channel错误: %w", err)
 	}
-	messages, err := channel.Consume(
-		q.Name, // queue
-		topic,  // consumer
-		true,   // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
+	closed := channel.NotifyClose(make(chan *amqp091.Error, 1))
+	canceled := channel.NotifyCancel(make(chan string, 1))
+	deliveries, err := p.declare(channel, c.key)
 	if err != nil {
-		return err
+		_ = channel.Close()
+		return fmt.Errorf("订阅 %s 错误: %w", c.key, err)
 	}
+	c.channel = channel
 	go func() {
-		for d := range messages {
-			handler(d.RoutingKey, strings.SplitN(d.RoutingKey, TOPICSEPWITHRABBIT, splitN), d.Body)
-			//if err := d.Ack(false); err != nil {}
+		for d := range deliveries {
+			p.handle(c, d)
 		}
 	}()
+	go p.watchConsumer(c, channel, closed, canceled)
 	return nil
 }
 
-func (p *rabbit) UnSubscription(ctx context.Context, topicParams []string) error {
-	topic := strings.Join(topicParams, TOPICSEPWITHRABBIT)
-	channel, err := p.conn.Channel()
+// watchConsumer 连接正常但服务端关闭订阅的channel或取消消费者(例如队列被删除)时按重连间隔重新订阅,
+// 连接断开时由watch统一重新订阅
+func (p *rabbit) watchConsumer(c *rabbitConsumer, channel *amqp091.Channel, closed chan *amqp091.Error, canceled chan string) {
+	select {
+	case <-p.done:
+		return
+	case err := <-closed:
+		// 主动关闭channel时没有错误
+		if err == nil {
+			return
+		}
+		p.lock.RLock()
+		conn := p.conn
+		p.lock.RUnlock()
+		if conn.IsClosed() {
+			return
+		}
+		logger.Errorf("RabbitMQ 订阅 %s 的channel被关闭: %v", c.key, err)
+	case tag := <-canceled:
+		logger.Errorf("RabbitMQ 订阅 %s 的消费者被服务端取消: %s", c.key, tag)
+	}
+	_ = channel.Close()
+	p.retrySubscribe(c, channel)
+}
+
+// retrySubscribe 按重连间隔重新订阅直到成功,channel为失效的channel.
+// 客户端关闭、已取消订阅或已在其他位置重新订阅时返回
+func (p *rabbit) retrySubscribe(c *rabbitConsumer, channel *amqp091.Channel) {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-time.After(p.cfg.ReconnectInterval):
+		}
+		p.subsLock.Lock()
+		if p.subs[c.key] != c || c.channel != channel {
+			p.subsLock.Unlock()
+			return
+		}
+		err := p.subscribe(c)
+		p.subsLock.Unlock()
+		if err == nil {
+			logger.Infof("RabbitMQ 已重新订阅 %s", c.key)
+			return
+		}
+		logger.Errorf("RabbitMQ 重新订阅 %s 错误: %v", c.key, err)
+	}
+}
+
+func (p *rabbit) declare(channel *amqp091.Channel, key string) (<-chan amqp091.Delivery, error) {
+	var queueName string
+	if p.cfg.Queue != "" {
+		queueName = p.cfg.Queue + TOPICSEPWITHRABBIT + key
+	}
+	q, err := p.NewQueue(channel, queueName)
 	if err != nil {
+		return nil, err
+	}
+	if err := channel.QueueBind(q.Name, key, p.cfg.Exchange, false, nil); err != nil {
+		return nil, err
+	}
+	if err := channel.Qos(p.cfg.Prefetch, 0, false); err != nil {
+		return nil, err
+	}
+	return channel.Consume(
+		q.Name,           // queue
+		key,              // consumer
+		!p.cfg.ManualAck, // auto-ack
+		false,            // exclusive
+		false,            // no-local
+		false,            // no-wait
+		nil,              // args
+	)
+}
+
+// handle 处理消息,手动确认时处理完成后确认,panic时重新入队一次,再次失败丢弃
+func (p *rabbit) handle(c *rabbitConsumer, d amqp091.Delivery) {
+	if p.cfg.ManualAck {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Errorf("RabbitMQ 处理消息 %s 错误: %v", d.RoutingKey, r)
+				if err := d.Nack(false, !d.Redelivered); err != nil {
+					logger.Errorf("RabbitMQ 拒绝消息 %s 错误: %v", d.RoutingKey, err)
+				}
+				return
+			}
+			if err := d.Ack(false); err != nil {
+				logger.Errorf("RabbitMQ 确认消息 %s 错误: %v", d.RoutingKey, err)
+			}
+		}()
+	}
+	c.handler(d.RoutingKey, strings.SplitN(d.RoutingKey, TOPICSEPWITHRABBIT, c.splitN), d.Body)
+}
+
+func (p *rabbit) resubscribe() {
+	p.subsLock.Lock()
+	defer p.subsLock.Unlock()
+	for key, c := range p.subs {
+		// 关闭旧连接上的channel,避免与watchConsumer重复订阅
+		_ = c.channel.Close()
+		if err := p.subscribe(c); err != nil {
+			logger.Errorf("RabbitMQ 重新订阅 %s 错误: %v,稍后重试", key, err)
+			go p.retrySubscribe(c, c.channel)
+		}
+	}
+}
+
+func (p *rabbit) UnSubscription(_ context.Context, topicParams []string) error {
+	key := routingKey(topicParams)
+	p.subsLock.Lock()
+	defer p.subsLock.Unlock()
+	c, ok := p.subs[key]
+	if !ok {
+		return nil
+	}
+	delete(p.subs, key)
+	if err := c.channel.Close(); err != nil && !errors.Is(err, amqp091.ErrClosed) {
 		return err
 	}
-	return channel.Cancel(topic, true)
+	return nil
 }
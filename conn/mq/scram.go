@@ -0,0 +1,35 @@
+package mq
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+
+	"github.com/xdg-go/scram"
+)
+
+// scramClient 实现sarama.SCRAMClient,用于Kafka SASL/SCRAM认证
+type scramClient struct {
+	hash scram.HashGeneratorFcn
+	conv *scram.ClientConversation
+}
+
+func newSCRAMSHA256Client() *scramClient { return &scramClient{hash: sha256.New} }
+
+func newSCRAMSHA512Client() *scramClient { return &scramClient{hash: sha512.New} }
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.hash.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conv = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conv.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conv.Done()
+}
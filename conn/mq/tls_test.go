@@ -0,0 +1,183 @@
+package mq
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+
+	"github.com/air-iot/sdk-go/v4/utils/tlsx"
+)
+
+// writeCert 生成localhost的自签名证书,返回证书文件路径和服务端证书
+func writeCert(t *testing.T) (string, tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, cert
+}
+
+// handshakeServer 只完成TLS握手的服务端,返回握手成功时客户端发送的服务端名称
+func handshakeServer(t *testing.T, cert tls.Certificate) (int, <-chan string) {
+	t.Helper()
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	names := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			tc := conn.(*tls.Conn)
+			if err := tc.Handshake(); err == nil {
+				names <- tc.ConnectionState().ServerName
+			}
+			_ = tc.Close()
+		}
+	}()
+	return lis.Addr().(*net.TCPAddr).Port, names
+}
+
+func waitHandshake(t *testing.T, names <-chan string, want string) {
+	t.Helper()
+	select {
+	case name := <-names:
+		if name != want {
+			t.Fatalf("服务端名称 = %s, want %s", name, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("未完成TLS握手")
+	}
+}
+
+func TestMQTT_TLS(t *testing.T) {
+	caFile, cert := writeCert(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := lis.Addr().(*net.TCPAddr).Port
+	_ = lis.Close()
+	s := mochi.New(nil)
+	if err := s.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddListener(listeners.NewTCP(listeners.Config{ID: "tls", Address: fmt.Sprintf("127.0.0.1:%d", port),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}})); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	for _, v := range protocolVersions {
+		t.Run(fmt.Sprintf("v%d", v), func(t *testing.T) {
+			m := newTestMQTT(t, port, MQTTConfig{ProtocolVersion: v, TLS: tlsx.Config{Enable: true, CAFile: caFile, ServerName: "localhost"}})
+			got := make(chan string, 1)
+			if err := m.Consume(context.Background(), []string{"tls"}, 1, func(_ string, _ []string, payload []byte) {
+				got <- string(payload)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Publish(context.Background(), []string{"tls"}, []byte("ok")); err != nil {
+				t.Fatal(err)
+			}
+			if msg := receive(t, got); msg != "ok" {
+				t.Fatalf("收到 = %s", msg)
+			}
+
+			// 不信任服务端证书时连接失败
+			if _, _, err := NewMQTTClient(MQTTConfig{Host: "127.0.0.1", Port: port, ProtocolVersion: v, ConnectTimeout: 2,
+				TLS: tlsx.Config{Enable: true, ServerName: "localhost"}}); err == nil {
+				t.Fatal("服务端证书不受信任时应返回错误")
+			}
+		})
+	}
+}
+
+func TestRabbit_TLS(t *testing.T) {
+	caFile, cert := writeCert(t)
+	port, names := handshakeServer(t, cert)
+	cfg := RabbitMQConfig{Host: "127.0.0.1", Port: port, Username: "u", Password: "p",
+		TLS: tlsx.Config{Enable: true, CAFile: caFile, ServerName: "localhost"}}
+	// 握手后服务端不响应AMQP协议,创建客户端失败
+	if _, _, err := NewRabbitClient(cfg); err == nil {
+		t.Fatal("NewRabbitClient() 应返回错误")
+	}
+	waitHandshake(t, names, "localhost")
+}
+
+func TestKafka_TLS(t *testing.T) {
+	caFile, cert := writeCert(t)
+	port, names := handshakeServer(t, cert)
+	k := &kafka{config: KafkaConfig{Brokers: []string{fmt.Sprintf("127.0.0.1:%d", port)},
+		TLS: tlsx.Config{Enable: true, CAFile: caFile, ServerName: "localhost"}}}
+	cfg, err := k.getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Net.TLS.Enable || cfg.Net.TLS.Config == nil || cfg.Net.TLS.Config.ServerName != "localhost" {
+		t.Fatalf("Net.TLS = %+v", cfg.Net.TLS)
+	}
+	k.config.TLS.Enable = false
+	if cfg, err := k.getConfig(); err != nil || cfg.Net.TLS.Enable {
+		t.Fatalf("未开启TLS时 Net.TLS = %+v, %v", cfg.Net.TLS, err)
+	}
+
+	// 握手后服务端不响应kafka协议,创建客户端失败
+	k.config.TLS.Enable = true
+	if _, err := k.getClient(); err == nil {
+		t.Fatal("getClient() 应返回错误")
+	}
+	waitHandshake(t, names, "localhost")
+}
@@ -0,0 +1,95 @@
+package mq
+
+import "strings"
+
+// topicTrie 按MQTT主题过滤器(+单层、#多层通配符)保存订阅,
+// 匹配时按主题层级查找,不需要为每条消息编译正则
+type topicTrie[T any] struct {
+	root *topicNode[T]
+}
+
+type topicNode[T any] struct {
+	children map[string]*topicNode[T]
+	value    T
+	ok       bool
+}
+
+func newTopicTrie[T any]() *topicTrie[T] {
+	return &topicTrie[T]{root: new(topicNode[T])}
+}
+
+// add 保存过滤器对应的值,过滤器已存在时替换
+func (t *topicTrie[T]) add(filter string, value T) {
+	n := t.root
+	for _, level := range strings.Split(filter, TOPICSEPWITHMQTT) {
+		child, ok := n.children[level]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*topicNode[T])
+			}
+			child = new(topicNode[T])
+			n.children[level] = child
+		}
+		n = child
+	}
+	n.value, n.ok = value, true
+}
+
+// get 返回过滤器对应的值
+func (t *topicTrie[T]) get(filter string) (value T, ok bool) {
+	n := t.root
+	for _, level := range strings.Split(filter, TOPICSEPWITHMQTT) {
+		if n, ok = n.children[level]; !ok {
+			return value, false
+		}
+	}
+	return n.value, n.ok
+}
+
+// remove 删除过滤器,返回删除的值
+func (t *topicTrie[T]) remove(filter string) (T, bool) {
+	return t.root.remove(strings.Split(filter, TOPICSEPWITHMQTT))
+}
+
+func (n *topicNode[T]) remove(levels []string) (value T, ok bool) {
+	if len(levels) == 0 {
+		value, ok = n.value, n.ok
+		var zero T
+		n.value, n.ok = zero, false
+		return value, ok
+	}
+	child, exist := n.children[levels[0]]
+	if !exist {
+		return value, false
+	}
+	value, ok = child.remove(levels[1:])
+	if !child.ok && len(child.children) == 0 {
+		delete(n.children, levels[0])
+	}
+	return value, ok
+}
+
+// match 返回与主题匹配的所有过滤器的值
+func (t *topicTrie[T]) match(topic string) []T {
+	return t.root.match(strings.Split(topic, TOPICSEPWITHMQTT), nil)
+}
+
+func (n *topicNode[T]) match(levels []string, ret []T) []T {
+	// #匹配剩余的任意层级,包括父级本身
+	if c, ok := n.children["#"]; ok && c.ok {
+		ret = append(ret, c.value)
+	}
+	if len(levels) == 0 {
+		if n.ok {
+			ret = append(ret, n.value)
+		}
+		return ret
+	}
+	if c, ok := n.children[levels[0]]; ok {
+		ret = c.match(levels[1:], ret)
+	}
+	if c, ok := n.children["+"]; ok && levels[0] != "+" {
+		ret = c.match(levels[1:], ret)
+	}
+	return ret
+}
@@ -0,0 +1,123 @@
+package mq
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestTopicTrie_Match(t *testing.T) {
+	filters := []string{
+		"data/+/t1/#",
+		"data/p1/+/d1",
+		"data/p1/t1/d1",
+		"data/#",
+		"#",
+		"log/+",
+		"warning/p1/t1",
+	}
+	tr := newTopicTrie[string]()
+	for _, f := range filters {
+		tr.add(f, f)
+	}
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{"data/p1/t1/d1", []string{"#", "data/#", "data/+/t1/#", "data/p1/+/d1", "data/p1/t1/d1"}},
+		{"data/p2/t1", []string{"#", "data/#", "data/+/t1/#"}},
+		{"data/p1/t2/d1", []string{"#", "data/#", "data/p1/+/d1"}},
+		{"data", []string{"#", "data/#"}},
+		{"log/a", []string{"#", "log/+"}},
+		{"log/a/b", []string{"#"}},
+		{"log", []string{"#"}},
+		{"warning/p1/t1", []string{"#", "warning/p1/t1"}},
+		{"warning/p1/t1/d1", []string{"#"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			got := tr.match(tt.topic)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("match(%s) = %v, want %v", tt.topic, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopicTrie_Overlap(t *testing.T) {
+	tr := newTopicTrie[int]()
+	tr.add("a/+/c", 1)
+	tr.add("a/b/c", 2)
+	// 相同过滤器替换原来的值
+	tr.add("a/+/c", 3)
+	got := tr.match("a/b/c")
+	sort.Ints(got)
+	if !reflect.DeepEqual(got, []int{2, 3}) {
+		t.Fatalf("match() = %v", got)
+	}
+	if v, ok := tr.get("a/+/c"); !ok || v != 3 {
+		t.Fatalf("get() = %v, %v", v, ok)
+	}
+	if _, ok := tr.get("a/+"); ok {
+		t.Fatal("get() 返回了中间节点")
+	}
+}
+
+func TestTopicTrie_Remove(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []string
+		remove  string
+		ok      bool
+		// nodes 删除后根节点的子节点
+		nodes []string
+	}{
+		{"删除唯一过滤器", []string{"a/b/c"}, "a/b/c", true, []string{}},
+		{"保留共享前缀", []string{"a/b/c", "a/d"}, "a/b/c", true, []string{"a"}},
+		{"保留父过滤器", []string{"a/b/c", "a/b"}, "a/b/c", true, []string{"a"}},
+		{"删除父过滤器保留子过滤器", []string{"a/b/c", "a/b"}, "a/b", true, []string{"a"}},
+		{"删除不存在的过滤器", []string{"a/b/c"}, "a/b", false, []string{"a"}},
+		{"删除不存在的分支", []string{"a/b/c"}, "x/y", false, []string{"a"}},
+		{"删除通配符", []string{"#", "+/b"}, "#", true, []string{"+"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newTopicTrie[string]()
+			for _, f := range tt.filters {
+				tr.add(f, f)
+			}
+			v, ok := tr.remove(tt.remove)
+			if ok != tt.ok || (ok && v != tt.remove) {
+				t.Fatalf("remove(%s) = %v, %v", tt.remove, v, ok)
+			}
+			if _, ok := tr.get(tt.remove); ok {
+				t.Fatalf("remove(%s) 后仍能查到", tt.remove)
+			}
+			nodes := make([]string, 0)
+			for level := range tr.root.children {
+				nodes = append(nodes, level)
+			}
+			sort.Strings(nodes)
+			if !reflect.DeepEqual(nodes, tt.nodes) {
+				t.Fatalf("根节点的子节点 = %v, want %v", nodes, tt.nodes)
+			}
+			for _, f := range tt.filters {
+				if f == tt.remove {
+					continue
+				}
+				if got, ok := tr.get(f); !ok || got != f {
+					t.Fatalf("get(%s) = %v, %v", f, got, ok)
+				}
+			}
+		})
+	}
+	// 删除后空的中间节点被清理
+	tr := newTopicTrie[string]()
+	tr.add("a/b/c/d", "x")
+	tr.add("a/e", "y")
+	tr.remove("a/b/c/d")
+	if _, ok := tr.root.children["a"].children["b"]; ok {
+		t.Fatal("空的中间节点未清理")
+	}
+}
@@ -16,6 +16,8 @@ import (
 	"github.com/air-iot/logger"
 	"github.com/air-iot/sdk-go/v4/conn/mq"
 	"github.com/air-iot/sdk-go/v4/etcd"
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
+	"github.com/air-iot/sdk-go/v4/utils/probe"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	clientv3 "go.etcd.io/etcd/client/v3"
@@ -36,6 +38,7 @@ type app struct {
 	apiClient *api_client_go.Client
 	clean     func()
 	mq        mq.MQ
+	mqState   *probe.MQState
 }
 
 func Init() {
@@ -138,6 +141,7 @@ func NewApp() App {
 			}
 		}()
 	}
+	metrics.Serve(Cfg.Metrics)
 	conn, err := etcd.NewConn(Cfg.Etcd)
 	if err != nil {
 		panic(err)
@@ -153,6 +157,7 @@ func NewApp() App {
 		panic(fmt.Errorf("初始化消息队列错误: %w", err))
 	}
 	a.mq = mqConn
+	a.mqState = probe.Watch(mqConn)
 	a.clean = func() {
 		clean()
 		cleanMQ()
@@ -182,6 +187,9 @@ func (a *app) Start(ext DataRelay) {
 	a.stopped = false
 	cli := Client{}
 	a.cli = cli.Start(a, ext)
+	probe.Serve(Cfg.Probe, func() []probe.Check {
+		return append(a.cli.checks(), a.mqState.Check())
+	})
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL)
 	sig := <-ch
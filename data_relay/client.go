@@ -12,10 +12,12 @@ import (
 	"github.com/air-iot/json"
 	"github.com/air-iot/logger"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 
 	pb "github.com/air-iot/api-client-go/v4/datarelay"
 	dGrpc "github.com/air-iot/sdk-go/v4/data_relay/grpc"
+	"github.com/air-iot/sdk-go/v4/utils/grpcx"
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
+	"github.com/air-iot/sdk-go/v4/utils/probe"
 )
 
 type Client struct {
@@ -27,6 +29,10 @@ type Client struct {
 	service     DataRelay
 	clean       func()
 	streamCount int32
+	// lastHealth 最近一次健康检查正常的时间(UnixNano)
+	lastHealth atomic.Int64
+	// started 数据中转服务的Start是否执行成功
+	started atomic.Bool
 }
 
 const totalStream = 2
@@ -100,10 +106,13 @@ func (c *Client) connDriver(ctx context.Context) error {
 	ctx, cancel := context.WithTimeout(ctx, Cfg.DataRelayGrpc.Timeout)
 	defer cancel()
 	logger.WithContext(ctx).Infof("连接数据中转服务: 配置=%+v", Cfg.DataRelayGrpc)
+	opts, err := grpcx.DialOptions(Cfg.DataRelayGrpc.TLS, string(Cfg.DataRelayGrpc.Token))
+	if err != nil {
+		return err
+	}
 	conn, err := grpc.NewClient(
 		fmt.Sprintf("%s:%d", Cfg.DataRelayGrpc.Host, Cfg.DataRelayGrpc.Port),
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(Cfg.DataRelayGrpc.Limit*1024*1024), grpc.MaxCallSendMsgSize(Cfg.DataRelayGrpc.Limit*1024*1024)),
+		append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(Cfg.DataRelayGrpc.Limit*1024*1024), grpc.MaxCallSendMsgSize(Cfg.DataRelayGrpc.Limit*1024*1024)))...,
 	)
 	if err != nil {
 		return fmt.Errorf("grpc.Dial error: %w", err)
@@ -131,6 +140,7 @@ func (c *Client) healthCheck(ctx context.Context) {
 			state := false
 			for retry >= 0 {
 				healthRes, err := c.healthRequest(ctx)
+				metrics.HealthCheck(metrics.ServiceDataRelay, err == nil && healthRes.GetStatus() == pb.HealthCheckResponse_SERVING)
 				if err != nil {
 					errCtx := logger.NewErrorContext(ctx1, err)
 					logger.WithContext(errCtx).Errorf("健康检查: 健康检查第 %d 次错误", Cfg.DataRelayGrpc.Health.Retry-retry+1)
@@ -140,6 +150,7 @@ func (c *Client) healthCheck(ctx context.Context) {
 					state = false
 					if healthRes.GetStatus() == pb.HealthCheckResponse_SERVING {
 						newLogger.Debugf("健康检查: 正常")
+						c.lastHealth.Store(time.Now().UnixNano())
 						if healthRes.Errors != nil && len(healthRes.Errors) > 0 {
 							for _, e := range healthRes.Errors {
 								newLogger.Errorf("健康检查: code=%s,错误=%s", e.Code.String(), e.Message)
@@ -171,6 +182,24 @@ func (c *Client) healthCheck(ctx context.Context) {
 
 }
 
+// checks 返回数据中转服务连接、stream、健康检查和服务启动的状态
+func (c *Client) checks() []probe.Check {
+	c.lock.RLock()
+	conn := c.conn
+	c.lock.RUnlock()
+	var last time.Time
+	if v := c.lastHealth.Load(); v > 0 {
+		last = time.Unix(0, v)
+	}
+	retry := time.Duration(Cfg.DataRelayGrpc.Health.Retry + 2)
+	return []probe.Check{
+		probe.GRPC(conn),
+		probe.Streams(int(atomic.LoadInt32(&c.streamCount)), totalStream),
+		probe.HealthCheck(last, (Cfg.DataRelayGrpc.WaitTime+Cfg.DataRelayGrpc.Health.RequestTime)*retry),
+		probe.Started(c.started.Load()),
+	}
+}
+
 func (c *Client) healthRequest(ctx context.Context) (*pb.HealthCheckResponse, error) {
 	reqCtx, reqCancel := context.WithTimeout(ctx, Cfg.DataRelayGrpc.Health.RequestTime)
 	defer reqCancel()
@@ -194,6 +223,7 @@ func (c *Client) startSteam(ctx context.Context) {
 					errCtx := logger.NewErrorContext(newCtx, err)
 					logger.WithContext(errCtx).Errorf("start: stream创建错误")
 				}
+				metrics.StreamReconnects.WithLabelValues(metrics.ServiceDataRelay, "start").Inc()
 				time.Sleep(Cfg.DataRelayGrpc.WaitTime)
 			}
 		}
@@ -214,6 +244,7 @@ func (c *Client) startSteam(ctx context.Context) {
 					errCtx := logger.NewErrorContext(newCtx, err)
 					logger.WithContext(errCtx).Errorf("httpProxy: stream创建错误")
 				}
+				metrics.StreamReconnects.WithLabelValues(metrics.ServiceDataRelay, "httpProxy").Inc()
 				time.Sleep(Cfg.DataRelayGrpc.WaitTime)
 			}
 		}
@@ -242,10 +273,13 @@ func (c *Client) StartStream(ctx context.Context) error {
 		ctx1 := logger.NewModuleContext(context.Background(), MODULE_START)
 		logger.WithContext(ctx1).Debugf("start: 接收到开始请求")
 		go func(res *pb.DataRelayInstanceStartRequest) {
+			obs := metrics.StartRequest(metrics.ServiceDataRelay, "start")
+			defer obs.Done()
 			newCtx, cancel := context.WithTimeout(ctx1, Cfg.DataRelayGrpc.Timeout)
 			defer cancel()
 			defer func() {
 				if errR := recover(); errR != nil {
+					obs.Panic()
 					var errStr string
 					switch v := errR.(type) {
 					case error:
@@ -269,7 +303,10 @@ func (c *Client) StartStream(ctx context.Context) error {
 			startRes := &pb.Result{
 				Request: res.Request,
 			}
-			if err := c.service.Start(newCtx, c.app, res.GetData()); err != nil {
+			err := c.service.Start(newCtx, c.app, res.GetData())
+			c.started.Store(err == nil)
+			if err != nil {
+				obs.Fail()
 				startRes.Detail = err.Error()
 				startRes.Info = "执行错误"
 				startRes.Status = false
@@ -305,6 +342,8 @@ func (c *Client) HttpProxyStream(ctx context.Context) error {
 			return err
 		}
 		go func(res *pb.HttpProxyRequest) {
+			obs := metrics.StartRequest(metrics.ServiceDataRelay, "httpProxy")
+			defer obs.Done()
 			var header http.Header
 			newCtx, cancel := context.WithTimeout(context.Background(), Cfg.DataRelayGrpc.Timeout)
 			defer cancel()
@@ -312,6 +351,7 @@ func (c *Client) HttpProxyStream(ctx context.Context) error {
 			logger.WithContext(newCtx).Debugf("httpProxy: type=%s,header=%s,请求数据=%s", res.Type, res.Headers, res.Data)
 			defer func() {
 				if errR := recover(); errR != nil {
+					obs.Panic()
 					var errStr string
 					switch v := errR.(type) {
 					case error:
@@ -337,12 +377,14 @@ func (c *Client) HttpProxyStream(ctx context.Context) error {
 			}
 			if res.GetHeaders() != nil {
 				if err := json.Unmarshal(res.GetHeaders(), &header); err != nil {
+					obs.Fail()
 					gr.Info = fmt.Sprintf("解析请求头错误")
 					gr.Detail = err.Error()
 					gr.Status = false
 				} else {
 					runRes, err := c.service.HttpProxy(newCtx, c.app, res.GetType(), header, res.GetData())
 					if err != nil {
+						obs.Fail()
 						gr.Info = fmt.Sprintf("执行请求错误")
 						gr.Detail = err.Error()
 						gr.Status = false
@@ -355,6 +397,7 @@ func (c *Client) HttpProxyStream(ctx context.Context) error {
 			} else {
 				runRes, err := c.service.HttpProxy(newCtx, c.app, res.GetType(), header, res.GetData())
 				if err != nil {
+					obs.Fail()
 					gr.Info = fmt.Sprintf("执行请求错误")
 					gr.Detail = err.Error()
 					gr.Status = false
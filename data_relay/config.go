@@ -6,6 +6,8 @@ import (
 	"github.com/air-iot/sdk-go/v4/conn/mq"
 	"github.com/air-iot/sdk-go/v4/data_relay/grpc"
 	"github.com/air-iot/sdk-go/v4/etcd"
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
+	"github.com/air-iot/sdk-go/v4/utils/probe"
 )
 
 // Cfg 全局配置(需要先执行MustLoad，否则拿不到配置)
@@ -25,8 +27,10 @@ type Config struct {
 		Host   string `json:"host" yaml:"host"`
 		Port   string `json:"port" yaml:"port"`
 	} `json:"pprof" yaml:"pprof"`
-	EtcdConfig string      `json:"etcdConfig" yaml:"etcdConfig"`
-	Etcd       etcd.Config `json:"etcd" yaml:"etcd"`
+	Metrics    metrics.Config `json:"metrics" yaml:"metrics"`
+	Probe      probe.Config   `json:"probe" yaml:"probe"`
+	EtcdConfig string         `json:"etcdConfig" yaml:"etcdConfig"`
+	Etcd       etcd.Config    `json:"etcd" yaml:"etcd"`
 	App        struct {
 		API grpcConfig.Config `json:"api" yaml:"API"`
 	} `json:"app" yaml:"app"`
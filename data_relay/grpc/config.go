@@ -6,6 +6,9 @@ import (
 	"time"
 
 	"google.golang.org/grpc/metadata"
+
+	"github.com/air-iot/sdk-go/v4/utils/grpcx"
+	"github.com/air-iot/sdk-go/v4/utils/tlsx"
 )
 
 type Config struct {
@@ -18,6 +21,8 @@ type Config struct {
 	WaitTime time.Duration `json:"waitTime" yaml:"waitTime"`
 	Timeout  time.Duration `json:"timeout" yaml:"timeout"`
 	Limit    int           `json:"limit" yaml:"limit"`
+	TLS      tlsx.Config   `json:"tls" yaml:"tls"`     // 传输层加密及双向认证
+	Token    grpcx.Token   `json:"token" yaml:"token"` // 每个请求携带的Bearer令牌
 }
 
 func GetGrpcContext(ctx context.Context, instanceId, projectId, id, name string) context.Context {
@@ -2,18 +2,17 @@ package driver
 
 import (
 	"context"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"math"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
-	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -22,20 +21,29 @@ import (
 	"github.com/shopspring/decimal"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/air-iot/sdk-go/v4/conn/mq"
+	"github.com/air-iot/sdk-go/v4/driver/buffer"
 	"github.com/air-iot/sdk-go/v4/driver/convert"
 	"github.com/air-iot/sdk-go/v4/driver/entity"
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
 	"github.com/air-iot/sdk-go/v4/utils/numberx"
+	"github.com/air-iot/sdk-go/v4/utils/probe"
+	"github.com/air-iot/sdk-go/v4/utils/tracing"
 )
 
 type App interface {
 	Start(Driver)
+	StartContext(context.Context, Driver) error
+	Shutdown(context.Context) error
 	GetProjectId() string
 	GetGroupID() string
 	GetServiceId() string
 	GetMQ() mq.MQ
 	WritePoints(context.Context, entity.Point) error
+	WritePointsBatch(context.Context, []entity.Point) error
 	SavePoints(ctx context.Context, tableId string, data *entity.WritePoint) error
 	WriteEvent(context.Context, entity.Event) error
 	WriteWarning(context.Context, entity.Warn) error
@@ -49,6 +57,23 @@ type App interface {
 	LogError(table, id string, msg interface{})
 	GetCommands(ctx context.Context, table, id string, ret interface{}) error
 	UpdateCommand(ctx context.Context, id string, data entity.DriverInstruct) error
+	SetDeviceOnline(ctx context.Context, table, id string) error
+	SetDeviceOffline(ctx context.Context, table, id string) error
+	SubmitCommand(ctx context.Context, id string, cmd *entity.Command) (interface{}, error)
+	// GetTables 最近一次start请求配置中的表ID
+	GetTables() []string
+	// GetDevices 最近一次start请求配置中表下的设备ID
+	GetDevices(table string) []string
+	// GetInstanceConfig 实例的驱动配置,返回的Settings和Tags与SDK共用,不能修改
+	GetInstanceConfig() (*entity.DriverConfig, error)
+	// GetDeviceConfig 合并模型和设备后的驱动配置,设备的配置项和数据点覆盖模型的同名配置. 返回的内容不能修改
+	GetDeviceConfig(table, id string) (*entity.DriverConfig, error)
+	// TablesOfDevice 设备ID所属的表ID,按实例配置中的顺序
+	TablesOfDevice(id string) []string
+	// ResolveTable table不为空时直接返回,否则按设备ID查找所属的表,存在多个表时使用SetTableResolver设置的方法选择
+	ResolveTable(table, id string) (string, error)
+	// SetTableResolver 设置设备存在于多个表时选择表的方法,未设置时返回错误
+	SetTableResolver(TableResolver)
 }
 
 const (
@@ -61,11 +86,31 @@ const (
 // app 数据采集类
 type app struct {
 	mq      mq.MQ
-	stopped bool
+	stopped atomic.Bool
 	cli     *Client
 	clean   func()
 
 	cacheValue sync.Map
+
+	buffer *buffer.Queue
+	// events 驱动管理不可用时缓存的事件,与消息队列的缓存分开重放
+	events        *buffer.Queue
+	bufferTrigger chan struct{}
+	mqOnline      int32
+	mqState       *probe.MQState
+
+	// resolver 设备存在于多个表时选择表,可以在启动前设置
+	resolver atomic.Pointer[TableResolver]
+
+	batcher  *batcher
+	status   *statusTracker
+	commands *commandExecutor
+	// pipelines 数据点值转换的缓存
+	pipelines pipelineCache
+
+	shutdownOnce sync.Once
+	shutdownDone chan struct{}
+	shutdownErr  error
 }
 
 func Init() {
@@ -98,9 +143,29 @@ func Init() {
 	viper.SetDefault("driverGrpc.health.requestTime", "10s")
 	viper.SetDefault("driverGrpc.health.retry", 3)
 	viper.SetDefault("driverGrpc.stream.heartbeat", "30s")
+	viper.SetDefault("driverGrpc.stream.missedBeats", 3)
+	viper.SetDefault("driverGrpc.stream.maxBackoff", "60s")
+	viper.SetDefault("driverGrpc.stream.jitter", 0.2)
 	viper.SetDefault("driverGrpc.waitTime", "5s")
 	viper.SetDefault("driverGrpc.timeout", "600s")
 	viper.SetDefault("driverGrpc.limit", 100)
+	viper.SetDefault("batch.linger", "100ms")
+	viper.SetDefault("batch.maxSize", 500)
+	viper.SetDefault("buffer.path", "./data/buffer")
+	viper.SetDefault("buffer.maxSize", 512*1024*1024)
+	viper.SetDefault("buffer.maxAge", "72h")
+	viper.SetDefault("buffer.segmentSize", 8*1024*1024)
+	viper.SetDefault("buffer.dropPolicy", buffer.DropOldest)
+	viper.SetDefault("buffer.retryInterval", "10s")
+	viper.SetDefault("deviceStatus.timeout", "5m")
+	viper.SetDefault("deviceStatus.interval", "10s")
+	viper.SetDefault("deviceStatus.field", "online")
+	viper.SetDefault("command.timeout", "60s")
+	viper.SetDefault("command.retry", 0)
+	viper.SetDefault("command.backoff", "1s")
+	viper.SetDefault("command.maxBackoff", "30s")
+	viper.SetDefault("command.queueSize", 100)
+	viper.SetDefault("shutdownTimeout", "30s")
 	viper.SetConfigType("env")
 	viper.AutomaticEnv()
 	viper.SetConfigType("yaml")
@@ -121,7 +186,6 @@ func Init() {
 // NewApp 创建App
 func NewApp() App {
 	Init()
-	a := new(app)
 	if Cfg.Project == "" {
 		panic("项目id未配置或未传参")
 	}
@@ -135,15 +199,26 @@ func NewApp() App {
 	Cfg.Log.Syslog.ServiceName = fmt.Sprintf("%s-%s-%s", Cfg.Project, Cfg.ServiceID, Cfg.Driver.ID)
 	logger.InitLogger(Cfg.Log)
 	logger.Infof("启动配置=%+v", *Cfg)
+	stopTracing, err := tracing.Init(Cfg.Tracing, Cfg.Log.Syslog.ServiceName)
+	if err != nil {
+		panic(fmt.Errorf("初始化链路追踪错误: %w", err))
+	}
 	mqConn, clean, err := mq.NewMQ(Cfg.MQ)
 	if err != nil {
 		panic(fmt.Errorf("初始化消息队列错误: %w", err))
 	}
-	a.mq = mqConn
-	a.clean = func() {
+	stopMetrics := metrics.Serve(Cfg.Metrics)
+	a := newApp(mqConn, func() {
 		clean()
-	}
-	a.cacheValue = sync.Map{}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := stopMetrics(ctx); err != nil {
+			logger.Errorf("停止指标服务错误: %v", err)
+		}
+		if err := stopTracing(ctx); err != nil {
+			logger.Errorf("停止链路追踪错误: %v", err)
+		}
+	})
 	if Cfg.Pprof.Enable {
 		go func() {
 			//  路径/debug/pprof/
@@ -158,30 +233,142 @@ func NewApp() App {
 	return a
 }
 
-// Start 开始服务
+// NewAppWithMQ 使用已设置的全局配置Cfg和传入的消息队列创建App,不读取配置文件和命令行参数,用于测试或嵌入其他程序
+func NewAppWithMQ(m mq.MQ) App {
+	return newApp(m, func() {})
+}
+
+func newApp(mqConn mq.MQ, clean func()) *app {
+	a := new(app)
+	a.mq = mqConn
+	a.mqOnline = 1
+	a.mqState = probe.Watch(mqConn)
+	a.clean = func() {
+		clean()
+	}
+	a.cacheValue = sync.Map{}
+	if Cfg.Buffer.Enable {
+		q, err := buffer.Open(Cfg.Buffer)
+		if err != nil {
+			panic(fmt.Errorf("初始化本地缓存错误: %w", err))
+		}
+		eventCfg := Cfg.Buffer
+		eventCfg.Path = filepath.Join(Cfg.Buffer.Path, "event")
+		events, err := buffer.Open(eventCfg)
+		if err != nil {
+			panic(fmt.Errorf("初始化事件本地缓存错误: %w", err))
+		}
+		a.buffer = q
+		a.events = events
+		a.bufferTrigger = make(chan struct{}, 1)
+		a.mq.Callback(&bufferCallback{a: a})
+		go a.replayBuffer()
+		a.clean = func() {
+			clean()
+			if err := q.Close(); err != nil {
+				logger.Errorf("关闭本地缓存错误: %v", err)
+			}
+			if err := events.Close(); err != nil {
+				logger.Errorf("关闭事件本地缓存错误: %v", err)
+			}
+		}
+	}
+	if Cfg.Batch.Enable {
+		a.batcher = newBatcher(a, Cfg.Batch)
+	}
+	a.status = newStatusTracker(a, Cfg.DeviceStatus)
+	a.commands = newCommandExecutor(a, Cfg.Command)
+	a.shutdownDone = make(chan struct{})
+	return a
+}
+
+// Start 开始服务,收到SIGTERM或SIGINT信号后停止服务
 func (a *app) Start(driver Driver) {
-	a.stopped = false
-	cli := Client{cacheConfig: sync.Map{}, cacheConfigNum: sync.Map{}}
-	a.cli = cli.Start(a, driver)
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL)
-	sig := <-ch
-	close(ch)
-	if err := driver.Stop(context.Background(), a); err != nil {
-		logger.Warnf("驱动停止: %v", err.Error())
-	}
-	cli.Stop()
-	a.stop()
-	logger.Debugf("关闭服务: 信号=%v", sig)
-	os.Exit(0)
-}
-
-// Stop 服务停止
-func (a *app) stop() {
-	a.stopped = true
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	if err := a.StartContext(ctx, driver); err != nil {
+		logger.Errorf("关闭服务: %v", err)
+		return
+	}
+	logger.Debugf("关闭服务: 完成")
+}
+
+// StartContext 连接驱动管理并处理请求,直到ctx取消或调用Shutdown后停止服务,返回停止过程中的错误.
+// ctx取消时使用Cfg.ShutdownTimeout作为停止的超时时间
+func (a *app) StartContext(ctx context.Context, driver Driver) error {
+	a.stopped.Store(false)
+	cli := &Client{cacheConfigNum: sync.Map{}}
+	a.cli = cli
+	cli.Start(a, driver)
+	stopProbe := probe.Serve(Cfg.Probe, a.checks)
+	defer func() {
+		if err := stopProbe(context.Background()); err != nil {
+			logger.Errorf("停止探针服务错误: %v", err)
+		}
+	}()
+	select {
+	case <-ctx.Done():
+		timeout := Cfg.ShutdownTimeout
+		if timeout <= 0 {
+			timeout = 30 * time.Second
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return a.Shutdown(shutdownCtx)
+	case <-a.shutdownDone:
+		return a.shutdownErr
+	}
+}
+
+// Shutdown 停止服务: 停止接收新请求并等待正在处理的请求完成,停止驱动,发送未发送的设备状态,断开驱动管理连接,
+// 等待指令队列执行完成,发送批量缓存的数据点后关闭消息队列. ctx超时后不再等待,继续关闭并返回错误.
+// 多次调用只执行一次
+func (a *app) Shutdown(ctx context.Context) error {
+	a.shutdownOnce.Do(func() {
+		a.shutdownErr = a.shutdown(ctx)
+		close(a.shutdownDone)
+	})
+	<-a.shutdownDone
+	return a.shutdownErr
+}
+
+func (a *app) shutdown(ctx context.Context) error {
+	var errs []error
+	if a.cli != nil {
+		if err := a.cli.handlers.wait(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("等待请求处理完成: %w", err))
+		}
+		if a.cli.driver != nil {
+			if err := a.cli.driver.Stop(ctx, a); err != nil {
+				errs = append(errs, fmt.Errorf("驱动停止: %w", err))
+			}
+		}
+	}
+	// 设备状态需要通过驱动管理更新表数据,在断开连接前发送
+	if a.status != nil {
+		a.status.close()
+	}
+	if a.cli != nil {
+		a.cli.Stop()
+	}
+	a.stopped.Store(true)
+	if a.commands != nil {
+		if err := a.commands.wait(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("等待指令执行完成: %w", err))
+		}
+	}
+	if a.batcher != nil {
+		a.batcher.close()
+	}
 	if a.clean != nil {
 		a.clean()
 	}
+	return errors.Join(errs...)
+}
+
+// checks 返回探针接口的检查结果
+func (a *app) checks() []probe.Check {
+	return append(a.cli.checks(), a.mqState.Check())
 }
 
 func (a *app) GetProjectId() string {
@@ -203,40 +390,90 @@ func (a *app) GetMQ() mq.MQ {
 // WritePoints 写数据点数据
 func (a *app) WritePoints(ctx context.Context, p entity.Point) error {
 	//ctx = logger.NewModuleContext(ctx, entity.MODULE_WRITEPOINT)
-	tableId := p.Table
-	if tableId == "" {
-		tableIdI, ok := a.cli.cacheConfig.Load(p.ID)
-		if !ok {
-			return fmt.Errorf("传入表id为空且未在配置中找到")
-		}
-		devI, ok := a.cli.cacheConfigNum.Load(p.ID)
-		if ok {
-			devM, _ := devI.(map[string]interface{})
-			if len(devM) >= 2 {
-				return fmt.Errorf("传入表id为空且在配置中找到多个表id")
-			}
-		}
-		tableId = tableIdI.(string)
+	ctx, tableId, err := a.preparePoint(ctx, p)
+	if err != nil {
+		return err
+	}
+	return a.writePoints(ctx, tableId, p)
+}
+
+// preparePoint 校验数据点并查找设备表id
+func (a *app) preparePoint(ctx context.Context, p entity.Point) (context.Context, string, error) {
+	tableId, err := a.ResolveTable(p.Table, p.ID)
+	if err != nil {
+		return ctx, "", err
 	}
 	if p.ID == "" {
-		return fmt.Errorf("设备id为空")
+		return ctx, "", fmt.Errorf("设备id为空")
 	}
 	if p.Fields == nil || len(p.Fields) == 0 {
-		return fmt.Errorf("采集数据有空值")
+		return ctx, "", fmt.Errorf("采集数据有空值")
 	}
 	ctx = logger.NewTableContext(ctx, tableId)
 	if Cfg.GroupID != "" {
 		ctx = logger.NewGroupContext(ctx, Cfg.GroupID)
 	}
-	return a.writePoints(ctx, tableId, p)
+	return ctx, tableId, nil
 }
 
 func (a *app) writePoints(ctx context.Context, tableId string, p entity.Point) error {
-	ctxTimeout, cancelTimeout := context.WithTimeout(context.Background(), Cfg.MQ.Timeout)
+	if a.status != nil {
+		a.status.touch(tableId, p.ID)
+	}
+	data, deadbands, pointErr := a.convertPoint(ctx, tableId, p)
+	if data == nil {
+		return pointErr
+	}
+	if a.batcher != nil {
+		if err := a.batcher.add(ctx, tableId, data); err != nil {
+			return err
+		}
+		a.commitDeadband(deadbands)
+		return pointErr
+	}
+	ctxTimeout, cancelTimeout := context.WithTimeout(context.WithoutCancel(ctx), Cfg.MQ.Timeout)
 	defer cancelTimeout()
+	if err := a.SavePoints(ctxTimeout, tableId, data); err != nil {
+		return err
+	}
+	a.commitDeadband(deadbands)
+	return pointErr
+}
+
+// convertPoint 按数据点配置转换采集值,全部数据点值被死区过滤时返回nil.
+// 部分数据点值转换失败时同时返回转换成功的数据和*PointError.
+// 返回的死区记录在发送成功后调用commitDeadband保存
+func (a *app) convertPoint(ctx context.Context, tableId string, p entity.Point) (*entity.WritePoint, deadbandUpdates, error) {
 	fields := make(map[string]interface{})
+	deadbands := make(deadbandUpdates)
 	newLogger := logger.WithContext(ctx)
+	pointTime := p.UnixTime
+	if pointTime == 0 {
+		pointTime = time.Now().Local().UnixMilli()
+	}
+	suppressed := 0
+	var fieldErrs []*FieldError
+	var fieldTypes map[string]string
+	setFieldType := func(id string, t numberx.FieldType) {
+		if p.FieldTypes[id] != "" {
+			return
+		}
+		if fieldTypes == nil {
+			fieldTypes = make(map[string]string, len(p.FieldTypes)+1)
+			for k, v := range p.FieldTypes {
+				fieldTypes[k] = v
+			}
+		}
+		fieldTypes[id] = t.String()
+	}
+	// values 转换后的数据点值,包含被死区过滤的值,用于计算表达式数据点
+	values := make(map[string]interface{})
+	computed := make([]entity.Tag, 0)
 	for _, field := range p.Fields {
+		if field.Tag.Expression != "" {
+			computed = append(computed, field.Tag)
+			continue
+		}
 		if field.Value == nil {
 			newLogger.Warnf("存数据点: 设备表=%s,设备=%s. 设备数据点值为空", tableId, p.ID)
 			continue
@@ -255,60 +492,32 @@ func (a *app) writePoints(ctx context.Context, tableId string, p entity.Point) e
 		//}
 		tag := field.Tag
 		if strings.TrimSpace(tag.ID) == "" {
-			newLogger.Errorf("存数据点: 设备表=%s,设备=%s. 设备数据点标识为空", tableId, p.ID)
+			fieldErrs = append(fieldErrs, &FieldError{Table: tableId, ID: p.ID, Tag: tag.ID, Value: field.Value, Err: errors.New("设备数据点标识为空")})
 			continue
 		}
 
-		var value decimal.Decimal
-		switch valueTmp := field.Value.(type) {
-		case float32:
-			if math.IsNaN(float64(valueTmp)) || math.IsInf(float64(valueTmp), 0) {
-				//fields[tag.ID] = valueTmp
-				newLogger.Errorf("存数据点: 设备表=%s,设备=%s,数据点=%s,值=%f. 设备数据点值不合法", tableId, p.ID, tag.ID, valueTmp)
-				continue
-			}
-			value = decimal.NewFromFloat32(valueTmp)
-		case float64:
-			if math.IsNaN(valueTmp) || math.IsInf(valueTmp, 0) {
-				//fields[tag.ID] = valueTmp
-				newLogger.Errorf("存数据点: 设备表=%s,设备=%s,数据点=%s,值=%f. 设备数据点值不合法", tableId, p.ID, tag.ID, valueTmp)
-				continue
-			}
-			value = decimal.NewFromFloat(valueTmp)
-		case uint:
-			value = decimal.NewFromInt(int64(valueTmp))
-		case uint8:
-			value = decimal.NewFromInt(int64(valueTmp))
-		case uint16:
-			value = decimal.NewFromInt(int64(valueTmp))
-		case uint32:
-			value = decimal.NewFromInt(int64(valueTmp))
-		case uint64:
-			value = decimal.NewFromInt(int64(valueTmp))
-		case int:
-			value = decimal.NewFromInt(int64(valueTmp))
-		case int8:
-			value = decimal.NewFromInt(int64(valueTmp))
-		case int16:
-			value = decimal.NewFromInt(int64(valueTmp))
-		case int32:
-			value = decimal.NewFromInt32(valueTmp)
-		case int64:
-			value = decimal.NewFromInt(valueTmp)
-		case []byte:
-			fields[tag.ID] = fmt.Sprintf("hex__%s", hex.EncodeToString(valueTmp))
+		normalized, valueType, err := normalizeValue(numberx.FieldType(p.FieldTypes[tag.ID]), field.Value)
+		if err != nil {
+			fieldErrs = append(fieldErrs, &FieldError{Table: tableId, ID: p.ID, Tag: tag.ID, Value: field.Value, Err: err})
 			continue
-		default:
-			valTmp, err := numberx.GetValueByType("", field.Value)
-			if err != nil {
-				errCtx := logger.NewErrorContext(ctx, err)
-				logger.WithContext(errCtx).Errorf("存数据点: 设备表=%s,设备=%s,数据点=%s. 设备数据点转类型失败", tableId, p.ID, tag.ID)
-				continue
-			}
-			fields[tag.ID] = valTmp
+		}
+		value, ok := normalized.(decimal.Decimal)
+		if !ok {
+			fields[tag.ID] = normalized
+			values[tag.ID] = normalized
+			setFieldType(tag.ID, valueType)
+			continue
+		}
+		pipeline, err := a.pipeline(&tag)
+		if err != nil {
+			fieldErrs = append(fieldErrs, &FieldError{Table: tableId, ID: p.ID, Tag: tag.ID, Value: field.Value, Err: err})
+			continue
+		}
+		val, err := pipeline.Apply(value)
+		if err != nil {
+			fieldErrs = append(fieldErrs, &FieldError{Table: tableId, ID: p.ID, Tag: tag.ID, Value: field.Value, Err: err})
 			continue
 		}
-		val := convert.Value(&tag, value)
 		if tag.Range != nil && (tag.Range.Enable == nil || *(tag.Range.Enable)) {
 			cacheKey := fmt.Sprintf("%s__%s__%s", tableId, p.ID, tag.ID)
 			preValF, ok := a.cacheValue.Load(cacheKey)
@@ -327,10 +536,15 @@ func (a *app) writePoints(ctx context.Context, tableId string, p entity.Point) e
 					errCtx := logger.NewErrorContext(ctx, err)
 					logger.WithContext(errCtx).Errorf("存数据点: 设备表=%s,设备=%s,数据点=%s. 设备数据点转类型失败", tableId, p.ID, tag.ID)
 				} else {
-					fields[tag.ID] = valTmp
 					if save {
 						a.cacheValue.Store(cacheKey, newVal)
 					}
+					values[tag.ID] = valTmp
+					if a.deadband(deadbands, tableId, p.ID, &tag, *newVal, pointTime) {
+						suppressed++
+					} else {
+						fields[tag.ID] = valTmp
+					}
 				}
 			}
 			if rawVal != nil {
@@ -347,24 +561,93 @@ func (a *app) writePoints(ctx context.Context, tableId string, p entity.Point) e
 			}
 		} else {
 			vTmp, _ := val.Float64()
-			fields[tag.ID] = vTmp
+			values[tag.ID] = vTmp
+			if a.deadband(deadbands, tableId, p.ID, &tag, vTmp, pointTime) {
+				suppressed++
+			} else {
+				fields[tag.ID] = vTmp
+			}
+		}
+	}
+	for _, tag := range computed {
+		pipeline, err := a.pipeline(&tag)
+		if err != nil {
+			fieldErrs = append(fieldErrs, &FieldError{Table: tableId, ID: p.ID, Tag: tag.ID, Value: tag.Expression, Err: err})
+			continue
+		}
+		result, valueType, err := computeTag(&tag, pipeline, numberx.FieldType(p.FieldTypes[tag.ID]), values)
+		if err != nil {
+			fieldErrs = append(fieldErrs, &FieldError{Table: tableId, ID: p.ID, Tag: tag.ID, Value: tag.Expression, Err: err})
+			continue
+		}
+		values[tag.ID] = result
+		if f, ok := result.(float64); ok {
+			if a.deadband(deadbands, tableId, p.ID, &tag, f, pointTime) {
+				suppressed++
+				continue
+			}
+		} else {
+			setFieldType(tag.ID, valueType)
+		}
+		fields[tag.ID] = result
+	}
+	var pointErr error
+	if len(fieldErrs) > 0 {
+		pointErr = &PointError{Fields: fieldErrs}
+		metrics.PointsDropped.WithLabelValues(metrics.DropInvalid).Add(float64(len(fieldErrs)))
+	}
+	if suppressed > 0 {
+		metrics.PointsDropped.WithLabelValues(metrics.DropSuppressed).Add(float64(suppressed))
+		if len(fields) == 0 {
+			return nil, nil, pointErr
 		}
 	}
 	if len(fields) == 0 {
-		return errors.New("数据点为空值")
+		if pointErr != nil {
+			return nil, nil, pointErr
+		}
+		return nil, nil, errors.New("数据点为空值")
 	}
 	if p.UnixTime == 0 {
 		p.UnixTime = time.Now().Local().UnixMilli()
 	} else if p.UnixTime > 9999999999999 || p.UnixTime < 1000000000000 {
-		return fmt.Errorf("时间无效")
+		return nil, nil, fmt.Errorf("时间无效")
+	}
+	if fieldTypes == nil {
+		fieldTypes = p.FieldTypes
+	}
+	return &entity.WritePoint{ID: p.ID, CID: p.CID, Source: "device", UnixTime: p.UnixTime, Fields: fields, FieldTypes: fieldTypes}, deadbands, pointErr
+}
+
+// deadbandValue 死区判断使用的上次上报值和时间
+type deadbandValue struct {
+	value    float64
+	unixTime int64
+}
+
+// deadbandUpdates 待保存的死区上报值,key为缓存key
+type deadbandUpdates map[string]deadbandValue
+
+// deadband 判断数据点值是否在死区内,未过滤时将本次上报值记录到updates,发送成功后再保存
+func (a *app) deadband(updates deadbandUpdates, tableId, id string, tag *entity.Tag, val float64, unixTime int64) bool {
+	if tag.Deadband == nil || (tag.Deadband.Enable != nil && !*tag.Deadband.Enable) {
+		return false
+	}
+	cacheKey := fmt.Sprintf("%s__%s__%s__deadband", tableId, id, tag.ID)
+	if preF, ok := a.cacheValue.Load(cacheKey); ok {
+		if pre, ok := preF.(deadbandValue); ok && convert.Deadband(tag.Deadband, pre.value, val, unixTime-pre.unixTime) {
+			return true
+		}
+	}
+	updates[cacheKey] = deadbandValue{value: val, unixTime: unixTime}
+	return false
+}
+
+// commitDeadband 数据点发送成功后保存死区上报值,发送失败的值下次不会被死区过滤
+func (a *app) commitDeadband(updates deadbandUpdates) {
+	for key, val := range updates {
+		a.cacheValue.Store(key, val)
 	}
-	data := &entity.WritePoint{ID: p.ID, CID: p.CID, Source: "device", UnixTime: p.UnixTime, Fields: fields, FieldTypes: p.FieldTypes}
-	//b, err := json.Marshal()
-	//if err != nil {
-	//	return err
-	//}
-	//return a.mq.Publish(ctxTimeout, []string{"data", Cfg.Project, tableId, p.ID}, b)
-	return a.SavePoints(ctxTimeout, tableId, data)
 }
 
 func (a *app) SavePoints(ctx context.Context, tableId string, data *entity.WritePoint) error {
@@ -392,25 +675,128 @@ func (a *app) SavePoints(ctx context.Context, tableId string, data *entity.Write
 	if logger.IsLevelEnabled(logger.DebugLevel) {
 		logger.Debugf("存数据点: 设备表=%s,设备=%s,数据=%s. 保存数据成功", tableId, data.ID, string(b))
 	}
-	return a.mq.Publish(ctx, []string{"data", Cfg.Project, tableId, data.ID}, b)
+	if err := a.publish(ctx, []string{"data", Cfg.Project, tableId, data.ID}, b); err != nil {
+		metrics.PointsDropped.WithLabelValues(metrics.DropPublish).Add(float64(len(data.Fields)))
+		return err
+	}
+	metrics.PointsWritten.Add(float64(len(data.Fields)))
+	return nil
 }
 
-func (a *app) WriteWarning(ctx context.Context, w entity.Warn) error {
-	//ctx = logger.NewModuleContext(ctx, entity.MODULE_WARN)
-	tableId := w.TableId
-	if tableId == "" {
-		tableIdI, ok := a.cli.cacheConfig.Load(w.TableDataId)
-		if !ok {
-			return fmt.Errorf("传入表id为空且未在配置中找到")
+// publish 发送消息,启用本地缓存时消息队列不可用或缓存中有未发送的数据则写入缓存
+func (a *app) publish(ctx context.Context, topic []string, payload []byte) error {
+	if a.buffer == nil {
+		return a.mq.Publish(ctx, topic, payload)
+	}
+	if atomic.LoadInt32(&a.mqOnline) == 1 && a.buffer.Len() == 0 {
+		err := a.mq.Publish(ctx, topic, payload)
+		if err == nil {
+			return nil
+		}
+		logger.Warnf("发送消息: topic=%s. 发送失败,写入本地缓存: %v", strings.Join(topic, "/"), err)
+	}
+	if err := a.buffer.Push(buffer.Record{Kind: buffer.KindMQ, Topic: topic, Payload: payload}); err != nil {
+		return fmt.Errorf("写入本地缓存错误: %w", err)
+	}
+	a.triggerReplay()
+	return nil
+}
+
+func (a *app) triggerReplay() {
+	select {
+	case a.bufferTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// replayBuffer 消息队列连接或定时重试时按顺序重放本地缓存
+func (a *app) replayBuffer() {
+	interval := Cfg.Buffer.RetryInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.bufferTrigger:
+		case <-ticker.C:
 		}
-		devI, ok := a.cli.cacheConfigNum.Load(w.TableDataId)
-		if ok {
-			devM, _ := devI.(map[string]interface{})
-			if len(devM) >= 2 {
-				return fmt.Errorf("传入表id为空且在配置中找到多个表id")
+		if a.stopped.Load() {
+			return
+		}
+		a.replay("事件", a.events)
+		if atomic.LoadInt32(&a.mqOnline) == 1 {
+			a.replay("消息", a.buffer)
+		}
+	}
+}
+
+// replay 按顺序发送一个缓存队列中的记录,发送失败时停止等待下次重试
+func (a *app) replay(name string, q *buffer.Queue) {
+	if q.Len() == 0 {
+		return
+	}
+	sent, err := q.Replay(func(r buffer.Record) error {
+		ctx, cancel := context.WithTimeout(context.Background(), Cfg.MQ.Timeout)
+		defer cancel()
+		if r.Kind == buffer.KindEvent {
+			if a.cli == nil {
+				return status.Error(codes.Unavailable, "驱动管理未连接")
+			}
+			if err := a.cli.sendEvent(ctx, r.Payload); err != nil && isUnavailable(err) {
+				return err
+			} else if err != nil {
+				logger.Errorf("重放本地缓存: 事件发送失败,丢弃: %v", err)
 			}
+			return nil
 		}
-		tableId = tableIdI.(string)
+		if atomic.LoadInt32(&a.mqOnline) == 0 {
+			return errMQOffline
+		}
+		return a.mq.Publish(ctx, r.Topic, r.Payload)
+	})
+	if sent > 0 {
+		logger.Infof("重放本地缓存: 类型=%s,发送=%d,剩余=%d", name, sent, q.Len())
+	}
+	if errors.Is(err, errMQOffline) {
+		logger.Debugf("重放本地缓存: 类型=%s. 消息队列未连接,剩余=%d", name, q.Len())
+	} else if err != nil {
+		logger.Warnf("重放本地缓存: 类型=%s. 发送失败,剩余=%d: %v", name, q.Len(), err)
+	}
+}
+
+var errMQOffline = errors.New("消息队列未连接")
+
+func isUnavailable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// bufferCallback 根据消息队列连接状态控制本地缓存重放
+type bufferCallback struct {
+	a *app
+}
+
+func (cb *bufferCallback) Connect(mq.MQ) error {
+	atomic.StoreInt32(&cb.a.mqOnline, 1)
+	cb.a.triggerReplay()
+	return nil
+}
+
+func (cb *bufferCallback) Lost(mq.MQ) error {
+	atomic.StoreInt32(&cb.a.mqOnline, 0)
+	return nil
+}
+
+func (a *app) WriteWarning(ctx context.Context, w entity.Warn) error {
+	//ctx = logger.NewModuleContext(ctx, entity.MODULE_WARN)
+	tableId, err := a.ResolveTable(w.TableId, w.TableDataId)
+	if err != nil {
+		return err
 	}
 	w.TableId = tableId
 	if w.TableDataId == "" {
@@ -447,9 +833,9 @@ func (a *app) WriteWarning(ctx context.Context, w entity.Warn) error {
 	if err != nil {
 		return err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), Cfg.MQ.Timeout)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), Cfg.MQ.Timeout)
 	defer cancel()
-	return a.mq.Publish(ctx, []string{"warningStorage", Cfg.Project, tableId, w.TableDataId}, b)
+	return a.publish(ctx, []string{"warningStorage", Cfg.Project, tableId, w.TableDataId}, b)
 }
 
 // WriteWarningRecovery 报警恢复
@@ -483,13 +869,37 @@ func (a *app) WriteWarningRecovery(ctx context.Context, tableId, dataId string,
 	if err != nil {
 		return err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), Cfg.MQ.Timeout)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), Cfg.MQ.Timeout)
 	defer cancel()
-	return a.mq.Publish(ctx, []string{"warningUpdate", Cfg.Project, tableId, dataId}, b)
+	return a.publish(ctx, []string{"warningUpdate", Cfg.Project, tableId, dataId}, b)
 }
 
 func (a *app) WriteEvent(ctx context.Context, event entity.Event) error {
-	return a.cli.WriteEvent(ctx, event)
+	if a.buffer == nil {
+		return a.cli.WriteEvent(ctx, event)
+	}
+	if event.Table == "" || event.ID == "" || event.EventID == "" {
+		return fmt.Errorf("表、设备或事件ID为空")
+	}
+	if event.UnixTime == 0 {
+		event.UnixTime = time.Now().Local().UnixMilli()
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if a.events.Len() == 0 {
+		err := a.cli.sendEvent(ctx, b)
+		if err == nil || !isUnavailable(err) {
+			return err
+		}
+		logger.Warnf("写事件: 设备表=%s,设备=%s,事件=%s. 驱动管理不可用,写入本地缓存: %v", event.Table, event.ID, event.EventID, err)
+	}
+	if err := a.events.Push(buffer.Record{Kind: buffer.KindEvent, Payload: b}); err != nil {
+		return fmt.Errorf("写入本地缓存错误: %w", err)
+	}
+	a.triggerReplay()
+	return nil
 }
 
 func (a *app) FindDevice(ctx context.Context, table, id string, ret interface{}) error {
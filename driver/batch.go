@@ -0,0 +1,264 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/air-iot/logger"
+
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+)
+
+var errBatcherClosed = errors.New("批量发送已关闭")
+
+// BatchError 批量写数据点错误,Errors与传入的数据点按下标对应,成功的数据点为nil
+type BatchError struct {
+	Errors []error
+}
+
+func (e *BatchError) Error() string {
+	var first error
+	n := 0
+	for _, err := range e.Errors {
+		if err == nil {
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+		n++
+	}
+	return fmt.Sprintf("批量写数据点: 失败数量=%d,第一个错误=%v", n, first)
+}
+
+// BatchConfig 批量发送配置. 开启后WritePoints等待所在批次发送完成后返回,
+// 最长等待Linger加上一次发送的超时时间
+type BatchConfig struct {
+	Enable  bool          `json:"enable" yaml:"enable"`
+	Linger  time.Duration `json:"linger" yaml:"linger"`   // 等待合并的最长时间
+	MaxSize int           `json:"maxSize" yaml:"maxSize"` // 单批次最大数据点数
+}
+
+type batchItem struct {
+	// ctx 写数据点的上下文,发送时保留其中的链路上下文
+	ctx     context.Context
+	tableId string
+	data    *entity.WritePoint
+	// deadbands 发送成功后保存的死区上报值
+	deadbands deadbandUpdates
+	result    chan error
+}
+
+// batcher 后台合并发送数据点,同一设备、子设备和时间的数据点合并为一条消息
+type batcher struct {
+	a       *app
+	linger  time.Duration
+	maxSize int
+	ch      chan *batchItem
+	done    chan struct{}
+	stopped chan struct{}
+
+	// lock 关闭时等待正在提交的数据点写入ch,关闭后不再写入,保证ch中的数据点都被发送
+	lock   sync.RWMutex
+	closed bool
+}
+
+func newBatcher(a *app, cfg BatchConfig) *batcher {
+	if cfg.Linger <= 0 {
+		cfg.Linger = 100 * time.Millisecond
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = 500
+	}
+	b := &batcher{
+		a:       a,
+		linger:  cfg.Linger,
+		maxSize: cfg.MaxSize,
+		ch:      make(chan *batchItem, cfg.MaxSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// add 提交数据点并等待所在批次发送完成
+func (b *batcher) add(ctx context.Context, tableId string, data *entity.WritePoint) error {
+	item := &batchItem{ctx: ctx, tableId: tableId, data: data, result: make(chan error, 1)}
+	if err := b.submit(ctx, item); err != nil {
+		return err
+	}
+	select {
+	case err := <-item.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *batcher) submit(ctx context.Context, item *batchItem) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.closed {
+		return errBatcherClosed
+	}
+	select {
+	case b.ch <- item:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *batcher) run() {
+	defer close(b.stopped)
+	items := make([]*batchItem, 0, b.maxSize)
+	timer := time.NewTimer(b.linger)
+	timer.Stop()
+	flush := func() {
+		if len(items) == 0 {
+			return
+		}
+		b.a.publishBatch(items)
+		items = make([]*batchItem, 0, b.maxSize)
+	}
+	for {
+		select {
+		case item := <-b.ch:
+			if len(items) == 0 {
+				timer.Reset(b.linger)
+			}
+			items = append(items, item)
+			if len(items) >= b.maxSize {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		case <-b.done:
+			timer.Stop()
+			for {
+				select {
+				case item := <-b.ch:
+					items = append(items, item)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// close 停止接收数据点并发送剩余数据
+func (b *batcher) close() {
+	b.lock.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+	b.lock.Unlock()
+	<-b.stopped
+}
+
+// WritePointsBatch 批量写数据点数据,返回的错误为*BatchError时可按下标获取每个数据点的错误
+func (a *app) WritePointsBatch(ctx context.Context, points []entity.Point) error {
+	errs := make([]error, len(points))
+	items := make([]*batchItem, 0, len(points))
+	index := make([]int, 0, len(points))
+	for i, p := range points {
+		pCtx, tableId, err := a.preparePoint(ctx, p)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if a.status != nil {
+			a.status.touch(tableId, p.ID)
+		}
+		data, deadbands, err := a.convertPoint(pCtx, tableId, p)
+		errs[i] = err
+		if data == nil {
+			continue
+		}
+		items = append(items, &batchItem{ctx: pCtx, tableId: tableId, data: data, deadbands: deadbands, result: make(chan error, 1)})
+		index = append(index, i)
+	}
+	a.publishBatch(items)
+	for i, item := range items {
+		if err := <-item.result; err != nil {
+			errs[index[i]] = err
+			continue
+		}
+		a.commitDeadband(item.deadbands)
+	}
+	for _, err := range errs {
+		if err != nil {
+			return &BatchError{Errors: errs}
+		}
+	}
+	return nil
+}
+
+// publishBatch 合并同一设备、子设备和时间的数据点后并发发送,每条消息使用单独的超时时间,
+// 全部发送完成后返回,结果写入各数据点的result. 合并后的消息使用第一个数据点的链路上下文
+func (a *app) publishBatch(items []*batchItem) {
+	if len(items) == 0 {
+		return
+	}
+	type group struct {
+		tableId string
+		data    *entity.WritePoint
+		items   []*batchItem
+	}
+	groups := make([]*group, 0)
+	keys := make(map[string]*group)
+	for _, item := range items {
+		key := fmt.Sprintf("%s__%s__%s__%d", item.tableId, item.data.ID, item.data.CID, item.data.UnixTime)
+		g, ok := keys[key]
+		if !ok {
+			data := *item.data
+			data.Fields = make(map[string]interface{}, len(item.data.Fields))
+			data.FieldTypes = nil
+			g = &group{tableId: item.tableId, data: &data}
+			keys[key] = g
+			groups = append(groups, g)
+		}
+		for k, v := range item.data.Fields {
+			g.data.Fields[k] = v
+		}
+		if len(item.data.FieldTypes) > 0 {
+			if g.data.FieldTypes == nil {
+				g.data.FieldTypes = make(map[string]string, len(item.data.FieldTypes))
+			}
+			for k, v := range item.data.FieldTypes {
+				g.data.FieldTypes[k] = v
+			}
+		}
+		g.items = append(g.items, item)
+	}
+	var wg sync.WaitGroup
+	for _, g := range groups {
+		wg.Add(1)
+		go func(g *group) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(g.items[0].ctx), Cfg.MQ.Timeout)
+			err := a.SavePoints(ctx, g.tableId, g.data)
+			cancel()
+			if err != nil {
+				logger.Errorf("批量写数据点: 设备表=%s,设备=%s,合并数量=%d. 发送失败: %v", g.tableId, g.data.ID, len(g.items), err)
+			}
+			for _, item := range g.items {
+				item.result <- err
+			}
+		}(g)
+	}
+	wg.Wait()
+}
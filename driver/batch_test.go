@@ -0,0 +1,146 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/air-iot/sdk-go/v4/conn/mq"
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+)
+
+type memMQ struct {
+	lock      sync.Mutex
+	published map[string][][]byte
+	err       error
+	// delay 每次发送的耗时
+	delay time.Duration
+}
+
+func (m *memMQ) Publish(ctx context.Context, topicParams []string, payload []byte) error {
+	if m.delay > 0 {
+		select {
+		case <-time.After(m.delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if m.published == nil {
+		m.published = make(map[string][][]byte)
+	}
+	topic := strings.Join(topicParams, "/")
+	m.published[topic] = append(m.published[topic], payload)
+	return nil
+}
+
+func (m *memMQ) Consume(context.Context, []string, int, mq.Handler) error { return nil }
+
+func (m *memMQ) UnSubscription(context.Context, []string) error { return nil }
+
+func (m *memMQ) Callback(mq.Callback) {}
+
+func TestApp_WritePointsBatch(t *testing.T) {
+	Cfg.Project = "p"
+	Cfg.MQ.Timeout = time.Second
+	m := new(memMQ)
+	a := &app{mq: m, cli: &Client{}}
+	now := time.Now().UnixMilli()
+	points := []entity.Point{
+		{Table: "t", ID: "d1", UnixTime: now, Fields: []entity.Field{{Tag: entity.Tag{ID: "a"}, Value: 1}}},
+		{Table: "t", ID: "d1", UnixTime: now, Fields: []entity.Field{{Tag: entity.Tag{ID: "b"}, Value: 2}}},
+		{Table: "t", ID: "d2", UnixTime: now, Fields: []entity.Field{{Tag: entity.Tag{ID: "a"}, Value: 3}}},
+		{Table: "t", ID: "", Fields: []entity.Field{{Tag: entity.Tag{ID: "a"}, Value: 4}}},
+	}
+	err := a.WritePointsBatch(context.Background(), points)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("WritePointsBatch() error = %v", err)
+	}
+	for i, e := range batchErr.Errors {
+		if (e != nil) != (i == 3) {
+			t.Fatalf("Errors[%d] = %v", i, e)
+		}
+	}
+	if n := len(m.published["data/p/t/d1"]); n != 1 {
+		t.Fatalf("d1 发送次数 = %d, want 1", n)
+	}
+	if !strings.Contains(string(m.published["data/p/t/d1"][0]), `"b":2`) {
+		t.Fatalf("d1 未合并: %s", m.published["data/p/t/d1"][0])
+	}
+	if n := len(m.published["data/p/t/d2"]); n != 1 {
+		t.Fatalf("d2 发送次数 = %d, want 1", n)
+	}
+}
+
+func TestApp_PublishBatchConcurrent(t *testing.T) {
+	Cfg.Project = "p"
+	Cfg.MQ.Timeout = 200 * time.Millisecond
+	m := &memMQ{delay: 100 * time.Millisecond}
+	a := &app{mq: m, cli: &Client{}}
+	// 每个设备单独发送,依次发送时后面的设备超时
+	points := make([]entity.Point, 10)
+	for i := range points {
+		points[i] = entity.Point{Table: "t", ID: fmt.Sprintf("d%d", i), Fields: []entity.Field{{Tag: entity.Tag{ID: "a"}, Value: i}}}
+	}
+	start := time.Now()
+	if err := a.WritePointsBatch(context.Background(), points); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("发送耗时 = %s", d)
+	}
+	for i := range points {
+		if n := len(m.published[fmt.Sprintf("data/p/t/d%d", i)]); n != 1 {
+			t.Fatalf("d%d 发送次数 = %d, want 1", i, n)
+		}
+	}
+}
+
+func TestBatcher_Linger(t *testing.T) {
+	Cfg.Project = "p"
+	Cfg.MQ.Timeout = time.Second
+	m := new(memMQ)
+	a := &app{mq: m, cli: &Client{}}
+	a.batcher = newBatcher(a, BatchConfig{Linger: 20 * time.Millisecond, MaxSize: 100})
+	defer a.batcher.close()
+	now := time.Now().UnixMilli()
+	var wg sync.WaitGroup
+	for _, tag := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func(tag string) {
+			defer wg.Done()
+			if err := a.writePoints(context.Background(), "t", entity.Point{ID: "d1", UnixTime: now, Fields: []entity.Field{{Tag: entity.Tag{ID: tag}, Value: 1}}}); err != nil {
+				t.Error(err)
+			}
+		}(tag)
+	}
+	wg.Wait()
+	if n := len(m.published["data/p/t/d1"]); n != 1 {
+		t.Fatalf("发送次数 = %d, want 1", n)
+	}
+}
+
+func TestBatcher_Closed(t *testing.T) {
+	Cfg.Project = "p"
+	Cfg.MQ.Timeout = time.Second
+	a := &app{mq: new(memMQ), cli: &Client{}}
+	b := newBatcher(a, BatchConfig{Linger: time.Hour, MaxSize: 100})
+	b.close()
+	b.close()
+	data := &entity.WritePoint{ID: "d1", Fields: map[string]interface{}{"a": 1}}
+	// ch有空余时关闭后也不能写入,否则没有协程发送,add一直等待
+	for i := 0; i < 100; i++ {
+		if err := b.add(context.Background(), "t", data); !errors.Is(err, errBatcherClosed) {
+			t.Fatalf("关闭后 add() = %v", err)
+		}
+	}
+}
@@ -0,0 +1,537 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/air-iot/json"
+)
+
+// DropPolicy 缓存满时的丢弃策略
+type DropPolicy string
+
+const (
+	DropOldest DropPolicy = "oldest" // 丢弃最早写入的数据
+	DropNewest DropPolicy = "newest" // 拒绝新写入的数据
+)
+
+const (
+	KindMQ    = "mq"    // 消息队列消息
+	KindEvent = "event" // 驱动事件
+)
+
+const (
+	segmentExt  = ".seg"
+	cursorFile  = "cursor"
+	headerSize  = 8
+	saveEvery   = 100
+	defaultSize = 8 * 1024 * 1024
+)
+
+// ErrFull 缓存已满且丢弃策略为拒绝新数据
+var ErrFull = errors.New("本地缓存已满")
+
+// ErrTooLarge 单条记录超过缓存最大字节数
+var ErrTooLarge = errors.New("缓存记录超过最大字节数")
+
+// ErrClosed 缓存已关闭
+var ErrClosed = errors.New("本地缓存已关闭")
+
+// Config 本地缓存配置. 记录写入缓存文件后同步到磁盘才返回,读取位置每确认100条记录和每次重放结束时保存,
+// 进程异常退出后最多重复发送保存读取位置后已确认的记录,即至少发送一次
+type Config struct {
+	Enable        bool          `json:"enable" yaml:"enable"`
+	Path          string        `json:"path" yaml:"path"`                   // 缓存目录
+	MaxSize       int64         `json:"maxSize" yaml:"maxSize"`             // 缓存最大字节数,0为不限制
+	MaxAge        time.Duration `json:"maxAge" yaml:"maxAge"`               // 缓存数据最长保留时间,0为不限制
+	SegmentSize   int64         `json:"segmentSize" yaml:"segmentSize"`     // 单个缓存文件最大字节数
+	DropPolicy    DropPolicy    `json:"dropPolicy" yaml:"dropPolicy"`       // 缓存满时的丢弃策略
+	RetryInterval time.Duration `json:"retryInterval" yaml:"retryInterval"` // 重放失败后的重试间隔
+}
+
+// Record 缓存记录
+type Record struct {
+	Kind    string   `json:"kind"`
+	Topic   []string `json:"topic,omitempty"`
+	Payload []byte   `json:"payload"`
+	Time    int64    `json:"time"` // 写入缓存时间 毫秒数
+}
+
+type segment struct {
+	seq   uint64
+	size  int64
+	count int
+}
+
+// Queue 基于本地文件的先进先出队列,数据按段文件追加写入,读取位置保存在cursor文件中
+type Queue struct {
+	lock       sync.Mutex
+	replayLock sync.Mutex
+
+	cfg       Config
+	segments  []*segment
+	writer    *os.File
+	reader    *os.File
+	readerSeq uint64
+	readOff   int64
+	readCount int
+	size      int64
+	pending   int
+	dropped   int64
+	commits   int
+	closed    bool
+}
+
+// Open 打开或创建缓存队列
+func Open(cfg Config) (*Queue, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("缓存目录为空")
+	}
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = defaultSize
+	}
+	if cfg.MaxSize > 0 && cfg.SegmentSize > cfg.MaxSize {
+		cfg.SegmentSize = cfg.MaxSize
+	}
+	if cfg.DropPolicy == "" {
+		cfg.DropPolicy = DropOldest
+	}
+	if err := os.MkdirAll(cfg.Path, 0o755); err != nil {
+		return nil, fmt.Errorf("创建缓存目录错误: %w", err)
+	}
+	q := &Queue{cfg: cfg}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Queue) load() error {
+	entries, err := os.ReadDir(q.cfg.Path)
+	if err != nil {
+		return fmt.Errorf("读取缓存目录错误: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s := &segment{seq: seq}
+		if err := q.scan(s); err != nil {
+			return err
+		}
+		q.segments = append(q.segments, s)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i].seq < q.segments[j].seq })
+	if seq, off, count, ok := q.loadCursor(); ok {
+		for len(q.segments) > 0 && q.segments[0].seq < seq {
+			_ = os.Remove(q.segmentPath(q.segments[0].seq))
+			q.segments = q.segments[1:]
+		}
+		if len(q.segments) > 0 && q.segments[0].seq == seq && off <= q.segments[0].size && count <= q.segments[0].count {
+			q.readOff = off
+			q.readCount = count
+		}
+	}
+	for _, s := range q.segments {
+		q.size += s.size
+		q.pending += s.count
+	}
+	q.pending -= q.readCount
+	var seq uint64 = 1
+	if n := len(q.segments); n > 0 {
+		seq = q.segments[n-1].seq
+	} else {
+		q.segments = append(q.segments, &segment{seq: seq})
+	}
+	return q.openWriter(seq)
+}
+
+// scan 统计段文件中的记录数,截断末尾写入不完整的记录
+func (q *Queue) scan(s *segment) error {
+	f, err := os.OpenFile(q.segmentPath(s.seq), os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("打开缓存文件错误: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("读取缓存文件信息错误: %w", err)
+	}
+	header := make([]byte, headerSize)
+	var off int64
+	for off+headerSize <= info.Size() {
+		if _, err := f.ReadAt(header, off); err != nil {
+			break
+		}
+		n := int64(binary.BigEndian.Uint32(header[:4]))
+		if off+headerSize+n > info.Size() {
+			break
+		}
+		off += headerSize + n
+		s.count++
+	}
+	if off != info.Size() {
+		if err := f.Truncate(off); err != nil {
+			return fmt.Errorf("截断缓存文件错误: %w", err)
+		}
+	}
+	s.size = off
+	return nil
+}
+
+// Push 追加记录到队列末尾,单条记录超过MaxSize时返回ErrTooLarge
+func (q *Queue) Push(r Record) error {
+	if r.Time == 0 {
+		r.Time = time.Now().UnixMilli()
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("序列化缓存记录错误: %w", err)
+	}
+	n := int64(len(body) + headerSize)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	if q.cfg.MaxSize > 0 {
+		if n > q.cfg.MaxSize {
+			q.dropped++
+			return ErrTooLarge
+		}
+		for q.size+n > q.cfg.MaxSize {
+			if q.cfg.DropPolicy == DropNewest {
+				q.dropped++
+				return ErrFull
+			}
+			if !q.dropOldest() {
+				break
+			}
+		}
+	}
+	w := q.segments[len(q.segments)-1]
+	if w.size > 0 && w.size+n > q.cfg.SegmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+		w = q.segments[len(q.segments)-1]
+	}
+	buf := make([]byte, n)
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[4:headerSize], crc32.ChecksumIEEE(body))
+	copy(buf[headerSize:], body)
+	if _, err := q.writer.Write(buf); err != nil {
+		return fmt.Errorf("写缓存文件错误: %w", err)
+	}
+	// 同步到磁盘后返回,避免调用方认为已缓存的记录在系统崩溃时丢失
+	if err := q.writer.Sync(); err != nil {
+		return fmt.Errorf("同步缓存文件错误: %w", err)
+	}
+	w.size += n
+	w.count++
+	q.size += n
+	q.pending++
+	return nil
+}
+
+// Replay 按写入顺序依次调用fn发送缓存记录,fn返回错误时停止并保留该记录,返回成功发送的记录数
+func (q *Queue) Replay(fn func(Record) error) (int, error) {
+	if !q.replayLock.TryLock() {
+		return 0, nil
+	}
+	defer q.replayLock.Unlock()
+	sent := 0
+	defer func() {
+		q.lock.Lock()
+		_ = q.saveCursor()
+		q.lock.Unlock()
+	}()
+	for {
+		q.lock.Lock()
+		if q.closed {
+			q.lock.Unlock()
+			return sent, ErrClosed
+		}
+		rec, seq, off, n, ok := q.next()
+		q.lock.Unlock()
+		if !ok {
+			return sent, nil
+		}
+		if q.cfg.MaxAge > 0 && time.Since(time.UnixMilli(rec.Time)) > q.cfg.MaxAge {
+			q.commit(seq, off, n, true)
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return sent, err
+		}
+		q.commit(seq, off, n, false)
+		sent++
+	}
+}
+
+// next 读取下一条未发送的记录,需持有锁
+func (q *Queue) next() (rec Record, seq uint64, off, n int64, ok bool) {
+	for len(q.segments) > 0 {
+		s := q.segments[0]
+		if q.readCount >= s.count {
+			if len(q.segments) == 1 {
+				if s.count > 0 {
+					q.reset()
+				}
+				return
+			}
+			q.removeFirst()
+			continue
+		}
+		f, err := q.openReader(s.seq)
+		if err != nil {
+			q.skipSegment()
+			continue
+		}
+		header := make([]byte, headerSize)
+		if _, err := f.ReadAt(header, q.readOff); err != nil {
+			q.skipSegment()
+			continue
+		}
+		size := binary.BigEndian.Uint32(header[:4])
+		body := make([]byte, size)
+		if _, err := f.ReadAt(body, q.readOff+headerSize); err != nil || crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+			q.skipSegment()
+			continue
+		}
+		n = int64(size) + headerSize
+		if err := json.Unmarshal(body, &rec); err != nil {
+			q.readOff += n
+			q.readCount++
+			q.pending--
+			q.dropped++
+			continue
+		}
+		return rec, s.seq, q.readOff, n, true
+	}
+	return
+}
+
+// commit 确认记录已处理,若读取后该记录所在段已被丢弃则忽略
+func (q *Queue) commit(seq uint64, off, n int64, drop bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.segments) == 0 || q.segments[0].seq != seq || q.readOff != off {
+		return
+	}
+	q.readOff += n
+	q.readCount++
+	q.pending--
+	if drop {
+		q.dropped++
+	}
+	q.commits++
+	if q.commits%saveEvery == 0 {
+		_ = q.saveCursor()
+	}
+}
+
+// dropOldest 删除最早的段文件,需持有锁
+func (q *Queue) dropOldest() bool {
+	if len(q.segments) == 1 {
+		if q.segments[0].size == 0 {
+			return false
+		}
+		if err := q.rotate(); err != nil {
+			return false
+		}
+	}
+	q.dropped += int64(q.segments[0].count - q.readCount)
+	q.removeFirst()
+	return true
+}
+
+// skipSegment 跳过损坏的段文件中剩余的记录,需持有锁
+func (q *Queue) skipSegment() {
+	s := q.segments[0]
+	q.dropped += int64(s.count - q.readCount)
+	q.pending -= s.count - q.readCount
+	q.readCount = s.count
+	q.readOff = s.size
+}
+
+func (q *Queue) removeFirst() {
+	s := q.segments[0]
+	q.pending -= s.count - q.readCount
+	q.size -= s.size
+	q.segments = q.segments[1:]
+	q.readOff = 0
+	q.readCount = 0
+	if q.reader != nil && q.readerSeq == s.seq {
+		_ = q.reader.Close()
+		q.reader = nil
+	}
+	_ = os.Remove(q.segmentPath(s.seq))
+	_ = q.saveCursor()
+}
+
+// reset 唯一的段文件已全部发送,清空文件继续使用
+func (q *Queue) reset() {
+	s := q.segments[0]
+	if err := q.writer.Truncate(0); err != nil {
+		return
+	}
+	q.size -= s.size
+	s.size = 0
+	s.count = 0
+	q.readOff = 0
+	q.readCount = 0
+	_ = q.saveCursor()
+}
+
+func (q *Queue) rotate() error {
+	seq := q.segments[len(q.segments)-1].seq + 1
+	if err := q.openWriter(seq); err != nil {
+		return err
+	}
+	q.segments = append(q.segments, &segment{seq: seq})
+	return nil
+}
+
+func (q *Queue) openWriter(seq uint64) error {
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("打开缓存文件错误: %w", err)
+	}
+	// 新建的段文件同步目录后才能在系统崩溃后找到
+	if err := q.syncDir(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("同步缓存目录错误: %w", err)
+	}
+	if q.writer != nil {
+		_ = q.writer.Close()
+	}
+	q.writer = f
+	return nil
+}
+
+func (q *Queue) openReader(seq uint64) (*os.File, error) {
+	if q.reader != nil && q.readerSeq == seq {
+		return q.reader, nil
+	}
+	if q.reader != nil {
+		_ = q.reader.Close()
+		q.reader = nil
+	}
+	f, err := os.Open(q.segmentPath(seq))
+	if err != nil {
+		return nil, err
+	}
+	q.reader = f
+	q.readerSeq = seq
+	return f, nil
+}
+
+func (q *Queue) loadCursor() (seq uint64, off int64, count int, ok bool) {
+	b, err := os.ReadFile(filepath.Join(q.cfg.Path, cursorFile))
+	if err != nil {
+		return
+	}
+	if _, err := fmt.Sscanf(string(b), "%d %d %d", &seq, &off, &count); err != nil {
+		return
+	}
+	return seq, off, count, true
+}
+
+func (q *Queue) saveCursor() error {
+	if len(q.segments) == 0 {
+		return nil
+	}
+	name := filepath.Join(q.cfg.Path, cursorFile)
+	tmp := name + ".tmp"
+	data := fmt.Sprintf("%d %d %d", q.segments[0].seq, q.readOff, q.readCount)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	return q.syncDir()
+}
+
+// syncDir 同步缓存目录,保证新建和重命名的文件在系统崩溃后仍然存在
+func (q *Queue) syncDir() error {
+	d, err := os.Open(q.cfg.Path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if e := d.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+func (q *Queue) segmentPath(seq uint64) string {
+	return filepath.Join(q.cfg.Path, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// Len 未发送的记录数
+func (q *Queue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.pending
+}
+
+// Size 缓存文件占用的字节数
+func (q *Queue) Size() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.size
+}
+
+// Dropped 因缓存满、过期或文件损坏丢弃的记录数
+func (q *Queue) Dropped() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.dropped
+}
+
+// Close 保存读取位置并关闭缓存文件
+func (q *Queue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	err := q.saveCursor()
+	if q.reader != nil {
+		_ = q.reader.Close()
+	}
+	if q.writer != nil {
+		if e := q.writer.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
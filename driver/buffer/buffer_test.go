@@ -0,0 +1,168 @@
+package buffer
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQueue_ReplayInOrder(t *testing.T) {
+	q, err := Open(Config{Path: t.TempDir(), SegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 0; i < 20; i++ {
+		if err := q.Push(Record{Kind: KindMQ, Topic: []string{"data", "p", "t", "d"}, Payload: []byte(fmt.Sprintf("%d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q.Len() != 20 {
+		t.Fatalf("Len() = %d, want 20", q.Len())
+	}
+	failErr := errors.New("mq不可用")
+	got := make([]string, 0)
+	sent, err := q.Replay(func(r Record) error {
+		if len(got) == 5 {
+			return failErr
+		}
+		got = append(got, string(r.Payload))
+		return nil
+	})
+	if !errors.Is(err, failErr) || sent != 5 {
+		t.Fatalf("Replay() = %d, %v", sent, err)
+	}
+	if _, err := q.Replay(func(r Record) error {
+		got = append(got, string(r.Payload))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range got {
+		if v != fmt.Sprintf("%d", i) {
+			t.Fatalf("got[%d] = %s", i, v)
+		}
+	}
+	if len(got) != 20 || q.Len() != 0 || q.Size() != 0 {
+		t.Fatalf("len=%d pending=%d size=%d", len(got), q.Len(), q.Size())
+	}
+}
+
+func TestQueue_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(Config{Path: dir, SegmentSize: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := q.Push(Record{Kind: KindMQ, Payload: []byte(fmt.Sprintf("%d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := 0
+	_, _ = q.Replay(func(r Record) error {
+		if n == 4 {
+			return errors.New("stop")
+		}
+		n++
+		return nil
+	})
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	q, err = Open(Config{Path: dir, SegmentSize: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Len() != 6 {
+		t.Fatalf("Len() = %d, want 6", q.Len())
+	}
+	var first string
+	_, _ = q.Replay(func(r Record) error {
+		if first == "" {
+			first = string(r.Payload)
+		}
+		return nil
+	})
+	if first != "4" {
+		t.Fatalf("first = %s, want 4", first)
+	}
+}
+
+func TestQueue_DropPolicy(t *testing.T) {
+	q, err := Open(Config{Path: t.TempDir(), MaxSize: 300, SegmentSize: 100, DropPolicy: DropNewest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var full bool
+	for i := 0; i < 20; i++ {
+		if err := q.Push(Record{Kind: KindMQ, Payload: []byte("0123456789")}); errors.Is(err, ErrFull) {
+			full = true
+			break
+		}
+	}
+	_ = q.Close()
+	if !full {
+		t.Fatal("DropNewest 未返回 ErrFull")
+	}
+
+	q, err = Open(Config{Path: t.TempDir(), MaxSize: 300, SegmentSize: 100, DropPolicy: DropOldest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 0; i < 20; i++ {
+		if err := q.Push(Record{Kind: KindMQ, Payload: []byte(fmt.Sprintf("%02d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q.Size() > 300 || q.Dropped() == 0 {
+		t.Fatalf("size=%d dropped=%d", q.Size(), q.Dropped())
+	}
+	var last string
+	_, _ = q.Replay(func(r Record) error {
+		last = string(r.Payload)
+		return nil
+	})
+	if last != "19" {
+		t.Fatalf("last = %s, want 19", last)
+	}
+}
+
+func TestQueue_MaxAge(t *testing.T) {
+	q, err := Open(Config{Path: t.TempDir(), MaxAge: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	_ = q.Push(Record{Kind: KindMQ, Payload: []byte("old"), Time: time.Now().Add(-time.Hour).UnixMilli()})
+	_ = q.Push(Record{Kind: KindMQ, Payload: []byte("new")})
+	got := make([]string, 0)
+	_, _ = q.Replay(func(r Record) error {
+		got = append(got, string(r.Payload))
+		return nil
+	})
+	if len(got) != 1 || got[0] != "new" || q.Dropped() != 1 {
+		t.Fatalf("got=%v dropped=%d", got, q.Dropped())
+	}
+}
+
+func TestQueue_TooLarge(t *testing.T) {
+	q, err := Open(Config{Path: t.TempDir(), MaxSize: 200, SegmentSize: 100, DropPolicy: DropOldest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err := q.Push(Record{Kind: KindMQ, Payload: []byte("01")}); err != nil {
+		t.Fatal(err)
+	}
+	// 超过MaxSize的记录直接拒绝,不淘汰已有数据
+	if err := q.Push(Record{Kind: KindMQ, Payload: make([]byte, 300)}); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Push() error = %v", err)
+	}
+	if q.Len() != 1 || q.Size() > 200 || q.Dropped() != 1 {
+		t.Fatalf("len=%d size=%d dropped=%d", q.Len(), q.Size(), q.Dropped())
+	}
+}
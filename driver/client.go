@@ -4,46 +4,62 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/air-iot/api-client-go/v4/apicontext"
 	"github.com/air-iot/api-client-go/v4/config"
-	"github.com/air-iot/errors"
 	"github.com/air-iot/json"
 	"github.com/air-iot/sdk-go/v4/driver/entity"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	api "github.com/air-iot/api-client-go/v4/api"
 	pb "github.com/air-iot/api-client-go/v4/driver"
 	"github.com/air-iot/logger"
 	dGrpc "github.com/air-iot/sdk-go/v4/driver/grpc"
+	"github.com/air-iot/sdk-go/v4/utils/grpcx"
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
+	"github.com/air-iot/sdk-go/v4/utils/probe"
 )
 
 type Client struct {
 	lock sync.RWMutex
 
-	conn           *grpc.ClientConn
-	cli            pb.DriverServiceClient
-	instructCli    pb.DriverInstructServiceClient
-	app            App
-	driver         Driver
-	clean          func()
-	cacheConfig    sync.Map
+	conn        *grpc.ClientConn
+	cli         pb.DriverServiceClient
+	instructCli pb.DriverInstructServiceClient
+	app         App
+	driver      Driver
+	clean       func()
+	// cacheConfigNum 设备ID对应的表ID,按实例配置中的顺序
 	cacheConfigNum sync.Map
-	streamCount    int32
+	streams        []*streamSupervisor
+	handlers       inflight
+	// wg 连接和stream的重连协程
+	wg sync.WaitGroup
+	// lastHealth 最近一次健康检查正常的时间(UnixNano)
+	lastHealth atomic.Int64
+	// started 驱动的Start是否执行成功
+	started atomic.Bool
+	// startLock 保证start请求串行处理
+	startLock sync.Mutex
+	// instance 最近一次成功应用的实例配置,用于比较设备变化
+	instance *instanceSnapshot
+	// config 最近一次start请求的实例配置
+	config atomic.Pointer[instanceConfig]
 }
 
-const totalStream = 7
 const STREAM_HEARTBEAT = "heartbeat"
 
 func (c *Client) Start(app App, driver Driver) *Client {
 	c.app = app
 	c.driver = driver
-	c.streamCount = 0
+	c.streams = c.newStreams()
 	c.start()
 	return c
 }
@@ -57,7 +73,9 @@ func (c *Client) start() {
 	c.clean = func() {
 		cancel()
 	}
+	c.wg.Add(1)
 	go func() {
+		defer c.wg.Done()
 		for {
 			select {
 			case <-ctx.Done():
@@ -67,7 +85,10 @@ func (c *Client) start() {
 				if err := c.run(ctx); err != nil {
 					logger.WithContext(ctx).Errorln(err)
 				}
-				time.Sleep(waitTime)
+				select {
+				case <-ctx.Done():
+				case <-time.After(waitTime):
+				}
 			}
 		}
 	}()
@@ -83,6 +104,8 @@ func (c *Client) Stop() {
 	if c.clean != nil {
 		c.clean()
 	}
+	c.wg.Wait()
+	c.closePools()
 	c.close(ctx)
 }
 
@@ -117,10 +140,13 @@ func (c *Client) connDriver(ctx context.Context) error {
 	ctx, cancel := context.WithTimeout(ctx, Cfg.DriverGrpc.Timeout)
 	defer cancel()
 	logger.WithContext(ctx).Infof("连接driver: 配置=%+v", Cfg.DriverGrpc)
+	opts, err := grpcx.DialOptions(Cfg.DriverGrpc.TLS, string(Cfg.DriverGrpc.Token))
+	if err != nil {
+		return err
+	}
 	conn, err := grpc.NewClient(
 		fmt.Sprintf("%s:%d", Cfg.DriverGrpc.Host, Cfg.DriverGrpc.Port),
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(Cfg.DriverGrpc.Limit*1024*1024), grpc.MaxCallSendMsgSize(Cfg.DriverGrpc.Limit*1024*1024)),
+		append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(Cfg.DriverGrpc.Limit*1024*1024), grpc.MaxCallSendMsgSize(Cfg.DriverGrpc.Limit*1024*1024)))...,
 	)
 	if err != nil {
 		return fmt.Errorf("grpc.Dial error: %w", err)
@@ -151,7 +177,12 @@ func (c *Client) healthCheck(ctx context.Context) {
 			state := false
 			for retry >= 0 {
 				healthRes, err := c.healthRequest(ctx)
+				metrics.HealthCheck(metrics.ServiceDriver, err == nil && healthRes.GetStatus() == pb.HealthCheckResponse_SERVING)
 				if err != nil {
+					if ctx.Err() != nil {
+						logger.WithContext(ctx).Infof("健康检查: 停止")
+						return
+					}
 					errCtx := logger.NewErrorContext(ctx1, err)
 					logger.WithContext(errCtx).Errorf("健康检查: 健康检查第 %d 次错误", Cfg.DriverGrpc.Health.Retry-retry+1)
 					state = true
@@ -168,6 +199,9 @@ func (c *Client) healthCheck(ctx context.Context) {
 								}
 							}
 						}
+						if !state {
+							c.lastHealth.Store(time.Now().UnixNano())
+						}
 					} else if healthRes.GetStatus() == pb.HealthCheckResponse_SERVICE_UNKNOWN {
 						newLogger.Errorf("健康检查: 服务端未找到本驱动服务")
 						state = true
@@ -181,19 +215,52 @@ func (c *Client) healthCheck(ctx context.Context) {
 				return
 			} else if time.Now().Local().After(nextTime) {
 				nextTime = time.Now().Local().Add(time.Duration(Cfg.DriverGrpc.Health.Retry) * waitTime)
-				getV := atomic.LoadInt32(&c.streamCount)
-				newLogger.Debugf("健康检查: 找到流数量=%d", getV)
-				if getV < totalStream {
-					newLogger.Errorf("健康检查: 找到流数量不匹配,应为=%d,实际为=%d", totalStream, getV)
+				grace := time.Duration(Cfg.DriverGrpc.Health.Retry) * waitTime
+				unhealthy := false
+				for _, st := range c.Streams() {
+					newLogger.Debugf("健康检查: stream=%s,状态=%s,重启次数=%d", st.Name, st.State, st.Restarts)
+					if st.State != StreamReady && time.Since(st.Since) > grace {
+						newLogger.Errorf("健康检查: stream=%s 未就绪,状态=%s,持续时间=%s,最近错误=%s", st.Name, st.State, time.Since(st.Since).Truncate(time.Second), st.LastError)
+						unhealthy = true
+					}
+				}
+				if unhealthy {
 					return
 				}
 			}
-			time.Sleep(waitTime)
+			select {
+			case <-ctx.Done():
+			case <-time.After(waitTime):
+			}
 		}
 	}
 
 }
 
+// checks 返回驱动管理连接、stream、健康检查和驱动启动的状态
+func (c *Client) checks() []probe.Check {
+	c.lock.RLock()
+	conn := c.conn
+	c.lock.RUnlock()
+	ready := 0
+	for _, st := range c.Streams() {
+		if st.State == StreamReady {
+			ready++
+		}
+	}
+	var last time.Time
+	if v := c.lastHealth.Load(); v > 0 {
+		last = time.Unix(0, v)
+	}
+	retry := time.Duration(Cfg.DriverGrpc.Health.Retry + 2)
+	return []probe.Check{
+		probe.GRPC(conn),
+		probe.Streams(ready, len(c.streams)),
+		probe.HealthCheck(last, (Cfg.DriverGrpc.WaitTime+Cfg.DriverGrpc.Health.RequestTime)*retry),
+		probe.Started(c.started.Load()),
+	}
+}
+
 func (c *Client) healthRequest(ctx context.Context) (*pb.HealthCheckResponse, error) {
 	reqCtx, reqCancel := context.WithTimeout(ctx, Cfg.DriverGrpc.Health.RequestTime)
 	defer reqCancel()
@@ -209,6 +276,14 @@ func (c *Client) WriteEvent(ctx context.Context, event entity.Event) error {
 	if err != nil {
 		return err
 	}
+	return c.sendEvent(ctx, b)
+}
+
+// sendEvent 发送序列化后的事件数据
+func (c *Client) sendEvent(ctx context.Context, b []byte) error {
+	if c.cli == nil {
+		return status.Error(codes.Unavailable, "驱动管理未连接")
+	}
 	res, err := c.cli.Event(ctx, &pb.Request{
 		Project: Cfg.Project,
 		Data:    b,
@@ -337,1026 +412,261 @@ func (c *Client) UpdateTableData(ctx context.Context, l entity.TableData, result
 }
 
 func (c *Client) startSteam(ctx context.Context, sessionId string) {
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				logger.WithContext(ctx).Infof("schema: 通过上下文关闭stream检查")
-				return
-			default:
-				newCtx := context.WithoutCancel(ctx)
-				if Cfg.GroupID != "" {
-					newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
-				}
-				newCtx = logger.NewModuleContext(newCtx, entity.MODULE_SCHEMA)
-				newLogger := logger.WithContext(newCtx)
-				newLogger.Infof("schema: 启动stream")
-				if err := c.SchemaStream(newCtx, sessionId); err != nil {
-					errCtx := logger.NewErrorContext(newCtx, err)
-					logger.WithContext(errCtx).Errorf("schema: stream创建错误")
-				}
-				time.Sleep(Cfg.DriverGrpc.WaitTime)
-			}
-		}
-	}()
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				logger.WithContext(ctx).Infof("start: 通过上下文关闭stream检查")
-				return
-			default:
-				newCtx := context.WithoutCancel(ctx)
-				if Cfg.GroupID != "" {
-					newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
-				}
-				newCtx = logger.NewModuleContext(newCtx, entity.MODULE_START)
-				newLogger := logger.WithContext(newCtx)
-				newLogger.Infof("start: 启动stream")
-				if err := c.StartStream(newCtx, sessionId); err != nil {
-					errCtx := logger.NewErrorContext(newCtx, err)
-					logger.WithContext(errCtx).Errorf("start: stream创建错误")
-				}
-				time.Sleep(Cfg.DriverGrpc.WaitTime)
-			}
-		}
-	}()
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				logger.WithContext(ctx).Infof("执行指令: 通过上下文关闭stream检查")
-				return
-			default:
-				newCtx := context.WithoutCancel(ctx)
-				if Cfg.GroupID != "" {
-					newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
-				}
-				newCtx = logger.NewModuleContext(newCtx, entity.MODULE_RUN)
-				newLogger := logger.WithContext(newCtx)
-				newLogger.Infof("执行指令: 启动stream")
-				if err := c.RunStream(newCtx, sessionId); err != nil {
-					errCtx := logger.NewErrorContext(newCtx, err)
-					logger.WithContext(errCtx).Errorf("执行指令: stream创建错误")
-				}
-				time.Sleep(Cfg.DriverGrpc.WaitTime)
-			}
-		}
-	}()
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				logger.WithContext(ctx).Infof("写数据点: 通过上下文关闭stream检查")
-				return
-			default:
-				newCtx := context.WithoutCancel(ctx)
-				if Cfg.GroupID != "" {
-					newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
-				}
-				newCtx = logger.NewModuleContext(newCtx, entity.MODULE_WRITETAG)
-				newLogger := logger.WithContext(newCtx)
-				newLogger.Infof("写数据点: 启动stream")
-				if err := c.WriteTagStream(newCtx, sessionId); err != nil {
-					errCtx := logger.NewErrorContext(newCtx, err)
-					logger.WithContext(errCtx).Errorf("写数据点: stream创建错误")
-				}
-				time.Sleep(Cfg.DriverGrpc.WaitTime)
-			}
-		}
-	}()
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				logger.WithContext(ctx).Infof("批量执行指令: stream创建错误")
-				return
-			default:
-				newCtx := context.WithoutCancel(ctx)
-				if Cfg.GroupID != "" {
-					newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
-				}
-				newCtx = logger.NewModuleContext(newCtx, entity.MODULE_BATCHRUN)
-				newLogger := logger.WithContext(newCtx)
-				newLogger.Infof("批量执行指令: 启动stream")
-				if err := c.BatchRunStream(newCtx, sessionId); err != nil {
-					errCtx := logger.NewErrorContext(newCtx, err)
-					logger.WithContext(errCtx).Errorf("批量执行指令: stream创建错误")
-				}
-				time.Sleep(Cfg.DriverGrpc.WaitTime)
-			}
-		}
-	}()
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				logger.WithContext(ctx).Infof("调试: 通过上下文关闭stream检查")
-				return
-			default:
-				newCtx := context.WithoutCancel(ctx)
-				if Cfg.GroupID != "" {
-					newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
-				}
-				newCtx = logger.NewModuleContext(newCtx, entity.MODULE_DEBUG)
-				newLogger := logger.WithContext(newCtx)
-				newLogger.Infof("调试: 启动stream")
-				if err := c.DebugStream(newCtx, sessionId); err != nil {
-					errCtx := logger.NewErrorContext(newCtx, err)
-					logger.WithContext(errCtx).Errorf("调试: stream创建错误")
-				}
-				time.Sleep(Cfg.DriverGrpc.WaitTime)
-			}
-		}
-	}()
+	for _, s := range c.streams {
+		c.wg.Add(1)
+		go func(s *streamSupervisor) {
+			defer c.wg.Done()
+			s.run(ctx, sessionId)
+		}(s)
+	}
+}
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				logger.WithContext(ctx).Infof("httpProxy: 通过上下文关闭stream检查")
-				return
-			default:
-				newCtx := context.WithoutCancel(ctx)
-				if Cfg.GroupID != "" {
-					newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
-				}
-				newCtx = logger.NewModuleContext(newCtx, entity.MODULE_HTTPPROXY)
-				newLogger := logger.WithContext(newCtx)
-				newLogger.Infof("httpProxy: 启动stream")
-				if err := c.HttpProxyStream(newCtx, sessionId); err != nil {
-					errCtx := logger.NewErrorContext(newCtx, err)
-					logger.WithContext(errCtx).Errorf("httpProxy: stream创建错误")
-				}
-				time.Sleep(Cfg.DriverGrpc.WaitTime)
-			}
-		}
-	}()
+func (c *Client) newStreams() []*streamSupervisor {
+	return []*streamSupervisor{
+		newStreamSupervisor("schema", "schema", entity.MODULE_SCHEMA, c.SchemaStream, newWorkerPool(Cfg.Workers.Schema)),
+		newStreamSupervisor("start", "start", entity.MODULE_START, c.StartStream, nil),
+		newStreamSupervisor("run", "执行指令", entity.MODULE_RUN, c.RunStream, newWorkerPool(Cfg.Workers.Run)),
+		newStreamSupervisor("writeTag", "写数据点", entity.MODULE_WRITETAG, c.WriteTagStream, newWorkerPool(Cfg.Workers.WriteTag)),
+		newStreamSupervisor("batchRun", "批量执行指令", entity.MODULE_BATCHRUN, c.BatchRunStream, newWorkerPool(Cfg.Workers.BatchRun)),
+		newStreamSupervisor("debug", "调试", entity.MODULE_DEBUG, c.DebugStream, newWorkerPool(Cfg.Workers.Debug)),
+		newStreamSupervisor("httpProxy", "httpProxy", entity.MODULE_HTTPPROXY, c.HttpProxyStream, newWorkerPool(Cfg.Workers.HttpProxy)),
+	}
+}
+
+// deviceKey 指令和写数据点请求按设备依次处理
+func deviceKey(req *pb.RunRequest) string {
+	return req.TableId + "/" + req.Id
+}
+
+func (c *Client) streamContext(ctx context.Context, sessionId string) context.Context {
+	return dGrpc.GetGrpcContext(ctx, Cfg.ServiceID, Cfg.Project, Cfg.Driver.ID, Cfg.Driver.Name, sessionId)
 }
 
 func (c *Client) SchemaStream(ctx context.Context, sessionId string) error {
-	stream, err := c.cli.SchemaStream(dGrpc.GetGrpcContext(ctx, Cfg.ServiceID, Cfg.Project, Cfg.Driver.ID, Cfg.Driver.Name, sessionId))
-	if err != nil {
-		return err
-	}
-	//hCtx, hCancel := context.WithCancel(ctx)
-	//ch := make(chan struct{}, 1)
-	defer func() {
-		//hCancel()
-		atomic.AddInt32(&c.streamCount, -1)
-		if err := stream.CloseSend(); err != nil {
-			errCtx := logger.NewErrorContext(ctx, err)
-			logger.WithContext(errCtx).Errorf("schema: stream关闭错误")
-		}
-	}()
-	logger.WithContext(ctx).Infof("schema: stream连接成功")
-	atomic.AddInt32(&c.streamCount, 1)
-	//go func() {
-	//	for {
-	//		select {
-	//		case <-hCtx.Done():
-	//			logger.WithContext(hCtx).Infof("schema stream心跳停止")
-	//			return
-	//		default:
-	//			time.Sleep(Cfg.DriverGrpc.Stream.Heartbeat)
-	//			logger.WithContext(hCtx).Debugf("schema stream心跳开始")
-	//			if err := stream.Send(&pb.SchemaResult{
-	//				Request: STREAM_HEARTBEAT,
-	//			}); err != nil {
-	//				logger.WithContext(logger.NewErrorContext(hCtx, err)).Errorf("schema stream心跳发送错误")
-	//				//if err := stream.CloseSend(); err != nil {
-	//				//	errCtx := logger.NewErrorContext(ctx, err)
-	//				//	logger.WithContext(errCtx).Errorf("schema stream心跳发送错误: 关闭stream错误")
-	//				//}
-	//				c.close(ctx)
-	//				return
-	//			}
-	//			select {
-	//			case <-hCtx.Done():
-	//				logger.WithContext(hCtx).Infof("schema stream心跳停止")
-	//				return
-	//			case <-time.After(Cfg.DriverGrpc.Stream.Heartbeat * 3):
-	//				logger.WithContext(hCtx).Errorf("schema stream心跳超时")
-	//				if err := stream.CloseSend(); err != nil {
-	//					logger.WithContext(hCtx).Errorf("schema stream心跳超时: 关闭stream错误")
-	//				}
-	//				return
-	//			case <-ch:
-	//				logger.WithContext(hCtx).Debugf("schema stream收到心跳响应")
-	//			}
-	//		}
-	//	}
-	//}()
-	for {
-		res, err := stream.Recv()
-		if err != nil {
-			return err
-		}
-		go func(res *pb.SchemaRequest) {
-			if res.GetRequest() == STREAM_HEARTBEAT {
-				//logger.WithContext(hCtx).Debugf("schema stream收到心跳响应包输入到管道")
-				//ch <- struct{}{}
-				return
+	return serveStream(ctx, c, streamHandler[*pb.SchemaRequest, *pb.SchemaResult]{
+		open: func(ctx context.Context) (streamConn[*pb.SchemaRequest, *pb.SchemaResult], error) {
+			return c.cli.SchemaStream(c.streamContext(ctx, sessionId))
+		},
+		id:     "schema",
+		name:   "schema",
+		module: entity.MODULE_SCHEMA,
+		handle: func(ctx context.Context, req *pb.SchemaRequest) (interface{}, error) {
+			logger.WithContext(ctx).Debugf("schema: 接收到查询请求")
+			return c.driver.Schema(ctx, c.app, req.GetLocale())
+		},
+		reply: func(request string, data []byte) *pb.SchemaResult {
+			return &pb.SchemaResult{Request: request, Message: data}
+		},
+	})
+}
+
+func (c *Client) StartStream(ctx context.Context, sessionId string) error {
+	return serveStream(ctx, c, streamHandler[*pb.StartRequest, *pb.StartResult]{
+		open: func(ctx context.Context) (streamConn[*pb.StartRequest, *pb.StartResult], error) {
+			return c.cli.StartStream(c.streamContext(ctx, sessionId))
+		},
+		id:     "start",
+		name:   "start",
+		module: entity.MODULE_START,
+		sync:   true,
+		handle: func(ctx context.Context, req *pb.StartRequest) (interface{}, error) {
+			logger.WithContext(ctx).Debugf("start: 接收到开始请求")
+			var cfg entity.Instance
+			if err := json.Unmarshal(req.Config, &cfg); err != nil {
+				return nil, err
+			}
+			c.startLock.Lock()
+			defer c.startLock.Unlock()
+			c.loadInstance(&cfg)
+			snapshot, err := snapshotInstance(req.Config)
+			if err != nil {
+				logger.WithContext(ctx).Warnf("start: 解析实例配置错误,重新启动驱动. %v", err)
 			}
-			newCtx, cancel := context.WithTimeout(context.Background(), Cfg.DriverGrpc.Timeout)
-			defer cancel()
-			newCtx = logger.NewModuleContext(newCtx, entity.MODULE_SCHEMA)
-			if Cfg.GroupID != "" {
-				newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
+			if c.reload(ctx, snapshot) {
+				c.instance = snapshot
+				return nil, nil
 			}
-			logger.WithContext(newCtx).Debugf("schema: 接收到查询请求")
-			schema, err := c.driver.Schema(newCtx, c.app, res.GetLocale())
-			schemaRes := new(entity.GrpcResult)
-			if err != nil {
-				schemaRes.Error = err.Error()
-				schemaRes.Code = 400
+			err = c.driver.Start(ctx, c.app, req.Config)
+			c.started.Store(err == nil)
+			if err == nil {
+				c.instance = snapshot
 			} else {
-				schemaRes.Result = schema
-				schemaRes.Code = 200
-			}
-			bts, _ := json.Marshal(schemaRes)
-			if err := stream.Send(&pb.SchemaResult{
-				Request: res.Request,
-				Message: bts,
-			}); err != nil {
-				errCtx := logger.NewErrorContext(newCtx, err)
-				logger.WithContext(errCtx).Errorf("schema: 配置返回到驱动管理错误")
+				c.instance = nil
 			}
-		}(res)
-	}
+			return nil, err
+		},
+		reply: func(request string, data []byte) *pb.StartResult {
+			return &pb.StartResult{Request: request, Message: data}
+		},
+	})
 }
 
-func (c *Client) StartStream(ctx context.Context, sessionId string) error {
-	stream, err := c.cli.StartStream(dGrpc.GetGrpcContext(ctx, Cfg.ServiceID, Cfg.Project, Cfg.Driver.ID, Cfg.Driver.Name, sessionId))
-	if err != nil {
-		return err
+// reload 驱动已启动且实现DeviceLifecycle时,按设备变化增量更新,返回false时需要调用Start
+func (c *Client) reload(ctx context.Context, snapshot *instanceSnapshot) bool {
+	lifecycle, ok := c.driver.(DeviceLifecycle)
+	if !ok || !c.started.Load() {
+		return false
 	}
-	//hCtx, hCancel := context.WithCancel(ctx)
-	//ch := make(chan struct{}, 1)
-	defer func() {
-		//hCancel()
-		atomic.AddInt32(&c.streamCount, -1)
-		if err := stream.CloseSend(); err != nil {
-			errCtx := logger.NewErrorContext(ctx, err)
-			logger.WithContext(errCtx).Errorf("start: stream关闭错误")
-		}
-	}()
-	logger.WithContext(ctx).Infof("start: stream连接成功")
-	atomic.AddInt32(&c.streamCount, 1)
-	//go func() {
-	//	for {
-	//		select {
-	//		case <-hCtx.Done():
-	//			logger.WithContext(hCtx).Infof("start stream心跳停止")
-	//			return
-	//		default:
-	//			time.Sleep(Cfg.DriverGrpc.Stream.Heartbeat)
-	//			logger.WithContext(hCtx).Debugf("start stream心跳开始")
-	//			if err := stream.Send(&pb.StartResult{
-	//				Request: STREAM_HEARTBEAT,
-	//			}); err != nil {
-	//				logger.WithContext(logger.NewErrorContext(hCtx, err)).Errorf("start stream心跳发送错误")
-	//				//if err := stream.CloseSend(); err != nil {
-	//				//	errCtx := logger.NewErrorContext(ctx, err)
-	//				//	logger.WithContext(errCtx).Errorf("start stream心跳发送错误: 关闭stream错误")
-	//				//}
-	//				c.close(ctx)
-	//				return
-	//			}
-	//			select {
-	//			case <-hCtx.Done():
-	//				logger.WithContext(hCtx).Infof("start stream心跳停止")
-	//				return
-	//			case <-time.After(Cfg.DriverGrpc.Stream.Heartbeat * 3):
-	//				logger.WithContext(hCtx).Errorf("start stream心跳超时")
-	//				if err := stream.CloseSend(); err != nil {
-	//					logger.WithContext(hCtx).Errorf("start stream心跳超时: 关闭stream错误")
-	//				}
-	//				return
-	//			case <-ch:
-	//				logger.WithContext(hCtx).Debugf("start stream收到心跳响应")
-	//			}
-	//		}
-	//	}
-	//}()
-	for {
-		res, err := stream.Recv()
-		if err != nil {
-			return err
-		}
-		if res.GetRequest() == STREAM_HEARTBEAT {
-			//logger.WithContext(hCtx).Debugf("start stream收到心跳响应包输入到管道")
-			//ch <- struct{}{}
-			continue
-		}
-		ctx1 := logger.NewModuleContext(context.Background(), entity.MODULE_START)
-		logger.WithContext(ctx1).Debugf("start: 接收到开始请求")
-		var cfg entity.Instance
-		if err := json.Unmarshal(res.Config, &cfg); err != nil {
-			startRes := new(entity.GrpcResult)
-			startRes.Error = err.Error()
-			startRes.Code = 400
-			bts, _ := json.Marshal(startRes)
-			if err := stream.Send(&pb.StartResult{
-				Request: res.Request,
-				Message: bts,
-			}); err != nil {
-				errCtx := logger.NewErrorContext(ctx1, err)
-				logger.WithContext(errCtx).Errorf("start: 解析配置的错误返回到驱动管理错误")
-			}
-			continue
-		}
-		if cfg.Debug != nil {
-			if *cfg.Debug {
-				logger.SetLevel(logger.DebugLevel)
-			} else {
-				logger.SetLevel(logger.InfoLevel)
-			}
-		}
-		c.cacheConfigNum = sync.Map{}
-		c.cacheConfig = sync.Map{}
-		if cfg.GroupId != "" {
-			Cfg.GroupID = cfg.GroupId
-		}
-		if Cfg.GroupID != "" {
-			ctx1 = logger.NewGroupContext(ctx1, Cfg.GroupID)
-		}
-		if cfg.Tables != nil {
-			for _, t := range cfg.Tables {
-				if t.Devices == nil {
-					continue
-				}
-				for _, device := range t.Devices {
-					devM, ok := c.cacheConfigNum.Load(device.Id)
-					var devI map[string]interface{}
-					if ok {
-						devI, _ = devM.(map[string]interface{})
-					} else {
-						devI = map[string]interface{}{}
-					}
-					devI[t.Id] = struct{}{}
-					c.cacheConfigNum.Store(device.Id, devI)
-					c.cacheConfig.Store(device.Id, t.Id)
-				}
-			}
+	diff, ok := diffInstance(c.instance, snapshot)
+	if !ok {
+		return false
+	}
+	logger.WithContext(ctx).Infof("start: 增量更新设备,添加=%d,修改=%d,删除=%d", len(diff.added), len(diff.updated), len(diff.removed))
+	if err := applyDiff(ctx, c.app, lifecycle, diff); err != nil {
+		logger.WithContext(ctx).Errorf("start: 增量更新设备错误,重新启动驱动. %v", err)
+		return false
+	}
+	return true
+}
+
+// loadInstance 按实例配置设置日志级别、分组和设备所属的表
+func (c *Client) loadInstance(cfg *entity.Instance) {
+	if cfg.Debug != nil {
+		if *cfg.Debug {
+			logger.SetLevel(logger.DebugLevel)
+		} else {
+			logger.SetLevel(logger.InfoLevel)
 		}
-		run := func(res *pb.StartRequest) {
-			newCtx, cancel := context.WithTimeout(ctx1, Cfg.DriverGrpc.Timeout)
-			defer cancel()
-			defer func() {
-				if errR := recover(); errR != nil {
-					var errStr string
-					switch v := errR.(type) {
-					case error:
-						errStr = v.Error()
-						logger.Errorf("%+v", errors.WithStack(v))
-					default:
-						errStr = fmt.Sprintf("%v", v)
-						logger.Errorln(v)
-					}
-					startRes := new(entity.GrpcResult)
-					startRes.Error = errStr
-					startRes.Code = 400
-					bts, _ := json.Marshal(startRes)
-					if err := stream.Send(&pb.StartResult{
-						Request: res.Request,
-						Message: bts,
-					}); err != nil {
-						errCtx := logger.NewErrorContext(newCtx, err)
-						logger.WithContext(errCtx).Errorf("start: 启动驱动结果返回到驱动管理错误")
-					}
-				}
-			}()
-			startRes := new(entity.GrpcResult)
-			if err := c.driver.Start(newCtx, c.app, res.Config); err != nil {
-				startRes.Error = err.Error()
-				startRes.Code = 400
-			} else {
-				startRes.Code = 200
+	}
+	logInvalidConfig(cfg)
+	c.cacheConfigNum = sync.Map{}
+	c.config.Store(newInstanceConfig(cfg))
+	if cfg.GroupId != "" {
+		Cfg.GroupID = cfg.GroupId
+	}
+	for _, t := range cfg.Tables {
+		for _, device := range t.Devices {
+			var tables []string
+			if v, ok := c.cacheConfigNum.Load(device.Id); ok {
+				tables = v.([]string)
 			}
-			bts, _ := json.Marshal(startRes)
-			if err := stream.Send(&pb.StartResult{
-				Request: res.Request,
-				Message: bts,
-			}); err != nil {
-				errCtx := logger.NewErrorContext(newCtx, err)
-				logger.WithContext(errCtx).Errorf("start: 启动驱动结果返回到驱动管理错误")
+			if !slices.Contains(tables, t.Id) {
+				c.cacheConfigNum.Store(device.Id, append(tables, t.Id))
 			}
 		}
-		run(res)
 	}
 }
 
 func (c *Client) RunStream(ctx context.Context, sessionId string) error {
-	stream, err := c.cli.RunStream(dGrpc.GetGrpcContext(ctx, Cfg.ServiceID, Cfg.Project, Cfg.Driver.ID, Cfg.Driver.Name, sessionId))
-	if err != nil {
-		return err
-	}
-	//hCtx, hCancel := context.WithCancel(ctx)
-	//ch := make(chan struct{}, 1)
-	defer func() {
-		//hCancel()
-		atomic.AddInt32(&c.streamCount, -1)
-		if err := stream.CloseSend(); err != nil {
-			errCtx := logger.NewErrorContext(ctx, err)
-			logger.WithContext(errCtx).Errorf("执行指令: stream关闭错误")
-		}
-	}()
-	logger.WithContext(ctx).Infof("执行指令: stream连接成功")
-	atomic.AddInt32(&c.streamCount, 1)
-	//go func() {
-	//	for {
-	//		select {
-	//		case <-hCtx.Done():
-	//			logger.WithContext(hCtx).Infof("执行指令stream心跳停止")
-	//			return
-	//		default:
-	//			time.Sleep(Cfg.DriverGrpc.Stream.Heartbeat)
-	//			logger.WithContext(hCtx).Debugf("执行指令stream心跳开始")
-	//			if err := stream.Send(&pb.RunResult{
-	//				Request: STREAM_HEARTBEAT,
-	//			}); err != nil {
-	//				logger.WithContext(logger.NewErrorContext(hCtx, err)).Errorf("执行指令stream心跳发送错误")
-	//				//if err := stream.CloseSend(); err != nil {
-	//				//	errCtx := logger.NewErrorContext(ctx, err)
-	//				//	logger.WithContext(errCtx).Errorf("执行指令stream心跳发送错误: 关闭stream错误")
-	//				//}
-	//				c.close(ctx)
-	//				return
-	//			}
-	//			select {
-	//			case <-hCtx.Done():
-	//				logger.WithContext(hCtx).Infof("执行指令stream心跳停止")
-	//				return
-	//			case <-time.After(Cfg.DriverGrpc.Stream.Heartbeat * 3):
-	//				logger.WithContext(hCtx).Errorf("执行指令stream心跳超时")
-	//				if err := stream.CloseSend(); err != nil {
-	//					logger.WithContext(hCtx).Errorf("执行指令stream心跳超时: 关闭stream错误")
-	//				}
-	//				return
-	//			case <-ch:
-	//				logger.WithContext(hCtx).Debugf("执行指令stream收到心跳响应")
-	//			}
-	//		}
-	//	}
-	//}()
-	for {
-		res, err := stream.Recv()
-		if err != nil {
-			return err
-		}
-		go func(res *pb.RunRequest) {
-			if res.GetRequest() == STREAM_HEARTBEAT {
-				//logger.WithContext(hCtx).Debugf("执行指令stream收到心跳响应包输入到管道")
-				//ch <- struct{}{}
-				return
-			}
-			newCtx, cancel := context.WithTimeout(context.Background(), Cfg.DriverGrpc.Timeout)
-			defer cancel()
-			newCtx = logger.NewTDMContext(newCtx, res.TableId, res.Id, entity.MODULE_RUN)
-			if Cfg.GroupID != "" {
-				newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
-			}
-			logger.WithContext(newCtx).Debugf("执行指令: 设备表=%s,设备=%s,指令=%s", res.TableId, res.Id, res.Command)
-			defer func() {
-				if errR := recover(); errR != nil {
-					var errStr string
-					switch v := errR.(type) {
-					case error:
-						errStr = v.Error()
-						logger.Errorf("%+v", errors.WithStack(v))
-					default:
-						errStr = fmt.Sprintf("%v", v)
-						logger.Errorln(v)
-					}
-					gr := new(entity.GrpcResult)
-					gr.Error = errStr
-					gr.Code = 400
-					bts, _ := json.Marshal(gr)
-					if err := stream.Send(&pb.RunResult{
-						Request: res.Request,
-						Message: bts,
-					}); err != nil {
-						errCtx := logger.NewErrorContext(newCtx, err)
-						logger.WithContext(errCtx).Errorf("执行指令: 执行指令结果返回到驱动管理错误")
-					}
-				}
-			}()
-			gr := new(entity.GrpcResult)
-			runRes, err := c.driver.Run(newCtx, c.app, &entity.Command{
-				Table:    res.TableId,
-				Id:       res.Id,
-				SerialNo: res.SerialNo,
-				Command:  res.Command,
-			})
-			if err != nil {
-				gr.Error = err.Error()
-				gr.Code = 400
-			} else {
-				gr.Result = runRes
-				gr.Code = 200
-			}
-			bts, _ := json.Marshal(gr)
-			if err := stream.Send(&pb.RunResult{
-				Request: res.Request,
-				Message: bts,
-			}); err != nil {
-				errCtx := logger.NewErrorContext(newCtx, err)
-				logger.WithContext(errCtx).Errorf("执行指令: 执行指令结果返回到驱动管理错误")
-			}
-		}(res)
-	}
+	return serveStream(ctx, c, streamHandler[*pb.RunRequest, *pb.RunResult]{
+		open: func(ctx context.Context) (streamConn[*pb.RunRequest, *pb.RunResult], error) {
+			return c.cli.RunStream(c.streamContext(ctx, sessionId))
+		},
+		id:   "run",
+		name: "执行指令",
+		key:  deviceKey,
+		context: func(ctx context.Context, req *pb.RunRequest) context.Context {
+			return logger.NewTDMContext(ctx, req.TableId, req.Id, entity.MODULE_RUN)
+		},
+		handle: func(ctx context.Context, req *pb.RunRequest) (interface{}, error) {
+			logger.WithContext(ctx).Debugf("执行指令: 设备表=%s,设备=%s,指令=%s", req.TableId, req.Id, req.Command)
+			cmd := &entity.Command{
+				Table:    req.TableId,
+				Id:       req.Id,
+				SerialNo: req.SerialNo,
+				Command:  req.Command,
+			}
+			if Cfg.Command.Enable {
+				// 驱动管理下发的指令没有指令ID,只按流水号写指令日志
+				return c.app.SubmitCommand(ctx, "", cmd)
+			}
+			return c.driver.Run(ctx, c.app, cmd)
+		},
+		reply: func(request string, data []byte) *pb.RunResult {
+			return &pb.RunResult{Request: request, Message: data}
+		},
+	})
 }
 
 func (c *Client) WriteTagStream(ctx context.Context, sessionId string) error {
-	stream, err := c.cli.WriteTagStream(dGrpc.GetGrpcContext(ctx, Cfg.ServiceID, Cfg.Project, Cfg.Driver.ID, Cfg.Driver.Name, sessionId))
-	if err != nil {
-		return err
-	}
-	//hCtx, hCancel := context.WithCancel(ctx)
-	//ch := make(chan struct{}, 1)
-	defer func() {
-		//hCancel()
-		atomic.AddInt32(&c.streamCount, -1)
-		if err := stream.CloseSend(); err != nil {
-			errCtx := logger.NewErrorContext(ctx, err)
-			logger.WithContext(errCtx).Errorf("写数据点: stream关闭错误")
-		}
-	}()
-	logger.WithContext(ctx).Infof("写数据点: stream连接成功")
-	atomic.AddInt32(&c.streamCount, 1)
-	//go func() {
-	//	for {
-	//		select {
-	//		case <-hCtx.Done():
-	//			logger.WithContext(hCtx).Infof("写数据点stream心跳停止")
-	//			return
-	//		default:
-	//			time.Sleep(Cfg.DriverGrpc.Stream.Heartbeat)
-	//			logger.WithContext(hCtx).Debugf("写数据点stream心跳开始")
-	//			if err := stream.Send(&pb.RunResult{
-	//				Request: STREAM_HEARTBEAT,
-	//			}); err != nil {
-	//				logger.WithContext(logger.NewErrorContext(hCtx, err)).Errorf("写数据点stream心跳发送错误")
-	//				//if err := stream.CloseSend(); err != nil {
-	//				//	errCtx := logger.NewErrorContext(ctx, err)
-	//				//	logger.WithContext(errCtx).Errorf("写数据点stream心跳发送错误: 关闭stream错误")
-	//				//}
-	//				c.close(ctx)
-	//				return
-	//			}
-	//			select {
-	//			case <-hCtx.Done():
-	//				logger.WithContext(hCtx).Infof("写数据点stream心跳停止")
-	//				return
-	//			case <-time.After(Cfg.DriverGrpc.Stream.Heartbeat * 3):
-	//				logger.WithContext(hCtx).Errorf("写数据点stream心跳超时")
-	//				if err := stream.CloseSend(); err != nil {
-	//					logger.WithContext(hCtx).Errorf("写数据点stream心跳超时: 关闭stream错误")
-	//				}
-	//				return
-	//			case <-ch:
-	//				logger.WithContext(hCtx).Debugf("写数据点stream收到心跳响应")
-	//			}
-	//		}
-	//	}
-	//}()
-	for {
-		res, err := stream.Recv()
-		if err != nil {
-			return err
-		}
-		go func(res *pb.RunRequest) {
-			if res.GetRequest() == STREAM_HEARTBEAT {
-				//logger.WithContext(hCtx).Debugf("写数据点stream收到心跳响应包输入到管道")
-				//ch <- struct{}{}
-				return
-			}
-			newCtx, cancel := context.WithTimeout(context.Background(), Cfg.DriverGrpc.Timeout)
-			defer cancel()
-			newCtx = logger.NewTDMContext(newCtx, res.TableId, res.Id, entity.MODULE_WRITETAG)
-			if Cfg.GroupID != "" {
-				newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
-			}
-			logger.WithContext(newCtx).Debugf("写数据点: 设备表=%s,设备=%s,指令=%s", res.TableId, res.Id, res.Command)
-			defer func() {
-				if errR := recover(); errR != nil {
-					var errStr string
-					switch v := errR.(type) {
-					case error:
-						errStr = v.Error()
-						logger.Errorf("%+v", errors.WithStack(v))
-					default:
-						errStr = fmt.Sprintf("%v", v)
-						logger.Errorln(v)
-					}
-					gr := new(entity.GrpcResult)
-					gr.Error = errStr
-					gr.Code = 400
-					bts, _ := json.Marshal(gr)
-					if err := stream.Send(&pb.RunResult{
-						Request: res.Request,
-						Message: bts,
-					}); err != nil {
-						errCtx := logger.NewErrorContext(newCtx, err)
-						logger.WithContext(errCtx).Errorf("写数据点: 写数据点执行结果返回到驱动管理错误")
-					}
-				}
-			}()
-			gr := new(entity.GrpcResult)
-			runRes, err := c.driver.WriteTag(newCtx, c.app, &entity.Command{
-				Table:    res.TableId,
-				Id:       res.Id,
-				SerialNo: res.SerialNo,
-				Command:  res.Command,
+	return serveStream(ctx, c, streamHandler[*pb.RunRequest, *pb.RunResult]{
+		open: func(ctx context.Context) (streamConn[*pb.RunRequest, *pb.RunResult], error) {
+			return c.cli.WriteTagStream(c.streamContext(ctx, sessionId))
+		},
+		id:   "writeTag",
+		name: "写数据点",
+		key:  deviceKey,
+		context: func(ctx context.Context, req *pb.RunRequest) context.Context {
+			return logger.NewTDMContext(ctx, req.TableId, req.Id, entity.MODULE_WRITETAG)
+		},
+		handle: func(ctx context.Context, req *pb.RunRequest) (interface{}, error) {
+			logger.WithContext(ctx).Debugf("写数据点: 设备表=%s,设备=%s,指令=%s", req.TableId, req.Id, req.Command)
+			return c.driver.WriteTag(ctx, c.app, &entity.Command{
+				Table:    req.TableId,
+				Id:       req.Id,
+				SerialNo: req.SerialNo,
+				Command:  req.Command,
 			})
-			if err != nil {
-				gr.Error = err.Error()
-				gr.Code = 400
-			} else {
-				gr.Result = runRes
-				gr.Code = 200
-			}
-			bts, _ := json.Marshal(gr)
-			if err := stream.Send(&pb.RunResult{
-				Request: res.Request,
-				Message: bts,
-			}); err != nil {
-				errCtx := logger.NewErrorContext(newCtx, err)
-				logger.WithContext(errCtx).Errorf("写数据点: 写数据点执行结果返回到驱动管理错误")
-			}
-		}(res)
-	}
+		},
+		reply: func(request string, data []byte) *pb.RunResult {
+			return &pb.RunResult{Request: request, Message: data}
+		},
+	})
 }
 
 func (c *Client) BatchRunStream(ctx context.Context, sessionId string) error {
-	stream, err := c.cli.BatchRunStream(dGrpc.GetGrpcContext(ctx, Cfg.ServiceID, Cfg.Project, Cfg.Driver.ID, Cfg.Driver.Name, sessionId))
-	if err != nil {
-		return err
-	}
-	//hCtx, hCancel := context.WithCancel(ctx)
-	//ch := make(chan struct{}, 1)
-	defer func() {
-		//hCancel()
-		atomic.AddInt32(&c.streamCount, -1)
-		if err := stream.CloseSend(); err != nil {
-			errCtx := logger.NewErrorContext(ctx, err)
-			logger.WithContext(errCtx).Errorf("批量执行指令: stream关闭错误")
-		}
-	}()
-	logger.WithContext(ctx).Infof("批量执行指令: stream连接成功")
-	atomic.AddInt32(&c.streamCount, 1)
-	//go func() {
-	//	for {
-	//		select {
-	//		case <-hCtx.Done():
-	//			logger.WithContext(hCtx).Infof("批量执行指令stream心跳停止")
-	//			return
-	//		default:
-	//			time.Sleep(Cfg.DriverGrpc.Stream.Heartbeat)
-	//			logger.WithContext(hCtx).Debugf("批量执行指令stream心跳开始")
-	//			if err := stream.Send(&pb.BatchRunResult{
-	//				Request: STREAM_HEARTBEAT,
-	//			}); err != nil {
-	//				logger.WithContext(logger.NewErrorContext(hCtx, err)).Errorf("批量执行指令stream心跳发送错误")
-	//				//if err := stream.CloseSend(); err != nil {
-	//				//	errCtx := logger.NewErrorContext(ctx, err)
-	//				//	logger.WithContext(errCtx).Errorf("批量执行指令stream心跳发送错误: 关闭stream错误")
-	//				//}
-	//				c.close(ctx)
-	//				return
-	//			}
-	//			select {
-	//			case <-hCtx.Done():
-	//				logger.WithContext(hCtx).Infof("批量执行指令stream心跳停止")
-	//				return
-	//			case <-time.After(Cfg.DriverGrpc.Stream.Heartbeat * 3):
-	//				logger.WithContext(hCtx).Errorf("批量执行指令stream心跳超时")
-	//				if err := stream.CloseSend(); err != nil {
-	//					logger.WithContext(hCtx).Errorf("批量执行指令stream心跳超时: 关闭stream错误")
-	//				}
-	//				return
-	//			case <-ch:
-	//				logger.WithContext(hCtx).Debugf("批量执行指令stream收到心跳响应")
-	//			}
-	//		}
-	//	}
-	//}()
-	for {
-		res, err := stream.Recv()
-		if err != nil {
-			return err
-		}
-		go func(res *pb.BatchRunRequest) {
-			if res.GetRequest() == STREAM_HEARTBEAT {
-				//logger.WithContext(hCtx).Debugf("批量执行指令stream收到心跳响应包输入到管道")
-				//ch <- struct{}{}
-				return
-			}
-			newCtx, cancel := context.WithTimeout(context.Background(), Cfg.DriverGrpc.Timeout)
-			defer cancel()
-			newCtx = logger.NewModuleContext(newCtx, entity.MODULE_BATCHRUN)
-			if Cfg.GroupID != "" {
-				newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
-			}
-			newCtx = logger.NewTableContext(newCtx, res.TableId)
-			logger.WithContext(newCtx).Debugf("批量执行指令: 设备表=%s,设备=%+v,指令=%s", res.TableId, res.Id, res.Command)
-			defer func() {
-				if errR := recover(); errR != nil {
-					var errStr string
-					switch v := errR.(type) {
-					case error:
-						errStr = v.Error()
-						logger.Errorf("%+v", errors.WithStack(v))
-					default:
-						errStr = fmt.Sprintf("%v", v)
-						logger.Errorln(v)
-					}
-					gr := new(entity.GrpcResult)
-					gr.Error = errStr
-					gr.Code = 400
-					bts, _ := json.Marshal(gr)
-					if err := stream.Send(&pb.BatchRunResult{
-						Request: res.Request,
-						Message: bts,
-					}); err != nil {
-						errCtx := logger.NewErrorContext(newCtx, err)
-						logger.WithContext(errCtx).Errorf("批量执行指令: 批量执行指令结果返回到驱动管理错误")
-					}
-				}
-			}()
-			gr := new(entity.GrpcResult)
-			runRes, err := c.driver.BatchRun(newCtx, c.app, &entity.BatchCommand{
-				Table:    res.TableId,
-				Ids:      res.Id,
-				SerialNo: res.SerialNo,
-				Command:  res.Command,
+	return serveStream(ctx, c, streamHandler[*pb.BatchRunRequest, *pb.BatchRunResult]{
+		open: func(ctx context.Context) (streamConn[*pb.BatchRunRequest, *pb.BatchRunResult], error) {
+			return c.cli.BatchRunStream(c.streamContext(ctx, sessionId))
+		},
+		id:   "batchRun",
+		name: "批量执行指令",
+		context: func(ctx context.Context, req *pb.BatchRunRequest) context.Context {
+			return logger.NewTableContext(logger.NewModuleContext(ctx, entity.MODULE_BATCHRUN), req.TableId)
+		},
+		handle: func(ctx context.Context, req *pb.BatchRunRequest) (interface{}, error) {
+			logger.WithContext(ctx).Debugf("批量执行指令: 设备表=%s,设备=%+v,指令=%s", req.TableId, req.Id, req.Command)
+			return c.driver.BatchRun(ctx, c.app, &entity.BatchCommand{
+				Table:    req.TableId,
+				Ids:      req.Id,
+				SerialNo: req.SerialNo,
+				Command:  req.Command,
 			})
-			if err != nil {
-				gr.Error = err.Error()
-				gr.Code = 400
-			} else {
-				gr.Result = runRes
-				gr.Code = 200
-			}
-			bts, _ := json.Marshal(gr)
-			if err := stream.Send(&pb.BatchRunResult{
-				Request: res.Request,
-				Message: bts,
-			}); err != nil {
-				errCtx := logger.NewErrorContext(newCtx, err)
-				logger.WithContext(errCtx).Errorf("批量执行指令: 批量执行指令结果返回到驱动管理错误")
-			}
-		}(res)
-	}
+		},
+		reply: func(request string, data []byte) *pb.BatchRunResult {
+			return &pb.BatchRunResult{Request: request, Message: data}
+		},
+	})
 }
 
 func (c *Client) DebugStream(ctx context.Context, sessionId string) error {
-	stream, err := c.cli.DebugStream(dGrpc.GetGrpcContext(ctx, Cfg.ServiceID, Cfg.Project, Cfg.Driver.ID, Cfg.Driver.Name, sessionId))
-	if err != nil {
-		return err
-	}
-	//hCtx, hCancel := context.WithCancel(ctx)
-	//ch := make(chan struct{}, 1)
-	defer func() {
-		//hCancel()
-		atomic.AddInt32(&c.streamCount, -1)
-		if err := stream.CloseSend(); err != nil {
-			errCtx := logger.NewErrorContext(ctx, err)
-			logger.WithContext(errCtx).Errorf("调试: stream关闭错误")
-		}
-	}()
-	logger.WithContext(ctx).Infof("调试: stream连接成功")
-	atomic.AddInt32(&c.streamCount, 1)
-	//go func() {
-	//	for {
-	//		select {
-	//		case <-hCtx.Done():
-	//			logger.WithContext(hCtx).Infof("调试stream心跳停止")
-	//			return
-	//		default:
-	//			time.Sleep(Cfg.DriverGrpc.Stream.Heartbeat)
-	//			logger.WithContext(hCtx).Debugf("调试stream心跳开始")
-	//			if err := stream.Send(&pb.Debug{
-	//				Request: STREAM_HEARTBEAT,
-	//			}); err != nil {
-	//				logger.WithContext(logger.NewErrorContext(hCtx, err)).Errorf("调试stream心跳发送错误")
-	//				//if err := stream.CloseSend(); err != nil {
-	//				//	errCtx := logger.NewErrorContext(ctx, err)
-	//				//	logger.WithContext(errCtx).Errorf("调试stream心跳发送错误: 关闭stream错误")
-	//				//}
-	//				c.close(ctx)
-	//				return
-	//			}
-	//			select {
-	//			case <-hCtx.Done():
-	//				logger.WithContext(hCtx).Infof("调试stream心跳停止")
-	//				return
-	//			case <-time.After(Cfg.DriverGrpc.Stream.Heartbeat * 3):
-	//				logger.WithContext(hCtx).Errorf("调试stream心跳超时")
-	//				if err := stream.CloseSend(); err != nil {
-	//					logger.WithContext(hCtx).Errorf("调试stream心跳超时: 关闭stream错误")
-	//				}
-	//				return
-	//			case <-ch:
-	//				logger.WithContext(hCtx).Debugf("调试stream收到心跳响应")
-	//			}
-	//
-	//		}
-	//	}
-	//}()
-	for {
-		res, err := stream.Recv()
-		if err != nil {
-			return err
-		}
-		go func(res *pb.Debug) {
-			if res.GetRequest() == STREAM_HEARTBEAT {
-				//logger.WithContext(hCtx).Debugf("调试stream收到心跳响应包输入到管道")
-				//ch <- struct{}{}
-				return
-			}
-			newCtx, cancel := context.WithTimeout(context.Background(), Cfg.DriverGrpc.Timeout)
-			defer cancel()
-			newCtx = logger.NewModuleContext(newCtx, entity.MODULE_DEBUG)
-			if Cfg.GroupID != "" {
-				newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
-			}
-			logger.WithContext(newCtx).Debugf("调试: 请求数据=%s", res.Data)
-			defer func() {
-				if errR := recover(); errR != nil {
-					var errStr string
-					switch v := errR.(type) {
-					case error:
-						errStr = v.Error()
-						logger.Errorf("%+v", errors.WithStack(v))
-					default:
-						errStr = fmt.Sprintf("%v", v)
-						logger.Errorln(v)
-					}
-					gr := new(entity.GrpcResult)
-					gr.Error = errStr
-					gr.Code = 400
-					bts, _ := json.Marshal(gr)
-					if err := stream.Send(&pb.Debug{
-						Request: res.Request,
-						Data:    bts,
-					}); err != nil {
-						errCtx := logger.NewErrorContext(newCtx, err)
-						logger.WithContext(errCtx).Errorf("调试: 调试结果返回到驱动管理错误")
-					}
-				}
-			}()
-			runRes, err := c.driver.Debug(newCtx, c.app, res.Data)
-			gr := new(entity.GrpcResult)
-			if err != nil {
-				gr.Error = err.Error()
-				gr.Code = 400
-			} else {
-				gr.Result = runRes
-				gr.Code = 200
-			}
-			bts, _ := json.Marshal(gr)
-			if err := stream.Send(&pb.Debug{
-				Request: res.Request,
-				Data:    bts,
-			}); err != nil {
-				errCtx := logger.NewErrorContext(newCtx, err)
-				logger.WithContext(errCtx).Errorf("调试: 调试结果返回到驱动管理错误")
-			}
-		}(res)
-	}
+	return serveStream(ctx, c, streamHandler[*pb.Debug, *pb.Debug]{
+		open: func(ctx context.Context) (streamConn[*pb.Debug, *pb.Debug], error) {
+			return c.cli.DebugStream(c.streamContext(ctx, sessionId))
+		},
+		id:     "debug",
+		name:   "调试",
+		module: entity.MODULE_DEBUG,
+		handle: func(ctx context.Context, req *pb.Debug) (interface{}, error) {
+			logger.WithContext(ctx).Debugf("调试: 请求数据=%s", req.Data)
+			return c.driver.Debug(ctx, c.app, req.Data)
+		},
+		reply: func(request string, data []byte) *pb.Debug {
+			return &pb.Debug{Request: request, Data: data}
+		},
+	})
 }
 
 func (c *Client) HttpProxyStream(ctx context.Context, sessionId string) error {
-	stream, err := c.cli.HttpProxyStream(dGrpc.GetGrpcContext(ctx, Cfg.ServiceID, Cfg.Project, Cfg.Driver.ID, Cfg.Driver.Name, sessionId))
-	if err != nil {
-		return err
-	}
-	//hCtx, hCancel := context.WithCancel(ctx)
-	//ch := make(chan struct{}, 1)
-	defer func() {
-		//hCancel()
-		atomic.AddInt32(&c.streamCount, -1)
-		if err := stream.CloseSend(); err != nil {
-			errCtx := logger.NewErrorContext(ctx, err)
-			logger.WithContext(errCtx).Errorf("httpProxy: stream关闭错误")
-		}
-	}()
-	logger.WithContext(ctx).Infof("httpProxy: stream连接成功")
-	atomic.AddInt32(&c.streamCount, 1)
-	//go func() {
-	//	for {
-	//		select {
-	//		case <-hCtx.Done():
-	//			logger.WithContext(hCtx).Infof("httpProxy stream心跳停止")
-	//			return
-	//		default:
-	//			time.Sleep(Cfg.DriverGrpc.Stream.Heartbeat)
-	//			logger.WithContext(hCtx).Debugf("httpProxy stream心跳开始")
-	//			if err := stream.Send(&pb.HttpProxyResult{
-	//				Request: STREAM_HEARTBEAT,
-	//			}); err != nil {
-	//				logger.WithContext(logger.NewErrorContext(hCtx, err)).Errorf("httpProxy stream心跳发送错误")
-	//				//if err := stream.CloseSend(); err != nil {
-	//				//	errCtx := logger.NewErrorContext(ctx, err)
-	//				//	logger.WithContext(errCtx).Errorf("httpProxy stream心跳发送错误: 关闭stream错误")
-	//				//}
-	//				c.close(ctx)
-	//				return
-	//			}
-	//			select {
-	//			case <-hCtx.Done():
-	//				logger.WithContext(hCtx).Infof("httpProxy stream心跳停止")
-	//				return
-	//			case <-time.After(Cfg.DriverGrpc.Stream.Heartbeat * 3):
-	//				logger.WithContext(hCtx).Errorf("httpProxy stream心跳超时")
-	//				if err := stream.CloseSend(); err != nil {
-	//					logger.WithContext(hCtx).Errorf("httpProxy stream心跳超时: 关闭stream错误")
-	//				}
-	//				return
-	//			case <-ch:
-	//				logger.WithContext(hCtx).Debugf("httpProxy stream收到心跳响应")
-	//			}
-	//		}
-	//	}
-	//}()
-	for {
-		res, err := stream.Recv()
-		if err != nil {
-			return err
-		}
-		go func(res *pb.HttpProxyRequest) {
-			if res.GetRequest() == STREAM_HEARTBEAT {
-				//logger.WithContext(hCtx).Debugf("httpProxy stream收到心跳响应包输入到管道")
-				//ch <- struct{}{}
-				return
-			}
+	return serveStream(ctx, c, streamHandler[*pb.HttpProxyRequest, *pb.HttpProxyResult]{
+		open: func(ctx context.Context) (streamConn[*pb.HttpProxyRequest, *pb.HttpProxyResult], error) {
+			return c.cli.HttpProxyStream(c.streamContext(ctx, sessionId))
+		},
+		id:     "httpProxy",
+		name:   "httpProxy",
+		module: entity.MODULE_HTTPPROXY,
+		handle: func(ctx context.Context, req *pb.HttpProxyRequest) (interface{}, error) {
+			logger.WithContext(ctx).Debugf("httpProxy: type=%s,header=%s,请求数据=%s", req.Type, req.Headers, req.Data)
 			var header http.Header
-			newCtx, cancel := context.WithTimeout(context.Background(), Cfg.DriverGrpc.Timeout)
-			defer cancel()
-			newCtx = logger.NewModuleContext(newCtx, entity.MODULE_HTTPPROXY)
-			if Cfg.GroupID != "" {
-				newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
-			}
-			logger.WithContext(newCtx).Debugf("httpProxy: type=%s,header=%s,请求数据=%s", res.Type, res.Headers, res.Data)
-			defer func() {
-				if errR := recover(); errR != nil {
-					var errStr string
-					switch v := errR.(type) {
-					case error:
-						errStr = v.Error()
-						logger.Errorf("%+v", errors.WithStack(v))
-					default:
-						errStr = fmt.Sprintf("%v", v)
-						logger.Errorln(v)
-					}
-					gr := new(entity.GrpcResult)
-					gr.Error = errStr
-					gr.Code = 400
-					bts, _ := json.Marshal(gr)
-					if err := stream.Send(&pb.HttpProxyResult{
-						Request: res.Request,
-						Data:    bts,
-					}); err != nil {
-						errCtx := logger.NewErrorContext(newCtx, err)
-						logger.WithContext(errCtx).Errorf("httpProxy: 请求结果返回到驱动管理错误")
-					}
-				}
-			}()
-			gr := new(entity.GrpcResult)
-			if res.GetHeaders() != nil {
-				if err := json.Unmarshal(res.GetHeaders(), &header); err != nil {
-					gr.Error = fmt.Sprintf("httpProxy流错误:%v", err)
-					gr.Code = 400
-				} else {
-					runRes, err := c.driver.HttpProxy(newCtx, c.app, res.GetType(), header, res.GetData())
-					if err != nil {
-						gr.Error = err.Error()
-						gr.Code = 400
-					} else {
-						gr.Result = runRes
-						gr.Code = 200
-					}
-				}
-			} else {
-				runRes, err := c.driver.HttpProxy(newCtx, c.app, res.GetType(), header, res.GetData())
-				if err != nil {
-					gr.Error = err.Error()
-					gr.Code = 400
-				} else {
-					gr.Result = runRes
-					gr.Code = 200
+			if req.GetHeaders() != nil {
+				if err := json.Unmarshal(req.GetHeaders(), &header); err != nil {
+					return nil, fmt.Errorf("httpProxy流错误:%v", err)
 				}
 			}
-			bts, _ := json.Marshal(gr)
-			if err := stream.Send(&pb.HttpProxyResult{
-				Request: res.Request,
-				Data:    bts,
-			}); err != nil {
-				errCtx := logger.NewErrorContext(newCtx, err)
-				logger.WithContext(errCtx).Errorf("httpProxy: 请求结果返回到驱动管理错误")
-			}
-		}(res)
-	}
+			return c.driver.HttpProxy(ctx, c.app, req.GetType(), header, req.GetData())
+		},
+		reply: func(request string, data []byte) *pb.HttpProxyResult {
+			return &pb.HttpProxyResult{Request: request, Data: data}
+		},
+	})
 }
@@ -0,0 +1,243 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/air-iot/logger"
+
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+)
+
+// ErrCommandQueueFull 设备的指令队列已满
+var ErrCommandQueueFull = errors.New("指令队列已满")
+
+// CommandConfig 指令执行配置
+type CommandConfig struct {
+	Enable     bool          `json:"enable" yaml:"enable"`         // 驱动管理下发的指令是否使用指令队列执行
+	Timeout    time.Duration `json:"timeout" yaml:"timeout"`       // 单次执行超时时间
+	Retry      int           `json:"retry" yaml:"retry"`           // 失败后重试次数
+	Backoff    time.Duration `json:"backoff" yaml:"backoff"`       // 首次重试等待时间,之后每次加倍
+	MaxBackoff time.Duration `json:"maxBackoff" yaml:"maxBackoff"` // 重试最大等待时间
+	QueueSize  int           `json:"queueSize" yaml:"queueSize"`   // 每个设备等待执行的指令数量上限
+}
+
+type commandResult struct {
+	result interface{}
+	err    error
+}
+
+type commandTask struct {
+	ctx    context.Context
+	id     string
+	cmd    *entity.Command
+	run    func(context.Context, *entity.Command) (interface{}, error)
+	result chan commandResult
+	// inflight 超时后仍在执行的Run,返回后才能执行同一设备的下一次指令
+	inflight chan commandResult
+}
+
+type commandQueue struct {
+	tasks chan *commandTask
+}
+
+// commandExecutor 同一设备的指令按顺序执行,执行失败时按退避时间重试,并更新指令状态和指令日志
+type commandExecutor struct {
+	app    *app
+	cfg    CommandConfig
+	lock   sync.Mutex
+	queues map[string]*commandQueue
+	wg     sync.WaitGroup
+}
+
+func newCommandExecutor(a *app, cfg CommandConfig) *commandExecutor {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = Cfg.DriverGrpc.Timeout
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Minute
+	}
+	if cfg.Retry < 0 {
+		cfg.Retry = 0
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = time.Second
+	}
+	if cfg.MaxBackoff < cfg.Backoff {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 100
+	}
+	return &commandExecutor{app: a, cfg: cfg, queues: make(map[string]*commandQueue)}
+}
+
+// submit 把指令加入设备队列并等待执行结果. id为指令ID,不为空时更新指令状态
+func (e *commandExecutor) submit(ctx context.Context, id string, cmd *entity.Command, run func(context.Context, *entity.Command) (interface{}, error)) (interface{}, error) {
+	task := &commandTask{ctx: ctx, id: id, cmd: cmd, run: run, result: make(chan commandResult, 1)}
+	key := cmd.Table + "/" + cmd.Id
+	e.report(ctx, task, entity.COMMAND_STATUS_READY, nil, "指令等待执行")
+	e.lock.Lock()
+	q, ok := e.queues[key]
+	if !ok {
+		q = &commandQueue{tasks: make(chan *commandTask, e.cfg.QueueSize)}
+		e.queues[key] = q
+		e.wg.Add(1)
+		go e.worker(key, q)
+	}
+	select {
+	case q.tasks <- task:
+	default:
+		e.lock.Unlock()
+		err := fmt.Errorf("%w: 设备表=%s,设备=%s", ErrCommandQueueFull, cmd.Table, cmd.Id)
+		e.report(ctx, task, entity.COMMAND_STATUS_FAIL, nil, err.Error())
+		return nil, err
+	}
+	e.lock.Unlock()
+	res := <-task.result
+	return res.result, res.err
+}
+
+// worker 顺序执行设备队列中的指令,队列为空时退出
+func (e *commandExecutor) worker(key string, q *commandQueue) {
+	defer e.wg.Done()
+	for {
+		e.lock.Lock()
+		select {
+		case task := <-q.tasks:
+			e.lock.Unlock()
+			e.execute(task)
+			e.waitInflight(task)
+		default:
+			delete(e.queues, key)
+			e.lock.Unlock()
+			return
+		}
+	}
+}
+
+func (e *commandExecutor) execute(task *commandTask) {
+	var (
+		result interface{}
+		err    error
+	)
+	backoff := e.cfg.Backoff
+	for attempt := 0; attempt <= e.cfg.Retry; attempt++ {
+		if task.ctx.Err() != nil {
+			err = task.ctx.Err()
+			break
+		}
+		result, err = e.runOnce(task)
+		if err == nil {
+			e.report(task.ctx, task, entity.COMMAND_STATUS_SUCCESS, result, "指令执行成功")
+			task.result <- commandResult{result: result}
+			return
+		}
+		if attempt == e.cfg.Retry {
+			break
+		}
+		e.report(task.ctx, task, entity.COMMAND_STATUS_READY, nil, fmt.Sprintf("第%d次执行失败,%s后重试: %v", attempt+1, backoff, err))
+		select {
+		case <-task.ctx.Done():
+		case <-time.After(backoff):
+		}
+		e.waitInflight(task)
+		if backoff *= 2; backoff > e.cfg.MaxBackoff {
+			backoff = e.cfg.MaxBackoff
+		}
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		e.report(context.Background(), task, entity.COMMAND_STATUS_TIMEOUT, nil, fmt.Sprintf("指令执行超时: %v", err))
+	case errors.Is(err, context.Canceled):
+		e.report(context.Background(), task, entity.COMMAND_STATUS_REVOKE, nil, fmt.Sprintf("指令已撤回: %v", err))
+	default:
+		e.report(task.ctx, task, entity.COMMAND_STATUS_FAIL, nil, fmt.Sprintf("指令执行失败: %v", err))
+	}
+	task.result <- commandResult{err: err}
+}
+
+// runOnce 执行一次指令,超时或panic时返回错误. 超时后不等待Run返回,记录到task.inflight
+func (e *commandExecutor) runOnce(task *commandTask) (result interface{}, err error) {
+	ctx, cancel := context.WithTimeout(task.ctx, e.cfg.Timeout)
+	defer cancel()
+	done := make(chan commandResult, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- commandResult{err: fmt.Errorf("指令执行异常: %v", r)}
+			}
+		}()
+		res, err := task.run(ctx, task.cmd)
+		done <- commandResult{result: res, err: err}
+	}()
+	select {
+	case res := <-done:
+		return res.result, res.err
+	case <-ctx.Done():
+		task.inflight = done
+		return nil, ctx.Err()
+	}
+}
+
+// waitInflight 等待超时后仍在执行的Run返回,保证同一设备同时只执行一个指令
+func (e *commandExecutor) waitInflight(task *commandTask) {
+	if task.inflight == nil {
+		return
+	}
+	logger.Warnf("执行指令: 设备表=%s,设备=%s. 等待超时的指令返回", task.cmd.Table, task.cmd.Id)
+	<-task.inflight
+	task.inflight = nil
+}
+
+// report 更新指令状态和指令日志,错误只记录日志
+func (e *commandExecutor) report(ctx context.Context, task *commandTask, status entity.CommandStatus, result interface{}, desc string) {
+	if ctx.Err() != nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, Cfg.MQ.Timeout)
+	defer cancel()
+	if task.id != "" && status != entity.COMMAND_STATUS_READY {
+		if err := e.app.UpdateCommand(ctx, task.id, entity.DriverInstruct{ID: task.id, Status: status, RunResult: result}); err != nil {
+			logger.Errorf("执行指令: 设备表=%s,设备=%s,指令=%s,状态=%s. 更新指令状态错误: %v", task.cmd.Table, task.cmd.Id, task.id, status, err)
+		}
+	}
+	if task.cmd.SerialNo != "" {
+		if err := e.app.RunLog(ctx, entity.Log{SerialNo: task.cmd.SerialNo, Status: string(status), UnixTime: time.Now().UnixMilli(), Desc: desc}); err != nil {
+			logger.Errorf("执行指令: 设备表=%s,设备=%s,流水号=%s,状态=%s. 写指令日志错误: %v", task.cmd.Table, task.cmd.Id, task.cmd.SerialNo, status, err)
+		}
+	}
+}
+
+// wait 等待正在执行和等待执行的指令完成
+func (e *commandExecutor) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SubmitCommand 使用指令队列执行指令. 同一设备的指令按顺序执行,失败时重试,
+// 执行过程中更新指令状态(id不为空时)和指令日志(流水号不为空时)
+func (a *app) SubmitCommand(ctx context.Context, id string, cmd *entity.Command) (interface{}, error) {
+	if cmd == nil || cmd.Table == "" || cmd.Id == "" {
+		return nil, fmt.Errorf("指令设备表或设备为空")
+	}
+	if a.commands == nil || a.cli == nil || a.cli.driver == nil {
+		return nil, fmt.Errorf("驱动未启动")
+	}
+	d := a.cli.driver
+	return a.commands.submit(ctx, id, cmd, func(ctx context.Context, cmd *entity.Command) (interface{}, error) {
+		return d.Run(ctx, a, cmd)
+	})
+}
@@ -1,10 +1,16 @@
 package driver
 
 import (
+	"time"
+
 	"github.com/air-iot/logger"
 	"github.com/air-iot/sdk-go/v4/conn/mq"
+	"github.com/air-iot/sdk-go/v4/driver/buffer"
 	"github.com/air-iot/sdk-go/v4/driver/grpc"
 	"github.com/air-iot/sdk-go/v4/etcd"
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
+	"github.com/air-iot/sdk-go/v4/utils/probe"
+	"github.com/air-iot/sdk-go/v4/utils/tracing"
 )
 
 // Cfg 全局配置(需要先执行MustLoad，否则拿不到配置)
@@ -26,6 +32,16 @@ type Config struct {
 		Host   string `json:"host" yaml:"host"`
 		Port   string `json:"port" yaml:"port"`
 	} `json:"pprof" yaml:"pprof"`
-	EtcdConfig string      `json:"etcdConfig" yaml:"etcdConfig"`
-	Etcd       etcd.Config `json:"etcd" yaml:"etcd"`
+	EtcdConfig   string             `json:"etcdConfig" yaml:"etcdConfig"`
+	Etcd         etcd.Config        `json:"etcd" yaml:"etcd"`
+	Buffer       buffer.Config      `json:"buffer" yaml:"buffer"`
+	Batch        BatchConfig        `json:"batch" yaml:"batch"`
+	DeviceStatus DeviceStatusConfig `json:"deviceStatus" yaml:"deviceStatus"`
+	Command      CommandConfig      `json:"command" yaml:"command"`
+	Workers      WorkersConfig      `json:"workers" yaml:"workers"`
+	Metrics      metrics.Config     `json:"metrics" yaml:"metrics"`
+	Tracing      tracing.Config     `json:"tracing" yaml:"tracing"`
+	Probe        probe.Config       `json:"probe" yaml:"probe"`
+	// ShutdownTimeout 停止服务时等待请求处理完成的超时时间
+	ShutdownTimeout time.Duration `json:"shutdownTimeout" yaml:"shutdownTimeout"`
 }
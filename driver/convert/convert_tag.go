@@ -1,6 +1,8 @@
 package convert
 
 import (
+	"math"
+
 	"github.com/air-iot/sdk-go/v4/driver/entity"
 	"github.com/shopspring/decimal"
 )
@@ -8,30 +10,7 @@ import (
 func Value(tagTemp *entity.Tag, raw decimal.Decimal) (val decimal.Decimal) {
 	var value = raw
 	if tagTemp.TagValue != nil {
-		if tagTemp.TagValue.MinRaw != nil {
-			minRaw := decimal.NewFromFloat(*tagTemp.TagValue.MinRaw)
-			if value.LessThan(minRaw) {
-				value = minRaw
-			}
-		}
-
-		if tagTemp.TagValue.MaxRaw != nil {
-			maxRaw := decimal.NewFromFloat(*tagTemp.TagValue.MaxRaw)
-			if value.GreaterThan(maxRaw) {
-				value = maxRaw
-			}
-		}
-
-		if tagTemp.TagValue.MinRaw != nil && tagTemp.TagValue.MaxRaw != nil && tagTemp.TagValue.MinValue != nil && tagTemp.TagValue.MaxValue != nil {
-			//value = (((rawTmp - minRaw) / (maxRaw - minRaw)) * (maxValue - minValue)) + minValue
-			minRaw := decimal.NewFromFloat(*tagTemp.TagValue.MinRaw)
-			maxRaw := decimal.NewFromFloat(*tagTemp.TagValue.MaxRaw)
-			minValue := decimal.NewFromFloat(*tagTemp.TagValue.MinValue)
-			maxValue := decimal.NewFromFloat(*tagTemp.TagValue.MaxValue)
-			if !maxRaw.Equal(minRaw) {
-				value = raw.Sub(minRaw).Div(maxRaw.Sub(minRaw)).Mul(maxValue.Sub(minValue)).Add(minValue)
-			}
-		}
+		value = tagValue(tagTemp.TagValue, raw)
 	}
 
 	if tagTemp.Fixed != nil {
@@ -45,6 +24,36 @@ func Value(tagTemp *entity.Tag, raw decimal.Decimal) (val decimal.Decimal) {
 	return value
 }
 
+// tagValue 按原始值范围限幅,配置了完整的原始值和工程值范围时线性转换
+func tagValue(tv *entity.TagValue, raw decimal.Decimal) decimal.Decimal {
+	var value = raw
+	if tv.MinRaw != nil {
+		minRaw := decimal.NewFromFloat(*tv.MinRaw)
+		if value.LessThan(minRaw) {
+			value = minRaw
+		}
+	}
+
+	if tv.MaxRaw != nil {
+		maxRaw := decimal.NewFromFloat(*tv.MaxRaw)
+		if value.GreaterThan(maxRaw) {
+			value = maxRaw
+		}
+	}
+
+	if tv.MinRaw != nil && tv.MaxRaw != nil && tv.MinValue != nil && tv.MaxValue != nil {
+		//value = (((rawTmp - minRaw) / (maxRaw - minRaw)) * (maxValue - minValue)) + minValue
+		minRaw := decimal.NewFromFloat(*tv.MinRaw)
+		maxRaw := decimal.NewFromFloat(*tv.MaxRaw)
+		minValue := decimal.NewFromFloat(*tv.MinValue)
+		maxValue := decimal.NewFromFloat(*tv.MaxValue)
+		if !maxRaw.Equal(minRaw) {
+			value = raw.Sub(minRaw).Div(maxRaw.Sub(minRaw)).Mul(maxValue.Sub(minValue)).Add(minValue)
+		}
+	}
+	return value
+}
+
 func Range(tagRange *entity.Range, preVal, raw *decimal.Decimal) (newValue, rawValue *float64, invalidType string, isSave bool) {
 	if raw == nil {
 		return
@@ -514,3 +523,25 @@ loop:
 
 	return
 }
+
+// Deadband 判断值是否在死区内需要过滤. preVal为上次上报的值, elapsed为距上次上报的毫秒数.
+// 同时设置绝对死区和百分比死区时,两者都超过才上报;都未设置时值不变即过滤
+func Deadband(deadband *entity.Deadband, preVal, val float64, elapsed int64) bool {
+	if deadband == nil || (deadband.Enable != nil && !*deadband.Enable) {
+		return false
+	}
+	if deadband.MaxSilence != nil && *deadband.MaxSilence > 0 && elapsed >= *deadband.MaxSilence*1000 {
+		return false
+	}
+	diff := math.Abs(val - preVal)
+	if deadband.Absolute == nil && deadband.Percent == nil {
+		return diff == 0
+	}
+	if deadband.Absolute != nil && diff <= *deadband.Absolute {
+		return true
+	}
+	if deadband.Percent != nil && preVal != 0 && diff <= math.Abs(preVal)**deadband.Percent/100 {
+		return true
+	}
+	return diff == 0
+}
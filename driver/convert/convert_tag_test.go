@@ -78,3 +78,32 @@ func Test_ConvertRange_3(t *testing.T) {
 		t.Log(*gotRawValue)
 	}
 }
+
+func Test_Deadband(t *testing.T) {
+	abs, pct := 0.5, 10.0
+	silence := int64(60)
+	tests := []struct {
+		name     string
+		deadband entity.Deadband
+		pre, val float64
+		elapsed  int64
+		want     bool
+	}{
+		{"绝对死区内", entity.Deadband{Absolute: &abs}, 10, 10.4, 0, true},
+		{"超过绝对死区", entity.Deadband{Absolute: &abs}, 10, 10.6, 0, false},
+		{"百分比死区内", entity.Deadband{Percent: &pct}, 10, 10.9, 0, true},
+		{"超过百分比死区", entity.Deadband{Percent: &pct}, 10, 11.1, 0, false},
+		{"只超过百分比死区", entity.Deadband{Absolute: &abs, Percent: &pct}, 1, 1.2, 0, true},
+		{"值不变", entity.Deadband{}, 10, 10, 0, true},
+		{"值变化", entity.Deadband{}, 10, 10.01, 0, false},
+		{"超过最大静默时间", entity.Deadband{Absolute: &abs, MaxSilence: &silence}, 10, 10, 60000, false},
+		{"未超过最大静默时间", entity.Deadband{Absolute: &abs, MaxSilence: &silence}, 10, 10, 59999, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Deadband(&tt.deadband, tt.pre, tt.val, tt.elapsed); got != tt.want {
+				t.Errorf("Deadband() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
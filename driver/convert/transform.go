@@ -0,0 +1,457 @@
+package convert
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/air-iot/json"
+	"github.com/shopspring/decimal"
+
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+)
+
+// Transform 数据点值转换步骤
+type Transform interface {
+	Apply(value decimal.Decimal) (decimal.Decimal, error)
+}
+
+// TransformFunc 函数形式的Transform
+type TransformFunc func(value decimal.Decimal) (decimal.Decimal, error)
+
+func (f TransformFunc) Apply(value decimal.Decimal) (decimal.Decimal, error) {
+	return f(value)
+}
+
+// TransformFactory 根据数据点配置中的参数创建Transform
+type TransformFactory func(params map[string]interface{}) (Transform, error)
+
+const (
+	TransformScale      = "scale"
+	TransformPolynomial = "polynomial"
+	TransformLookup     = "lookup"
+	TransformBit        = "bit"
+	TransformOffset     = "offset"
+	TransformUnit       = "unit"
+	TransformClamp      = "clamp"
+	// TransformTagValue、TransformFixed、TransformMod 与数据点tagValue、fixed、mod配置相同的计算,
+	// 在transforms中使用时可以调整执行顺序
+	TransformTagValue = "tagValue"
+	TransformFixed    = "fixed"
+	TransformMod      = "mod"
+)
+
+var (
+	factoriesLock sync.RWMutex
+	factories     = map[string]TransformFactory{
+		TransformScale:      newScale,
+		TransformPolynomial: newPolynomial,
+		TransformLookup:     newLookup,
+		TransformBit:        newBit,
+		TransformOffset:     newOffset,
+		TransformUnit:       newUnit,
+		TransformClamp:      newClamp,
+		TransformTagValue:   newTagValue,
+		TransformFixed:      newFixed,
+		TransformMod:        newMod,
+	}
+)
+
+// RegisterTransform 注册自定义转换,注册后可以在数据点transforms配置中使用name. 名称重复时panic
+func RegisterTransform(name string, factory TransformFactory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	if factory == nil {
+		panic("convert: 注册转换 " + name + " 为空")
+	}
+	if _, ok := factories[name]; ok {
+		panic("convert: 转换 " + name + " 重复注册")
+	}
+	factories[name] = factory
+}
+
+// NewTransform 根据配置创建Transform
+func NewTransform(cfg entity.Transform) (Transform, error) {
+	factoriesLock.RLock()
+	factory, ok := factories[cfg.Type]
+	factoriesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("转换 %s 未注册", cfg.Type)
+	}
+	t, err := factory(cfg.Params)
+	if err != nil {
+		return nil, fmt.Errorf("转换 %s 参数错误: %w", cfg.Type, err)
+	}
+	return t, nil
+}
+
+// Pipeline 数据点的全部值转换步骤,创建后可以并发使用
+type Pipeline struct {
+	steps []pipelineStep
+}
+
+type pipelineStep struct {
+	name      string
+	transform Transform
+}
+
+// Compile 按数据点配置创建值转换. 没有配置transforms时按tagValue、fixed、mod的顺序计算,与Value相同.
+// 配置transforms时tagValue、mod在transforms之前执行,fixed在最后执行;
+// transforms中包含tagValue、fixed或mod时按其位置和参数执行,不再使用数据点上的同名配置
+func Compile(tag *entity.Tag) (*Pipeline, error) {
+	p := new(Pipeline)
+	if len(tag.Transforms) == 0 {
+		p.legacy(tag, nil, TransformTagValue, TransformFixed, TransformMod)
+		return p, nil
+	}
+	explicit := make(map[string]bool, len(tag.Transforms))
+	for _, cfg := range tag.Transforms {
+		explicit[cfg.Type] = true
+	}
+	p.legacy(tag, explicit, TransformTagValue, TransformMod)
+	for i, cfg := range tag.Transforms {
+		t, err := NewTransform(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("第%d个转换: %w", i+1, err)
+		}
+		p.steps = append(p.steps, pipelineStep{name: cfg.Type, transform: t})
+	}
+	p.legacy(tag, explicit, TransformFixed)
+	return p, nil
+}
+
+// legacy 添加数据点上tagValue、fixed、mod配置对应的转换,已在transforms中出现的跳过
+func (p *Pipeline) legacy(tag *entity.Tag, explicit map[string]bool, names ...string) {
+	for _, name := range names {
+		if explicit[name] {
+			continue
+		}
+		var t Transform
+		switch name {
+		case TransformTagValue:
+			if tag.TagValue != nil {
+				t = tagValueTransform(*tag.TagValue)
+			}
+		case TransformFixed:
+			if tag.Fixed != nil {
+				t = fixedTransform(*tag.Fixed)
+			}
+		case TransformMod:
+			if tag.Mod != nil {
+				t = modTransform(*tag.Mod)
+			}
+		}
+		if t != nil {
+			p.steps = append(p.steps, pipelineStep{name: name, transform: t})
+		}
+	}
+}
+
+// Apply 按顺序执行全部转换
+func (p *Pipeline) Apply(value decimal.Decimal) (decimal.Decimal, error) {
+	for _, step := range p.steps {
+		v, err := step.transform.Apply(value)
+		if err != nil {
+			return value, fmt.Errorf("转换 %s 错误: %w", step.name, err)
+		}
+		value = v
+	}
+	return value, nil
+}
+
+func decodeParams(params map[string]interface{}, v interface{}) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// newScale 线性转换, 参数minRaw、maxRaw、minValue、maxValue
+func newScale(params map[string]interface{}) (Transform, error) {
+	var p struct {
+		MinRaw   *float64 `json:"minRaw"`
+		MaxRaw   *float64 `json:"maxRaw"`
+		MinValue *float64 `json:"minValue"`
+		MaxValue *float64 `json:"maxValue"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.MinRaw == nil || p.MaxRaw == nil || p.MinValue == nil || p.MaxValue == nil {
+		return nil, fmt.Errorf("minRaw、maxRaw、minValue、maxValue不能为空")
+	}
+	if *p.MinRaw == *p.MaxRaw {
+		return nil, fmt.Errorf("minRaw与maxRaw不能相等")
+	}
+	minRaw, maxRaw := decimal.NewFromFloat(*p.MinRaw), decimal.NewFromFloat(*p.MaxRaw)
+	minValue, maxValue := decimal.NewFromFloat(*p.MinValue), decimal.NewFromFloat(*p.MaxValue)
+	return TransformFunc(func(value decimal.Decimal) (decimal.Decimal, error) {
+		return value.Sub(minRaw).Div(maxRaw.Sub(minRaw)).Mul(maxValue.Sub(minValue)).Add(minValue), nil
+	}), nil
+}
+
+// newPolynomial 多项式, 参数coefficients为从0次项开始的系数
+func newPolynomial(params map[string]interface{}) (Transform, error) {
+	var p struct {
+		Coefficients []float64 `json:"coefficients"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p.Coefficients) == 0 {
+		return nil, fmt.Errorf("coefficients不能为空")
+	}
+	coefficients := make([]decimal.Decimal, len(p.Coefficients))
+	for i, c := range p.Coefficients {
+		coefficients[i] = decimal.NewFromFloat(c)
+	}
+	return TransformFunc(func(value decimal.Decimal) (decimal.Decimal, error) {
+		// 秦九韶算法
+		ret := coefficients[len(coefficients)-1]
+		for i := len(coefficients) - 2; i >= 0; i-- {
+			ret = ret.Mul(value).Add(coefficients[i])
+		}
+		return ret, nil
+	}), nil
+}
+
+// newLookup 查表, 参数points为[原始值,转换值]列表, interpolate为false时取不大于原始值的最近点,
+// 默认线性插值. 超出范围时取端点的值
+func newLookup(params map[string]interface{}) (Transform, error) {
+	var p struct {
+		Points      [][2]float64 `json:"points"`
+		Interpolate *bool        `json:"interpolate"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p.Points) == 0 {
+		return nil, fmt.Errorf("points不能为空")
+	}
+	points := append([][2]float64(nil), p.Points...)
+	sort.Slice(points, func(i, j int) bool { return points[i][0] < points[j][0] })
+	interpolate := p.Interpolate == nil || *p.Interpolate
+	return TransformFunc(func(value decimal.Decimal) (decimal.Decimal, error) {
+		v, _ := value.Float64()
+		i := sort.Search(len(points), func(i int) bool { return points[i][0] > v })
+		switch {
+		case i == 0:
+			return decimal.NewFromFloat(points[0][1]), nil
+		case i == len(points) || !interpolate:
+			return decimal.NewFromFloat(points[i-1][1]), nil
+		}
+		x0, y0 := decimal.NewFromFloat(points[i-1][0]), decimal.NewFromFloat(points[i-1][1])
+		x1, y1 := decimal.NewFromFloat(points[i][0]), decimal.NewFromFloat(points[i][1])
+		return value.Sub(x0).Div(x1.Sub(x0)).Mul(y1.Sub(y0)).Add(y0), nil
+	}), nil
+}
+
+// newBit 位提取, 参数bit为起始位(从0开始), length为位数默认1
+func newBit(params map[string]interface{}) (Transform, error) {
+	var p struct {
+		Bit    int  `json:"bit"`
+		Length *int `json:"length"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	length := 1
+	if p.Length != nil {
+		length = *p.Length
+	}
+	if p.Bit < 0 || length < 1 || p.Bit+length > 64 {
+		return nil, fmt.Errorf("bit=%d,length=%d超出范围", p.Bit, length)
+	}
+	mask := uint64(1)<<uint(length) - 1
+	if length == 64 {
+		mask = math.MaxUint64
+	}
+	return TransformFunc(func(value decimal.Decimal) (decimal.Decimal, error) {
+		if !value.IsInteger() {
+			return value, fmt.Errorf("值 %s 不是整数", value)
+		}
+		v := uint64(value.IntPart())
+		return decimal.NewFromInt(int64((v >> uint(p.Bit)) & mask)), nil
+	}), nil
+}
+
+// newOffset 偏移, 参数value
+func newOffset(params map[string]interface{}) (Transform, error) {
+	var p struct {
+		Value *float64 `json:"value"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Value == nil {
+		return nil, fmt.Errorf("value不能为空")
+	}
+	offset := decimal.NewFromFloat(*p.Value)
+	return TransformFunc(func(value decimal.Decimal) (decimal.Decimal, error) {
+		return value.Add(offset), nil
+	}), nil
+}
+
+// units 单位换算到基本单位的系数,同一类单位的基本单位系数为1
+var units = map[string]struct {
+	kind   string
+	factor float64
+}{
+	"mm": {"length", 0.001}, "cm": {"length", 0.01}, "m": {"length", 1}, "km": {"length", 1000},
+	"in": {"length", 0.0254}, "ft": {"length", 0.3048},
+	"pa": {"pressure", 1}, "kpa": {"pressure", 1e3}, "mpa": {"pressure", 1e6}, "bar": {"pressure", 1e5},
+	"psi": {"pressure", 6894.757293168},
+	"w":   {"power", 1}, "kw": {"power", 1e3}, "mw": {"power", 1e6},
+	"wh": {"energy", 3600}, "kwh": {"energy", 3.6e6}, "mwh": {"energy", 3.6e9}, "j": {"energy", 1}, "kj": {"energy", 1e3},
+	"ms": {"time", 0.001}, "s": {"time", 1}, "min": {"time", 60}, "h": {"time", 3600},
+	"g": {"mass", 0.001}, "kg": {"mass", 1}, "t": {"mass", 1000},
+	"ml": {"volume", 0.001}, "l": {"volume", 1}, "m3": {"volume", 1000},
+}
+
+// newUnit 单位换算, 参数from、to. 温度支持c、f、k
+func newUnit(params map[string]interface{}) (Transform, error) {
+	var p struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	from, to := strings.ToLower(p.From), strings.ToLower(p.To)
+	if temperature(from) && temperature(to) {
+		return TransformFunc(func(value decimal.Decimal) (decimal.Decimal, error) {
+			return fromKelvin(to, toKelvin(from, value)), nil
+		}), nil
+	}
+	f, ok := units[from]
+	if !ok {
+		return nil, fmt.Errorf("不支持的单位 %s", p.From)
+	}
+	t, ok := units[to]
+	if !ok {
+		return nil, fmt.Errorf("不支持的单位 %s", p.To)
+	}
+	if f.kind != t.kind {
+		return nil, fmt.Errorf("单位 %s 不能转换为 %s", p.From, p.To)
+	}
+	factor := decimal.NewFromFloat(f.factor).Div(decimal.NewFromFloat(t.factor))
+	return TransformFunc(func(value decimal.Decimal) (decimal.Decimal, error) {
+		return value.Mul(factor), nil
+	}), nil
+}
+
+func temperature(unit string) bool {
+	return unit == "c" || unit == "f" || unit == "k"
+}
+
+var (
+	kelvin0 = decimal.NewFromFloat(273.15)
+	f32     = decimal.NewFromInt(32)
+	f9      = decimal.NewFromInt(9)
+	f5      = decimal.NewFromInt(5)
+)
+
+func toKelvin(unit string, value decimal.Decimal) decimal.Decimal {
+	switch unit {
+	case "c":
+		return value.Add(kelvin0)
+	case "f":
+		return value.Sub(f32).Mul(f5).Div(f9).Add(kelvin0)
+	}
+	return value
+}
+
+func fromKelvin(unit string, value decimal.Decimal) decimal.Decimal {
+	switch unit {
+	case "c":
+		return value.Sub(kelvin0)
+	case "f":
+		return value.Sub(kelvin0).Mul(f9).Div(f5).Add(f32)
+	}
+	return value
+}
+
+// newClamp 限幅, 参数min、max可只设置一个
+func newClamp(params map[string]interface{}) (Transform, error) {
+	var p struct {
+		Min *float64 `json:"min"`
+		Max *float64 `json:"max"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Min == nil && p.Max == nil {
+		return nil, fmt.Errorf("min、max不能都为空")
+	}
+	if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+		return nil, fmt.Errorf("min不能大于max")
+	}
+	return TransformFunc(func(value decimal.Decimal) (decimal.Decimal, error) {
+		if p.Min != nil {
+			value = decimal.Max(value, decimal.NewFromFloat(*p.Min))
+		}
+		if p.Max != nil {
+			value = decimal.Min(value, decimal.NewFromFloat(*p.Max))
+		}
+		return value, nil
+	}), nil
+}
+
+// newTagValue 与数据点tagValue配置相同, 参数minRaw、maxRaw、minValue、maxValue
+func newTagValue(params map[string]interface{}) (Transform, error) {
+	var tv entity.TagValue
+	if err := decodeParams(params, &tv); err != nil {
+		return nil, err
+	}
+	return tagValueTransform(tv), nil
+}
+
+func tagValueTransform(tv entity.TagValue) Transform {
+	return TransformFunc(func(value decimal.Decimal) (decimal.Decimal, error) {
+		return tagValue(&tv, value), nil
+	})
+}
+
+// newFixed 保留小数位数, 参数digits
+func newFixed(params map[string]interface{}) (Transform, error) {
+	var p struct {
+		Digits *int32 `json:"digits"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Digits == nil {
+		return nil, fmt.Errorf("digits不能为空")
+	}
+	return fixedTransform(*p.Digits), nil
+}
+
+func fixedTransform(digits int32) Transform {
+	return TransformFunc(func(value decimal.Decimal) (decimal.Decimal, error) {
+		return value.Round(digits), nil
+	})
+}
+
+// newMod 倍率, 参数value
+func newMod(params map[string]interface{}) (Transform, error) {
+	var p struct {
+		Value *float64 `json:"value"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Value == nil {
+		return nil, fmt.Errorf("value不能为空")
+	}
+	return modTransform(*p.Value), nil
+}
+
+func modTransform(mod float64) Transform {
+	factor := decimal.NewFromFloat(mod)
+	return TransformFunc(func(value decimal.Decimal) (decimal.Decimal, error) {
+		return value.Mul(factor), nil
+	})
+}
@@ -0,0 +1,116 @@
+package convert
+
+import (
+	"testing"
+
+	"github.com/air-iot/json"
+	"github.com/shopspring/decimal"
+
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+)
+
+func Test_Transforms(t *testing.T) {
+	tests := []struct {
+		name       string
+		transforms string
+		raw, want  float64
+	}{
+		{"线性", `[{"type":"scale","params":{"minRaw":0,"maxRaw":100,"minValue":0,"maxValue":10}}]`, 50, 5},
+		{"多项式", `[{"type":"polynomial","params":{"coefficients":[1,2,3]}}]`, 2, 17},
+		{"查表插值", `[{"type":"lookup","params":{"points":[[0,0],[10,100]]}}]`, 2.5, 25},
+		{"查表不插值", `[{"type":"lookup","params":{"points":[[0,0],[10,100]],"interpolate":false}}]`, 9, 0},
+		{"查表超出范围", `[{"type":"lookup","params":{"points":[[0,0],[10,100]]}}]`, 20, 100},
+		{"位提取", `[{"type":"bit","params":{"bit":2,"length":2}}]`, 0b1100, 3},
+		{"偏移", `[{"type":"offset","params":{"value":-1.5}}]`, 1, -0.5},
+		{"单位", `[{"type":"unit","params":{"from":"kWh","to":"Wh"}}]`, 1.5, 1500},
+		{"温度", `[{"type":"unit","params":{"from":"c","to":"f"}}]`, 100, 212},
+		{"限幅", `[{"type":"clamp","params":{"max":10}}]`, 11, 10},
+		{"顺序执行", `[{"type":"offset","params":{"value":1}},{"type":"polynomial","params":{"coefficients":[0,2]}}]`, 1, 4},
+		{"保留小数", `[{"type":"fixed","params":{"digits":1}}]`, 1.26, 1.3},
+		{"倍率", `[{"type":"mod","params":{"value":0.1}}]`, 12, 1.2},
+		{"工程值", `[{"type":"tagValue","params":{"minRaw":0,"maxRaw":100,"minValue":0,"maxValue":10}}]`, 50, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tag entity.Tag
+			if err := json.Unmarshal([]byte(`{"id":"a","transforms":`+tt.transforms+`}`), &tag); err != nil {
+				t.Fatal(err)
+			}
+			p, err := Compile(&tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.Apply(decimal.NewFromFloat(tt.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(decimal.NewFromFloat(tt.want)) {
+				t.Errorf("Apply() = %s, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_RegisterTransform(t *testing.T) {
+	RegisterTransform("test_double", func(map[string]interface{}) (Transform, error) {
+		return TransformFunc(func(value decimal.Decimal) (decimal.Decimal, error) {
+			return value.Mul(decimal.NewFromInt(2)), nil
+		}), nil
+	})
+	tag := entity.Tag{Transforms: []entity.Transform{{Type: "test_double"}}}
+	p, err := Compile(&tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.Apply(decimal.NewFromInt(3)); err != nil || !got.Equal(decimal.NewFromInt(6)) {
+		t.Fatalf("Apply() = %s, %v", got, err)
+	}
+	tag.Transforms = []entity.Transform{{Type: "unknown"}}
+	if _, err := Compile(&tag); err == nil {
+		t.Fatal("未注册的转换应返回错误")
+	}
+}
+
+func Test_CompileOrder(t *testing.T) {
+	fixed := int32(1)
+	mod := 10.0
+	tests := []struct {
+		name      string
+		tag       string
+		raw, want float64
+	}{
+		// 没有transforms时与Value相同,先保留小数再乘倍率
+		{"兼容", `{"fixed":1,"mod":10}`, 1.26, 13},
+		// transforms之前执行tagValue、mod,最后保留小数
+		{"保留小数最后执行", `{"fixed":1,"mod":10,"transforms":[{"type":"unit","params":{"from":"kWh","to":"Wh"}}]}`, 0.000126, 1.3},
+		{"指定位置", `{"fixed":1,"transforms":[{"type":"fixed","params":{"digits":0}},{"type":"offset","params":{"value":0.25}}]}`, 1.6, 2.25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tag entity.Tag
+			if err := json.Unmarshal([]byte(tt.tag), &tag); err != nil {
+				t.Fatal(err)
+			}
+			p, err := Compile(&tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.Apply(decimal.NewFromFloat(tt.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(decimal.NewFromFloat(tt.want)) {
+				t.Errorf("Apply() = %s, want %v", got, tt.want)
+			}
+		})
+	}
+	tag := entity.Tag{Fixed: &fixed, Mod: &mod}
+	p, err := Compile(&tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := decimal.NewFromFloat(1.26)
+	if got, _ := p.Apply(raw); !got.Equal(Value(&tag, raw)) {
+		t.Errorf("Apply() = %s, Value() = %s", got, Value(&tag, raw))
+	}
+}
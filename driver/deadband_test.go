@@ -0,0 +1,80 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
+)
+
+func TestApp_WritePointsDeadband(t *testing.T) {
+	Cfg.Project = "p"
+	Cfg.MQ.Timeout = time.Second
+	m := new(memMQ)
+	a := &app{mq: m, cli: &Client{}}
+	abs := 1.0
+	tag := entity.Tag{ID: "a", Deadband: &entity.Deadband{Absolute: &abs}}
+	suppressed := metrics.PointsDropped.WithLabelValues(metrics.DropSuppressed)
+	before := testutil.ToFloat64(suppressed)
+	for _, v := range []float64{1, 1.5, 2.5} {
+		if err := a.writePoints(context.Background(), "t", entity.Point{ID: "d1", Fields: []entity.Field{{Tag: tag, Value: v}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(m.published["data/p/t/d1"]); n != 2 {
+		t.Fatalf("发送次数 = %d, want 2", n)
+	}
+	if n := testutil.ToFloat64(suppressed) - before; n != 1 {
+		t.Fatalf("过滤数量 = %v, want 1", n)
+	}
+}
+
+func TestApp_WritePointsDeadbandFailed(t *testing.T) {
+	Cfg.Project = "p"
+	Cfg.MQ.Timeout = time.Second
+	abs := 1.0
+	tag := entity.Tag{ID: "a", Deadband: &entity.Deadband{Absolute: &abs}}
+	point := func(v float64) entity.Point {
+		return entity.Point{Table: "t", ID: "d1", Fields: []entity.Field{{Tag: tag, Value: v}}}
+	}
+
+	t.Run("writePoints", func(t *testing.T) {
+		m := &memMQ{err: errors.New("发送失败")}
+		a := &app{mq: m, cli: &Client{}}
+		if err := a.writePoints(context.Background(), "t", point(1)); err == nil {
+			t.Fatal("发送失败时应返回错误")
+		}
+		// 发送失败的值未记录,恢复后相同的值不被死区过滤
+		m.err = nil
+		for _, v := range []float64{1, 1.5} {
+			if err := a.writePoints(context.Background(), "t", point(v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := len(m.published["data/p/t/d1"]); n != 1 {
+			t.Fatalf("发送次数 = %d, want 1", n)
+		}
+	})
+
+	t.Run("WritePointsBatch", func(t *testing.T) {
+		m := &memMQ{err: errors.New("发送失败")}
+		a := &app{mq: m, cli: &Client{}}
+		if err := a.WritePointsBatch(context.Background(), []entity.Point{point(1)}); err == nil {
+			t.Fatal("发送失败时应返回错误")
+		}
+		m.err = nil
+		for _, v := range []float64{1, 1.5} {
+			if err := a.WritePointsBatch(context.Background(), []entity.Point{point(v)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := len(m.published["data/p/t/d1"]); n != 1 {
+			t.Fatalf("发送次数 = %d, want 1", n)
+		}
+	})
+}
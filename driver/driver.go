@@ -55,3 +55,26 @@ type Driver interface {
 	// @description 驱动停止处理
 	Stop(ctx context.Context, app App) (err error)
 }
+
+// DeviceLifecycle 驱动可选实现的设备增量更新接口.
+// 驱动已启动且实例配置只有设备变化时,按变化的设备调用对应方法,不再调用Start;
+// 实例或表的其他配置变化、驱动未实现该接口或增量更新失败时仍调用Start
+type DeviceLifecycle interface {
+	// AddDevice
+	// @description 添加设备
+	// @param table 设备所属的表ID
+	// @param device "设备配置,与Start配置中的设备数据相同"
+	AddDevice(ctx context.Context, app App, table string, device []byte) (err error)
+
+	// UpdateDevice
+	// @description 设备配置修改
+	// @param table 设备所属的表ID
+	// @param device "修改后的设备配置"
+	UpdateDevice(ctx context.Context, app App, table string, device []byte) (err error)
+
+	// RemoveDevice
+	// @description 删除设备
+	// @param table 设备所属的表ID
+	// @param id 设备ID
+	RemoveDevice(ctx context.Context, app App, table, id string) (err error)
+}
@@ -0,0 +1,85 @@
+// Package drivertest 提供驱动单元测试使用的模拟驱动管理服务和内存消息队列,
+// 驱动不需要连接平台即可测试Schema、Start、Run等请求的处理结果以及发送的数据点、报警和日志.
+//
+// 驱动配置使用全局变量driver.Cfg,同一进程内同时只能运行一个Harness.
+package drivertest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/air-iot/sdk-go/v4/driver"
+)
+
+// Harness 组合模拟驱动管理服务、内存消息队列和驱动App
+type Harness struct {
+	Server *Server
+	MQ     *MQ
+	App    driver.App
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Start 启动模拟服务并运行驱动,等待驱动连接全部stream后返回
+func Start(d driver.Driver) (*Harness, error) {
+	srv, err := NewServer()
+	if err != nil {
+		return nil, err
+	}
+	return StartWithServer(srv, d)
+}
+
+// StartWithServer 使用已创建的模拟服务运行驱动,用于在驱动连接前设置模拟服务
+func StartWithServer(srv *Server, d driver.Driver) (*Harness, error) {
+	if driver.Cfg.Project == "" {
+		driver.Cfg.Project = "test"
+	}
+	if driver.Cfg.ServiceID == "" {
+		driver.Cfg.ServiceID = "test"
+	}
+	if driver.Cfg.Driver.ID == "" {
+		driver.Cfg.Driver.ID = "test"
+	}
+	if driver.Cfg.Driver.Name == "" {
+		driver.Cfg.Driver.Name = "test"
+	}
+	driver.Cfg.DriverGrpc.Host = "127.0.0.1"
+	driver.Cfg.DriverGrpc.Port = srv.Port()
+	driver.Cfg.DriverGrpc.WaitTime = 200 * time.Millisecond
+	driver.Cfg.DriverGrpc.Timeout = 30 * time.Second
+	driver.Cfg.DriverGrpc.Limit = 10
+	driver.Cfg.DriverGrpc.Health.RequestTime = time.Second
+	driver.Cfg.DriverGrpc.Health.Retry = 3
+	if driver.Cfg.DriverGrpc.Stream.Heartbeat == 0 {
+		driver.Cfg.DriverGrpc.Stream.Heartbeat = 30 * time.Second
+	}
+	if driver.Cfg.MQ.Timeout == 0 {
+		driver.Cfg.MQ.Timeout = 5 * time.Second
+	}
+	m := NewMQ()
+	h := &Harness{Server: srv, MQ: m, App: driver.NewAppWithMQ(m), done: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	go func() {
+		defer close(h.done)
+		h.err = h.App.StartContext(ctx, d)
+	}()
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer waitCancel()
+	if err := srv.WaitStreams(waitCtx); err != nil {
+		_ = h.Close()
+		return nil, fmt.Errorf("驱动未连接模拟服务: %w", err)
+	}
+	return h, nil
+}
+
+// Close 停止驱动和模拟服务,返回驱动停止过程中的错误
+func (h *Harness) Close() error {
+	h.cancel()
+	<-h.done
+	h.Server.Close()
+	return h.err
+}
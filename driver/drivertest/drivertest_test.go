@@ -0,0 +1,871 @@
+package drivertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/air-iot/json"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/air-iot/sdk-go/v4/driver"
+	"github.com/air-iot/sdk-go/v4/driver/buffer"
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+	"github.com/air-iot/sdk-go/v4/utils/probe"
+)
+
+type testDriver struct{}
+
+func (testDriver) Schema(_ context.Context, _ driver.App, locale string) (string, error) {
+	return "schema-" + locale, nil
+}
+
+func (testDriver) Start(context.Context, driver.App, []byte) error { return nil }
+
+func (testDriver) Run(ctx context.Context, app driver.App, cmd *entity.Command) (interface{}, error) {
+	if cmd.Id == "bad" {
+		return nil, errors.New("设备不存在")
+	}
+	app.LogInfo(cmd.Table, cmd.Id, "执行指令")
+	return "ok", app.WritePoints(ctx, entity.Point{Table: cmd.Table, ID: cmd.Id, Fields: []entity.Field{{Tag: entity.Tag{ID: "v"}, Value: 1.5}}})
+}
+
+func (testDriver) BatchRun(_ context.Context, _ driver.App, cmd *entity.BatchCommand) (interface{}, error) {
+	return len(cmd.Ids), nil
+}
+
+func (testDriver) WriteTag(context.Context, driver.App, *entity.Command) (interface{}, error) {
+	return nil, nil
+}
+
+func (testDriver) Debug(_ context.Context, _ driver.App, data []byte) (interface{}, error) {
+	return string(data), nil
+}
+
+func (testDriver) HttpProxy(_ context.Context, _ driver.App, t string, header http.Header, _ []byte) (interface{}, error) {
+	return t + header.Get("X-Test"), nil
+}
+
+func (testDriver) Stop(context.Context, driver.App) error { return nil }
+
+func TestHarness(t *testing.T) {
+	h, err := Start(testDriver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := h.Server.Schema(ctx, "zh")
+	if err != nil || res.Code != 200 || res.Result != "schema-zh" {
+		t.Fatalf("Schema() = %+v, %v", res, err)
+	}
+	res, err = h.Server.Run(ctx, entity.Command{Table: "t1", Id: "d1", SerialNo: "1"})
+	if err != nil || res.Code != 200 {
+		t.Fatalf("Run() = %+v, %v", res, err)
+	}
+	points := h.MQ.Points("t1", "d1")
+	if len(points) != 1 || points[0].Fields["v"] != 1.5 {
+		t.Fatalf("Points() = %+v", points)
+	}
+	if logs := h.MQ.Logs("info"); len(logs) != 1 || logs[0].ID != "d1" {
+		t.Fatalf("Logs() = %+v", logs)
+	}
+	res, err = h.Server.Run(ctx, entity.Command{Table: "t1", Id: "bad"})
+	if err != nil || res.Code != 400 || res.Error == "" {
+		t.Fatalf("Run() = %+v, %v", res, err)
+	}
+	res, err = h.Server.BatchRun(ctx, entity.BatchCommand{Table: "t1", Ids: []string{"a", "b"}})
+	if err != nil || res.Result != float64(2) {
+		t.Fatalf("BatchRun() = %+v, %v", res, err)
+	}
+	res, err = h.Server.Debug(ctx, []byte("dbg"))
+	if err != nil || res.Result != "dbg" {
+		t.Fatalf("Debug() = %+v, %v", res, err)
+	}
+	res, err = h.Server.HttpProxy(ctx, "type", http.Header{"X-Test": []string{"1"}}, nil)
+	if err != nil || res.Result != "type1" {
+		t.Fatalf("HttpProxy() = %+v, %v", res, err)
+	}
+	res, err = h.Server.Start(ctx, []byte(`{"id":"i1","tables":[{"id":"t1","devices":[{"id":"d1"}]}]}`))
+	if err != nil || res.Code != 200 {
+		t.Fatalf("Start() = %+v, %v", res, err)
+	}
+	if err := h.App.WritePoints(ctx, entity.Point{ID: "d1", Fields: []entity.Field{{Tag: entity.Tag{ID: "v"}, Value: 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.App.WriteEvent(ctx, entity.Event{Table: "t1", ID: "d1", EventID: "e1"}); err != nil {
+		t.Fatal(err)
+	}
+	if events := h.Server.Events(); len(events) != 1 || events[0].EventID != "e1" {
+		t.Fatalf("Events() = %+v", events)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"data/#", "data/p/t/d", true},
+		{"data/+/t/+", "data/p/t/d", true},
+		{"data/+/t", "data/p/t/d", false},
+		{"data/p/t/d", "data/p/t/d", true},
+		{"logs/+", "data/p", false},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("Match(%s, %s) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceStatus(t *testing.T) {
+	driver.Cfg.DeviceStatus = driver.DeviceStatusConfig{Enable: true, Timeout: 100 * time.Millisecond, Interval: 20 * time.Millisecond}
+	defer func() { driver.Cfg.DeviceStatus = driver.DeviceStatusConfig{} }()
+	h, err := Start(testDriver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := h.App.WritePoints(ctx, entity.Point{Table: "t1", ID: "d1", Fields: []entity.Field{{Tag: entity.Tag{ID: "v"}, Value: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := h.MQ.Wait(ctx, "deviceStatus/#", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{entity.DeviceOnline, entity.DeviceOffline} {
+		var status entity.DeviceStatus
+		if err := json.Unmarshal(msgs[i].Payload, &status); err != nil || status.Status != want || status.ID != "d1" {
+			t.Fatalf("状态[%d] = %+v, %v, want %s", i, status, err, want)
+		}
+	}
+	// 状态消息发送后才更新设备表数据,等待第二次更新完成
+	data := h.Server.TableData()
+	for len(data) < 2 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+		data = h.Server.TableData()
+	}
+	if len(data) != 2 || data[0].Data["online"] != true || data[1].Data["online"] != false {
+		t.Fatalf("TableData() = %+v", data)
+	}
+
+	if err := h.App.SetDeviceOnline(ctx, "t1", "d2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.App.SetDeviceOnline(ctx, "t1", "d2"); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := h.MQ.Messages("deviceStatus/+/t1/d2"); len(msgs) != 1 {
+		t.Fatalf("状态未变化时不应重复发送: %d", len(msgs))
+	}
+}
+
+type flakyDriver struct {
+	testDriver
+	fails int32
+}
+
+func (d *flakyDriver) Run(ctx context.Context, _ driver.App, cmd *entity.Command) (interface{}, error) {
+	if cmd.Id == "slow" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if atomic.AddInt32(&d.fails, -1) >= 0 {
+		return nil, errors.New("设备未响应")
+	}
+	return "ok", nil
+}
+
+func TestCommandExecutor(t *testing.T) {
+	driver.Cfg.Command = driver.CommandConfig{Enable: true, Timeout: 100 * time.Millisecond, Retry: 2, Backoff: 10 * time.Millisecond}
+	defer func() { driver.Cfg.Command = driver.CommandConfig{} }()
+	d := &flakyDriver{fails: 2}
+	h, err := Start(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := h.Server.Run(ctx, entity.Command{Table: "t1", Id: "d1", SerialNo: "s1"})
+	if err != nil || res.Code != 200 || res.Result != "ok" {
+		t.Fatalf("Run() = %+v, %v", res, err)
+	}
+	var statuses []string
+	for _, l := range h.Server.RunLogs() {
+		statuses = append(statuses, l.Status)
+	}
+	want := []string{"ready", "ready", "ready", "success"}
+	if strings.Join(statuses, ",") != strings.Join(want, ",") {
+		t.Fatalf("RunLogs() = %v, want %v", statuses, want)
+	}
+	// 驱动管理下发的指令没有指令ID,不更新指令状态
+	if updates := h.Server.CommandUpdates(); len(updates) != 0 {
+		t.Fatalf("CommandUpdates() = %+v", updates)
+	}
+	if rejected := h.Server.RejectedCommandUpdates(); len(rejected) != 0 {
+		t.Fatalf("RejectedCommandUpdates() = %+v", rejected)
+	}
+
+	if err := h.Server.SetCommands("t1", "slow", []entity.DriverInstruct{{ID: "c1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.App.SubmitCommand(ctx, "c1", &entity.Command{Table: "t1", Id: "slow"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("SubmitCommand() error = %v", err)
+	}
+	updates := h.Server.CommandUpdates()
+	if len(updates) != 1 || updates[0].ID != "c1" || updates[0].Data.Status != entity.COMMAND_STATUS_TIMEOUT {
+		t.Fatalf("CommandUpdates() = %+v", updates)
+	}
+	if rejected := h.Server.RejectedCommandUpdates(); len(rejected) != 0 {
+		t.Fatalf("RejectedCommandUpdates() = %+v", rejected)
+	}
+
+	// 不存在的指令ID更新失败,只记录日志,不影响执行结果
+	if _, err := h.App.SubmitCommand(ctx, "unknown", &entity.Command{Table: "t1", Id: "d2"}); err != nil {
+		t.Fatalf("SubmitCommand() error = %v", err)
+	}
+	if rejected := h.Server.RejectedCommandUpdates(); len(rejected) != 1 || rejected[0].ID != "unknown" {
+		t.Fatalf("RejectedCommandUpdates() = %+v", rejected)
+	}
+}
+
+// stuckDriver Run不响应ctx取消,记录同时执行的指令数量
+type stuckDriver struct {
+	testDriver
+	delay   time.Duration
+	running int32
+	max     int32
+}
+
+func (d *stuckDriver) Run(context.Context, driver.App, *entity.Command) (interface{}, error) {
+	n := atomic.AddInt32(&d.running, 1)
+	defer atomic.AddInt32(&d.running, -1)
+	for {
+		m := atomic.LoadInt32(&d.max)
+		if n <= m || atomic.CompareAndSwapInt32(&d.max, m, n) {
+			break
+		}
+	}
+	time.Sleep(d.delay)
+	return "ok", nil
+}
+
+func TestCommandTimeoutSerial(t *testing.T) {
+	driver.Cfg.Command = driver.CommandConfig{Enable: true, Timeout: 20 * time.Millisecond}
+	defer func() { driver.Cfg.Command = driver.CommandConfig{} }()
+	d := &stuckDriver{delay: 100 * time.Millisecond}
+	h, err := Start(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 超时的指令返回后才执行同一设备的下一个指令
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := h.App.SubmitCommand(ctx, "", &entity.Command{Table: "t1", Id: "d1"}); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("SubmitCommand() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := h.App.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if m := atomic.LoadInt32(&d.max); m != 1 {
+		t.Fatalf("同一设备同时执行的指令数量 = %d", m)
+	}
+}
+
+type slowDriver struct {
+	testDriver
+	started chan struct{}
+	delay   time.Duration
+	stopped int32
+}
+
+func (d *slowDriver) Run(context.Context, driver.App, *entity.Command) (interface{}, error) {
+	close(d.started)
+	time.Sleep(d.delay)
+	return "done", nil
+}
+
+func (d *slowDriver) Stop(context.Context, driver.App) error {
+	atomic.StoreInt32(&d.stopped, 1)
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		delay   time.Duration
+		timeout time.Duration
+		wantErr bool
+	}{
+		{"等待请求完成", 200 * time.Millisecond, 2 * time.Second, false},
+		{"等待超时", 2 * time.Second, 100 * time.Millisecond, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &slowDriver{started: make(chan struct{}), delay: tt.delay}
+			h, err := Start(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+			type result struct {
+				res *entity.GrpcResult
+				err error
+			}
+			ch := make(chan result, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				res, err := h.Server.Run(ctx, entity.Command{Table: "t1", Id: "d1"})
+				ch <- result{res, err}
+			}()
+			<-d.started
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			err = h.App.Shutdown(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Shutdown() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if atomic.LoadInt32(&d.stopped) != 1 {
+				t.Fatal("驱动未停止")
+			}
+			if tt.wantErr {
+				return
+			}
+			r := <-ch
+			if r.err != nil || r.res.Result != "done" {
+				t.Fatalf("Run() = %+v, %v", r.res, r.err)
+			}
+		})
+	}
+}
+
+type blockingDriver struct {
+	testDriver
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingDriver) Run(context.Context, driver.App, *entity.Command) (interface{}, error) {
+	d.started <- struct{}{}
+	<-d.release
+	return "ok", nil
+}
+
+func TestBusy(t *testing.T) {
+	driver.Cfg.Workers.Run = driver.WorkerConfig{Workers: 1, QueueSize: 1}
+	defer func() { driver.Cfg.Workers.Run = driver.WorkerConfig{} }()
+	d := &blockingDriver{started: make(chan struct{}, 3), release: make(chan struct{})}
+	h, err := Start(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			res, err := h.Server.Run(ctx, entity.Command{Table: "t1", Id: "d1"})
+			if err != nil {
+				t.Error(err)
+				codes <- 0
+				return
+			}
+			codes <- res.Code
+		}()
+		if i == 0 {
+			<-d.started
+		}
+	}
+	// 第一个请求正在处理,第二个请求在队列中等待,第三个请求返回繁忙
+	time.Sleep(100 * time.Millisecond)
+	res, err := h.Server.Run(ctx, entity.Command{Table: "t1", Id: "d1"})
+	if err != nil || res.Code != entity.GrpcCodeBusy {
+		t.Fatalf("Run() = %+v, %v", res, err)
+	}
+	close(d.release)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != 200 {
+			t.Fatalf("Run() code = %d", code)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	driver.Cfg.DriverGrpc.Stream.Heartbeat = 30 * time.Millisecond
+	driver.Cfg.DriverGrpc.Stream.MissedBeats = 3
+	defer func() {
+		driver.Cfg.DriverGrpc.Stream.Heartbeat = 0
+		driver.Cfg.DriverGrpc.Stream.MissedBeats = 0
+	}()
+	h, err := Start(testDriver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	waitFor := func(msg string, cond func() bool) {
+		t.Helper()
+		for !cond() {
+			if ctx.Err() != nil {
+				t.Fatal(msg)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("未收到心跳", func() bool { return h.Server.Heartbeats(StreamSchema) >= 5 })
+	if n := h.Server.Connects(StreamSchema); n != 1 {
+		t.Fatalf("心跳正常时stream连接次数 = %d", n)
+	}
+
+	h.Server.SetHeartbeatReply(false)
+	waitFor("心跳超时后未重连", func() bool { return h.Server.Connects(StreamSchema) >= 2 })
+	h.Server.SetHeartbeatReply(true)
+	if err := h.Server.WaitStreams(ctx); err != nil {
+		t.Fatal(err)
+	}
+	res, err := h.Server.Schema(ctx, "zh")
+	if err != nil || res.Code != 200 {
+		t.Fatalf("Schema() = %+v, %v", res, err)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+	h, err := Start(testDriver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 同一个stream上的请求分别使用请求中携带的链路上下文
+	parents := map[string]string{
+		"d1": "0af7651916cd43dd8448eb211c80319c",
+		"d2": "4bf92f3577b34da6a3ce929d0e0e4736",
+	}
+	for id, traceId := range parents {
+		cmd := []byte(`{"traceparent":"00-` + traceId + `-b7ad6b7169203331-01"}`)
+		res, err := h.Server.Run(ctx, entity.Command{Table: "t1", Id: id, SerialNo: "s-" + id, Command: cmd})
+		if err != nil || res.Code != 200 {
+			t.Fatalf("Run() = %+v, %v", res, err)
+		}
+	}
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for len(spans) < len(parents) {
+		if ctx.Err() != nil {
+			t.Fatal("未记录driver.run span")
+		}
+		for _, s := range rec.Ended() {
+			if s.Name() != "driver.run" {
+				continue
+			}
+			for _, kv := range s.Attributes() {
+				if kv.Key == "airiot.id" {
+					spans[kv.Value.AsString()] = s
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for id, traceId := range parents {
+		span := spans[id]
+		if span.Parent().TraceID().String() != traceId || !span.Parent().IsRemote() {
+			t.Fatalf("设备 %s 父span = %+v", id, span.Parent())
+		}
+		want := map[attribute.Key]string{"airiot.serialNo": "s-" + id, "airiot.table": "t1"}
+		for _, kv := range span.Attributes() {
+			if v, ok := want[kv.Key]; ok && kv.Value.AsString() == v {
+				delete(want, kv.Key)
+			}
+		}
+		if len(want) > 0 {
+			t.Fatalf("span缺少属性 %v", want)
+		}
+		// 驱动在Run中写入的数据点消息携带同一链路
+		msgs := h.MQ.Messages("data/+/t1/" + id)
+		if len(msgs) != 1 {
+			t.Fatalf("设备 %s 数据点消息数量 = %d", id, len(msgs))
+		}
+		got := trace.SpanContextFromContext(otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(msgs[0].Headers)))
+		if got.TraceID().String() != traceId {
+			t.Fatalf("设备 %s 数据点消息头 = %v", id, msgs[0].Headers)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+	driver.Cfg.Probe = probe.Config{Enable: true, Host: "127.0.0.1", Port: strconv.Itoa(port)}
+	defer func() {
+		driver.Cfg.Probe = probe.Config{}
+	}()
+	h, err := Start(testDriver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	get := func(path string) (int, probe.Report) {
+		t.Helper()
+		var report probe.Report
+		for {
+			res, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + path)
+			if err == nil {
+				defer res.Body.Close()
+				if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+					t.Fatal(err)
+				}
+				return res.StatusCode, report
+			}
+			if ctx.Err() != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	ready := func(report probe.Report, name string) bool {
+		for _, c := range report.Checks {
+			if c.Name == name {
+				return c.Ready
+			}
+		}
+		t.Fatalf("没有检查项%s: %+v", name, report)
+		return false
+	}
+	waitReady := func(want int) probe.Report {
+		t.Helper()
+		for {
+			code, report := get("/readyz")
+			if code == want {
+				return report
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("/readyz = %d, %+v", code, report)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	if code, report := get("/healthz"); code != http.StatusOK || report.Status != probe.StatusOK {
+		t.Fatalf("/healthz = %d, %+v", code, report)
+	}
+	if code, report := get("/readyz"); code != http.StatusServiceUnavailable || ready(report, "start") {
+		t.Fatalf("驱动未启动时 /readyz = %d, %+v", code, report)
+	}
+	res, err := h.Server.Start(ctx, []byte(`{"id":"i1"}`))
+	if err != nil || res.Code != 200 {
+		t.Fatalf("Start() = %+v, %v", res, err)
+	}
+	report := waitReady(http.StatusOK)
+	for _, name := range []string{"grpc", "streams", "healthCheck", "start", "mq"} {
+		if !ready(report, name) {
+			t.Fatalf("%s未就绪: %+v", name, report)
+		}
+	}
+	h.MQ.Lost()
+	if report := waitReady(http.StatusServiceUnavailable); ready(report, "mq") {
+		t.Fatalf("消息队列断开后 /readyz = %+v", report)
+	}
+	h.MQ.Connect()
+	waitReady(http.StatusOK)
+}
+
+type lifecycleDriver struct {
+	testDriver
+	lock   sync.Mutex
+	starts int
+	calls  []string
+}
+
+func (d *lifecycleDriver) Start(context.Context, driver.App, []byte) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.starts++
+	return nil
+}
+
+func (d *lifecycleDriver) AddDevice(_ context.Context, _ driver.App, table string, device []byte) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.calls = append(d.calls, "add "+table+" "+string(device))
+	return nil
+}
+
+func (d *lifecycleDriver) UpdateDevice(_ context.Context, _ driver.App, table string, device []byte) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.calls = append(d.calls, "update "+table+" "+string(device))
+	return nil
+}
+
+func (d *lifecycleDriver) RemoveDevice(_ context.Context, _ driver.App, table, id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.calls = append(d.calls, "remove "+table+" "+id)
+	return nil
+}
+
+func TestDeviceLifecycle(t *testing.T) {
+	d := new(lifecycleDriver)
+	h, err := Start(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, config := range []string{
+		`{"id":"i1","tables":[{"id":"t1","devices":[{"id":"d1","settings":{"ip":"1"}},{"id":"d2"}]}]}`,
+		`{"id":"i1","tables":[{"id":"t1","devices":[{"id":"d1","settings":{"ip":"2"}},{"id":"d3"}]}]}`,
+	} {
+		if res, err := h.Server.Start(ctx, []byte(config)); err != nil || res.Code != 200 {
+			t.Fatalf("Start() = %+v, %v", res, err)
+		}
+	}
+	d.lock.Lock()
+	starts, calls := d.starts, strings.Join(d.calls, ";")
+	d.lock.Unlock()
+	want := `remove t1 d2;update t1 {"id":"d1","settings":{"ip":"2"}};add t1 {"id":"d3"}`
+	if starts != 1 || calls != want {
+		t.Fatalf("Start调用%d次,设备变化=%s", starts, calls)
+	}
+	if err := h.App.WritePoints(ctx, entity.Point{ID: "d3", Fields: []entity.Field{{Tag: entity.Tag{ID: "v"}, Value: 1}}}); err != nil {
+		t.Fatalf("新增设备的表未加载: %v", err)
+	}
+
+	if res, err := h.Server.Start(ctx, []byte(`{"id":"i1","settings":{"a":1},"tables":[{"id":"t1","devices":[{"id":"d3"}]}]}`)); err != nil || res.Code != 200 {
+		t.Fatalf("Start() = %+v, %v", res, err)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.starts != 2 {
+		t.Fatalf("实例配置变化时Start调用%d次,应为2", d.starts)
+	}
+}
+
+// stoppingDriver Stop阻塞到release关闭
+type stoppingDriver struct {
+	testDriver
+	stopping chan struct{}
+	release  chan struct{}
+}
+
+func (d *stoppingDriver) Stop(context.Context, driver.App) error {
+	close(d.stopping)
+	<-d.release
+	return nil
+}
+
+func TestShutdownReject(t *testing.T) {
+	d := &stoppingDriver{stopping: make(chan struct{}), release: make(chan struct{})}
+	h, err := Start(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- h.App.Shutdown(ctx) }()
+	<-d.stopping
+	// 停止过程中的请求立即返回错误,不等待驱动管理超时
+	res, err := h.Server.Run(ctx, entity.Command{Table: "t1", Id: "d1"})
+	if err != nil || res.Code != entity.GrpcCodeUnavailable {
+		t.Fatalf("Run() = %+v, %v", res, err)
+	}
+	close(d.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuffer(t *testing.T) {
+	driver.Cfg.Buffer = buffer.Config{Enable: true, Path: t.TempDir(), RetryInterval: 20 * time.Millisecond}
+	defer func() { driver.Cfg.Buffer = buffer.Config{} }()
+	h, err := Start(testDriver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if res, err := h.Server.Start(ctx, []byte(`{"id":"i1","tables":[{"id":"t1","devices":[{"id":"d1"}]}]}`)); err != nil || res.Code != 200 {
+		t.Fatalf("Start() = %+v, %v", res, err)
+	}
+
+	// 消息队列断开时数据点和设备状态写入缓存,事件不受影响
+	h.MQ.Lost()
+	if err := h.App.WritePoints(ctx, entity.Point{ID: "d1", Fields: []entity.Field{{Tag: entity.Tag{ID: "v"}, Value: 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.App.SetDeviceOnline(ctx, "t1", "d1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.App.WriteEvent(ctx, entity.Event{Table: "t1", ID: "d1", EventID: "e1"}); err != nil {
+		t.Fatal(err)
+	}
+	if events := h.Server.Events(); len(events) != 1 || events[0].EventID != "e1" {
+		t.Fatalf("Events() = %+v", events)
+	}
+	if msgs := h.MQ.Messages("#"); len(msgs) != 0 {
+		t.Fatalf("Messages() = %+v", msgs)
+	}
+
+	h.MQ.Connect()
+	if _, err := h.MQ.Wait(ctx, "data/#", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.MQ.Wait(ctx, "deviceStatus/#", 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeviceStatusOrder(t *testing.T) {
+	driver.Cfg.DeviceStatus = driver.DeviceStatusConfig{Enable: true, Timeout: time.Minute, Interval: time.Minute}
+	defer func() { driver.Cfg.DeviceStatus = driver.DeviceStatusConfig{} }()
+	h, err := Start(testDriver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 写数据点后立即设置离线,离线状态在在线状态之后发送
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("d%d", i)
+		if err := h.App.WritePoints(ctx, entity.Point{Table: "t1", ID: id, Fields: []entity.Field{{Tag: entity.Tag{ID: "v"}, Value: 1}}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.App.SetDeviceOffline(ctx, "t1", id); err != nil {
+			t.Fatal(err)
+		}
+		msgs := h.MQ.Messages("deviceStatus/+/t1/" + id)
+		if len(msgs) != 2 {
+			t.Fatalf("设备%s状态消息 = %d", id, len(msgs))
+		}
+		var status entity.DeviceStatus
+		if err := json.Unmarshal(msgs[1].Payload, &status); err != nil || status.Status != entity.DeviceOffline {
+			t.Fatalf("设备%s最后的状态 = %+v, %v", id, status, err)
+		}
+	}
+
+	// 停止时发送队列中剩余的状态
+	if err := h.App.WritePoints(ctx, entity.Point{Table: "t1", ID: "last", Fields: []entity.Field{{Tag: entity.Tag{ID: "v"}, Value: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.App.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := h.MQ.Messages("deviceStatus/+/t1/last"); len(msgs) != 1 {
+		t.Fatalf("停止时未发送的状态 = %d", len(msgs))
+	}
+}
+
+func TestDeviceStatusRetry(t *testing.T) {
+	driver.Cfg.DeviceStatus = driver.DeviceStatusConfig{Enable: true, Timeout: 50 * time.Millisecond, Interval: 10 * time.Millisecond}
+	defer func() { driver.Cfg.DeviceStatus = driver.DeviceStatusConfig{} }()
+	h, err := Start(testDriver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	point := func(id string) entity.Point {
+		return entity.Point{Table: "t1", ID: id, Fields: []entity.Field{{Tag: entity.Tag{ID: "v"}, Value: 1}}}
+	}
+
+	// 显式设置状态失败后再次设置时重新发送
+	h.MQ.SetError(errors.New("发送失败"))
+	if err := h.App.SetDeviceOffline(ctx, "t1", "d1"); err == nil {
+		t.Fatal("发送失败时应返回错误")
+	}
+	h.MQ.SetError(nil)
+	if err := h.App.SetDeviceOffline(ctx, "t1", "d1"); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := h.MQ.Messages("deviceStatus/+/t1/d1"); len(msgs) != 1 {
+		t.Fatalf("重新设置后的状态消息 = %d", len(msgs))
+	}
+
+	// 写数据点时在线状态发送失败,再次写数据点时重新发送
+	h.MQ.SetError(errors.New("发送失败"))
+	_ = h.App.WritePoints(ctx, point("d2"))
+	h.MQ.SetError(nil)
+	if err := h.App.WritePoints(ctx, point("d2")); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := h.MQ.Wait(ctx, "deviceStatus/+/t1/d2", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status entity.DeviceStatus
+	if err := json.Unmarshal(msgs[0].Payload, &status); err != nil || status.Status != entity.DeviceOnline {
+		t.Fatalf("状态 = %+v, %v", status, err)
+	}
+
+	// 自动离线发送失败时在下次检查时重试
+	h.MQ.SetError(errors.New("发送失败"))
+	time.Sleep(200 * time.Millisecond)
+	h.MQ.SetError(nil)
+	msgs, err = h.MQ.Wait(ctx, "deviceStatus/+/t1/d2", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(msgs[1].Payload, &status); err != nil || status.Status != entity.DeviceOffline {
+		t.Fatalf("状态 = %+v, %v", status, err)
+	}
+}
@@ -0,0 +1,234 @@
+package drivertest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/air-iot/json"
+
+	"github.com/air-iot/sdk-go/v4/conn/mq"
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+	"github.com/air-iot/sdk-go/v4/utils/tracing"
+)
+
+var _ mq.MQ = new(MQ)
+
+// Message 发布到内存消息队列的消息
+type Message struct {
+	Topic   string
+	Payload []byte
+	// Headers 发布时ctx中的链路上下文,与Kafka、RabbitMQ写入消息头的内容相同
+	Headers map[string]string
+}
+
+// Log 驱动通过LogDebug、LogInfo等方法发布的日志
+type Log struct {
+	Level   string
+	Table   string
+	ID      string
+	Time    string
+	Message interface{}
+}
+
+type subscription struct {
+	splitN  int
+	handler mq.Handler
+}
+
+// MQ 内存消息队列,记录发布的消息并分发给匹配的订阅,topic使用mqtt格式
+type MQ struct {
+	lock      sync.RWMutex
+	messages  []Message
+	subs      map[string]subscription
+	callbacks []mq.Callback
+	err       error
+}
+
+// NewMQ 创建内存消息队列
+func NewMQ() *MQ {
+	return &MQ{subs: make(map[string]subscription)}
+}
+
+func (m *MQ) Publish(ctx context.Context, topicParams []string, payload []byte) error {
+	if len(topicParams) == 0 {
+		return fmt.Errorf("topic为空")
+	}
+	topic := strings.Join(topicParams, mq.TOPICSEPWITHMQTT)
+	m.lock.Lock()
+	if m.err != nil {
+		err := m.err
+		m.lock.Unlock()
+		return err
+	}
+	b := make([]byte, len(payload))
+	copy(b, payload)
+	m.messages = append(m.messages, Message{Topic: topic, Payload: b, Headers: tracing.Headers(ctx)})
+	subs := make([]subscription, 0)
+	for filter, sub := range m.subs {
+		if Match(filter, topic) {
+			subs = append(subs, sub)
+		}
+	}
+	m.lock.Unlock()
+	for _, sub := range subs {
+		sub.handler(topic, strings.SplitN(topic, mq.TOPICSEPWITHMQTT, sub.splitN), b)
+	}
+	return nil
+}
+
+func (m *MQ) Consume(_ context.Context, topicParams []string, splitN int, handler mq.Handler) error {
+	if len(topicParams) == 0 {
+		return fmt.Errorf("topic为空")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.subs[strings.Join(topicParams, mq.TOPICSEPWITHMQTT)] = subscription{splitN: splitN, handler: handler}
+	return nil
+}
+
+func (m *MQ) UnSubscription(_ context.Context, topicParams []string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.subs, strings.Join(topicParams, mq.TOPICSEPWITHMQTT))
+	return nil
+}
+
+func (m *MQ) Callback(cb mq.Callback) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.callbacks = append(m.callbacks, cb)
+}
+
+// SetError 设置Publish返回的错误,用于模拟消息队列不可用,传入nil恢复
+func (m *MQ) SetError(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.err = err
+}
+
+// Lost 模拟连接断开,Publish返回错误并触发Lost回调
+func (m *MQ) Lost() {
+	m.SetError(fmt.Errorf("内存消息队列已断开"))
+	for _, cb := range m.getCallbacks() {
+		_ = cb.Lost(m)
+	}
+}
+
+// Connect 模拟连接恢复,触发Connect回调
+func (m *MQ) Connect() {
+	m.SetError(nil)
+	for _, cb := range m.getCallbacks() {
+		_ = cb.Connect(m)
+	}
+}
+
+func (m *MQ) getCallbacks() []mq.Callback {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return append([]mq.Callback(nil), m.callbacks...)
+}
+
+// Reset 清空已记录的消息
+func (m *MQ) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.messages = nil
+}
+
+// Messages 返回topic匹配filter的消息,filter支持mqtt通配符+和#
+func (m *MQ) Messages(filter string) []Message {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	ret := make([]Message, 0)
+	for _, msg := range m.messages {
+		if Match(filter, msg.Topic) {
+			ret = append(ret, msg)
+		}
+	}
+	return ret
+}
+
+// Wait 等待topic匹配filter的消息数量达到n
+func (m *MQ) Wait(ctx context.Context, filter string, n int) ([]Message, error) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if msgs := m.Messages(filter); len(msgs) >= n {
+			return msgs, nil
+		}
+		select {
+		case <-ctx.Done():
+			return m.Messages(filter), fmt.Errorf("等待消息 %s 数量 %d: %w", filter, n, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Points 返回发送到设备的数据点,table或id为空时匹配全部
+func (m *MQ) Points(table, id string) []entity.WritePoint {
+	ret := make([]entity.WritePoint, 0)
+	for _, msg := range m.Messages(strings.Join([]string{"data", "+", wildcard(table), wildcard(id)}, mq.TOPICSEPWITHMQTT)) {
+		var p entity.WritePoint
+		if err := json.Unmarshal(msg.Payload, &p); err == nil {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// Warnings 返回发送的报警
+func (m *MQ) Warnings() []entity.WarnSend {
+	ret := make([]entity.WarnSend, 0)
+	for _, msg := range m.Messages("warningStorage/#") {
+		var w entity.WarnSend
+		if err := json.Unmarshal(msg.Payload, &w); err == nil {
+			ret = append(ret, w)
+		}
+	}
+	return ret
+}
+
+// Logs 返回驱动发布的日志,level为空时匹配全部级别
+func (m *MQ) Logs(level string) []Log {
+	ret := make([]Log, 0)
+	for _, msg := range m.Messages(strings.Join([]string{"logs", "+", wildcard(level), "+", "+"}, mq.TOPICSEPWITHMQTT)) {
+		var l struct {
+			Time    string      `json:"time"`
+			Message interface{} `json:"message"`
+		}
+		if err := json.Unmarshal(msg.Payload, &l); err != nil {
+			continue
+		}
+		parts := strings.Split(msg.Topic, mq.TOPICSEPWITHMQTT)
+		ret = append(ret, Log{Level: parts[2], Table: parts[3], ID: parts[4], Time: l.Time, Message: l.Message})
+	}
+	return ret
+}
+
+func wildcard(s string) string {
+	if s == "" {
+		return "+"
+	}
+	return s
+}
+
+// Match 判断topic是否匹配mqtt格式的订阅filter
+func Match(filter, topic string) bool {
+	fs := strings.Split(filter, mq.TOPICSEPWITHMQTT)
+	ts := strings.Split(topic, mq.TOPICSEPWITHMQTT)
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
@@ -0,0 +1,489 @@
+package drivertest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/air-iot/json"
+	"google.golang.org/grpc"
+
+	api "github.com/air-iot/api-client-go/v4/api"
+	pb "github.com/air-iot/api-client-go/v4/driver"
+
+	"github.com/air-iot/sdk-go/v4/driver"
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+)
+
+const (
+	StreamSchema    = "schema"
+	StreamStart     = "start"
+	StreamRun       = "run"
+	StreamWriteTag  = "writeTag"
+	StreamBatchRun  = "batchRun"
+	StreamDebug     = "debug"
+	StreamHttpProxy = "httpProxy"
+)
+
+// Streams 驱动连接的全部stream
+var Streams = []string{StreamSchema, StreamStart, StreamRun, StreamWriteTag, StreamBatchRun, StreamDebug, StreamHttpProxy}
+
+// CommandUpdate 驱动调用UpdateCommand更新的指令状态
+type CommandUpdate struct {
+	ID   string
+	Data entity.DriverInstruct
+}
+
+type stream struct {
+	lock sync.Mutex
+	send func(request string, build func(string) interface{}) error
+}
+
+// Server 模拟驱动管理的DriverService和DriverInstructService,监听本地回环地址
+type Server struct {
+	lock     sync.Mutex
+	srv      *grpc.Server
+	lis      net.Listener
+	seq      int64
+	streams  map[string]*stream
+	waiters  map[string]chan []byte
+	notify   chan struct{}
+	health   *pb.HealthCheckResponse
+	devices  map[string][]byte
+	commands map[string][]byte
+	// instructs SetCommands设置的指令ID,只能更新这些指令的状态
+	instructs map[string]bool
+	// heartbeats 每个stream收到的心跳数量
+	heartbeats map[string]int
+	// connects 每个stream的连接次数
+	connects map[string]int
+	noBeat   bool
+
+	events         []entity.Event
+	runLogs        []entity.Log
+	tableData      []entity.TableData
+	commandUpdates []CommandUpdate
+	// rejectedUpdates 指令ID不存在时被拒绝的更新
+	rejectedUpdates []CommandUpdate
+}
+
+// NewServer 在127.0.0.1的随机端口启动模拟服务
+func NewServer() (*Server, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("监听本地端口错误: %w", err)
+	}
+	s := &Server{
+		lis:       lis,
+		streams:   make(map[string]*stream),
+		waiters:   make(map[string]chan []byte),
+		notify:    make(chan struct{}),
+		health:    &pb.HealthCheckResponse{Status: pb.HealthCheckResponse_SERVING},
+		devices:   make(map[string][]byte),
+		commands:  make(map[string][]byte),
+		instructs: make(map[string]bool),
+
+		heartbeats: make(map[string]int),
+		connects:   make(map[string]int),
+	}
+	s.srv = grpc.NewServer()
+	pb.RegisterDriverServiceServer(s.srv, &service{s: s})
+	pb.RegisterDriverInstructServiceServer(s.srv, &service{s: s})
+	go func() {
+		_ = s.srv.Serve(lis)
+	}()
+	return s, nil
+}
+
+// Port 监听端口
+func (s *Server) Port() int {
+	return s.lis.Addr().(*net.TCPAddr).Port
+}
+
+// Close 停止服务,断开所有stream
+func (s *Server) Close() {
+	s.srv.Stop()
+}
+
+// WaitStreams 等待驱动连接全部stream
+func (s *Server) WaitStreams(ctx context.Context) error {
+	for {
+		s.lock.Lock()
+		n := len(s.streams)
+		notify := s.notify
+		s.lock.Unlock()
+		if n == len(Streams) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("等待stream连接,已连接=%d: %w", n, ctx.Err())
+		case <-notify:
+		}
+	}
+}
+
+// SetHealth 设置健康检查返回结果
+func (s *Server) SetHealth(res *pb.HealthCheckResponse) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.health = res
+}
+
+// SetDevice 设置FindDevice返回的设备数据
+func (s *Server) SetDevice(table, id string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.devices[table+"/"+id] = b
+	return nil
+}
+
+// SetCommands 设置GetCommands返回的指令,指令的id字段作为可以更新状态的指令ID
+func (s *Server) SetCommands(table, id string, commands interface{}) error {
+	b, err := json.Marshal(commands)
+	if err != nil {
+		return err
+	}
+	var instructs []entity.DriverInstruct
+	_ = json.Unmarshal(b, &instructs)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.commands[table+"/"+id] = b
+	for _, v := range instructs {
+		if v.ID != "" {
+			s.instructs[v.ID] = true
+		}
+	}
+	return nil
+}
+
+// Events 驱动发送的事件
+func (s *Server) Events() []entity.Event {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]entity.Event(nil), s.events...)
+}
+
+// RunLogs 驱动发送的指令日志
+func (s *Server) RunLogs() []entity.Log {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]entity.Log(nil), s.runLogs...)
+}
+
+// TableData 驱动更新的表数据
+func (s *Server) TableData() []entity.TableData {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]entity.TableData(nil), s.tableData...)
+}
+
+// CommandUpdates 驱动更新的指令状态
+func (s *Server) CommandUpdates() []CommandUpdate {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]CommandUpdate(nil), s.commandUpdates...)
+}
+
+// RejectedCommandUpdates 指令ID不存在而被拒绝的指令状态更新
+func (s *Server) RejectedCommandUpdates() []CommandUpdate {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]CommandUpdate(nil), s.rejectedUpdates...)
+}
+
+// Schema 发送查询schema请求
+func (s *Server) Schema(ctx context.Context, locale string) (*entity.GrpcResult, error) {
+	return s.request(ctx, StreamSchema, func(req string) interface{} {
+		return &pb.SchemaRequest{Request: req, Locale: locale}
+	})
+}
+
+// Start 发送启动请求,config为实例配置
+func (s *Server) Start(ctx context.Context, config []byte) (*entity.GrpcResult, error) {
+	return s.request(ctx, StreamStart, func(req string) interface{} {
+		return &pb.StartRequest{Request: req, Config: config}
+	})
+}
+
+// Run 发送执行指令请求
+func (s *Server) Run(ctx context.Context, cmd entity.Command) (*entity.GrpcResult, error) {
+	return s.request(ctx, StreamRun, func(req string) interface{} {
+		return &pb.RunRequest{Request: req, TableId: cmd.Table, Id: cmd.Id, SerialNo: cmd.SerialNo, Command: cmd.Command}
+	})
+}
+
+// WriteTag 发送写数据点请求
+func (s *Server) WriteTag(ctx context.Context, cmd entity.Command) (*entity.GrpcResult, error) {
+	return s.request(ctx, StreamWriteTag, func(req string) interface{} {
+		return &pb.RunRequest{Request: req, TableId: cmd.Table, Id: cmd.Id, SerialNo: cmd.SerialNo, Command: cmd.Command}
+	})
+}
+
+// BatchRun 发送批量执行指令请求
+func (s *Server) BatchRun(ctx context.Context, cmd entity.BatchCommand) (*entity.GrpcResult, error) {
+	return s.request(ctx, StreamBatchRun, func(req string) interface{} {
+		return &pb.BatchRunRequest{Request: req, TableId: cmd.Table, Id: cmd.Ids, SerialNo: cmd.SerialNo, Command: cmd.Command}
+	})
+}
+
+// Debug 发送调试请求
+func (s *Server) Debug(ctx context.Context, data []byte) (*entity.GrpcResult, error) {
+	return s.request(ctx, StreamDebug, func(req string) interface{} {
+		return &pb.Debug{Request: req, Data: data}
+	})
+}
+
+// HttpProxy 发送代理接口请求
+func (s *Server) HttpProxy(ctx context.Context, t string, header http.Header, data []byte) (*entity.GrpcResult, error) {
+	var headers []byte
+	if header != nil {
+		b, err := json.Marshal(header)
+		if err != nil {
+			return nil, err
+		}
+		headers = b
+	}
+	return s.request(ctx, StreamHttpProxy, func(req string) interface{} {
+		return &pb.HttpProxyRequest{Request: req, Type: t, Headers: headers, Data: data}
+	})
+}
+
+// request 在指定stream上发送请求并等待相同请求标识的结果
+func (s *Server) request(ctx context.Context, name string, build func(string) interface{}) (*entity.GrpcResult, error) {
+	req := fmt.Sprintf("%s-%d", name, atomic.AddInt64(&s.seq, 1))
+	ch := make(chan []byte, 1)
+	s.lock.Lock()
+	st, ok := s.streams[name]
+	if ok {
+		s.waiters[req] = ch
+	}
+	s.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("stream %s 未连接", name)
+	}
+	defer func() {
+		s.lock.Lock()
+		delete(s.waiters, req)
+		s.lock.Unlock()
+	}()
+	if err := st.send(req, build); err != nil {
+		return nil, fmt.Errorf("stream %s 发送请求错误: %w", name, err)
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case b := <-ch:
+		res := new(entity.GrpcResult)
+		if err := json.Unmarshal(b, res); err != nil {
+			return nil, fmt.Errorf("解析结果错误: %w", err)
+		}
+		return res, nil
+	}
+}
+
+// SetHeartbeatReply 设置是否回复驱动发送的心跳,不回复时模拟半开连接
+func (s *Server) SetHeartbeatReply(reply bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.noBeat = !reply
+}
+
+// Heartbeats 指定stream收到的心跳数量
+func (s *Server) Heartbeats(name string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.heartbeats[name]
+}
+
+// Connects 指定stream的连接次数
+func (s *Server) Connects(name string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.connects[name]
+}
+
+// serve 记录stream并把收到的结果分发给等待的请求,收到心跳时使用beat回复
+func (s *Server) serve(name string, beat interface{}, send func(interface{}) error, recv func() (string, []byte, error)) error {
+	st := &stream{}
+	st.send = func(request string, build func(string) interface{}) error {
+		st.lock.Lock()
+		defer st.lock.Unlock()
+		return send(build(request))
+	}
+	s.lock.Lock()
+	s.streams[name] = st
+	s.connects[name]++
+	close(s.notify)
+	s.notify = make(chan struct{})
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		if s.streams[name] == st {
+			delete(s.streams, name)
+		}
+		s.lock.Unlock()
+	}()
+	for {
+		req, msg, err := recv()
+		if err != nil {
+			return err
+		}
+		if req == driver.STREAM_HEARTBEAT {
+			s.lock.Lock()
+			s.heartbeats[name]++
+			reply := !s.noBeat
+			s.lock.Unlock()
+			if reply {
+				if err := st.send(req, func(string) interface{} { return beat }); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		s.lock.Lock()
+		ch, ok := s.waiters[req]
+		s.lock.Unlock()
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+// service 实现驱动管理的gRPC接口
+type service struct {
+	pb.UnimplementedDriverServiceServer
+	pb.UnimplementedDriverInstructServiceServer
+
+	s *Server
+}
+
+func (g *service) SchemaStream(st pb.DriverService_SchemaStreamServer) error {
+	return g.s.serve(StreamSchema, &pb.SchemaRequest{Request: driver.STREAM_HEARTBEAT}, func(m interface{}) error { return st.Send(m.(*pb.SchemaRequest)) }, func() (string, []byte, error) {
+		res, err := st.Recv()
+		return res.GetRequest(), res.GetMessage(), err
+	})
+}
+
+func (g *service) StartStream(st pb.DriverService_StartStreamServer) error {
+	return g.s.serve(StreamStart, &pb.StartRequest{Request: driver.STREAM_HEARTBEAT}, func(m interface{}) error { return st.Send(m.(*pb.StartRequest)) }, func() (string, []byte, error) {
+		res, err := st.Recv()
+		return res.GetRequest(), res.GetMessage(), err
+	})
+}
+
+func (g *service) RunStream(st pb.DriverService_RunStreamServer) error {
+	return g.s.serve(StreamRun, &pb.RunRequest{Request: driver.STREAM_HEARTBEAT}, func(m interface{}) error { return st.Send(m.(*pb.RunRequest)) }, func() (string, []byte, error) {
+		res, err := st.Recv()
+		return res.GetRequest(), res.GetMessage(), err
+	})
+}
+
+func (g *service) WriteTagStream(st pb.DriverService_WriteTagStreamServer) error {
+	return g.s.serve(StreamWriteTag, &pb.RunRequest{Request: driver.STREAM_HEARTBEAT}, func(m interface{}) error { return st.Send(m.(*pb.RunRequest)) }, func() (string, []byte, error) {
+		res, err := st.Recv()
+		return res.GetRequest(), res.GetMessage(), err
+	})
+}
+
+func (g *service) BatchRunStream(st pb.DriverService_BatchRunStreamServer) error {
+	return g.s.serve(StreamBatchRun, &pb.BatchRunRequest{Request: driver.STREAM_HEARTBEAT}, func(m interface{}) error { return st.Send(m.(*pb.BatchRunRequest)) }, func() (string, []byte, error) {
+		res, err := st.Recv()
+		return res.GetRequest(), res.GetMessage(), err
+	})
+}
+
+func (g *service) DebugStream(st pb.DriverService_DebugStreamServer) error {
+	return g.s.serve(StreamDebug, &pb.Debug{Request: driver.STREAM_HEARTBEAT}, func(m interface{}) error { return st.Send(m.(*pb.Debug)) }, func() (string, []byte, error) {
+		res, err := st.Recv()
+		return res.GetRequest(), res.GetData(), err
+	})
+}
+
+func (g *service) HttpProxyStream(st pb.DriverService_HttpProxyStreamServer) error {
+	return g.s.serve(StreamHttpProxy, &pb.HttpProxyRequest{Request: driver.STREAM_HEARTBEAT}, func(m interface{}) error { return st.Send(m.(*pb.HttpProxyRequest)) }, func() (string, []byte, error) {
+		res, err := st.Recv()
+		return res.GetRequest(), res.GetData(), err
+	})
+}
+
+func (g *service) HealthCheck(context.Context, *pb.HealthCheckRequest) (*pb.HealthCheckResponse, error) {
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	return g.s.health, nil
+}
+
+func (g *service) Event(_ context.Context, req *pb.Request) (*pb.Response, error) {
+	var e entity.Event
+	if err := json.Unmarshal(req.GetData(), &e); err != nil {
+		return &pb.Response{Status: false, Info: err.Error()}, nil
+	}
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	g.s.events = append(g.s.events, e)
+	return &pb.Response{Status: true}, nil
+}
+
+func (g *service) CommandLog(_ context.Context, req *pb.Request) (*pb.Response, error) {
+	var l entity.Log
+	if err := json.Unmarshal(req.GetData(), &l); err != nil {
+		return &pb.Response{Status: false, Info: err.Error()}, nil
+	}
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	g.s.runLogs = append(g.s.runLogs, l)
+	return &pb.Response{Status: true}, nil
+}
+
+func (g *service) UpdateTableData(_ context.Context, req *pb.Request) (*pb.Response, error) {
+	var d entity.TableData
+	if err := json.Unmarshal(req.GetData(), &d); err != nil {
+		return &pb.Response{Status: false, Info: err.Error()}, nil
+	}
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	g.s.tableData = append(g.s.tableData, d)
+	return &pb.Response{Status: true, Result: []byte("{}")}, nil
+}
+
+func (g *service) FindTableData(_ context.Context, req *pb.TableDataRequest) (*pb.Response, error) {
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	b, ok := g.s.devices[req.GetTableId()+"/"+req.GetTableDataId()]
+	if !ok {
+		return &pb.Response{Status: false, Code: 404, Info: "设备未找到"}, nil
+	}
+	return &pb.Response{Status: true, Result: b}, nil
+}
+
+func (g *service) GetCommands(_ context.Context, req *pb.RequestCommand) (*api.Response, error) {
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	b, ok := g.s.commands[req.GetTableId()+"/"+req.GetTableDataId()]
+	if !ok {
+		b = []byte("[]")
+	}
+	return &api.Response{Status: true, Result: b}, nil
+}
+
+func (g *service) Update(_ context.Context, req *api.UpdateRequest) (*api.Response, error) {
+	var d entity.DriverInstruct
+	if err := json.Unmarshal(req.GetData(), &d); err != nil {
+		return &api.Response{Status: false, Info: err.Error()}, nil
+	}
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	if !g.s.instructs[req.GetId()] {
+		g.s.rejectedUpdates = append(g.s.rejectedUpdates, CommandUpdate{ID: req.GetId(), Data: d})
+		return &api.Response{Status: false, Code: 404, Info: "指令未找到"}, nil
+	}
+	g.s.commandUpdates = append(g.s.commandUpdates, CommandUpdate{ID: req.GetId(), Data: d})
+	return &api.Response{Status: true}, nil
+}
@@ -0,0 +1,14 @@
+package entity
+
+const (
+	DeviceOnline  = "online"
+	DeviceOffline = "offline"
+)
+
+// DeviceStatus 设备在线状态
+type DeviceStatus struct {
+	Table  string `json:"table"`  // 表id
+	ID     string `json:"id"`     // 设备编号
+	Status string `json:"status"` // 在线状态 online或offline
+	Time   int64  `json:"time"`   // 状态变化时间 毫秒数
+}
@@ -1,5 +1,11 @@
 package entity
 
+// GrpcCodeBusy 请求队列已满,驱动暂时无法处理请求
+const GrpcCodeBusy = 429
+
+// GrpcCodeUnavailable 驱动正在停止,不再处理新请求
+const GrpcCodeUnavailable = 503
+
 type GrpcResult struct {
 	Code   int         `json:"code"`
 	Error  string      `json:"error"`
@@ -1,13 +1,31 @@
 package entity
 
+import (
+	"fmt"
+
+	"github.com/air-iot/json"
+)
+
 type Tag struct {
 	ID   string `json:"id" description:"ID"`
 	Name string `json:"name" description:"自定义名称"`
+	// Expression 计算数据点表达式,不为空时数据点值由同一设备的其他数据点计算,表达式中使用数据点ID或tags["数据点ID"]引用
+	Expression string `json:"expression"`
 	//以下为通用值计算相关属性
 	TagValue *TagValue `json:"tagValue"`
 	Fixed    *int32    `json:"fixed"`
 	Mod      *float64  `json:"mod"`
 	Range    *Range    `json:"range"`
+	Deadband *Deadband `json:"deadband"`
+	// Transforms 按顺序执行的值转换. TagValue、Mod在transforms之前计算,Fixed在最后计算,
+	// transforms中包含tagValue、fixed、mod时按配置的位置计算,不再使用同名字段
+	Transforms []Transform `json:"transforms"`
+}
+
+// Transform 值转换步骤, Type为内置或驱动注册的转换名称, Params为转换参数
+type Transform struct {
+	Type   string                 `json:"type"`
+	Params map[string]interface{} `json:"params"`
 }
 
 type TagValue struct {
@@ -50,6 +68,17 @@ type Range struct {
 	InvalidAction InvalidAction    `json:"invalidAction"`
 }
 
+// Deadband 死区设置,值的变化未超过死区时不上报,超过最大静默时间时强制上报一次
+type Deadband struct {
+	Enable *bool `json:"enable"`
+	// Absolute 绝对死区,与上次上报值的差值绝对值
+	Absolute *float64 `json:"absolute"`
+	// Percent 百分比死区,差值占上次上报值绝对值的百分比
+	Percent *float64 `json:"percent"`
+	// MaxSilence 最大静默时间,单位秒
+	MaxSilence *int64 `json:"maxSilence"`
+}
+
 type ConditionMode string
 
 const (
@@ -77,18 +106,86 @@ type RangeCondition struct {
 }
 
 type Instance struct {
-	ID      string  `json:"id"`
-	Debug   *bool   `json:"debug"`
-	GroupId string  `json:"groupId"`
-	Tables  []table `json:"tables"`
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Debug   *bool  `json:"debug"`
+	GroupId string `json:"groupId"`
+	// Config 实例的驱动配置
+	Config DriverConfig    `json:"device"`
+	Tables []InstanceTable `json:"tables"`
 }
 
-// table 设置
-type table struct {
-	Id      string   `json:"id"`
-	Devices []Device `json:"devices"`
+// InstanceTable 实例下的表(模型)
+type InstanceTable struct {
+	Id string `json:"id"`
+	// Config 模型的驱动配置,设备未设置的配置项使用模型的配置
+	Config  DriverConfig `json:"device"`
+	Devices []Device     `json:"devices"`
 }
 
 type Device struct {
-	Id string `json:"id"`
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// Config 设备的驱动配置
+	Config DriverConfig `json:"device"`
+}
+
+// DriverConfig 实例、模型或设备上的驱动配置,Settings为驱动自定义的配置项
+type DriverConfig struct {
+	Driver   string                 `json:"driver"`
+	Settings map[string]interface{} `json:"settings"`
+	Tags     []Tag                  `json:"tags"`
+	// Invalid 解析时忽略的配置项和数据点的错误
+	Invalid []error `json:"-"`
+}
+
+// rawConfig 保留原始json,逐项解析时使用
+type rawConfig []byte
+
+func (r *rawConfig) UnmarshalJSON(b []byte) error {
+	*r = append((*r)[:0], b...)
+	return nil
+}
+
+// UnmarshalJSON 逐项解析驱动配置,类型不符的配置项和数据点不返回错误,跳过后记录到Invalid.
+// 驱动可能使用同名但类型不同的字段,解析失败不能影响驱动启动
+func (c *DriverConfig) UnmarshalJSON(b []byte) error {
+	*c = DriverConfig{}
+	var raw struct {
+		Driver   rawConfig `json:"driver"`
+		Settings rawConfig `json:"settings"`
+		Tags     rawConfig `json:"tags"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		c.Invalid = append(c.Invalid, fmt.Errorf("驱动配置格式错误: %w", err))
+		return nil
+	}
+	if len(raw.Driver) > 0 {
+		if err := json.Unmarshal(raw.Driver, &c.Driver); err != nil {
+			c.Invalid = append(c.Invalid, fmt.Errorf("driver错误: %w", err))
+		}
+	}
+	if len(raw.Settings) > 0 {
+		if err := json.Unmarshal(raw.Settings, &c.Settings); err != nil {
+			c.Invalid = append(c.Invalid, fmt.Errorf("settings错误: %w", err))
+		}
+	}
+	if len(raw.Tags) == 0 {
+		return nil
+	}
+	var tags []rawConfig
+	if err := json.Unmarshal(raw.Tags, &tags); err != nil {
+		c.Invalid = append(c.Invalid, fmt.Errorf("tags错误: %w", err))
+		return nil
+	}
+	c.Tags = make([]Tag, 0, len(tags))
+	for i, t := range tags {
+		var tag Tag
+		if err := json.Unmarshal(t, &tag); err != nil {
+			c.Invalid = append(c.Invalid, fmt.Errorf("第%d个数据点错误: %w", i+1, err))
+			continue
+		}
+		c.Tags = append(c.Tags, tag)
+	}
+	return nil
 }
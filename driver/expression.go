@@ -0,0 +1,110 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/shopspring/decimal"
+
+	"github.com/air-iot/sdk-go/v4/driver/convert"
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+	"github.com/air-iot/sdk-go/v4/utils/numberx"
+)
+
+var (
+	// programs 已编译的表达式
+	programs sync.Map
+	// runtimes goja.Runtime不能并发使用,每次计算从池中获取
+	runtimes = sync.Pool{New: func() interface{} { return goja.New() }}
+	// expressionTimeout 单次表达式计算的最长时间,超时后中断计算,避免死循环阻塞写数据点
+	expressionTimeout = time.Second
+)
+
+// compileExpression 编译表达式,相同表达式只编译一次.
+// 表达式包装为函数,使用with语句引用数据点. with内的函数使用严格模式计算表达式,
+// 给未声明的变量赋值时返回错误,避免写入池中Runtime的全局变量影响其他设备的计算
+func compileExpression(expr string) (*goja.Program, error) {
+	if p, ok := programs.Load(expr); ok {
+		return p.(*goja.Program), nil
+	}
+	p, err := goja.Compile("expression", fmt.Sprintf("(function(tags){with(tags){return (function(){'use strict';return (%s\n);})();}})", expr), false)
+	if err != nil {
+		return nil, fmt.Errorf("表达式编译错误: %w", err)
+	}
+	programs.Store(expr, p)
+	return p, nil
+}
+
+// evalExpression 使用数据点值计算表达式. 超时或panic后Runtime状态不确定,不再放回池中
+func evalExpression(expr string, values map[string]interface{}) (ret interface{}, err error) {
+	p, err := compileExpression(expr)
+	if err != nil {
+		return nil, err
+	}
+	vm := runtimes.Get().(*goja.Runtime)
+	timeout := expressionTimeout
+	timer := time.AfterFunc(timeout, func() {
+		vm.Interrupt(fmt.Sprintf("超过%s", timeout))
+	})
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("表达式计算错误: %v", r)
+		}
+		// 定时器已触发时中断标记可能在计算结束后才设置
+		var interrupted *goja.InterruptedError
+		if timer.Stop() && r == nil && !errors.As(err, &interrupted) {
+			runtimes.Put(vm)
+		}
+	}()
+	fn, err := vm.RunProgram(p)
+	if err != nil {
+		return nil, fmt.Errorf("表达式计算错误: %w", err)
+	}
+	call, ok := goja.AssertFunction(fn)
+	if !ok {
+		return nil, fmt.Errorf("表达式计算错误: 不是函数")
+	}
+	tags := vm.NewObject()
+	for k, v := range values {
+		if err := tags.Set(k, v); err != nil {
+			return nil, fmt.Errorf("表达式设置数据点 %s 错误: %w", k, err)
+		}
+	}
+	res, err := call(goja.Undefined(), tags)
+	if err != nil {
+		return nil, fmt.Errorf("表达式计算错误: %w", err)
+	}
+	if goja.IsUndefined(res) || goja.IsNull(res) {
+		return nil, fmt.Errorf("表达式计算结果为空")
+	}
+	return res.Export(), nil
+}
+
+// computeTag 计算表达式数据点. 数值结果按数据点的值转换计算后返回float64,其他类型返回可直接发送的值
+func computeTag(tag *entity.Tag, pipeline *convert.Pipeline, fieldType numberx.FieldType, values map[string]interface{}) (interface{}, numberx.FieldType, error) {
+	res, err := evalExpression(tag.Expression, values)
+	if err != nil {
+		return nil, "", err
+	}
+	normalized, valueType, err := normalizeValue(fieldType, res)
+	if err != nil {
+		return nil, "", err
+	}
+	value, ok := normalized.(decimal.Decimal)
+	if !ok {
+		return normalized, valueType, nil
+	}
+	if value, err = pipeline.Apply(value); err != nil {
+		return nil, "", err
+	}
+	f, _ := value.Float64()
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, "", ErrInvalidValue
+	}
+	return f, valueType, nil
+}
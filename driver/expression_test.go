@@ -0,0 +1,93 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/air-iot/json"
+	"github.com/dop251/goja"
+
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+)
+
+func TestEvalExpression(t *testing.T) {
+	values := map[string]interface{}{"v": 220.0, "i": 2.5, "status": 6.0, "a-b": 1.0}
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		{"v * i", int64(550)},
+		{"(status & 0x04) != 0", true},
+		{`tags["a-b"] + 1`, int64(2)},
+	}
+	for _, tt := range tests {
+		got, err := evalExpression(tt.expr, values)
+		if err != nil {
+			t.Fatalf("evalExpression(%s) error = %v", tt.expr, err)
+		}
+		if got != tt.want {
+			t.Fatalf("evalExpression(%s) = %v(%T), want %v", tt.expr, got, got, tt.want)
+		}
+	}
+	if _, err := evalExpression("missing * 2", values); err == nil {
+		t.Fatal("引用不存在的数据点应返回错误")
+	}
+	if _, err := evalExpression("v *", values); err == nil {
+		t.Fatal("表达式语法错误应返回错误")
+	}
+	// 给未声明的变量赋值返回错误,不写入Runtime的全局变量
+	if _, err := evalExpression("x = 1", values); err == nil {
+		t.Fatal("给未声明的变量赋值应返回错误")
+	}
+	for i := 0; i < 10; i++ {
+		if got, err := evalExpression("typeof x", values); err != nil || got != "undefined" {
+			t.Fatalf("evalExpression(typeof x) = %v, %v", got, err)
+		}
+	}
+}
+
+func TestEvalExpressionTimeout(t *testing.T) {
+	defer func(d time.Duration) { expressionTimeout = d }(expressionTimeout)
+	expressionTimeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err := evalExpression("(function(){while(true){}})()", map[string]interface{}{})
+	var interrupted *goja.InterruptedError
+	if !errors.As(err, &interrupted) {
+		t.Fatalf("evalExpression() error = %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("中断耗时 %s", d)
+	}
+	// 中断的Runtime不放回池中,之后的计算不受影响
+	for i := 0; i < 10; i++ {
+		if got, err := evalExpression("v + 1", map[string]interface{}{"v": 1.0}); err != nil || got != int64(2) {
+			t.Fatalf("evalExpression() = %v, %v", got, err)
+		}
+	}
+}
+
+func TestApp_WritePointsComputed(t *testing.T) {
+	Cfg.Project = "p"
+	Cfg.MQ.Timeout = time.Second
+	m := new(memMQ)
+	a := &app{mq: m, cli: &Client{}}
+	err := a.writePoints(context.Background(), "t", entity.Point{ID: "d1", Fields: []entity.Field{
+		{Tag: entity.Tag{ID: "v"}, Value: 220},
+		{Tag: entity.Tag{ID: "i"}, Value: 2.5},
+		{Tag: entity.Tag{ID: "p", Expression: "v * i"}},
+		{Tag: entity.Tag{ID: "bad", Expression: "x * i"}},
+	}})
+	var pointErr *PointError
+	if !errors.As(err, &pointErr) || len(pointErr.Fields) != 1 || pointErr.Fields[0].Tag != "bad" {
+		t.Fatalf("writePoints() error = %v", err)
+	}
+	var p entity.WritePoint
+	if err := json.Unmarshal(m.published["data/p/t/d1"][0], &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Fields["p"] != float64(550) {
+		t.Fatalf("数据点 = %+v", p.Fields)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"time"
 
 	"google.golang.org/grpc/metadata"
+
+	"github.com/air-iot/sdk-go/v4/utils/grpcx"
+	"github.com/air-iot/sdk-go/v4/utils/tlsx"
 )
 
 type Config struct {
@@ -16,11 +19,16 @@ type Config struct {
 		Retry       int           `json:"retry" yaml:"retry"`
 	} `json:"health" yaml:"health"`
 	Stream struct {
-		Heartbeat time.Duration `json:"heartbeat" yaml:"heartbeat"`
+		Heartbeat   time.Duration `json:"heartbeat" yaml:"heartbeat"`     // 心跳间隔,为0时不发送心跳
+		MissedBeats int           `json:"missedBeats" yaml:"missedBeats"` // 连续多少个心跳间隔未收到数据时关闭stream
+		MaxBackoff  time.Duration `json:"maxBackoff" yaml:"maxBackoff"`   // stream重连最大等待时间,初始等待时间为WaitTime
+		Jitter      float64       `json:"jitter" yaml:"jitter"`           // 重连等待时间的随机抖动比例,取值(0,1)
 	} `json:"stream" yaml:"stream"`
 	WaitTime time.Duration `json:"waitTime" yaml:"waitTime"`
 	Timeout  time.Duration `json:"timeout" yaml:"timeout"`
 	Limit    int           `json:"limit" yaml:"limit"`
+	TLS      tlsx.Config   `json:"tls" yaml:"tls"`     // 传输层加密及双向认证
+	Token    grpcx.Token   `json:"token" yaml:"token"` // 每个请求携带的Bearer令牌
 }
 
 func GetGrpcContext(ctx context.Context, serviceId, projectId, driverId, driverName, sessionId string) context.Context {
@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"context"
+	"sync"
+)
+
+// inflight 记录正在处理的请求数量,关闭后不再接收新请求
+type inflight struct {
+	lock   sync.Mutex
+	n      int
+	closed bool
+	idle   chan struct{}
+}
+
+// add 开始处理请求,已关闭时返回false
+func (f *inflight) add() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return false
+	}
+	f.n++
+	return true
+}
+
+// done 请求处理完成
+func (f *inflight) done() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.n--
+	if f.n == 0 && f.idle != nil {
+		close(f.idle)
+		f.idle = nil
+	}
+}
+
+// wait 关闭并等待正在处理的请求完成
+func (f *inflight) wait(ctx context.Context) error {
+	f.lock.Lock()
+	f.closed = true
+	if f.n == 0 {
+		f.lock.Unlock()
+		return nil
+	}
+	if f.idle == nil {
+		f.idle = make(chan struct{})
+	}
+	idle := f.idle
+	f.lock.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
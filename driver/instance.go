@@ -0,0 +1,249 @@
+package driver
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/air-iot/json"
+	"github.com/air-iot/logger"
+
+	"github.com/air-iot/sdk-go/v4/driver/convert"
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+)
+
+// instanceConfig 最近一次start请求的实例配置及按表、设备的索引
+type instanceConfig struct {
+	instance *entity.Instance
+	tables   map[string]*entity.InstanceTable
+	devices  map[string]map[string]*entity.Device
+}
+
+func newInstanceConfig(instance *entity.Instance) *instanceConfig {
+	c := &instanceConfig{
+		instance: instance,
+		tables:   make(map[string]*entity.InstanceTable, len(instance.Tables)),
+		devices:  make(map[string]map[string]*entity.Device, len(instance.Tables)),
+	}
+	for i := range instance.Tables {
+		t := &instance.Tables[i]
+		c.tables[t.Id] = t
+		devices := make(map[string]*entity.Device, len(t.Devices))
+		for j := range t.Devices {
+			devices[t.Devices[j].Id] = &t.Devices[j]
+		}
+		c.devices[t.Id] = devices
+	}
+	// 加载配置时检查值转换配置,写数据点时按驱动传入的数据点创建
+	for table, devices := range c.devices {
+		for id := range devices {
+			cfg, err := c.deviceConfig(table, id)
+			if err != nil {
+				continue
+			}
+			for i := range cfg.Tags {
+				if _, err := convert.Compile(&cfg.Tags[i]); err != nil {
+					logger.Warnf("实例配置: 设备表=%s,设备=%s,数据点=%s. 值转换配置错误. %v", table, id, cfg.Tags[i].ID, err)
+				}
+			}
+		}
+	}
+	return c
+}
+
+// logInvalidConfig 记录解析实例配置时忽略的驱动配置项和数据点
+func logInvalidConfig(cfg *entity.Instance) {
+	for _, err := range cfg.Config.Invalid {
+		logger.Warnf("实例配置: 忽略无效的驱动配置. %v", err)
+	}
+	for _, t := range cfg.Tables {
+		for _, err := range t.Config.Invalid {
+			logger.Warnf("实例配置: 设备表=%s. 忽略无效的驱动配置. %v", t.Id, err)
+		}
+		for _, d := range t.Devices {
+			for _, err := range d.Config.Invalid {
+				logger.Warnf("实例配置: 设备表=%s,设备=%s. 忽略无效的驱动配置. %v", t.Id, d.Id, err)
+			}
+		}
+	}
+}
+
+// deviceConfig 合并模型和设备的驱动配置,设备的配置项覆盖模型的同名配置项,数据点按ID覆盖
+func (c *instanceConfig) deviceConfig(table, id string) (*entity.DriverConfig, error) {
+	t, ok := c.tables[table]
+	if !ok {
+		return nil, fmt.Errorf("实例配置中没有表 %s", table)
+	}
+	device, ok := c.devices[table][id]
+	if !ok {
+		return nil, fmt.Errorf("表 %s 中没有设备 %s", table, id)
+	}
+	driver := device.Config.Driver
+	if driver == "" {
+		driver = t.Config.Driver
+	}
+	return &entity.DriverConfig{
+		Driver:   driver,
+		Settings: mergeSettings(t.Config.Settings, device.Config.Settings),
+		Tags:     mergeTags(t.Config.Tags, device.Config.Tags),
+	}, nil
+}
+
+// mergeSettings 返回合并后的新配置,两边都是对象的配置项递归合并,其余使用override的值
+func mergeSettings(base, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		if o, ok := v.(map[string]interface{}); ok {
+			if b, ok := merged[k].(map[string]interface{}); ok {
+				merged[k] = mergeSettings(b, o)
+				continue
+			}
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// mergeTags 按base的顺序合并数据点,override中同ID的数据点替换base中的数据点,新的数据点追加到末尾
+func mergeTags(base, override []entity.Tag) []entity.Tag {
+	merged := make([]entity.Tag, 0, len(base)+len(override))
+	index := make(map[string]int, len(base)+len(override))
+	for _, tags := range [][]entity.Tag{base, override} {
+		for _, tag := range tags {
+			if i, ok := index[tag.ID]; ok {
+				merged[i] = tag
+				continue
+			}
+			index[tag.ID] = len(merged)
+			merged = append(merged, tag)
+		}
+	}
+	return merged
+}
+
+// instanceConfig 返回最近一次start请求的实例配置,驱动未启动时返回错误
+func (a *app) instanceConfig() (*instanceConfig, error) {
+	if a.cli == nil {
+		return nil, fmt.Errorf("驱动未启动,没有实例配置")
+	}
+	c := a.cli.config.Load()
+	if c == nil {
+		return nil, fmt.Errorf("驱动未启动,没有实例配置")
+	}
+	return c, nil
+}
+
+func (a *app) GetTables() []string {
+	c, err := a.instanceConfig()
+	if err != nil {
+		return nil
+	}
+	tables := make([]string, 0, len(c.instance.Tables))
+	for _, t := range c.instance.Tables {
+		tables = append(tables, t.Id)
+	}
+	return tables
+}
+
+func (a *app) GetDevices(table string) []string {
+	c, err := a.instanceConfig()
+	if err != nil {
+		return nil
+	}
+	t, ok := c.tables[table]
+	if !ok {
+		return nil
+	}
+	devices := make([]string, 0, len(t.Devices))
+	for _, d := range t.Devices {
+		devices = append(devices, d.Id)
+	}
+	return devices
+}
+
+func (a *app) GetInstanceConfig() (*entity.DriverConfig, error) {
+	c, err := a.instanceConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg := c.instance.Config
+	return &cfg, nil
+}
+
+func (a *app) GetDeviceConfig(table, id string) (*entity.DriverConfig, error) {
+	c, err := a.instanceConfig()
+	if err != nil {
+		return nil, err
+	}
+	return c.deviceConfig(table, id)
+}
+
+// maxPipelineCache 缓存的值转换数量上限,超过时清空重新创建
+const maxPipelineCache = 4096
+
+// pipelineCache 按数据点的值转换配置缓存创建的值转换,配置相同的数据点共用
+type pipelineCache struct {
+	lock  sync.RWMutex
+	items map[string]compiledPipeline
+}
+
+type compiledPipeline struct {
+	pipeline *convert.Pipeline
+	err      error
+}
+
+// get 返回数据点的值转换,只使用tagValue、fixed、mod和transforms配置
+func (c *pipelineCache) get(tag *entity.Tag) (*convert.Pipeline, error) {
+	b, err := json.Marshal(entity.Tag{TagValue: tag.TagValue, Fixed: tag.Fixed, Mod: tag.Mod, Transforms: tag.Transforms})
+	if err != nil {
+		return convert.Compile(tag)
+	}
+	key := string(b)
+	c.lock.RLock()
+	p, ok := c.items[key]
+	c.lock.RUnlock()
+	if ok {
+		return p.pipeline, p.err
+	}
+	p.pipeline, p.err = convert.Compile(tag)
+	c.lock.Lock()
+	if c.items == nil || len(c.items) >= maxPipelineCache {
+		c.items = make(map[string]compiledPipeline)
+	}
+	c.items[key] = p
+	c.lock.Unlock()
+	return p.pipeline, p.err
+}
+
+// pipeline 按驱动传入的数据点配置返回值转换
+func (a *app) pipeline(tag *entity.Tag) (*convert.Pipeline, error) {
+	return a.pipelines.get(tag)
+}
+
+// InstanceSettings 将实例的驱动配置项解析为驱动自定义的结构体
+func InstanceSettings[T any](a App) (T, error) {
+	var ret T
+	cfg, err := a.GetInstanceConfig()
+	if err != nil {
+		return ret, err
+	}
+	if err := json.CopyByJson(&ret, cfg.Settings); err != nil {
+		return ret, fmt.Errorf("解析实例配置项错误: %w", err)
+	}
+	return ret, nil
+}
+
+// DeviceSettings 将设备合并后的驱动配置项解析为驱动自定义的结构体
+func DeviceSettings[T any](a App, table, id string) (T, error) {
+	var ret T
+	cfg, err := a.GetDeviceConfig(table, id)
+	if err != nil {
+		return ret, err
+	}
+	if err := json.CopyByJson(&ret, cfg.Settings); err != nil {
+		return ret, fmt.Errorf("解析设备 %s/%s 配置项错误: %w", table, id, err)
+	}
+	return ret, nil
+}
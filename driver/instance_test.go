@@ -0,0 +1,151 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/air-iot/json"
+	"github.com/shopspring/decimal"
+
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+)
+
+func TestInstanceConfig(t *testing.T) {
+	if tables := new(app).GetTables(); tables != nil {
+		t.Fatalf("未启动时 GetTables() = %v", tables)
+	}
+	a := &app{cli: &Client{}}
+	if tables := a.GetTables(); tables != nil {
+		t.Fatalf("未启动时 GetTables() = %v", tables)
+	}
+	if _, err := DeviceSettings[map[string]interface{}](a, "t1", "d1"); err == nil {
+		t.Fatal("未启动时应返回错误")
+	}
+
+	var cfg entity.Instance
+	if err := json.Unmarshal([]byte(`{
+		"id":"i1",
+		"device":{"settings":{"server":"tcp://127.0.0.1:1883"}},
+		"tables":[{
+			"id":"t1",
+			"device":{"driver":"test","settings":{"interval":10,"network":{"ip":"10.0.0.1","port":502}},"tags":[{"id":"a","name":"A"},{"id":"b"}]},
+			"devices":[
+				{"id":"d1","device":{"settings":{"network":{"ip":"10.0.0.2"}},"tags":[{"id":"a","name":"A1"},{"id":"c"}]}},
+				{"id":"d2"}
+			]
+		}]
+	}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	a.cli.loadInstance(&cfg)
+
+	if tables := a.GetTables(); len(tables) != 1 || tables[0] != "t1" {
+		t.Fatalf("GetTables() = %v", tables)
+	}
+	if devices := a.GetDevices("t1"); len(devices) != 2 || devices[1] != "d2" {
+		t.Fatalf("GetDevices() = %v", devices)
+	}
+	if devices := a.GetDevices("t2"); devices != nil {
+		t.Fatalf("不存在的表 GetDevices() = %v", devices)
+	}
+
+	device, err := a.GetDeviceConfig("t1", "d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Driver != "test" || len(device.Tags) != 3 || device.Tags[0].Name != "A1" || device.Tags[2].ID != "c" {
+		t.Fatalf("GetDeviceConfig() = %+v", device)
+	}
+
+	type settings struct {
+		Interval int `json:"interval"`
+		Network  struct {
+			IP   string `json:"ip"`
+			Port int    `json:"port"`
+		} `json:"network"`
+	}
+	s, err := DeviceSettings[settings](a, "t1", "d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Interval != 10 || s.Network.IP != "10.0.0.2" || s.Network.Port != 502 {
+		t.Fatalf("DeviceSettings() = %+v", s)
+	}
+	if s, err := DeviceSettings[settings](a, "t1", "d2"); err != nil || s.Network.IP != "10.0.0.1" {
+		t.Fatalf("没有设备配置时 DeviceSettings() = %+v, %v", s, err)
+	}
+	if _, err := a.GetDeviceConfig("t1", "d3"); err == nil {
+		t.Fatal("不存在的设备应返回错误")
+	}
+
+	instance, err := InstanceSettings[struct {
+		Server string `json:"server"`
+	}](a)
+	if err != nil || instance.Server != "tcp://127.0.0.1:1883" {
+		t.Fatalf("InstanceSettings() = %+v, %v", instance, err)
+	}
+}
+
+func TestInstanceConfigInvalid(t *testing.T) {
+	var cfg entity.Instance
+	// 类型不符的数据点和配置项被忽略,不影响其他配置
+	if err := json.Unmarshal([]byte(`{
+		"id":"i1",
+		"device":{"settings":"bad"},
+		"tables":[{
+			"id":"t1",
+			"device":{"driver":"test","tags":[{"id":"a","fixed":"2"},{"id":"b","fixed":2}]},
+			"devices":[{"id":"d1","device":{"tags":{"id":"c"}}}]
+		}]
+	}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Config.Invalid) != 1 || cfg.Config.Settings != nil {
+		t.Fatalf("实例配置 = %+v", cfg.Config)
+	}
+	table := cfg.Tables[0].Config
+	if table.Driver != "test" || len(table.Tags) != 1 || table.Tags[0].ID != "b" || len(table.Invalid) != 1 {
+		t.Fatalf("表配置 = %+v", table)
+	}
+	if len(cfg.Tables[0].Devices[0].Config.Invalid) != 1 {
+		t.Fatalf("设备配置 = %+v", cfg.Tables[0].Devices[0].Config)
+	}
+
+	a := &app{cli: &Client{}}
+	a.cli.loadInstance(&cfg)
+	device, err := a.GetDeviceConfig("t1", "d1")
+	if err != nil || len(device.Tags) != 1 || device.Tags[0].ID != "b" {
+		t.Fatalf("GetDeviceConfig() = %+v, %v", device, err)
+	}
+}
+
+func TestApp_Pipeline(t *testing.T) {
+	a := &app{cli: &Client{}}
+	var cfg entity.Instance
+	if err := json.Unmarshal([]byte(`{"id":"i1","tables":[{"id":"t1","device":{"tags":[{"id":"a","fixed":1}]},"devices":[{"id":"d1"}]}]}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	a.cli.loadInstance(&cfg)
+
+	// 使用驱动传入的数据点配置,不使用实例配置中的同名数据点
+	fixed := int32(3)
+	tag := entity.Tag{ID: "a", Fixed: &fixed}
+	p, err := a.pipeline(&tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := p.Apply(decimal.NewFromFloat(1.23456)); err != nil || v.String() != "1.235" {
+		t.Fatalf("Apply() = %v, %v", v, err)
+	}
+	// 值转换配置相同的数据点共用缓存的值转换
+	other := entity.Tag{ID: "b", Name: "B", Fixed: &fixed}
+	if cached, _ := a.pipeline(&other); cached != p {
+		t.Fatal("相同配置的数据点未使用缓存")
+	}
+	fixed2 := int32(1)
+	if changed, _ := a.pipeline(&entity.Tag{ID: "a", Fixed: &fixed2}); changed == p {
+		t.Fatal("配置变化后仍使用原来的值转换")
+	}
+	if _, err := a.pipeline(&entity.Tag{ID: "a", Transforms: []entity.Transform{{Type: "unknown"}}}); err == nil {
+		t.Fatal("未注册的转换应返回错误")
+	}
+}
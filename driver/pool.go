@@ -0,0 +1,136 @@
+package driver
+
+import (
+	"sync"
+)
+
+const defaultWorkerQueueSize = 1000
+
+// WorkerConfig 驱动管理下发请求的处理配置
+type WorkerConfig struct {
+	Workers   int  `json:"workers" yaml:"workers"`     // 同时处理的请求数量,小于等于0时不限制
+	QueueSize int  `json:"queueSize" yaml:"queueSize"` // 等待处理的请求数量上限,队列已满时返回繁忙
+	Serial    bool `json:"serial" yaml:"serial"`       // 同一设备的请求按接收顺序依次处理
+}
+
+// WorkersConfig 各类请求的处理配置
+type WorkersConfig struct {
+	Schema    WorkerConfig `json:"schema" yaml:"schema"`
+	Run       WorkerConfig `json:"run" yaml:"run"`
+	WriteTag  WorkerConfig `json:"writeTag" yaml:"writeTag"`
+	BatchRun  WorkerConfig `json:"batchRun" yaml:"batchRun"`
+	Debug     WorkerConfig `json:"debug" yaml:"debug"`
+	HttpProxy WorkerConfig `json:"httpProxy" yaml:"httpProxy"`
+}
+
+type poolTask struct {
+	key string
+	run func()
+}
+
+// workerPool 限制同时处理的请求数量和等待队列长度.
+// 开启Serial时,key相同的请求在前一个请求处理完成后才进入队列
+type workerPool struct {
+	cfg     WorkerConfig
+	lock    sync.Mutex
+	queued  int
+	closed  bool
+	tasks   chan *poolTask
+	pending map[string][]*poolTask
+}
+
+func newWorkerPool(cfg WorkerConfig) *workerPool {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultWorkerQueueSize
+	}
+	p := &workerPool{cfg: cfg, pending: make(map[string][]*poolTask)}
+	if cfg.Workers > 0 {
+		p.tasks = make(chan *poolTask, cfg.QueueSize)
+		for i := 0; i < cfg.Workers; i++ {
+			go p.worker()
+		}
+	}
+	return p
+}
+
+// submit 提交请求,队列已满或已关闭时返回false
+func (p *workerPool) submit(key string, run func()) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return false
+	}
+	if !p.cfg.Serial {
+		key = ""
+	}
+	t := &poolTask{key: key, run: run}
+	if key != "" {
+		if q, ok := p.pending[key]; ok {
+			if p.queued >= p.cfg.QueueSize {
+				return false
+			}
+			p.pending[key] = append(q, t)
+			p.queued++
+			return true
+		}
+	}
+	if p.tasks != nil && p.queued >= p.cfg.QueueSize {
+		return false
+	}
+	if key != "" {
+		p.pending[key] = nil
+	}
+	p.dispatch(t)
+	return true
+}
+
+// dispatch 需要持有锁. 队列中的请求数量不超过QueueSize,写入tasks不会阻塞;
+// 关闭后设备剩余的请求直接在新协程中处理
+func (p *workerPool) dispatch(t *poolTask) {
+	if p.tasks == nil || p.closed {
+		go p.exec(t)
+		return
+	}
+	p.queued++
+	p.tasks <- t
+}
+
+func (p *workerPool) worker() {
+	for t := range p.tasks {
+		p.lock.Lock()
+		p.queued--
+		p.lock.Unlock()
+		p.exec(t)
+	}
+}
+
+func (p *workerPool) exec(t *poolTask) {
+	t.run()
+	if t.key == "" {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	q := p.pending[t.key]
+	if len(q) == 0 {
+		delete(p.pending, t.key)
+		return
+	}
+	p.pending[t.key] = q[1:]
+	p.queued--
+	p.dispatch(q[0])
+}
+
+// close 停止接收请求,已接收的请求处理完成后协程退出
+func (p *workerPool) close() {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return
+	}
+	p.closed = true
+	if p.tasks != nil {
+		close(p.tasks)
+	}
+	p.lock.Unlock()
+}
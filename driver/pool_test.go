@@ -0,0 +1,91 @@
+package driver
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool_Limit(t *testing.T) {
+	p := newWorkerPool(WorkerConfig{Workers: 2, QueueSize: 2})
+	defer p.close()
+	var running, maxRunning int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	run := func() {
+		defer wg.Done()
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+	}
+	wg.Add(2)
+	p.submit("", run)
+	p.submit("", run)
+	for atomic.LoadInt32(&running) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	wg.Add(2)
+	if !p.submit("", run) || !p.submit("", run) {
+		t.Fatal("队列未满时提交失败")
+	}
+	if p.submit("", run) {
+		t.Fatal("队列已满时应提交失败")
+	}
+	close(release)
+	wg.Wait()
+	if maxRunning != 2 {
+		t.Fatalf("同时处理数量 = %d, want 2", maxRunning)
+	}
+}
+
+func TestWorkerPool_Serial(t *testing.T) {
+	for _, workers := range []int{0, 4} {
+		p := newWorkerPool(WorkerConfig{Workers: workers, QueueSize: 100, Serial: true})
+		var (
+			lock    sync.Mutex
+			order   = map[string][]int{}
+			running = map[string]bool{}
+			wg      sync.WaitGroup
+		)
+		for i := 0; i < 20; i++ {
+			key := []string{"t/d1", "t/d2"}[i%2]
+			i := i
+			wg.Add(1)
+			if !p.submit(key, func() {
+				defer wg.Done()
+				lock.Lock()
+				if running[key] {
+					t.Errorf("设备 %s 的请求并发执行", key)
+				}
+				running[key] = true
+				lock.Unlock()
+				time.Sleep(time.Millisecond)
+				lock.Lock()
+				running[key] = false
+				order[key] = append(order[key], i)
+				lock.Unlock()
+			}) {
+				t.Fatal("提交失败")
+			}
+		}
+		wg.Wait()
+		p.close()
+		for key, seq := range order {
+			for j := 1; j < len(seq); j++ {
+				if seq[j] < seq[j-1] {
+					t.Fatalf("workers=%d: 设备 %s 处理顺序 = %v", workers, key, seq)
+				}
+			}
+		}
+		if p.submit("t/d1", func() {}) {
+			t.Fatal("关闭后应提交失败")
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// deviceChange 实例配置中变化的设备
+type deviceChange struct {
+	table  string
+	id     string
+	config []byte
+}
+
+// instanceDiff 两次实例配置之间的设备变化
+type instanceDiff struct {
+	added   []deviceChange
+	updated []deviceChange
+	removed []deviceChange
+}
+
+// instanceSnapshot 拆分后的实例配置. devices中的设备配置已按键排序序列化,可以直接比较
+type instanceSnapshot struct {
+	rest    []byte
+	order   []string
+	devices map[string]deviceChange
+}
+
+// snapshotInstance 将实例配置拆分为设备配置和其余配置.
+// 使用encoding/json序列化,map按键排序,保证相同配置的结果一致
+func snapshotInstance(config []byte) (*instanceSnapshot, error) {
+	var instance map[string]interface{}
+	if err := json.Unmarshal(config, &instance); err != nil {
+		return nil, err
+	}
+	// 日志级别由loadInstance设置,变化时不需要重新启动
+	delete(instance, "debug")
+	s := &instanceSnapshot{devices: map[string]deviceChange{}}
+	tables, _ := instance["tables"].([]interface{})
+	for _, t := range tables {
+		table, ok := t.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("表配置格式错误: %v", t)
+		}
+		tableId, _ := table["id"].(string)
+		devices, _ := table["devices"].([]interface{})
+		for _, d := range devices {
+			device, ok := d.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("表 %s 设备配置格式错误: %v", tableId, d)
+			}
+			id, _ := device["id"].(string)
+			b, err := json.Marshal(device)
+			if err != nil {
+				return nil, err
+			}
+			key := tableId + "/" + id
+			if _, ok := s.devices[key]; !ok {
+				s.order = append(s.order, key)
+			}
+			s.devices[key] = deviceChange{table: tableId, id: id, config: b}
+		}
+		delete(table, "devices")
+	}
+	rest, err := json.Marshal(instance)
+	if err != nil {
+		return nil, err
+	}
+	s.rest = rest
+	return s, nil
+}
+
+// diffInstance 比较两次实例配置,返回设备的增删改. 除设备外的配置有变化时返回false,需要重新启动驱动
+func diffInstance(prev, next *instanceSnapshot) (instanceDiff, bool) {
+	var diff instanceDiff
+	if prev == nil || next == nil || string(prev.rest) != string(next.rest) {
+		return diff, false
+	}
+	for _, key := range prev.order {
+		if _, ok := next.devices[key]; !ok {
+			diff.removed = append(diff.removed, prev.devices[key])
+		}
+	}
+	for _, key := range next.order {
+		device := next.devices[key]
+		old, ok := prev.devices[key]
+		switch {
+		case !ok:
+			diff.added = append(diff.added, device)
+		case string(old.config) != string(device.config):
+			diff.updated = append(diff.updated, device)
+		}
+	}
+	return diff, true
+}
+
+// applyDiff 按删除、修改、添加的顺序通知驱动设备变化,先删除以释放设备占用的连接
+func applyDiff(ctx context.Context, app App, lifecycle DeviceLifecycle, diff instanceDiff) error {
+	for _, d := range diff.removed {
+		if err := lifecycle.RemoveDevice(ctx, app, d.table, d.id); err != nil {
+			return fmt.Errorf("删除设备 %s/%s 错误: %w", d.table, d.id, err)
+		}
+	}
+	for _, d := range diff.updated {
+		if err := lifecycle.UpdateDevice(ctx, app, d.table, d.config); err != nil {
+			return fmt.Errorf("修改设备 %s/%s 错误: %w", d.table, d.id, err)
+		}
+	}
+	for _, d := range diff.added {
+		if err := lifecycle.AddDevice(ctx, app, d.table, d.config); err != nil {
+			return fmt.Errorf("添加设备 %s/%s 错误: %w", d.table, d.id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDiffInstance(t *testing.T) {
+	snapshot := func(config string) *instanceSnapshot {
+		s, err := snapshotInstance([]byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	prev := snapshot(`{"id":"i1","debug":false,"tables":[{"id":"t1","devices":[{"id":"d1","settings":{"a":1,"b":2}},{"id":"d2"},{"id":"d3"}]}]}`)
+
+	// 键顺序和debug变化不影响比较
+	diff, ok := diffInstance(prev, snapshot(`{"debug":true,"tables":[{"devices":[{"settings":{"b":2,"a":1},"id":"d1"},{"id":"d2"},{"id":"d3"}],"id":"t1"}],"id":"i1"}`))
+	if !ok || len(diff.added)+len(diff.updated)+len(diff.removed) != 0 {
+		t.Fatalf("diffInstance() = %+v, %v", diff, ok)
+	}
+
+	diff, ok = diffInstance(prev, snapshot(`{"id":"i1","tables":[{"id":"t1","devices":[{"id":"d1","settings":{"a":3}},{"id":"d3"},{"id":"d4"}]}]}`))
+	if !ok {
+		t.Fatal("只有设备变化时应增量更新")
+	}
+	if len(diff.added) != 1 || diff.added[0].id != "d4" ||
+		len(diff.updated) != 1 || diff.updated[0].id != "d1" || string(diff.updated[0].config) != `{"id":"d1","settings":{"a":3}}` ||
+		len(diff.removed) != 1 || diff.removed[0].id != "d2" || diff.removed[0].table != "t1" {
+		t.Fatalf("diffInstance() = %+v", diff)
+	}
+
+	for _, config := range []string{
+		`{"id":"i1","settings":{"x":1},"tables":[{"id":"t1","devices":[{"id":"d1","settings":{"a":1,"b":2}}]}]}`,
+		`{"id":"i1","tables":[{"id":"t1","model":"m","devices":[{"id":"d1","settings":{"a":1,"b":2}}]}]}`,
+	} {
+		if _, ok := diffInstance(prev, snapshot(config)); ok {
+			t.Errorf("%s: 实例或表配置变化时应重新启动", config)
+		}
+	}
+	if _, ok := diffInstance(nil, prev); ok {
+		t.Error("没有上次配置时应重新启动")
+	}
+	if _, err := snapshotInstance([]byte(`{"tables":[1]}`)); err == nil {
+		t.Error("表配置格式错误时应返回错误")
+	}
+}
+
+type lifecycleCall struct {
+	op, table, id string
+}
+
+type testLifecycle struct {
+	calls []lifecycleCall
+	err   error
+}
+
+func (l *testLifecycle) AddDevice(_ context.Context, _ App, table string, _ []byte) error {
+	l.calls = append(l.calls, lifecycleCall{"add", table, ""})
+	return l.err
+}
+
+func (l *testLifecycle) UpdateDevice(_ context.Context, _ App, table string, _ []byte) error {
+	l.calls = append(l.calls, lifecycleCall{"update", table, ""})
+	return nil
+}
+
+func (l *testLifecycle) RemoveDevice(_ context.Context, _ App, table, id string) error {
+	l.calls = append(l.calls, lifecycleCall{"remove", table, id})
+	return nil
+}
+
+func TestApplyDiff(t *testing.T) {
+	diff := instanceDiff{
+		added:   []deviceChange{{table: "t", id: "d3"}},
+		updated: []deviceChange{{table: "t", id: "d2"}},
+		removed: []deviceChange{{table: "t", id: "d1"}},
+	}
+	l := new(testLifecycle)
+	if err := applyDiff(context.Background(), nil, l, diff); err != nil {
+		t.Fatal(err)
+	}
+	want := []lifecycleCall{{"remove", "t", "d1"}, {"update", "t", ""}, {"add", "t", ""}}
+	if len(l.calls) != len(want) {
+		t.Fatalf("调用 = %+v", l.calls)
+	}
+	for i := range want {
+		if l.calls[i] != want[i] {
+			t.Fatalf("调用 = %+v,应为%+v", l.calls, want)
+		}
+	}
+	l = &testLifecycle{err: errors.New("连接失败")}
+	if err := applyDiff(context.Background(), nil, l, diff); !errors.Is(err, l.err) {
+		t.Fatalf("applyDiff() = %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package driver
+
+import (
+	"fmt"
+	"slices"
+)
+
+// TableResolver 未传入表ID且设备ID存在于多个表时选择设备所属的表,tables按实例配置中的顺序排列
+type TableResolver func(id string, tables []string) (string, error)
+
+// FirstTable 选择实例配置中第一个包含该设备的表
+func FirstTable(_ string, tables []string) (string, error) {
+	return tables[0], nil
+}
+
+func (a *app) SetTableResolver(r TableResolver) {
+	a.resolver.Store(&r)
+}
+
+func (a *app) TablesOfDevice(id string) []string {
+	if a.cli == nil {
+		return nil
+	}
+	tables, ok := a.cli.cacheConfigNum.Load(id)
+	if !ok {
+		return nil
+	}
+	return slices.Clone(tables.([]string))
+}
+
+func (a *app) ResolveTable(table, id string) (string, error) {
+	if table != "" {
+		return table, nil
+	}
+	if a.cli == nil {
+		return "", fmt.Errorf("驱动未启动,传入表id为空")
+	}
+	tablesI, ok := a.cli.cacheConfigNum.Load(id)
+	if !ok {
+		return "", fmt.Errorf("传入表id为空且未在配置中找到")
+	}
+	tables := tablesI.([]string)
+	if len(tables) == 1 {
+		return tables[0], nil
+	}
+	r := a.resolver.Load()
+	if r == nil || *r == nil {
+		return "", fmt.Errorf("传入表id为空且在配置中找到多个表id: %v", tables)
+	}
+	table, err := (*r)(id, slices.Clone(tables))
+	if err != nil {
+		return "", fmt.Errorf("设备 %s 选择表错误: %w", id, err)
+	}
+	if !slices.Contains(tables, table) {
+		return "", fmt.Errorf("设备 %s 选择的表 %s 不在配置中: %v", id, table, tables)
+	}
+	return table, nil
+}
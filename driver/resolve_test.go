@@ -0,0 +1,67 @@
+package driver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+)
+
+func TestResolveTable(t *testing.T) {
+	// 启动前可以设置选择方法
+	a := &app{}
+	a.SetTableResolver(FirstTable)
+	if _, err := a.ResolveTable("", "d1"); err == nil {
+		t.Fatal("未启动时应返回错误")
+	}
+	if tables := a.TablesOfDevice("d1"); tables != nil {
+		t.Fatalf("未启动时 TablesOfDevice() = %v", tables)
+	}
+	a.cli = &Client{}
+	a.cli.loadInstance(&entity.Instance{Tables: []entity.InstanceTable{
+		{Id: "t2", Devices: []entity.Device{{Id: "d1"}, {Id: "d2"}}},
+		{Id: "t1", Devices: []entity.Device{{Id: "d1"}}},
+	}})
+
+	if tables := a.TablesOfDevice("d1"); strings.Join(tables, ",") != "t2,t1" {
+		t.Fatalf("TablesOfDevice() = %v", tables)
+	}
+	if tables := a.TablesOfDevice("d3"); tables != nil {
+		t.Fatalf("不存在的设备 TablesOfDevice() = %v", tables)
+	}
+	for _, c := range []struct {
+		table, id, want string
+	}{
+		{"t9", "d1", "t9"},
+		{"", "d2", "t2"},
+	} {
+		if got, err := a.ResolveTable(c.table, c.id); err != nil || got != c.want {
+			t.Errorf("ResolveTable(%q, %q) = %q, %v", c.table, c.id, got, err)
+		}
+	}
+	if _, err := a.ResolveTable("", "d3"); err == nil {
+		t.Error("不存在的设备应返回错误")
+	}
+	if got, err := a.ResolveTable("", "d1"); err != nil || got != "t2" {
+		t.Errorf("启动前设置的FirstTable ResolveTable() = %q, %v", got, err)
+	}
+	a.SetTableResolver(nil)
+	if _, err := a.ResolveTable("", "d1"); err == nil || !strings.Contains(err.Error(), "多个表") {
+		t.Errorf("未设置选择方法时 ResolveTable() = %v", err)
+	}
+
+	a.SetTableResolver(FirstTable)
+	if got, err := a.ResolveTable("", "d1"); err != nil || got != "t2" {
+		t.Errorf("FirstTable ResolveTable() = %q, %v", got, err)
+	}
+	a.SetTableResolver(func(string, []string) (string, error) { return "t3", nil })
+	if _, err := a.ResolveTable("", "d1"); err == nil {
+		t.Error("选择的表不在配置中时应返回错误")
+	}
+	errResolve := errors.New("无法选择")
+	a.SetTableResolver(func(string, []string) (string, error) { return "", errResolve })
+	if _, err := a.ResolveTable("", "d1"); !errors.Is(err, errResolve) {
+		t.Errorf("ResolveTable() = %v", err)
+	}
+}
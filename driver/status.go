@@ -0,0 +1,287 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/air-iot/json"
+	"github.com/air-iot/logger"
+
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+)
+
+// DeviceStatusConfig 设备在线状态配置
+type DeviceStatusConfig struct {
+	Enable   bool          `json:"enable" yaml:"enable"`     // 是否根据写数据点自动判断设备在线状态
+	Timeout  time.Duration `json:"timeout" yaml:"timeout"`   // 超过该时间没有写数据点时设备离线
+	Interval time.Duration `json:"interval" yaml:"interval"` // 检查离线的间隔
+	Field    string        `json:"field" yaml:"field"`       // UpdateTableData更新的在线状态字段
+}
+
+type deviceState struct {
+	table string
+	id    string
+	// online 最后一次加入队列或发送成功的状态,发送失败时恢复
+	online bool
+	last   time.Time
+	// seq 最后一次加入队列的状态序号
+	seq uint64
+}
+
+// statusChange 待发送的设备状态
+type statusChange struct {
+	ctx    context.Context
+	status entity.DeviceStatus
+	seq    uint64
+	// result 显式设置状态时返回发送结果,自动判断的状态为nil
+	result chan error
+}
+
+// statusTracker 记录设备最后写数据点的时间,设备状态变化时发送状态消息并更新表数据.
+// 自动判断和显式设置的状态在持有锁时按变化顺序进入同一个队列,由run依次发送.
+// 发送失败时恢复设备原来的状态,下次写数据点、检查离线或设置状态时重新发送
+type statusTracker struct {
+	app     *app
+	cfg     DeviceStatusConfig
+	lock    sync.Mutex
+	devices map[string]*deviceState
+	seq     uint64
+	changes chan statusChange
+	closed  bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newStatusTracker(a *app, cfg DeviceStatusConfig) *statusTracker {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Minute
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Field == "" {
+		cfg.Field = "online"
+	}
+	t := &statusTracker{
+		app:     a,
+		cfg:     cfg,
+		devices: make(map[string]*deviceState),
+		changes: make(chan statusChange, 1024),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if cfg.Enable {
+		go t.run()
+	} else {
+		close(t.done)
+	}
+	return t
+}
+
+// touch 记录设备写数据点,设备离线或未知时变为在线
+func (t *statusTracker) touch(table, id string) {
+	if !t.cfg.Enable {
+		return
+	}
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	key := table + "/" + id
+	d, ok := t.devices[key]
+	if !ok {
+		d = &deviceState{table: table, id: id}
+		t.devices[key] = d
+	}
+	d.last = now
+	if d.online {
+		return
+	}
+	status := entity.DeviceStatus{Table: table, ID: id, Status: entity.DeviceOnline, Time: now.UnixMilli()}
+	if !t.notify(d, statusChange{ctx: context.Background(), status: status}) {
+		logger.Warnf("设备状态: 设备表=%s,设备=%s,状态=%s. 状态队列已满,下次写数据点时重试", table, id, status.Status)
+	}
+}
+
+// set 设置设备状态并等待状态消息发送完成,状态未变化时不发送
+func (t *statusTracker) set(ctx context.Context, status entity.DeviceStatus) error {
+	online := status.Status == entity.DeviceOnline
+	t.lock.Lock()
+	key := status.Table + "/" + status.ID
+	d, ok := t.devices[key]
+	if !ok {
+		d = &deviceState{table: status.Table, id: status.ID, online: !online}
+		t.devices[key] = d
+	}
+	d.last = time.Now()
+	if d.online == online {
+		t.lock.Unlock()
+		return nil
+	}
+	if !t.cfg.Enable || t.closed {
+		// 没有自动判断或已停止时直接发送,发送成功后记录状态
+		t.lock.Unlock()
+		if err := t.app.sendDeviceStatus(ctx, status, t.cfg.Field); err != nil {
+			return err
+		}
+		t.lock.Lock()
+		t.seq++
+		d.online, d.seq = online, t.seq
+		t.lock.Unlock()
+		return nil
+	}
+	change := statusChange{ctx: ctx, status: status, result: make(chan error, 1)}
+	ok = t.notify(d, change)
+	t.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("状态队列已满")
+	}
+	select {
+	case err := <-change.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notify 状态加入发送队列,成功后记录设备状态,需持有锁
+func (t *statusTracker) notify(d *deviceState, change statusChange) bool {
+	t.seq++
+	change.seq = t.seq
+	select {
+	case t.changes <- change:
+		d.online, d.seq = change.status.Status == entity.DeviceOnline, change.seq
+		return true
+	default:
+		return false
+	}
+}
+
+// restore 状态发送失败后恢复设备原来的状态,之后已有新的状态加入队列时不恢复
+func (t *statusTracker) restore(change statusChange) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	d, ok := t.devices[change.status.Table+"/"+change.status.ID]
+	if !ok || d.seq != change.seq {
+		return
+	}
+	d.online = change.status.Status != entity.DeviceOnline
+}
+
+func (t *statusTracker) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			// 发送停止前已变化的状态
+			for {
+				select {
+				case change := <-t.changes:
+					t.emit(change)
+				default:
+					return
+				}
+			}
+		case change := <-t.changes:
+			t.emit(change)
+		case now := <-ticker.C:
+			t.expired(now)
+		}
+	}
+}
+
+// expired 超时未写数据点的在线设备标记为离线并加入发送队列
+func (t *statusTracker) expired(now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, d := range t.devices {
+		if !d.online || now.Sub(d.last) < t.cfg.Timeout {
+			continue
+		}
+		status := entity.DeviceStatus{Table: d.table, ID: d.id, Status: entity.DeviceOffline, Time: now.UnixMilli()}
+		if !t.notify(d, statusChange{ctx: context.Background(), status: status}) {
+			logger.Warnf("设备状态: 设备表=%s,设备=%s,状态=%s. 状态队列已满,下次检查时重试", d.table, d.id, status.Status)
+			return
+		}
+	}
+}
+
+func (t *statusTracker) emit(change statusChange) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(change.ctx), Cfg.MQ.Timeout)
+	defer cancel()
+	err := t.app.sendDeviceStatus(ctx, change.status, t.cfg.Field)
+	if err != nil {
+		t.restore(change)
+	}
+	if change.result != nil {
+		change.result <- err
+		return
+	}
+	if err != nil {
+		logger.Errorf("设备状态: 设备表=%s,设备=%s,状态=%s. %v,稍后重试", change.status.Table, change.status.ID, change.status.Status, err)
+	}
+}
+
+// close 停止自动判断,发送队列中剩余的状态后返回
+func (t *statusTracker) close() {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		<-t.done
+		return
+	}
+	t.closed = true
+	t.lock.Unlock()
+	close(t.stop)
+	<-t.done
+}
+
+// SetDeviceOnline 设置设备在线,状态变化时发送状态消息并更新表数据
+func (a *app) SetDeviceOnline(ctx context.Context, table, id string) error {
+	return a.setDeviceStatus(ctx, table, id, true)
+}
+
+// SetDeviceOffline 设置设备离线,状态变化时发送状态消息并更新表数据.
+// 开启自动判断在线状态时,设备再次写数据点后变为在线
+func (a *app) SetDeviceOffline(ctx context.Context, table, id string) error {
+	return a.setDeviceStatus(ctx, table, id, false)
+}
+
+func (a *app) setDeviceStatus(ctx context.Context, table, id string, online bool) error {
+	if table == "" || id == "" {
+		return fmt.Errorf("设备表或设备为空")
+	}
+	status := entity.DeviceStatus{Table: table, ID: id, Status: entity.DeviceOffline, Time: time.Now().UnixMilli()}
+	if online {
+		status.Status = entity.DeviceOnline
+	}
+	if a.status != nil {
+		return a.status.set(ctx, status)
+	}
+	field := Cfg.DeviceStatus.Field
+	if field == "" {
+		field = "online"
+	}
+	return a.sendDeviceStatus(ctx, status, field)
+}
+
+// sendDeviceStatus 发送设备状态消息并更新表数据的在线状态字段
+func (a *app) sendDeviceStatus(ctx context.Context, status entity.DeviceStatus, field string) error {
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	if err := a.publish(ctx, []string{"deviceStatus", Cfg.Project, status.Table, status.ID}, b); err != nil {
+		return fmt.Errorf("发送设备状态错误: %w", err)
+	}
+	if err := a.UpdateTableData(ctx, status.Table, status.ID, map[string]interface{}{field: status.Status == entity.DeviceOnline}); err != nil {
+		return fmt.Errorf("更新设备状态错误: %w", err)
+	}
+	return nil
+}
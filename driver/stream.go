@@ -0,0 +1,399 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/air-iot/errors"
+	"github.com/air-iot/json"
+	"github.com/air-iot/logger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
+	"github.com/air-iot/sdk-go/v4/utils/tracing"
+)
+
+// StreamState 驱动管理stream的连接状态
+type StreamState string
+
+const (
+	// StreamConnecting 正在创建stream
+	StreamConnecting StreamState = "connecting"
+	// StreamReady stream已连接,可以接收请求
+	StreamReady StreamState = "ready"
+	// StreamFailed stream断开或创建失败,等待重连
+	StreamFailed StreamState = "failed"
+)
+
+// StreamStatus stream的状态和重启次数
+type StreamStatus struct {
+	Name      string      `json:"name"` // stream标识,如schema、run
+	State     StreamState `json:"state"`
+	Since     time.Time   `json:"since"`     // 进入当前状态的时间
+	Restarts  int64       `json:"restarts"`  // stream断开后重新创建的次数
+	LastError string      `json:"lastError"` // 最近一次断开的原因
+}
+
+const (
+	defaultStreamJitter = 0.2
+	defaultMissedBeats  = 3
+)
+
+// streamSupervisor 负责单个stream的创建和重连,重连等待时间按指数退避并加入随机抖动
+type streamSupervisor struct {
+	id     string
+	name   string
+	module string
+	open   func(ctx context.Context, sessionId string) error
+	// pool 请求处理协程池,为空时每个请求启动一个协程
+	pool *workerPool
+
+	lock     sync.Mutex
+	state    StreamState
+	since    time.Time
+	restarts int64
+	lastErr  error
+}
+
+func newStreamSupervisor(id, name, module string, open func(ctx context.Context, sessionId string) error, pool *workerPool) *streamSupervisor {
+	return &streamSupervisor{id: id, name: name, module: module, open: open, pool: pool, state: StreamConnecting, since: time.Now()}
+}
+
+func (s *streamSupervisor) setState(state StreamState, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.state != state {
+		s.state = state
+		s.since = time.Now()
+	}
+	if state == StreamFailed {
+		s.restarts++
+		s.lastErr = err
+	}
+}
+
+func (s *streamSupervisor) status() StreamStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st := StreamStatus{Name: s.id, State: s.state, Since: s.since, Restarts: s.restarts}
+	if s.lastErr != nil {
+		st.LastError = s.lastErr.Error()
+	}
+	return st
+}
+
+// run 循环创建stream直到ctx取消. stream保持连接的时间超过当前等待时间后,等待时间恢复为初始值
+func (s *streamSupervisor) run(ctx context.Context, sessionId string) {
+	wait := Cfg.DriverGrpc.WaitTime
+	for {
+		if ctx.Err() != nil {
+			logger.WithContext(ctx).Infof("%s: 通过上下文关闭stream检查", s.name)
+			return
+		}
+		s.setState(StreamConnecting, nil)
+		newCtx := context.WithoutCancel(ctx)
+		if Cfg.GroupID != "" {
+			newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
+		}
+		newCtx = logger.NewModuleContext(newCtx, s.module)
+		logger.WithContext(newCtx).Infof("%s: 启动stream", s.name)
+		err := s.open(newCtx, sessionId)
+		if err == nil {
+			err = fmt.Errorf("stream已关闭")
+		}
+		if st := s.status(); st.State == StreamReady && time.Since(st.Since) > wait {
+			wait = Cfg.DriverGrpc.WaitTime
+		}
+		s.setState(StreamFailed, err)
+		metrics.StreamReconnects.WithLabelValues(metrics.ServiceDriver, s.id).Inc()
+		delay := streamBackoff(wait)
+		errCtx := logger.NewErrorContext(newCtx, err)
+		logger.WithContext(errCtx).Errorf("%s: stream断开, %s后重连", s.name, delay)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		if wait *= 2; Cfg.DriverGrpc.Stream.MaxBackoff > 0 && wait > Cfg.DriverGrpc.Stream.MaxBackoff {
+			wait = Cfg.DriverGrpc.Stream.MaxBackoff
+		}
+	}
+}
+
+// streamBackoff 在等待时间上加入随机抖动,避免所有stream同时重连
+func streamBackoff(wait time.Duration) time.Duration {
+	jitter := Cfg.DriverGrpc.Stream.Jitter
+	if jitter <= 0 || jitter >= 1 {
+		jitter = defaultStreamJitter
+	}
+	if wait <= 0 {
+		return 0
+	}
+	delta := time.Duration(float64(wait) * jitter)
+	if delta <= 0 {
+		return wait
+	}
+	return wait - delta + time.Duration(rand.Int63n(int64(2*delta)))
+}
+
+// Streams 返回所有stream的状态
+func (c *Client) Streams() []StreamStatus {
+	ret := make([]StreamStatus, len(c.streams))
+	for i, s := range c.streams {
+		ret[i] = s.status()
+	}
+	return ret
+}
+
+func (c *Client) stream(id string) *streamSupervisor {
+	for _, s := range c.streams {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func (c *Client) streamReady(id string) {
+	if s := c.stream(id); s != nil {
+		s.setState(StreamReady, nil)
+	}
+}
+
+// closePools 停止所有stream的请求处理协程池
+func (c *Client) closePools() {
+	for _, s := range c.streams {
+		if s.pool != nil {
+			s.pool.close()
+		}
+	}
+}
+
+// streamRequest 驱动管理通过stream下发的请求
+type streamRequest interface {
+	GetRequest() string
+}
+
+// streamConn 驱动管理stream的收发接口
+type streamConn[Req streamRequest, Res any] interface {
+	Recv() (Req, error)
+	Send(Res) error
+	CloseSend() error
+}
+
+// streamHandler 描述一个stream的请求处理方式
+type streamHandler[Req streamRequest, Res any] struct {
+	id     string
+	name   string
+	module string
+	open   func(ctx context.Context) (streamConn[Req, Res], error)
+	// sync 为true时按接收顺序逐个处理请求
+	sync bool
+	// key 开启Serial时同一key的请求依次处理
+	key func(req Req) string
+	// context 为请求上下文添加日志字段,为空时只添加模块
+	context func(ctx context.Context, req Req) context.Context
+	handle  func(ctx context.Context, req Req) (interface{}, error)
+	reply   func(request string, data []byte) Res
+}
+
+// requestPayload 返回请求中携带链路上下文的JSON内容,HTTP代理请求为请求头
+func requestPayload(req interface{}) []byte {
+	switch r := req.(type) {
+	case interface{ GetHeaders() []byte }:
+		return r.GetHeaders()
+	case interface{ GetCommand() []byte }:
+		return r.GetCommand()
+	case interface{ GetConfig() []byte }:
+		return r.GetConfig()
+	case interface{ GetData() []byte }:
+		return r.GetData()
+	}
+	return nil
+}
+
+// requestAttributes 返回请求中的流水号、表和设备,作为span的属性
+func requestAttributes(req interface{}) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, 3)
+	if r, ok := req.(interface{ GetSerialNo() string }); ok && r.GetSerialNo() != "" {
+		attrs = append(attrs, attribute.String("airiot.serialNo", r.GetSerialNo()))
+	}
+	if r, ok := req.(interface{ GetTableId() string }); ok && r.GetTableId() != "" {
+		attrs = append(attrs, attribute.String("airiot.table", r.GetTableId()))
+	}
+	switch r := req.(type) {
+	case interface{ GetId() string }:
+		if r.GetId() != "" {
+			attrs = append(attrs, attribute.String("airiot.id", r.GetId()))
+		}
+	case interface{ GetId() []string }:
+		if len(r.GetId()) > 0 {
+			attrs = append(attrs, attribute.StringSlice("airiot.id", r.GetId()))
+		}
+	}
+	return attrs
+}
+
+// serveStream 创建stream,接收请求后调用处理函数并把结果返回到驱动管理. 处理函数panic时返回错误结果.
+// 配置心跳间隔时定时发送心跳,连续多个心跳间隔没有收到任何数据时关闭stream.
+// 每个请求创建一个span,请求内容中携带链路上下文(traceparent等字段)时作为父span
+func serveStream[Req streamRequest, Res any](ctx context.Context, c *Client, h streamHandler[Req, Res]) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stream, err := h.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := stream.CloseSend(); err != nil {
+			errCtx := logger.NewErrorContext(ctx, err)
+			logger.WithContext(errCtx).Errorf("%s: stream关闭错误", h.name)
+		}
+	}()
+	logger.WithContext(ctx).Infof("%s: stream连接成功", h.name)
+	c.streamReady(h.id)
+	var pool *workerPool
+	if h.sync {
+		// 顺序处理请求,接收协程继续接收心跳
+		pool = newWorkerPool(WorkerConfig{Workers: 1})
+		defer pool.close()
+	} else if s := c.stream(h.id); s != nil {
+		pool = s.pool
+	}
+	// grpc stream不支持并发发送
+	var sendLock sync.Mutex
+	send := func(ctx context.Context, req Req, gr *entity.GrpcResult) {
+		bts, _ := json.Marshal(gr)
+		sendLock.Lock()
+		defer sendLock.Unlock()
+		if err := stream.Send(h.reply(req.GetRequest(), bts)); err != nil {
+			errCtx := logger.NewErrorContext(ctx, err)
+			logger.WithContext(errCtx).Errorf("%s: 结果返回到驱动管理错误", h.name)
+		}
+	}
+	serve := func(req Req) {
+		defer c.handlers.done()
+		obs := metrics.StartRequest(metrics.ServiceDriver, h.id)
+		defer obs.Done()
+		newCtx, cancel := context.WithTimeout(tracing.ExtractJSON(context.Background(), requestPayload(req)), Cfg.DriverGrpc.Timeout)
+		defer cancel()
+		if h.context != nil {
+			newCtx = h.context(newCtx, req)
+		} else {
+			newCtx = logger.NewModuleContext(newCtx, h.module)
+		}
+		if Cfg.GroupID != "" {
+			newCtx = logger.NewGroupContext(newCtx, Cfg.GroupID)
+		}
+		newCtx, span := tracing.Start(newCtx, "driver."+h.id, trace.SpanKindServer, requestAttributes(req)...)
+		var spanErr error
+		defer func() {
+			tracing.End(span, spanErr)
+		}()
+		defer func() {
+			if errR := recover(); errR != nil {
+				obs.Panic()
+				var errStr string
+				switch v := errR.(type) {
+				case error:
+					errStr = v.Error()
+					logger.Errorf("%+v", errors.WithStack(v))
+				default:
+					errStr = fmt.Sprintf("%v", v)
+					logger.Errorln(v)
+				}
+				spanErr = fmt.Errorf("panic: %s", errStr)
+				send(newCtx, req, &entity.GrpcResult{Code: 400, Error: errStr})
+			}
+		}()
+		gr := new(entity.GrpcResult)
+		if res, err := h.handle(newCtx, req); err != nil {
+			obs.Fail()
+			spanErr = err
+			gr.Error = err.Error()
+			gr.Code = 400
+		} else {
+			gr.Result = res
+			gr.Code = 200
+		}
+		send(newCtx, req, gr)
+	}
+	var lastRecv atomic.Int64
+	lastRecv.Store(time.Now().UnixNano())
+	if interval := Cfg.DriverGrpc.Stream.Heartbeat; interval > 0 {
+		missed := Cfg.DriverGrpc.Stream.MissedBeats
+		if missed <= 0 {
+			missed = defaultMissedBeats
+		}
+		heartbeatDone := make(chan struct{})
+		defer func() {
+			cancel(nil)
+			<-heartbeatDone
+		}()
+		go func() {
+			defer close(heartbeatDone)
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				if idle := time.Since(time.Unix(0, lastRecv.Load())); idle > interval*time.Duration(missed) {
+					err := fmt.Errorf("stream心跳超时: %s未收到数据", idle.Truncate(time.Millisecond))
+					logger.WithContext(ctx).Errorf("%s: %v", h.name, err)
+					cancel(err)
+					return
+				}
+				logger.WithContext(ctx).Debugf("%s: 发送stream心跳", h.name)
+				sendLock.Lock()
+				err := stream.Send(h.reply(STREAM_HEARTBEAT, nil))
+				sendLock.Unlock()
+				if err != nil {
+					logger.WithContext(logger.NewErrorContext(ctx, err)).Errorf("%s: stream心跳发送错误", h.name)
+					cancel(fmt.Errorf("stream心跳发送错误: %w", err))
+					return
+				}
+			}
+		}()
+	}
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			return err
+		}
+		lastRecv.Store(time.Now().UnixNano())
+		if req.GetRequest() == STREAM_HEARTBEAT {
+			logger.WithContext(ctx).Debugf("%s: 收到stream心跳", h.name)
+			continue
+		}
+		if !c.handlers.add() {
+			logger.WithContext(ctx).Warnf("%s: 驱动正在停止,拒绝请求=%s", h.name, req.GetRequest())
+			send(ctx, req, &entity.GrpcResult{Code: entity.GrpcCodeUnavailable, Error: "驱动正在停止"})
+			continue
+		}
+		if pool == nil {
+			go serve(req)
+			continue
+		}
+		var key string
+		if h.key != nil {
+			key = h.key(req)
+		}
+		if !pool.submit(key, func() { serve(req) }) {
+			c.handlers.done()
+			metrics.Busy(metrics.ServiceDriver, h.id)
+			logger.WithContext(ctx).Warnf("%s: 请求队列已满,请求=%s", h.name, req.GetRequest())
+			send(ctx, req, &entity.GrpcResult{Code: entity.GrpcCodeBusy, Error: "驱动繁忙,请稍后重试"})
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamBackoff(t *testing.T) {
+	defer func(j float64) { Cfg.DriverGrpc.Stream.Jitter = j }(Cfg.DriverGrpc.Stream.Jitter)
+	Cfg.DriverGrpc.Stream.Jitter = 0.5
+	wait := time.Second
+	for i := 0; i < 100; i++ {
+		if d := streamBackoff(wait); d < wait/2 || d >= wait*3/2 {
+			t.Fatalf("streamBackoff(%s) = %s", wait, d)
+		}
+	}
+	if d := streamBackoff(0); d != 0 {
+		t.Fatalf("streamBackoff(0) = %s", d)
+	}
+}
+
+func TestStreamSupervisor(t *testing.T) {
+	defer func(cfg Config) { *Cfg = cfg }(*Cfg)
+	Cfg.DriverGrpc.WaitTime = 10 * time.Millisecond
+	Cfg.DriverGrpc.Stream.MaxBackoff = 40 * time.Millisecond
+
+	c := &Client{}
+	var opened int32
+	s := newStreamSupervisor("test", "test", "test", func(ctx context.Context, _ string) error {
+		if atomic.AddInt32(&opened, 1) == 1 {
+			c.streamReady("test")
+			if st := c.Streams()[0]; st.State != StreamReady {
+				t.Errorf("连接成功后状态 = %s", st.State)
+			}
+		}
+		return errors.New("连接断开")
+	}, nil)
+	c.streams = []*streamSupervisor{s}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx, "session")
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&opened) < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	st := c.Streams()[0]
+	if st.State != StreamFailed || st.Restarts < 4 || st.LastError != "连接断开" {
+		t.Fatalf("Streams() = %+v", st)
+	}
+}
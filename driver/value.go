@@ -0,0 +1,205 @@
+package driver
+
+import (
+	"encoding/hex"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/air-iot/json"
+	"github.com/shopspring/decimal"
+
+	"github.com/air-iot/sdk-go/v4/utils/numberx"
+)
+
+var (
+	// ErrUnsupportedType 数据点值的类型不支持
+	ErrUnsupportedType = errors.New("不支持的数据类型")
+	// ErrInvalidFieldType 数据点类型不是numberx.FieldType中定义的类型
+	ErrInvalidFieldType = errors.New("数据点类型无效")
+	// ErrInvalidValue 数据点值不合法或不能转换为指定的数据点类型
+	ErrInvalidValue = errors.New("数据点值不合法")
+)
+
+// FieldError 单个数据点值转换失败
+type FieldError struct {
+	Table string
+	ID    string
+	Tag   string
+	Value interface{}
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("数据点: 设备表=%s,设备=%s,数据点=%s,值=%v. %v", e.Table, e.ID, e.Tag, e.Value, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// PointError 数据点中转换失败的值,其余转换成功的值仍然会发送
+type PointError struct {
+	Fields []*FieldError
+}
+
+func (e *PointError) Error() string {
+	if len(e.Fields) == 0 {
+		return "写数据点: 失败数量=0"
+	}
+	return fmt.Sprintf("写数据点: 失败数量=%d,第一个错误=%v", len(e.Fields), e.Fields[0])
+}
+
+// Unwrap 返回每个数据点的错误,可以使用errors.Is判断错误类型
+func (e *PointError) Unwrap() []error {
+	errs := make([]error, len(e.Fields))
+	for i, err := range e.Fields {
+		errs[i] = err
+	}
+	return errs
+}
+
+// normalizeValue 按数据点类型转换采集值. 数值类型返回decimal.Decimal,后续进行数据点计算;
+// 其他类型返回可直接发送的值. fieldType为空时按值的类型推断,布尔值按1/0的数值处理,
+// 设置为boolean时才发送布尔值
+func normalizeValue(fieldType numberx.FieldType, v interface{}) (interface{}, numberx.FieldType, error) {
+	if fieldType != "" && !fieldType.Valid() {
+		return nil, "", fmt.Errorf("%w: %s", ErrInvalidFieldType, fieldType)
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, "", fmt.Errorf("%w: 空指针", ErrInvalidValue)
+		}
+		v = rv.Elem().Interface()
+	}
+	switch fieldType {
+	case numberx.Float:
+		f, err := numberx.GetFloat(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", ErrInvalidValue, err)
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, "", ErrInvalidValue
+		}
+		return decimal.NewFromFloat(f), numberx.Float, nil
+	case numberx.Int:
+		i, err := numberx.GetInt(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", ErrInvalidValue, err)
+		}
+		return decimal.NewFromInt(int64(i)), numberx.Int, nil
+	case numberx.String:
+		if b, ok := v.([]byte); ok {
+			return string(b), numberx.String, nil
+		}
+		s, err := numberx.GetString(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", ErrInvalidValue, err)
+		}
+		return s, numberx.String, nil
+	case numberx.Bool:
+		b, err := numberx.GetBool(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", ErrInvalidValue, err)
+		}
+		return b != 0, numberx.Bool, nil
+	case numberx.Object, numberx.Array:
+		val, t, err := jsonValue(v)
+		if err != nil {
+			return nil, "", err
+		}
+		if t != fieldType {
+			return nil, "", fmt.Errorf("%w: 值类型为%s,数据点类型为%s", ErrInvalidValue, t, fieldType)
+		}
+		return val, t, nil
+	case numberx.Binary:
+		switch b := v.(type) {
+		case []byte:
+			return fmt.Sprintf("hex__%s", hex.EncodeToString(b)), numberx.Binary, nil
+		case string:
+			return fmt.Sprintf("hex__%s", hex.EncodeToString([]byte(b))), numberx.Binary, nil
+		}
+		return nil, "", fmt.Errorf("%w: %T", ErrInvalidValue, v)
+	}
+
+	switch val := v.(type) {
+	case float32:
+		if math.IsNaN(float64(val)) || math.IsInf(float64(val), 0) {
+			return nil, "", ErrInvalidValue
+		}
+		return decimal.NewFromFloat32(val), numberx.Float, nil
+	case float64:
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return nil, "", ErrInvalidValue
+		}
+		return decimal.NewFromFloat(val), numberx.Float, nil
+	case uint:
+		return decimal.NewFromInt(int64(val)), numberx.Float, nil
+	case uint8:
+		return decimal.NewFromInt(int64(val)), numberx.Float, nil
+	case uint16:
+		return decimal.NewFromInt(int64(val)), numberx.Float, nil
+	case uint32:
+		return decimal.NewFromInt(int64(val)), numberx.Float, nil
+	case uint64:
+		return decimal.NewFromInt(int64(val)), numberx.Float, nil
+	case int:
+		return decimal.NewFromInt(int64(val)), numberx.Float, nil
+	case int8:
+		return decimal.NewFromInt(int64(val)), numberx.Float, nil
+	case int16:
+		return decimal.NewFromInt(int64(val)), numberx.Float, nil
+	case int32:
+		return decimal.NewFromInt32(val), numberx.Float, nil
+	case int64:
+		return decimal.NewFromInt(val), numberx.Float, nil
+	case bool:
+		// 未设置数据点类型时与之前的版本相同,按1/0发送
+		if val {
+			return decimal.NewFromInt(1), numberx.Float, nil
+		}
+		return decimal.NewFromInt(0), numberx.Float, nil
+	case string:
+		return val, numberx.String, nil
+	case stdjson.RawMessage:
+		return jsonValue(val)
+	case []byte:
+		return fmt.Sprintf("hex__%s", hex.EncodeToString(val)), numberx.Binary, nil
+	}
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Map, reflect.Struct, reflect.Slice, reflect.Array:
+		return jsonValue(v)
+	}
+	return nil, "", fmt.Errorf("%w: %T", ErrUnsupportedType, v)
+}
+
+// jsonValue 将对象或数组转换为json对应的map或切片. 值为字符串或json.RawMessage时按json解析
+func jsonValue(v interface{}) (interface{}, numberx.FieldType, error) {
+	var b []byte
+	switch val := v.(type) {
+	case stdjson.RawMessage:
+		b = val
+	case []byte:
+		b = val
+	case string:
+		b = []byte(val)
+	default:
+		var err error
+		if b, err = json.Marshal(v); err != nil {
+			return nil, "", fmt.Errorf("%w: %v", ErrUnsupportedType, err)
+		}
+	}
+	var ret interface{}
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrInvalidValue, err)
+	}
+	switch ret.(type) {
+	case map[string]interface{}:
+		return ret, numberx.Object, nil
+	case []interface{}:
+		return ret, numberx.Array, nil
+	}
+	return nil, "", fmt.Errorf("%w: 不是json对象或数组", ErrInvalidValue)
+}
@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/air-iot/sdk-go/v4/driver/entity"
+	"github.com/air-iot/sdk-go/v4/utils/numberx"
+)
+
+func TestNormalizeValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		fieldType numberx.FieldType
+		value     interface{}
+		wantType  numberx.FieldType
+		wantErr   error
+	}{
+		{"浮点数", "", 1.5, numberx.Float, nil},
+		{"字符串转浮点数", numberx.Float, "1.5", numberx.Float, nil},
+		{"布尔", "", true, numberx.Float, nil},
+		{"布尔类型", numberx.Bool, true, numberx.Bool, nil},
+		{"字符串", "", "abc", numberx.String, nil},
+		{"对象", "", map[string]interface{}{"a": 1}, numberx.Object, nil},
+		{"结构体", "", struct{ A int }{1}, numberx.Object, nil},
+		{"数组", "", []int{1, 2}, numberx.Array, nil},
+		{"json", "", json.RawMessage(`[1]`), numberx.Array, nil},
+		{"二进制", "", []byte{1, 2}, numberx.Binary, nil},
+		{"对象类型不匹配", numberx.Object, []int{1}, "", ErrInvalidValue},
+		{"无效类型", "double", 1, "", ErrInvalidFieldType},
+		{"不支持的类型", "", make(chan int), "", ErrUnsupportedType},
+		{"NaN", "", math.NaN(), "", ErrInvalidValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got, err := normalizeValue(tt.fieldType, tt.value)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("normalizeValue() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.wantType {
+				t.Fatalf("normalizeValue() type = %s, want %s", got, tt.wantType)
+			}
+		})
+	}
+	if v, _, _ := normalizeValue(numberx.Int, "12"); !v.(decimal.Decimal).Equal(decimal.NewFromInt(12)) {
+		t.Fatalf("normalizeValue() = %v", v)
+	}
+	// 未设置类型的布尔值按1/0发送
+	if v, _, _ := normalizeValue("", true); !v.(decimal.Decimal).Equal(decimal.NewFromInt(1)) {
+		t.Fatalf("normalizeValue(true) = %v", v)
+	}
+	if v, _, _ := normalizeValue(numberx.Bool, 1); v != true {
+		t.Fatalf("normalizeValue(boolean, true) = %v", v)
+	}
+}
+
+func TestApp_WritePointsTyped(t *testing.T) {
+	Cfg.Project = "p"
+	Cfg.MQ.Timeout = time.Second
+	m := new(memMQ)
+	a := &app{mq: m, cli: &Client{}}
+	err := a.writePoints(context.Background(), "t", entity.Point{ID: "d1", Fields: []entity.Field{
+		{Tag: entity.Tag{ID: "s"}, Value: "on"},
+		{Tag: entity.Tag{ID: "o"}, Value: map[string]interface{}{"a": 1}},
+		{Tag: entity.Tag{ID: "bad"}, Value: make(chan int)},
+	}})
+	var pointErr *PointError
+	if !errors.As(err, &pointErr) || len(pointErr.Fields) != 1 || pointErr.Fields[0].Tag != "bad" || !errors.Is(err, ErrUnsupportedType) {
+		t.Fatalf("writePoints() error = %v", err)
+	}
+	msgs := m.published["data/p/t/d1"]
+	if len(msgs) != 1 {
+		t.Fatalf("发送次数 = %d, want 1", len(msgs))
+	}
+	var p entity.WritePoint
+	if err := json.Unmarshal(msgs[0], &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Fields["s"] != "on" || p.FieldTypes["s"] != String || p.FieldTypes["o"] != "object" {
+		t.Fatalf("数据点 = %+v", p)
+	}
+}
@@ -16,6 +16,9 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/air-iot/logger"
+
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
+	"github.com/air-iot/sdk-go/v4/utils/probe"
 )
 
 type App interface {
@@ -80,6 +83,7 @@ func NewApp() App {
 			}
 		}()
 	}
+	metrics.Serve(Cfg.Metrics)
 	return a
 }
 
@@ -88,6 +92,7 @@ func (a *app) Start(flow Flow) {
 	a.stopped = false
 	cli := Client{}
 	a.cli = cli.Start(a, flow)
+	probe.Serve(Cfg.Probe, a.cli.checks)
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL)
 	sig := <-ch
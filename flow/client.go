@@ -3,6 +3,8 @@ package flow
 import (
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/air-iot/api-client-go/v4/engine"
@@ -10,7 +12,10 @@ import (
 	"github.com/air-iot/json"
 	"github.com/air-iot/logger"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/air-iot/sdk-go/v4/utils/grpcx"
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
+	"github.com/air-iot/sdk-go/v4/utils/probe"
 )
 
 const (
@@ -18,14 +23,20 @@ const (
 )
 
 type Client struct {
+	lock             sync.RWMutex
 	conn             *grpc.ClientConn
 	cli              pb.PluginServiceClient
 	app              App
 	flow             Flow
 	cleanStream      func()
 	cleanHealthCheck func()
+	streamCount      int32
+	// lastHealth 最近一次健康检查正常的时间(UnixNano)
+	lastHealth atomic.Int64
 }
 
+const totalStream = 2
+
 func (c *Client) Start(app App, flow Flow) *Client {
 	c.app = app
 	c.flow = flow
@@ -47,17 +58,22 @@ func (c *Client) Start(app App, flow Flow) *Client {
 
 func (c *Client) connFlow() error {
 	logger.Infof("连接流程引擎: 配置=%+v", Cfg.FlowEngine)
+	opts, err := grpcx.DialOptions(Cfg.FlowEngine.TLS, string(Cfg.FlowEngine.Token))
+	if err != nil {
+		return err
+	}
 	conn, err := grpc.NewClient(
 		fmt.Sprintf("%s:%d", Cfg.FlowEngine.Host, Cfg.FlowEngine.Port),
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(Cfg.FlowEngine.Limit*1024*1024), grpc.MaxCallSendMsgSize(Cfg.FlowEngine.Limit*1024*1024)),
+		append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(Cfg.FlowEngine.Limit*1024*1024), grpc.MaxCallSendMsgSize(Cfg.FlowEngine.Limit*1024*1024)))...,
 	)
 	if err != nil {
 		return fmt.Errorf("grpc.Dial error: %s", err)
 	}
 	cli := pb.NewPluginServiceClient(conn)
+	c.lock.Lock()
 	c.conn = conn
 	c.cli = cli
+	c.lock.Unlock()
 	return nil
 }
 
@@ -77,6 +93,7 @@ func (c *Client) healthCheck(ctx context.Context) {
 				state := false
 				for retry >= 0 {
 					healthRes, err := c.cli.HealthCheck(ctx, &pb.HealthCheckRequest{Name: Cfg.Flow.Name})
+					metrics.HealthCheck(metrics.ServiceFlow, err == nil && healthRes.GetStatus() == pb.HealthCheckResponse_SERVING)
 					if err != nil {
 						errCtx := logger.NewErrorContext(newCtx, err)
 						logger.WithContext(errCtx).Errorf("健康检查: 健康检查重试错误")
@@ -85,6 +102,7 @@ func (c *Client) healthCheck(ctx context.Context) {
 					} else {
 						state = false
 						if healthRes.GetStatus() == pb.HealthCheckResponse_SERVING {
+							c.lastHealth.Store(time.Now().UnixNano())
 							if healthRes.Errors != nil && len(healthRes.Errors) > 0 {
 								for _, e := range healthRes.Errors {
 									newLogger.Errorf("健康检查: code=%s,错误=%s", e.Code.String(), e.Message)
@@ -118,6 +136,23 @@ func (c *Client) healthCheck(ctx context.Context) {
 	}()
 }
 
+// checks 返回流程引擎连接、stream和健康检查的状态
+func (c *Client) checks() []probe.Check {
+	c.lock.RLock()
+	conn := c.conn
+	c.lock.RUnlock()
+	var last time.Time
+	if v := c.lastHealth.Load(); v > 0 {
+		last = time.Unix(0, v)
+	}
+	// 健康检查每wait秒执行一次,失败时最多重试3次
+	return []probe.Check{
+		probe.GRPC(conn),
+		probe.Streams(int(atomic.LoadInt32(&c.streamCount)), totalStream),
+		probe.HealthCheck(last, time.Second*wait*5),
+	}
+}
+
 func (c *Client) startSteam(ctx context.Context) {
 	go func() {
 		for {
@@ -134,6 +169,7 @@ func (c *Client) startSteam(ctx context.Context) {
 					errCtx := logger.NewErrorContext(ctx1, err)
 					logger.WithContext(errCtx).Errorf("handler: stream创建错误")
 				}
+				metrics.StreamReconnects.WithLabelValues(metrics.ServiceFlow, "handler").Inc()
 				time.Sleep(time.Second * time.Duration(wait))
 			}
 		}
@@ -154,6 +190,7 @@ func (c *Client) startSteam(ctx context.Context) {
 					errCtx := logger.NewErrorContext(ctx1, err)
 					logger.WithContext(errCtx).Errorf("调试流: stream创建错误")
 				}
+				metrics.StreamReconnects.WithLabelValues(metrics.ServiceFlow, "debug").Inc()
 				time.Sleep(time.Second * time.Duration(wait))
 			}
 		}
@@ -182,17 +219,22 @@ func (c *Client) Handler(ctx context.Context) error {
 		}
 	}()
 	logger.WithContext(ctx).Infof("handler: stream连接成功")
+	atomic.AddInt32(&c.streamCount, 1)
+	defer atomic.AddInt32(&c.streamCount, -1)
 	for {
 		res, err := stream.Recv()
 		if err != nil {
 			return err
 		}
 		go func(res *pb.FlowRequest) {
+			obs := metrics.StartRequest(metrics.ServiceFlow, "handler")
+			defer obs.Done()
 			ctx1, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(Cfg.Flow.Timeout))
 			defer cancel()
 			ctx1 = logger.NewModuleContext(ctx1, MODULE_HANDLER)
 			defer func() {
 				if errR := recover(); errR != nil {
+					obs.Panic()
 					var errStr string
 					switch v := errR.(type) {
 					case error:
@@ -228,6 +270,7 @@ func (c *Client) Handler(ctx context.Context) error {
 			}
 			if err != nil {
 				gr.Status = false
+				obs.Fail()
 				gr.Info = err.Error()
 			} else {
 				gr.Status = true
@@ -257,17 +300,22 @@ func (c *Client) DebugStream(ctx context.Context) error {
 		}
 	}()
 	logger.WithContext(ctx).Infof("调试: stream连接成功")
+	atomic.AddInt32(&c.streamCount, 1)
+	defer atomic.AddInt32(&c.streamCount, -1)
 	for {
 		res, err := stream.Recv()
 		if err != nil {
 			return err
 		}
 		go func(res *pb.DebugRequest) {
+			obs := metrics.StartRequest(metrics.ServiceFlow, "debug")
+			defer obs.Done()
 			ctx1, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(Cfg.Flow.Timeout))
 			defer cancel()
 			ctx1 = logger.NewModuleContext(ctx1, MODULE_DEBUG)
 			defer func() {
 				if errR := recover(); errR != nil {
+					obs.Panic()
 					var errStr string
 					switch v := errR.(type) {
 					case error:
@@ -301,6 +349,7 @@ func (c *Client) DebugStream(ctx context.Context) error {
 			}
 			if err != nil {
 				gr.Status = false
+				obs.Fail()
 				gr.Info = err.Error()
 			} else {
 				gr.Status = true
@@ -5,6 +5,11 @@ import (
 	"encoding/hex"
 	"github.com/air-iot/logger"
 	"google.golang.org/grpc/metadata"
+
+	"github.com/air-iot/sdk-go/v4/utils/grpcx"
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
+	"github.com/air-iot/sdk-go/v4/utils/probe"
+	"github.com/air-iot/sdk-go/v4/utils/tlsx"
 )
 
 // Cfg 全局配置(需要先执行MustLoad，否则拿不到配置)
@@ -23,12 +28,16 @@ type Config struct {
 		Host   string `json:"host" yaml:"host"`
 		Port   string `json:"port" yaml:"port"`
 	} `json:"pprof" yaml:"pprof"`
+	Metrics metrics.Config `json:"metrics" yaml:"metrics"`
+	Probe   probe.Config   `json:"probe" yaml:"probe"`
 }
 
 type Grpc struct {
-	Host  string `json:"host" yaml:"host"`
-	Port  int    `json:"port" yaml:"port"`
-	Limit int    `json:"limit" yaml:"limit"`
+	Host  string      `json:"host" yaml:"host"`
+	Port  int         `json:"port" yaml:"port"`
+	Limit int         `json:"limit" yaml:"limit"`
+	TLS   tlsx.Config `json:"tls" yaml:"tls"`     // 传输层加密及双向认证
+	Token grpcx.Token `json:"token" yaml:"token"` // 每个请求携带的Bearer令牌
 }
 
 type TaskMode string
@@ -14,6 +14,8 @@ import (
 	"github.com/air-iot/logger"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
 )
 
 type App interface {
@@ -78,6 +80,7 @@ func NewApp() App {
 			}
 		}()
 	}
+	metrics.Serve(Cfg.Metrics)
 	return a
 }
 
@@ -8,10 +8,12 @@ import (
 	"github.com/air-iot/errors"
 	"github.com/air-iot/json"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 
 	pb "github.com/air-iot/api-client-go/v4/engine"
 	"github.com/air-iot/logger"
+
+	"github.com/air-iot/sdk-go/v4/utils/grpcx"
+	"github.com/air-iot/sdk-go/v4/utils/metrics"
 )
 
 const (
@@ -48,10 +50,13 @@ func (c *Client) Start(app App, extension Extension) *Client {
 
 func (c *Client) connFlow() error {
 	logger.Infof("连接flow: 配置=%+v", Cfg.FlowEngine)
+	opts, err := grpcx.DialOptions(Cfg.FlowEngine.TLS, string(Cfg.FlowEngine.Token))
+	if err != nil {
+		return err
+	}
 	conn, err := grpc.NewClient(
 		fmt.Sprintf("%s:%d", Cfg.FlowEngine.Host, Cfg.FlowEngine.Port),
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(Cfg.FlowEngine.Limit*1024*1024), grpc.MaxCallSendMsgSize(Cfg.FlowEngine.Limit*1024*1024)),
+		append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(Cfg.FlowEngine.Limit*1024*1024), grpc.MaxCallSendMsgSize(Cfg.FlowEngine.Limit*1024*1024)))...,
 	)
 	if err != nil {
 		return fmt.Errorf("grpc.Dial error: %s", err)
@@ -77,6 +82,7 @@ func (c *Client) healthCheck(ctx context.Context) {
 				state := false
 				for retry >= 0 {
 					healthRes, err := c.cli.HealthCheck(ctx, &pb.ExtensionHealthCheckRequest{Id: Cfg.Extension.Id})
+					metrics.HealthCheck(metrics.ServiceFlowExtension, err == nil && healthRes.GetStatus() == pb.ExtensionHealthCheckResponse_SERVING)
 					if err != nil {
 						errCtx := logger.NewErrorContext(newCtx, err)
 						logger.WithContext(errCtx).Errorf("健康检查: 健康检查重试错误")
@@ -134,6 +140,7 @@ func (c *Client) startSteam(ctx context.Context) {
 					errCtx := logger.NewErrorContext(ctx1, err)
 					logger.WithContext(errCtx).Errorf("schema: stream创建错误")
 				}
+				metrics.StreamReconnects.WithLabelValues(metrics.ServiceFlowExtension, "schema").Inc()
 				time.Sleep(time.Second * time.Duration(wait))
 			}
 		}
@@ -154,6 +161,7 @@ func (c *Client) startSteam(ctx context.Context) {
 					errCtx := logger.NewErrorContext(ctx1, err)
 					logger.WithContext(errCtx).Errorf("run: stream创建错误")
 				}
+				metrics.StreamReconnects.WithLabelValues(metrics.ServiceFlowExtension, "run").Inc()
 				time.Sleep(time.Second * time.Duration(wait))
 			}
 		}
@@ -188,11 +196,14 @@ func (c *Client) Schema(ctx context.Context) error {
 			return err
 		}
 		go func(res *pb.ExtensionSchemaRequest) {
+			obs := metrics.StartRequest(metrics.ServiceFlowExtension, "schema")
+			defer obs.Done()
 			ctx1, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(Cfg.Extension.Timeout))
 			defer cancel()
 			ctx1 = logger.NewModuleContext(ctx1, MODULE_SCHEMA)
 			defer func() {
 				if errR := recover(); errR != nil {
+					obs.Panic()
 					var errStr string
 					switch v := errR.(type) {
 					case error:
@@ -219,6 +230,7 @@ func (c *Client) Schema(ctx context.Context) error {
 			}
 			if err != nil {
 				gr.Status = false
+				obs.Fail()
 				gr.Info = err.Error()
 			} else {
 				gr.Status = true
@@ -250,11 +262,14 @@ func (c *Client) Run(ctx context.Context) error {
 			return err
 		}
 		go func(res *pb.ExtensionRunRequest) {
+			obs := metrics.StartRequest(metrics.ServiceFlowExtension, "run")
+			defer obs.Done()
 			ctx1, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(Cfg.Extension.Timeout))
 			defer cancel()
 			ctx1 = logger.NewModuleContext(ctx1, MODULE_RUN)
 			defer func() {
 				if errR := recover(); errR != nil {
+					obs.Panic()
 					var errStr string
 					switch v := errR.(type) {
 					case error:
@@ -283,6 +298,7 @@ func (c *Client) Run(ctx context.Context) error {
 			}
 			if err != nil {
 				gr.Status = false
+				obs.Fail()
 				gr.Info = err.Error()
 			} else {
 				gr.Status = true
@@ -0,0 +1,56 @@
+// Package grpcx 提供连接平台grpc服务时共用的传输安全和令牌认证选项
+package grpcx
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/air-iot/sdk-go/v4/utils/tlsx"
+)
+
+// tokenCredentials 每个请求在authorization中携带Bearer令牌
+type tokenCredentials struct {
+	token  string
+	secure bool
+}
+
+func (t tokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return t.secure
+}
+
+// DialOptions 根据TLS配置和令牌生成grpc连接选项. 未开启TLS时使用明文连接,
+// token不为空时每个请求携带Bearer令牌,开启TLS后令牌只通过加密连接发送
+func DialOptions(tlsCfg tlsx.Config, token string) ([]grpc.DialOption, error) {
+	cfg, err := tlsCfg.Load()
+	if err != nil {
+		return nil, fmt.Errorf("grpc TLS配置错误: %w", err)
+	}
+	opts := make([]grpc.DialOption, 0, 2)
+	if cfg != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(cfg)))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	if token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{token: token, secure: cfg != nil}))
+	}
+	return opts, nil
+}
+
+// Token 认证令牌,打印配置时不输出明文
+type Token string
+
+func (t Token) String() string {
+	if t == "" {
+		return ""
+	}
+	return "******"
+}
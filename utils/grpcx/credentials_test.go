@@ -0,0 +1,182 @@
+package grpcx
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/air-iot/sdk-go/v4/utils/tlsx"
+)
+
+func TestDialOptions(t *testing.T) {
+	opts, err := DialOptions(tlsx.Config{}, "")
+	if err != nil || len(opts) != 1 {
+		t.Fatalf("DialOptions() = %d, %v", len(opts), err)
+	}
+	opts, err = DialOptions(tlsx.Config{Enable: true}, "abc")
+	if err != nil || len(opts) != 2 {
+		t.Fatalf("DialOptions() = %d, %v", len(opts), err)
+	}
+	if _, err := DialOptions(tlsx.Config{Enable: true, CAFile: "none.pem"}, ""); err == nil {
+		t.Fatal("CA文件不存在时应返回错误")
+	}
+}
+
+func TestTokenCredentials(t *testing.T) {
+	md, err := tokenCredentials{token: "abc", secure: true}.GetRequestMetadata(context.Background())
+	if err != nil || md["authorization"] != "Bearer abc" {
+		t.Fatalf("GetRequestMetadata() = %v, %v", md, err)
+	}
+	cfg := struct{ Token Token }{Token: "abc"}
+	if s := fmt.Sprintf("%+v", cfg); s != "{Token:******}" {
+		t.Fatalf("打印配置 = %s", s)
+	}
+}
+
+// writeCert 生成localhost的自签名证书,返回证书和私钥文件路径
+func writeCert(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// request 服务端收到请求时的令牌和是否使用TLS
+type request struct {
+	auth string
+	tls  bool
+}
+
+// startServer 启动健康检查服务,serverTLS为nil时使用明文连接
+func startServer(t *testing.T, serverTLS *credentials.TransportCredentials) (string, <-chan request) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := make(chan request, 1)
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var r request
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md["authorization"]) > 0 {
+			r.auth = md["authorization"][0]
+		}
+		if p, ok := peer.FromContext(ctx); ok {
+			_, r.tls = p.AuthInfo.(credentials.TLSInfo)
+		}
+		reqs <- r
+		return handler(ctx, req)
+	})}
+	if serverTLS != nil {
+		opts = append(opts, grpc.Creds(*serverTLS))
+	}
+	srv := grpc.NewServer(opts...)
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String(), reqs
+}
+
+func check(addr string, opts []grpc.DialOption) error {
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
+
+func TestDialOptions_Connect(t *testing.T) {
+	certFile, keyFile := writeCert(t)
+	serverTLS, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsAddr, tlsReqs := startServer(t, &serverTLS)
+	plainAddr, plainReqs := startServer(t, nil)
+
+	tests := []struct {
+		name    string
+		addr    string
+		reqs    <-chan request
+		tls     tlsx.Config
+		token   string
+		want    request
+		wantErr bool
+	}{
+		{name: "TLS和令牌", addr: tlsAddr, reqs: tlsReqs, tls: tlsx.Config{Enable: true, CAFile: certFile, ServerName: "localhost"}, token: "abc",
+			want: request{auth: "Bearer abc", tls: true}},
+		{name: "明文和令牌", addr: plainAddr, reqs: plainReqs, token: "abc", want: request{auth: "Bearer abc"}},
+		{name: "明文无令牌", addr: plainAddr, reqs: plainReqs},
+		{name: "服务端证书不受信任", addr: tlsAddr, tls: tlsx.Config{Enable: true, ServerName: "localhost"}, wantErr: true},
+		{name: "服务端名称不匹配", addr: tlsAddr, tls: tlsx.Config{Enable: true, CAFile: certFile, ServerName: "other"}, wantErr: true},
+		{name: "明文连接TLS服务端", addr: tlsAddr, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := DialOptions(tt.tls, tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = check(tt.addr, opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("请求 error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := <-tt.reqs; got != tt.want {
+				t.Fatalf("服务端收到 = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+// Package metrics 提供driver、algorithm、flow、flow_extension和data_relay共用的Prometheus指标
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/air-iot/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "airiot_sdk"
+
+// 服务类型,作为指标的service标签
+const (
+	ServiceDriver        = "driver"
+	ServiceAlgorithm     = "algorithm"
+	ServiceFlow          = "flow"
+	ServiceFlowExtension = "flow_extension"
+	ServiceDataRelay     = "data_relay"
+)
+
+// 请求处理结果,作为指标的result标签
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+	ResultPanic   = "panic"
+	ResultBusy    = "busy"
+)
+
+// 数据点丢弃原因,作为指标的reason标签
+const (
+	DropSuppressed = "suppressed" // 死区或值未变化
+	DropInvalid    = "invalid"    // 数据点值转换失败
+	DropPublish    = "publish"    // 发送到消息队列失败
+)
+
+// Config 指标服务配置
+type Config struct {
+	Enable bool   `json:"enable" yaml:"enable"`
+	Host   string `json:"host" yaml:"host"`
+	Port   string `json:"port" yaml:"port"`
+	Path   string `json:"path" yaml:"path"` // 默认为/metrics
+}
+
+// Registry 所有SDK指标的注册表,包含Go运行时和进程指标
+var Registry = prometheus.NewRegistry()
+
+var (
+	// StreamReconnects stream断开后重连的次数
+	StreamReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_reconnects_total",
+		Help:      "stream断开后重连的次数",
+	}, []string{"service", "stream"})
+	// Requests 通过stream接收的请求数量
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "通过stream接收的请求数量,按处理结果区分",
+	}, []string{"service", "stream", "result"})
+	// RequestDuration 请求处理耗时
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "请求处理耗时",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 4, 8),
+	}, []string{"service", "stream"})
+	// MQPublishDuration 消息发送耗时,按主题第一段区分
+	MQPublishDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mq_publish_duration_seconds",
+		Help:      "消息发送耗时",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"prefix"})
+	// MQPublishFailures 消息发送失败次数,按主题第一段区分
+	MQPublishFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mq_publish_failures_total",
+		Help:      "消息发送失败次数",
+	}, []string{"prefix"})
+	// PointsWritten 驱动发送的数据点值数量
+	PointsWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "points_written_total",
+		Help:      "驱动发送的数据点值数量",
+	})
+	// PointsDropped 驱动丢弃的数据点值数量
+	PointsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "points_dropped_total",
+		Help:      "驱动丢弃的数据点值数量,按原因区分",
+	}, []string{"reason"})
+	// HealthChecks 健康检查次数
+	HealthChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "health_checks_total",
+		Help:      "健康检查次数,按结果区分",
+	}, []string{"service", "result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		StreamReconnects,
+		Requests,
+		RequestDuration,
+		MQPublishDuration,
+		MQPublishFailures,
+		PointsWritten,
+		PointsDropped,
+		HealthChecks,
+	)
+}
+
+// Request 记录一次请求的处理结果和耗时
+type Request struct {
+	service string
+	stream  string
+	begin   time.Time
+	result  string
+}
+
+// StartRequest 开始记录请求,处理结束时调用Done. 需要在recover之前defer Done,才能记录panic
+func StartRequest(service, stream string) *Request {
+	return &Request{service: service, stream: stream, begin: time.Now(), result: ResultSuccess}
+}
+
+// Fail 标记请求处理失败
+func (r *Request) Fail() {
+	r.result = ResultError
+}
+
+// Panic 标记请求处理时发生panic
+func (r *Request) Panic() {
+	r.result = ResultPanic
+}
+
+// Done 记录请求结果和耗时
+func (r *Request) Done() {
+	Requests.WithLabelValues(r.service, r.stream, r.result).Inc()
+	RequestDuration.WithLabelValues(r.service, r.stream).Observe(time.Since(r.begin).Seconds())
+}
+
+// Busy 记录因队列已满而拒绝的请求
+func Busy(service, stream string) {
+	Requests.WithLabelValues(service, stream, ResultBusy).Inc()
+}
+
+// HealthCheck 记录健康检查结果
+func HealthCheck(service string, ok bool) {
+	result := ResultSuccess
+	if !ok {
+		result = ResultError
+	}
+	HealthChecks.WithLabelValues(service, result).Inc()
+}
+
+// Handler 返回指标的http处理器
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Serve 开启指标服务时在后台监听,返回停止服务的函数
+func Serve(cfg Config) func(context.Context) error {
+	if !cfg.Enable {
+		return func(context.Context) error { return nil }
+	}
+	path := cfg.Path
+	if path == "" {
+		path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, Handler())
+	srv := &http.Server{Addr: net.JoinHostPort(cfg.Host, cfg.Port), Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		logger.Infof("指标服务启动: 地址=%s,路径=%s", srv.Addr, path)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("指标服务启动: 地址=%s. %v", srv.Addr, err)
+		}
+	}()
+	return srv.Shutdown
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequest(t *testing.T) {
+	for _, c := range []struct {
+		result string
+		mark   func(r *Request)
+	}{
+		{ResultSuccess, func(*Request) {}},
+		{ResultError, (*Request).Fail},
+		{ResultPanic, (*Request).Panic},
+	} {
+		before := testutil.ToFloat64(Requests.WithLabelValues(ServiceDriver, "test", c.result))
+		r := StartRequest(ServiceDriver, "test")
+		c.mark(r)
+		r.Done()
+		if got := testutil.ToFloat64(Requests.WithLabelValues(ServiceDriver, "test", c.result)) - before; got != 1 {
+			t.Errorf("%s: 请求数量=%v,应为1", c.result, got)
+		}
+	}
+	before := testutil.ToFloat64(Requests.WithLabelValues(ServiceDriver, "test", ResultBusy))
+	Busy(ServiceDriver, "test")
+	if got := testutil.ToFloat64(Requests.WithLabelValues(ServiceDriver, "test", ResultBusy)) - before; got != 1 {
+		t.Errorf("busy: 请求数量=%v,应为1", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	HealthCheck(ServiceFlow, true)
+	HealthCheck(ServiceFlow, false)
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`airiot_sdk_health_checks_total{result="success",service="flow"}`,
+		`airiot_sdk_health_checks_total{result="error",service="flow"}`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("指标中没有%s", want)
+		}
+	}
+}
+
+func TestServeDisabled(t *testing.T) {
+	if err := Serve(Config{})(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -15,6 +15,9 @@ const (
 	Float   FieldType = "float"
 	Int     FieldType = "integer"
 	Bool    FieldType = "boolean"
+	Object  FieldType = "object"
+	Array   FieldType = "array"
+	Binary  FieldType = "binary"
 	UNKNOWN FieldType = "UNKNOWN"
 )
 
@@ -28,11 +31,22 @@ func (v FieldType) String() string {
 		return "integer"
 	case Bool:
 		return "boolean"
+	case Object:
+		return "object"
+	case Array:
+		return "array"
+	case Binary:
+		return "binary"
 	default:
 		return "UNKNOWN"
 	}
 }
 
+// Valid 判断是否为支持的数据类型
+func (v FieldType) Valid() bool {
+	return v.String() != UNKNOWN.String()
+}
+
 func GetValueByType(valueType FieldType, v interface{}) (interface{}, error) {
 	if reflect.TypeOf(v).Kind() == reflect.Ptr {
 		v = reflect.ValueOf(v).Elem().Interface()
@@ -0,0 +1,150 @@
+// Package probe 提供/healthz和/readyz探针接口,用于Kubernetes存活和就绪检查
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/air-iot/json"
+	"github.com/air-iot/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+
+	"github.com/air-iot/sdk-go/v4/conn/mq"
+)
+
+// Config 探针服务配置
+type Config struct {
+	Enable bool   `json:"enable" yaml:"enable"`
+	Host   string `json:"host" yaml:"host"`
+	Port   string `json:"port" yaml:"port"`
+}
+
+// Check 单项检查结果
+type Check struct {
+	Name   string `json:"name"`
+	Ready  bool   `json:"ready"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report 探针接口返回的内容
+type Report struct {
+	Status string  `json:"status"` // ok或unavailable
+	Checks []Check `json:"checks"`
+}
+
+// Checker 返回当前的检查结果
+type Checker func() []Check
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// Handler 返回检查结果. strict为true时有检查未通过返回503,否则只要进程能响应就返回200
+func Handler(checker Checker, strict bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		report := Report{Status: StatusOK, Checks: checker()}
+		code := http.StatusOK
+		for _, c := range report.Checks {
+			if !c.Ready && strict {
+				report.Status = StatusUnavailable
+				code = http.StatusServiceUnavailable
+				break
+			}
+		}
+		b, _ := json.Marshal(report)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_, _ = w.Write(b)
+	})
+}
+
+// Serve 开启探针服务时在后台监听,返回停止服务的函数.
+// /healthz 进程存活即返回200; /readyz 所有检查通过时返回200,否则返回503
+func Serve(cfg Config, checker Checker) func(context.Context) error {
+	if !cfg.Enable {
+		return func(context.Context) error { return nil }
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", Handler(checker, false))
+	mux.Handle("/readyz", Handler(checker, true))
+	srv := &http.Server{Addr: net.JoinHostPort(cfg.Host, cfg.Port), Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		logger.Infof("探针服务启动: 地址=%s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("探针服务启动: 地址=%s. %v", srv.Addr, err)
+		}
+	}()
+	return srv.Shutdown
+}
+
+// GRPC gRPC连接状态,连接就绪时通过
+func GRPC(conn *grpc.ClientConn) Check {
+	if conn == nil {
+		return Check{Name: "grpc", Detail: "未连接"}
+	}
+	state := conn.GetState()
+	return Check{Name: "grpc", Ready: state == connectivity.Ready, Detail: state.String()}
+}
+
+// Streams 已连接的stream数量,全部连接时通过
+func Streams(ready, total int) Check {
+	return Check{Name: "streams", Ready: ready >= total, Detail: fmt.Sprintf("%d/%d", ready, total)}
+}
+
+// HealthCheck 最近一次健康检查成功的时间,超过maxAge未成功时不通过
+func HealthCheck(last time.Time, maxAge time.Duration) Check {
+	if last.IsZero() {
+		return Check{Name: "healthCheck", Detail: "未成功"}
+	}
+	return Check{Name: "healthCheck", Ready: time.Since(last) <= maxAge, Detail: last.Format(time.RFC3339)}
+}
+
+// Started 服务的Start是否执行成功
+func Started(started bool) Check {
+	if started {
+		return Check{Name: "start", Ready: true}
+	}
+	return Check{Name: "start", Detail: "未启动或启动失败"}
+}
+
+// MQState 通过mq.Callback记录消息队列的连接状态,创建时视为已连接
+type MQState struct {
+	lost  atomic.Bool
+	since atomic.Int64
+}
+
+// Watch 注册消息队列回调,返回连接状态
+func Watch(m mq.MQ) *MQState {
+	s := new(MQState)
+	s.since.Store(time.Now().UnixNano())
+	m.Callback(s)
+	return s
+}
+
+func (s *MQState) Connect(mq.MQ) error {
+	s.lost.Store(false)
+	s.since.Store(time.Now().UnixNano())
+	return nil
+}
+
+func (s *MQState) Lost(mq.MQ) error {
+	s.lost.Store(true)
+	s.since.Store(time.Now().UnixNano())
+	return nil
+}
+
+// Check 消息队列连接状态
+func (s *MQState) Check() Check {
+	since := time.Unix(0, s.since.Load()).Format(time.RFC3339)
+	if s.lost.Load() {
+		return Check{Name: "mq", Detail: "连接断开: " + since}
+	}
+	return Check{Name: "mq", Ready: true, Detail: "已连接: " + since}
+}
@@ -0,0 +1,63 @@
+package probe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/air-iot/json"
+)
+
+func TestHandler(t *testing.T) {
+	checks := []Check{Streams(1, 2), HealthCheck(time.Now(), time.Minute)}
+	checker := func() []Check { return checks }
+	for _, c := range []struct {
+		strict bool
+		code   int
+		status string
+	}{
+		{false, http.StatusOK, StatusOK},
+		{true, http.StatusServiceUnavailable, StatusUnavailable},
+	} {
+		rec := httptest.NewRecorder()
+		Handler(checker, c.strict).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		var report Report
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != c.code || report.Status != c.status || len(report.Checks) != 2 {
+			t.Errorf("strict=%v: %d, %+v", c.strict, rec.Code, report)
+		}
+	}
+	checks[0] = Streams(2, 2)
+	rec := httptest.NewRecorder()
+	Handler(checker, true).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("全部通过时返回 %d", rec.Code)
+	}
+}
+
+func TestChecks(t *testing.T) {
+	if c := GRPC(nil); c.Ready {
+		t.Errorf("GRPC(nil) = %+v", c)
+	}
+	if c := HealthCheck(time.Time{}, time.Minute); c.Ready {
+		t.Errorf("未成功的健康检查 = %+v", c)
+	}
+	if c := HealthCheck(time.Now().Add(-2*time.Minute), time.Minute); c.Ready {
+		t.Errorf("超时的健康检查 = %+v", c)
+	}
+	s := &MQState{}
+	if !s.Check().Ready {
+		t.Error("创建时应视为已连接")
+	}
+	_ = s.Lost(nil)
+	if s.Check().Ready {
+		t.Error("断开后应未就绪")
+	}
+	_ = s.Connect(nil)
+	if !s.Check().Ready {
+		t.Error("重连后应就绪")
+	}
+}
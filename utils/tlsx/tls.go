@@ -0,0 +1,54 @@
+// Package tlsx 提供grpc、消息队列等客户端共用的TLS配置
+package tlsx
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// Config TLS配置. CAFile为空时使用系统根证书验证服务端,
+// CertFile和KeyFile同时设置时向服务端提供客户端证书(双向认证)
+type Config struct {
+	Enable             bool   `json:"enable" yaml:"enable"`
+	CAFile             string `json:"caFile" yaml:"caFile"`
+	CertFile           string `json:"certFile" yaml:"certFile"`
+	KeyFile            string `json:"keyFile" yaml:"keyFile"`
+	ServerName         string `json:"serverName" yaml:"serverName"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify" yaml:"insecureSkipVerify"`
+}
+
+// Load 读取证书生成tls.Config,未开启时返回nil
+func (c Config) Load() (*tls.Config, error) {
+	if !c.Enable {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if c.CAFile != "" {
+		b, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取CA证书 %s 错误: %w", c.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("CA证书 %s 中没有有效的PEM证书", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("客户端证书和私钥需要同时配置")
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取客户端证书错误: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
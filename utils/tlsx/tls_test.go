@@ -0,0 +1,107 @@
+package tlsx
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert 生成自签名证书,返回证书和私钥文件路径
+func writeCert(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestConfig_Load(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "localhost")
+	_, otherKey := writeCert(t, dir, "other")
+	bad := filepath.Join(dir, "bad.pem")
+	if err := os.WriteFile(bad, []byte("bad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantNil bool
+		wantErr bool
+		check   func(*tls.Config) bool
+	}{
+		{name: "未开启", cfg: Config{CAFile: certFile, CertFile: certFile}, wantNil: true},
+		{name: "系统根证书", cfg: Config{Enable: true}, check: func(c *tls.Config) bool {
+			return c.RootCAs == nil && len(c.Certificates) == 0 && c.MinVersion == tls.VersionTLS12
+		}},
+		{name: "CA证书", cfg: Config{Enable: true, CAFile: certFile, ServerName: "localhost"}, check: func(c *tls.Config) bool {
+			return c.RootCAs != nil && c.ServerName == "localhost"
+		}},
+		{name: "双向认证", cfg: Config{Enable: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile}, check: func(c *tls.Config) bool {
+			return c.RootCAs != nil && len(c.Certificates) == 1
+		}},
+		{name: "跳过验证", cfg: Config{Enable: true, InsecureSkipVerify: true}, check: func(c *tls.Config) bool {
+			return c.InsecureSkipVerify
+		}},
+		{name: "CA文件不存在", cfg: Config{Enable: true, CAFile: filepath.Join(dir, "none.pem")}, wantErr: true},
+		{name: "CA文件无效", cfg: Config{Enable: true, CAFile: bad}, wantErr: true},
+		{name: "CA文件是私钥", cfg: Config{Enable: true, CAFile: keyFile}, wantErr: true},
+		{name: "证书缺少私钥", cfg: Config{Enable: true, CertFile: certFile}, wantErr: true},
+		{name: "私钥缺少证书", cfg: Config{Enable: true, KeyFile: keyFile}, wantErr: true},
+		{name: "私钥不匹配", cfg: Config{Enable: true, CertFile: certFile, KeyFile: otherKey}, wantErr: true},
+		{name: "私钥无效", cfg: Config{Enable: true, CertFile: certFile, KeyFile: bad}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.cfg.Load()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (cfg == nil) != tt.wantNil {
+				t.Fatalf("Load() = %+v, wantNil %v", cfg, tt.wantNil)
+			}
+			if tt.check != nil && !tt.check(cfg) {
+				t.Fatalf("Load() = %+v", cfg)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+// Package tracing 提供可选的OpenTelemetry链路追踪,用于在gRPC stream、驱动回调和消息队列之间传递链路上下文
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/air-iot/json"
+	"github.com/air-iot/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// instrumentation SDK创建span时使用的tracer名称
+const instrumentation = "github.com/air-iot/sdk-go/v4"
+
+// Config 链路追踪配置,开启后通过OTLP gRPC导出span
+type Config struct {
+	Enable   bool    `json:"enable" yaml:"enable"`
+	Endpoint string  `json:"endpoint" yaml:"endpoint"` // OTLP gRPC地址,如localhost:4317,为空时使用OTEL_EXPORTER_OTLP_ENDPOINT
+	Insecure bool    `json:"insecure" yaml:"insecure"` // 不使用TLS连接
+	Ratio    float64 `json:"ratio" yaml:"ratio"`       // 采样比例,取值(0,1],默认为1. 上游已采样的链路始终采样
+}
+
+// Init 开启链路追踪时设置全局TracerProvider和W3C传播器,返回刷新并停止导出的函数.
+// 未开启时不修改全局设置,使用方自行设置的TracerProvider仍然生效
+func Init(cfg Config, service string) (func(context.Context) error, error) {
+	if !cfg.Enable {
+		return func(context.Context) error { return nil }, nil
+	}
+	opts := make([]otlptracegrpc.Option, 0, 2)
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("创建链路追踪导出器错误: %w", err)
+	}
+	ratio := cfg.Ratio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(service))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	logger.Infof("链路追踪启动: 地址=%s,采样比例=%v", cfg.Endpoint, ratio)
+	return tp.Shutdown, nil
+}
+
+// Start 创建span,未初始化时使用全局TracerProvider,默认为不记录的空实现
+func Start(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// End 结束span,err不为空时记录错误
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// metadataCarrier 使用gRPC metadata读写链路上下文
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// ExtractMetadata 从gRPC metadata中提取链路上下文
+func ExtractMetadata(ctx context.Context, md metadata.MD) context.Context {
+	if len(md) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+}
+
+// ExtractJSON 从JSON对象的顶层字段中提取链路上下文,字段名不区分大小写,值为字符串或字符串数组(如HTTP头).
+// payload不是JSON对象或不包含链路字段时返回ctx
+func ExtractJSON(ctx context.Context, payload []byte) context.Context {
+	propagator := otel.GetTextMapPropagator()
+	lower := bytes.ToLower(payload)
+	found := false
+	for _, field := range propagator.Fields() {
+		if bytes.Contains(lower, []byte(field)) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ctx
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return ctx
+	}
+	carrier := propagation.MapCarrier{}
+	for k, v := range fields {
+		switch val := v.(type) {
+		case string:
+			carrier[strings.ToLower(k)] = val
+		case []interface{}:
+			if len(val) > 0 {
+				if s, ok := val[0].(string); ok {
+					carrier[strings.ToLower(k)] = s
+				}
+			}
+		}
+	}
+	return propagator.Extract(ctx, carrier)
+}
+
+// Headers 返回ctx中需要传递的链路上下文,用于写入消息头. 没有需要传递的内容时返回nil
+func Headers(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
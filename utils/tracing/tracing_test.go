@@ -0,0 +1,73 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestPropagation(t *testing.T) {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if h := Headers(context.Background()); h != nil {
+		t.Fatalf("没有span时 Headers() = %v", h)
+	}
+	ctx := ExtractMetadata(context.Background(), metadata.Pairs("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"))
+	remote := trace.SpanContextFromContext(ctx)
+	if !remote.IsValid() || !remote.IsRemote() {
+		t.Fatalf("ExtractMetadata() = %+v", remote)
+	}
+	ctx, span := Start(ctx, "test", trace.SpanKindProducer)
+	defer End(span, nil)
+	if span.SpanContext().TraceID() != remote.TraceID() {
+		t.Fatalf("span链路 = %s,应为%s", span.SpanContext().TraceID(), remote.TraceID())
+	}
+	h := Headers(ctx)
+	got := trace.SpanContextFromContext(otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(h)))
+	if got.TraceID() != remote.TraceID() || got.SpanID() != span.SpanContext().SpanID() {
+		t.Fatalf("Headers() = %v", h)
+	}
+}
+
+func TestInitDisabled(t *testing.T) {
+	stop, err := Init(Config{}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	tests := []struct {
+		name    string
+		payload string
+		valid   bool
+	}{
+		{name: "字段", payload: `{"name":"on","traceparent":"` + traceparent + `"}`, valid: true},
+		{name: "HTTP头", payload: `{"Traceparent":["` + traceparent + `"]}`, valid: true},
+		{name: "没有链路字段", payload: `{"name":"on"}`},
+		{name: "不是对象", payload: `["traceparent"]`},
+		{name: "空", payload: ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := trace.SpanContextFromContext(ExtractJSON(context.Background(), []byte(tt.payload)))
+			if sc.IsValid() != tt.valid {
+				t.Fatalf("ExtractJSON() = %+v, valid应为%v", sc, tt.valid)
+			}
+			if tt.valid && sc.TraceID().String() != "0af7651916cd43dd8448eb211c80319c" {
+				t.Fatalf("ExtractJSON() TraceID = %s", sc.TraceID())
+			}
+		})
+	}
+}